@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/fileutil"
+	"builder/internal/log"
+	"builder/internal/repo"
+	"builder/internal/selftest"
+	"builder/internal/state"
+)
+
+// runAdopt copies externally built packages into the repository, adds them
+// to the database and registers them so cleanup keeps them. With --forget,
+// the named packages are unregistered instead and removed by the next run.
+// It returns the exit code.
+func runAdopt(args []string) int {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+	forget := fs.Bool("forget", false, "unregister the named adopted packages, so the next run removes them")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Error("Usage: repo-builder adopt <package file>... | --forget <name>...")
+		return ExitConfig
+	}
+
+	cfg := loadConfig()
+	lockRun()
+	repoDB := mainRepo(cfg)
+	if err := os.MkdirAll(repoDB.Dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create build dir: %v", err))
+		return 1
+	}
+
+	path := filepath.Join(BuildDir, state.AdoptedFile)
+	adopted, err := state.LoadAdopted(path)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+
+	failed := 0
+	if *forget {
+		for _, name := range fs.Args() {
+			if _, ok := adopted[name]; !ok {
+				log.Error(fmt.Sprintf("%s is not adopted", name))
+				failed++
+				continue
+			}
+			delete(adopted, name)
+			log.Success(fmt.Sprintf("Forgot %s, the next run removes it", name))
+		}
+	} else {
+		managed := managedNames(cfg, repoDB)
+		var files []string
+		for _, file := range fs.Args() {
+			name, pkg, err := adoptFile(file, repoDB.Dir, managed)
+			if err != nil {
+				log.Error(fmt.Sprintf("Not adopting %s: %v", file, err))
+				failed++
+				continue
+			}
+			adopted[name] = pkg
+			files = append(files, pkg.File)
+			log.Success(fmt.Sprintf("Adopted: %s", pkg.File))
+		}
+		if len(files) == 0 {
+			return 1
+		}
+		if err := repoDB.Add(files); err != nil {
+			log.Error(fmt.Sprintf("Failed to update the database: %v", err))
+			return 1
+		}
+	}
+
+	if err := adopted.Save(path); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// managedNames returns the packages the config builds, which can't be
+// adopted
+func managedNames(cfg *config.Config, repoDB *repo.RepoDB) []string {
+	names := cfg.PublishedNames()
+	for _, name := range cfg.AURNames() {
+		for _, pkg := range repoDB.Split(name) {
+			names = append(names, pkg.Name)
+		}
+	}
+	return names
+}
+
+// adoptFile validates the package file and copies it, with its signature if
+// there is one, into dir. It returns the package name and its record.
+func adoptFile(file, dir string, managed []string) (string, state.AdoptedPackage, error) {
+	if err := selftest.VerifyArchive(file); err != nil {
+		return "", state.AdoptedPackage{}, err
+	}
+	info, err := buildsys.ReadPkginfo(file)
+	if err != nil {
+		return "", state.AdoptedPackage{}, err
+	}
+	name, ver := info["pkgname"][0], info["pkgver"][0]
+	if slices.Contains(managed, name) {
+		return "", state.AdoptedPackage{}, fmt.Errorf("%s is built from config.yml", name)
+	}
+
+	base := filepath.Base(file)
+	if err := fileutil.CopyFile(file, filepath.Join(dir, base)); err != nil {
+		return "", state.AdoptedPackage{}, err
+	}
+	if _, err := os.Stat(file + ".sig"); err == nil {
+		if err := fileutil.CopyFile(file+".sig", filepath.Join(dir, base+".sig")); err != nil {
+			return "", state.AdoptedPackage{}, err
+		}
+	}
+	return name, state.AdoptedPackage{Version: ver, File: base, Time: time.Now().UTC()}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"builder/internal/agent"
+	"builder/internal/config"
+	"builder/internal/log"
+)
+
+// runAgent builds the packages a builder on another host sends, on a
+// build machine listed under builders with agent. It returns the exit
+// code.
+func runAgent(args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	addr := fs.String("addr", fmt.Sprintf(":%d", agent.DefaultPort), "`address` to listen on")
+	dir := fs.String("dir", "agent", "`directory` the jobs are built in")
+	key := fs.String("key", os.Getenv(config.DefaultAgentKeyEnv), "`key` jobs must be signed with (default $GOB_AGENT_KEY)")
+	fs.Parse(args)
+
+	if *key == "" {
+		log.Error("agent needs the --key builders sign their jobs with")
+		return ExitConfig
+	}
+	if _, err := exec.LookPath("makepkg"); err != nil {
+		log.Error("makepkg is required but not installed")
+		return 1
+	}
+	if os.Geteuid() == 0 {
+		log.Error("makepkg refuses to run as root, run the agent as a regular user with sudo rights")
+		return 1
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create the job dir: %v", err))
+		return 1
+	}
+
+	s := agent.NewServer(*dir, []byte(*key))
+	log.Info(fmt.Sprintf("Agent listening on %s, building in %s", *addr, *dir))
+	server := &http.Server{Addr: *addr, Handler: logRequests(s.Handler()), ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		log.Error(fmt.Sprintf("Failed to serve: %v", err))
+		return 1
+	}
+	return 0
+}
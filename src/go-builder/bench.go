@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"builder/internal/aur"
+	"builder/internal/log"
+	"builder/internal/pages"
+	"builder/internal/repodb"
+	"builder/internal/state"
+)
+
+// benchIterations is how often the cheap operations are repeated; the
+// median is reported
+const benchIterations = 5
+
+// Benchmark is the baseline bench writes, comparable across tool versions
+type Benchmark struct {
+	Time      time.Time `json:"time"`
+	GoVersion string    `json:"go_version"`
+	Packages  int       `json:"packages"`
+
+	DBParseMs       float64 `json:"db_parse_ms"`
+	SiteGenerateMs  float64 `json:"site_generate_ms"`
+	HashMBPerSecond float64 `json:"hash_mb_per_second"`
+	HashedMB        float64 `json:"hashed_mb"`
+	AURLatencyMs    float64 `json:"aur_latency_ms,omitempty"`
+	AURError        string  `json:"aur_error,omitempty"`
+}
+
+// runBench measures the repository operations on the current repository
+// and writes the results as JSON. It returns the exit code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	out := fs.String("out", "bench.json", "write the JSON baseline to `file`")
+	baseline := fs.String("baseline", "", "compare against an earlier baseline `file`")
+	offline := fs.Bool("offline", false, "skip the AUR latency measurement")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	repoDB := mainRepo(cfg)
+	aurClient := newAURClient(cfg)
+	b := Benchmark{Time: time.Now().UTC(), GoVersion: runtime.Version()}
+
+	log.Info("Parsing database...")
+	b.DBParseMs = median(benchIterations, func() {
+		// Bypasses the cache of repoDB.Open
+		if db, err := repodb.Open(filepath.Join(repoDB.Dir, repoDB.DBFile())); err == nil {
+			b.Packages = db.Len()
+		}
+	})
+
+	log.Info("Generating site...")
+	tmp, err := os.MkdirTemp("", "bench-site-")
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+	st, _ := state.Load(filepath.Join(BuildDir, state.FileName))
+	site := &pages.Generator{Config: cfg, Repo: repoDB, AUR: aurClient, OutDir: tmp, Arch: Arch,
+		AURInfo: func(string) *aur.Package { return nil }, State: st}
+	b.SiteGenerateMs = median(1, site.Generate)
+
+	log.Info("Hashing packages...")
+	b.HashedMB, b.HashMBPerSecond = hashThroughput(repoDB.Dir)
+
+	if !*offline && len(cfg.AURSourceNames()) > 0 {
+		log.Info("Querying the AUR...")
+		name := cfg.AURSourceNames()[0]
+		var rpcErr error
+		b.AURLatencyMs = median(benchIterations, func() {
+			if _, err := aurClient.Info([]string{name}); err != nil {
+				rpcErr = err
+			}
+		})
+		if rpcErr != nil {
+			b.AURLatencyMs = 0
+			b.AURError = rpcErr.Error()
+		}
+	}
+
+	log.Msg("")
+	log.Msg(fmt.Sprintf("   DB parse:       %.2f ms (%d packages)", b.DBParseMs, b.Packages))
+	log.Msg(fmt.Sprintf("   Site generate:  %.2f ms", b.SiteGenerateMs))
+	log.Msg(fmt.Sprintf("   Hashing:        %.1f MB/s over %.1f MB", b.HashMBPerSecond, b.HashedMB))
+	if b.AURError != "" {
+		log.Warn(fmt.Sprintf("   AUR latency:    failed (%s)", b.AURError))
+	} else if b.AURLatencyMs != 0 {
+		log.Msg(fmt.Sprintf("   AUR latency:    %.0f ms", b.AURLatencyMs))
+	}
+
+	data, _ := json.MarshalIndent(b, "", "  ")
+	if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		log.Error(fmt.Sprintf("Failed to write %s: %v", *out, err))
+		return 1
+	}
+	log.Success(fmt.Sprintf("Baseline written to %s", *out))
+
+	if *baseline != "" {
+		return compareBench(*baseline, b)
+	}
+	return 0
+}
+
+// median runs fn n times and returns the median duration in milliseconds
+func median(n int, fn func()) float64 {
+	times := make([]float64, n)
+	for i := range times {
+		start := time.Now()
+		fn()
+		times[i] = float64(time.Since(start).Microseconds()) / 1000
+	}
+	sort.Float64s(times)
+	return times[n/2]
+}
+
+// hashThroughput hashes every package file in dir and returns the MB hashed
+// and the rate
+func hashThroughput(dir string) (float64, float64) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.pkg.tar.*"))
+	var total int64
+	start := time.Now()
+	for _, path := range matches {
+		if strings.HasSuffix(path, ".sig") {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		n, _ := io.Copy(sha256.New(), f)
+		f.Close()
+		total += n
+	}
+	mb := float64(total) / 1e6
+	secs := time.Since(start).Seconds()
+	if secs == 0 {
+		return mb, 0
+	}
+	return mb, mb / secs
+}
+
+// compareBench prints the change of every timing against a baseline file
+func compareBench(path string, cur Benchmark) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read baseline: %v", err))
+		return 1
+	}
+	var old Benchmark
+	if err := json.Unmarshal(data, &old); err != nil {
+		log.Error(fmt.Sprintf("Failed to parse baseline: %v", err))
+		return 1
+	}
+
+	log.Msg("")
+	log.Info(fmt.Sprintf("Compared to %s (%s):", path, old.Time.Format(time.DateTime)))
+	row := func(label string, before, after float64, higherIsBetter bool) {
+		if before == 0 || after == 0 {
+			return
+		}
+		change := (after - before) / before * 100
+		msg := fmt.Sprintf("   %-16s %10.2f -> %10.2f (%+.1f%%)", label, before, after, change)
+		if (change > 0) == higherIsBetter {
+			log.Success(msg)
+		} else {
+			log.Warn(msg)
+		}
+	}
+	row("DB parse ms", old.DBParseMs, cur.DBParseMs, false)
+	row("Site gen ms", old.SiteGenerateMs, cur.SiteGenerateMs, false)
+	row("Hash MB/s", old.HashMBPerSecond, cur.HashMBPerSecond, true)
+	row("AUR latency ms", old.AURLatencyMs, cur.AURLatencyMs, false)
+	return 0
+}
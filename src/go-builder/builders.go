@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os/exec"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/remote"
+)
+
+// buildHost returns the first build machine of builders reached over SSH,
+// which runs repo-add and pacman, or nil
+func buildHost(cfg *config.Config) *remote.Host {
+	return commandHost(buildHosts(cfg))
+}
+
+// commandHost returns the first of hosts that runs commands, as agents
+// only build packages, or nil
+func commandHost(hosts []*remote.Host) *remote.Host {
+	for _, host := range hosts {
+		if host.Agent == nil {
+			return host
+		}
+	}
+	return nil
+}
+
+// buildHosts returns the build machines of builders
+func buildHosts(cfg *config.Config) []*remote.Host {
+	var hosts []*remote.Host
+	for _, b := range cfg.Builders {
+		if b.Agent != "" {
+			key := b.AgentKey()
+			if key == "" {
+				log.Error(fmt.Sprintf("builders: %s: the agent key is missing, set $%s", b.Name, cmp.Or(b.KeyEnv, config.DefaultAgentKeyEnv)))
+				exit(ExitConfig)
+			}
+			hosts = append(hosts, remote.NewAgent(b.Name, b.Agent, []byte(key)))
+			continue
+		}
+		host, err := remote.NewSSH(b.Name, b.SSH, b.Identity, b.Dir)
+		if err != nil {
+			log.Error(fmt.Sprintf("builders: %s: %v", b.Name, err))
+			exit(ExitConfig)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// readyHosts returns the hosts passing their check, warning about the
+// others. It exits if none does.
+func readyHosts(hosts []*remote.Host) []*remote.Host {
+	var ready []*remote.Host
+	for _, host := range hosts {
+		if err := host.Check(); err != nil {
+			log.Warn(fmt.Sprintf("Skipping the build machine %s, run repo-builder doctor for details: %v", host.Name, err))
+			continue
+		}
+		ready = append(ready, host)
+	}
+	if len(ready) == 0 {
+		log.Error("No build machine is ready, run repo-builder doctor for details")
+		exit(ExitConfig)
+	}
+	return ready
+}
+
+// repoHost returns where repo-add and repo-remove run on hosts without
+// them: the build machine, or a container in container build mode. It
+// returns nil to run them here.
+func repoHost(cfg *config.Config) *remote.Host {
+	if _, err := exec.LookPath("repo-add"); err == nil {
+		return nil
+	}
+	if host := buildHost(cfg); host != nil {
+		return host
+	}
+	if cfg.Meta.BuildMode == config.BuildModeContainer {
+		if c, err := buildsys.DetectContainer(); err == nil {
+			return remote.NewContainer(c.Runtime, c.Image)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/source"
+)
+
+// runCleanCache prunes the pacman package cache and the shared source
+// directory to their configured sizes, and compacts the git clones of the
+// PKGBUILD sources. It returns the exit code.
+func runCleanCache(args []string) int {
+	fs := flag.NewFlagSet("clean-cache", flag.ExitOnError)
+	maxSize := fs.String("max-size", "", "prune the pacman cache to `size` instead of build.pacman-cache-max-size")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	lockRun()
+	limit := cfg.Build.PacmanCacheMaxSize
+	if *maxSize != "" {
+		var err error
+		if limit, err = config.ParseByteSize(*maxSize); err != nil {
+			log.Error(fmt.Sprintf("Invalid --max-size: %v", err))
+			return 1
+		}
+	}
+
+	failed := 0
+	dir := cfg.Build.PacmanCache
+	if dir == "" {
+		dir = buildsys.DefaultPkgCache
+	}
+	log.Info(fmt.Sprintf("Cleaning pacman cache %s...", dir))
+	cache := &buildsys.PkgCache{Dir: dir}
+	removed, freed, err := cache.Prune(int64(limit))
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to prune pacman cache: %v", err))
+		failed++
+	}
+	log.Msg(fmt.Sprintf("   Removed %d packages (%s)", removed, config.ByteSize(freed)))
+
+	if cfg.Build.SrcDest != "" && cfg.Build.SrcDestMaxSize != 0 {
+		log.Info(fmt.Sprintf("Cleaning source dir %s...", cfg.Build.SrcDest))
+		srcdest, err := buildsys.NewSrcDest(cfg.Build.SrcDest)
+		if err == nil {
+			removed, freed, err = srcdest.Prune(int64(cfg.Build.SrcDestMaxSize))
+			log.Msg(fmt.Sprintf("   Removed %d sources (%s)", removed, config.ByteSize(freed)))
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to prune source dir: %v", err))
+			failed++
+		}
+	}
+
+	log.Info(fmt.Sprintf("Compacting source clones in %s...", AURCloneDir))
+	clones, freed, err := source.GC(AURCloneDir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to compact source clones: %v", err))
+		failed++
+	}
+	log.Msg(fmt.Sprintf("   Compacted %d clones (%s)", clones, config.ByteSize(freed)))
+
+	if failed > 0 {
+		return 1
+	}
+	log.Success("Caches cleaned")
+	return 0
+}
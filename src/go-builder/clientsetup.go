@@ -0,0 +1,140 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/pages"
+	"builder/internal/selftest"
+)
+
+// runClientSetup prints the pacman.conf sections and keyring commands that
+// add the repositories on a client, or writes them to a file, and with
+// --check verifies that the published URL serves a valid database. Given
+// --url it needs no config, so it also runs on the client. It returns the
+// exit code.
+func runClientSetup(args []string) int {
+	fs := flag.NewFlagSet("client-setup", flag.ExitOnError)
+	url := fs.String("url", "", "set up the repository at `url` instead of those of the config, which isn't needed then")
+	name := fs.String("name", "", "repository `name`, with --url")
+	signingKey := fs.String("signing-key", "", "GPG key `id` the packages are signed with, with --url")
+	keyserver := fs.String("keyserver", pages.DefaultKeyserver, "`host` clients fetch the signing key from")
+	arch := fs.String("arch", Arch, "`arch` to check, for pacman's $arch")
+	write := fs.String("write", "", "write the pacman.conf sections to `file`, e.g. /etc/pacman.d/myrepo.conf, instead of printing them")
+	keyring := fs.Bool("keyring", false, "only print the commands importing the signing keys, e.g. to pipe to sudo sh")
+	check := fs.Bool("check", false, "only check that every server of each repository serves a database pacman can parse")
+	fs.Parse(args)
+
+	var repos []*config.Config
+	if *url != "" {
+		if *name == "" {
+			log.Error("--url needs --name")
+			return ExitConfig
+		}
+		cfg := &config.Config{}
+		cfg.Meta.RepoName, cfg.Meta.RepoURL, cfg.Meta.SigningKey = *name, strings.TrimSuffix(*url, "/"), *signingKey
+		repos = []*config.Config{cfg}
+	} else {
+		for _, t := range targets(loadConfig()) {
+			repos = append(repos, t.Config)
+		}
+	}
+
+	if *check {
+		return checkClient(repos, *arch)
+	}
+	if *keyring {
+		fmt.Print(keyringCommands(repos, *keyserver))
+		return 0
+	}
+
+	var b strings.Builder
+	for i, cfg := range repos {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(pacmanSection(cfg, *keyserver))
+	}
+	if *write == "" {
+		fmt.Print(b.String())
+		return 0
+	}
+	if err := os.WriteFile(*write, []byte(b.String()), 0644); err != nil {
+		log.Error(fmt.Sprintf("Failed to write %s: %v", *write, err))
+		return 1
+	}
+	log.Success(fmt.Sprintf("Wrote %s", *write))
+	log.Msg(fmt.Sprintf("   Add \"Include = %s\" to the end of /etc/pacman.conf", *write))
+	if cmds := keyringCommands(repos, *keyserver); cmds != "" {
+		log.Msg("   Import the signing keys first:")
+		for _, line := range strings.Split(strings.TrimSpace(cmds), "\n") {
+			log.Msg("   " + line)
+		}
+	}
+	return 0
+}
+
+// pacmanSection returns the pacman.conf section adding the repository of
+// cfg with its servers in order of preference, as the installer appends it.
+// The keyring commands it needs precede it as comments.
+func pacmanSection(cfg *config.Config, keyserver string) string {
+	var b strings.Builder
+	if key := cfg.Meta.SigningKey; key != "" {
+		b.WriteString("# Import the signing key first:\n")
+		for _, line := range strings.Split(strings.TrimSpace(keyringCommands([]*config.Config{cfg}, keyserver)), "\n") {
+			fmt.Fprintf(&b, "#   sudo %s\n", line)
+		}
+	}
+	fmt.Fprintf(&b, "[%s]\n", cfg.Meta.RepoName)
+	fmt.Fprintf(&b, "SigLevel = %s\n", pages.SigLevel(cfg))
+	for _, server := range cfg.Servers() {
+		fmt.Fprintf(&b, "Server = %s/$arch\n", server)
+	}
+	return b.String()
+}
+
+// keyringCommands returns the pacman-key commands importing and locally
+// signing the signing keys of repos, each once
+func keyringCommands(repos []*config.Config, keyserver string) string {
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, cfg := range repos {
+		key := cfg.Meta.SigningKey
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		fmt.Fprintf(&b, "pacman-key --recv-keys %s --keyserver %s\n", key, cmp.Or(keyserver, pages.DefaultKeyserver))
+		fmt.Fprintf(&b, "pacman-key --lsign-key %s\n", key)
+	}
+	return b.String()
+}
+
+// checkClient checks that every server of every repository serves its
+// database for arch the way pacman -Sy fetches it, and returns the exit code
+func checkClient(repos []*config.Config, arch string) int {
+	client := &http.Client{Timeout: 30 * time.Second}
+	failed := 0
+	for _, cfg := range repos {
+		for _, server := range cfg.Servers() {
+			url := server + "/" + arch
+			log.Info(fmt.Sprintf("Checking %s at %s...", cfg.Meta.RepoName, url))
+			failed += printReport(selftest.Client(client, url, cfg.Meta.RepoName))
+		}
+	}
+
+	log.Msg("")
+	if failed > 0 {
+		log.Error(fmt.Sprintf("Client check failed: %d checks", failed))
+		return 1
+	}
+	log.Success("The repositories are ready for pacman -Sy")
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"builder/internal/log"
+	"builder/internal/report"
+)
+
+// maxCommentLines caps the lines of a pinned comment in the log; the
+// report keeps all of them
+const maxCommentLines = 15
+
+// pinnedComments shows the comments pinned on the AUR page of a package
+// being updated, where maintainers post manual steps and known breakage,
+// and records them in the report
+func (r *run) pinnedComments(results *report.Report, name string) {
+	if show := r.Config.Network.AURComments; r.Offline || (show != nil && !*show) {
+		return
+	}
+	comments, err := r.AUR.PinnedComments(name)
+	if err != nil {
+		log.Warn(fmt.Sprintf("   Failed to fetch the pinned AUR comments: %v", err))
+		return
+	}
+	var recorded []report.Comment
+	for _, c := range comments {
+		recorded = append(recorded, report.Comment{Author: c.Author, Date: c.Date, Text: c.Text, URL: fmt.Sprintf("%s#comment-%d", r.AUR.PackageURL(name), c.ID)})
+	}
+	results.SetComments(name, recorded)
+	if len(comments) == 0 {
+		return
+	}
+
+	log.Warn(fmt.Sprintf("%d pinned comments on the AUR, check them for manual steps:", len(comments)))
+	log.Annotate(log.AnnotationWarning, "Package "+name, fmt.Sprintf("%d pinned comments on the AUR: %s", len(comments), r.AUR.PackageURL(name)))
+	for _, c := range comments {
+		log.Msg(fmt.Sprintf("   %s on %s:", c.Author, c.Date))
+		lines := strings.Split(c.Text, "\n")
+		for i, line := range lines {
+			if i == maxCommentLines {
+				log.Msg(fmt.Sprintf("     ... %d more lines, see %s", len(lines)-i, r.AUR.PackageURL(name)))
+				break
+			}
+			log.Msg("     " + line)
+		}
+	}
+}
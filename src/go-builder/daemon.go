@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/log"
+)
+
+// runDaemon polls the AUR feed of recently updated packages and runs a
+// targeted build for configured AUR packages as soon as they show up. It
+// never returns.
+func runDaemon(r *run, interval time.Duration) {
+	log.Info(fmt.Sprintf("Daemon mode: polling the AUR feed every %s", interval))
+
+	watched := make(map[string]bool)
+	for _, cfg := range r.Root.AllRepos() {
+		for _, pkg := range cfg.Packages.AUR {
+			if pkg.Source.Kind() == config.SourceAUR {
+				watched[pkg.Name] = true
+			}
+		}
+	}
+
+	since := time.Now()
+	for {
+		select {
+		case <-time.After(interval):
+		case <-r.stop:
+			exit(ExitInterrupted)
+		}
+
+		items, err := r.AUR.RecentlyModified()
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to poll AUR feed: %v", err))
+			continue
+		}
+
+		updated := make(map[string]bool)
+		newest := since
+		for _, item := range items {
+			if !item.Updated.After(since) {
+				continue
+			}
+			if item.Updated.After(newest) {
+				newest = item.Updated
+			}
+			if watched[item.Name] {
+				updated[item.Name] = true
+			}
+		}
+		since = newest
+
+		if len(updated) == 0 {
+			continue
+		}
+
+		log.Msg("")
+		log.Info(fmt.Sprintf("AUR feed reports %d updated packages", len(updated)))
+		failed := r.RunAll(updated, false)
+		if r.interrupted() {
+			exit(ExitInterrupted)
+		}
+		if failed > 0 {
+			log.Warn("Daemon keeps running, failed packages are retried on their next update")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+)
+
+// DebugSuffix turns a repository name into the name of the repository of
+// its debug packages with debug-packages: separate
+const DebugSuffix = "-debug"
+
+// debugDir is the build directory of the debug repository of t, inside the
+// one of t
+func debugDir(t target) string {
+	return filepath.Join(t.Dir, t.Config.Meta.RepoName+DebugSuffix)
+}
+
+// publishDebug adds the debug packages published by the run to the debug
+// repository. It reports whether the database was updated.
+func (r *run) publishDebug() bool {
+	if r.Debug == nil || len(r.debugFiles) == 0 {
+		return true
+	}
+	return r.withDBPolicy("update debug database", func() error { return r.Debug.Add(r.debugFiles) })
+}
+
+// cleanupDebug removes the debug packages of packages no longer in the
+// config from the debug repository, like cleanup does from the repository.
+// It reports whether the database was updated.
+func (r *run) cleanupDebug() bool {
+	if r.Debug == nil {
+		return true
+	}
+	var valid []string
+	for _, name := range r.Config.AURNames() {
+		valid = append(valid, name+"-debug")
+		for _, pkg := range r.Repo.Split(name) {
+			if pkg.Base != "" && !slices.Contains(valid, pkg.Base+"-debug") {
+				valid = append(valid, pkg.Base+"-debug")
+			}
+		}
+	}
+	stale := r.Debug.Cleanup(valid)
+	ok := r.withDBPolicy("remove stale debug packages", func() error { return r.Debug.Remove(stale...) })
+	r.updateChecksums(r.Debug)
+	return ok
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/state"
+	"builder/internal/version"
+)
+
+// provision is a name a repo package satisfies dependencies on
+type provision struct {
+	pkg     string
+	version string
+	// provided is the version of the name, empty if it is unversioned
+	provided string
+}
+
+// depIndex maps every name the repo packages satisfy dependencies on, their
+// own and the ones they provide, to the packages providing it
+type depIndex map[string][]provision
+
+// dependencyIndex indexes the packages in the database, or returns nil if
+// dependency rebuilds are off
+func (r *run) dependencyIndex() depIndex {
+	if r.Config.Build.DependencyRebuilds == config.DepRebuildsOff {
+		return nil
+	}
+	idx := make(depIndex)
+	db, err := r.Repo.Open()
+	if err != nil {
+		return idx
+	}
+	for _, pkg := range db.List() {
+		idx.add(pkg.Name, pkg.Version, pkg.Provides)
+	}
+	return idx
+}
+
+func (idx depIndex) add(pkg, ver string, provides []string) {
+	idx[pkg] = append(idx[pkg], provision{pkg, ver, ver})
+	for _, p := range provides {
+		name, _, provided := version.ParseDep(p)
+		idx[name] = append(idx[name], provision{pkg, ver, provided})
+	}
+}
+
+func (idx depIndex) remove(pkg string) {
+	for name, provs := range idx {
+		provs = slices.DeleteFunc(provs, func(p provision) bool { return p.pkg == pkg })
+		if len(provs) == 0 {
+			delete(idx, name)
+		} else {
+			idx[name] = provs
+		}
+	}
+}
+
+// versions maps the repo packages providing depends, except own ones, to
+// their versions
+func (idx depIndex) versions(depends []string, own map[string]bool) map[string]string {
+	versions := make(map[string]string)
+	for _, dep := range depends {
+		name, _, _ := version.ParseDep(dep)
+		for _, p := range idx[name] {
+			if !own[p.pkg] {
+				versions[p.pkg] = p.version
+			}
+		}
+	}
+	return versions
+}
+
+// changedDeps returns why the packages built from name need a rebuild
+// against their changed dependencies, or "" if they don't. A dependency on
+// a version or soname no longer in the repo triggers it, unless the packages
+// were already rebuilt against the current provider; with
+// dependency-rebuilds: version, so does any new version of a dependency
+// since the last build. Packages built before the versions were recorded
+// take the current ones as theirs.
+func (r *run) changedDeps(idx depIndex, st *state.State, name string) string {
+	if idx == nil {
+		return ""
+	}
+	own := make(map[string]bool)
+	var depends []string
+	for _, pkg := range r.Repo.Split(name) {
+		own[pkg.Name] = true
+		depends = append(depends, pkg.Depends...)
+	}
+	var built map[string]string
+	if entry := st.Get(name); entry != nil {
+		built = entry.Deps
+	}
+
+	for _, dep := range depends {
+		depName, op, want := version.ParseDep(dep)
+		provs := slices.DeleteFunc(slices.Clone(idx[depName]), func(p provision) bool { return own[p.pkg] })
+		if len(provs) == 0 || slices.ContainsFunc(provs, func(p provision) bool { return version.Satisfies(p.provided, op, want) }) {
+			continue
+		}
+		// A rebuild that still links the old soname, e.g. when the build
+		// host installs the library from elsewhere, is not repeated
+		if p := provs[0]; built[p.pkg] != p.version {
+			return fmt.Sprintf("Dependency %s is no longer provided, %s is now %s", dep, p.pkg, p.version)
+		}
+	}
+
+	current := idx.versions(depends, own)
+	if built == nil {
+		st.SetDeps(name, current)
+		return ""
+	}
+	if r.Config.Build.DependencyRebuilds != config.DepRebuildsVersion {
+		return ""
+	}
+	for _, pkg := range slices.Sorted(maps.Keys(current)) {
+		if v, ok := built[pkg]; ok && v != current[pkg] {
+			return fmt.Sprintf("Dependency %s changed from %s to %s", pkg, v, current[pkg])
+		}
+	}
+	return ""
+}
+
+// recordBuilt updates the index with the packages built from name, so
+// packages processed later see them, and records the versions of the
+// dependencies they were built against
+func (r *run) recordBuilt(idx depIndex, st *state.State, name string, files []string) {
+	if idx == nil {
+		return
+	}
+	own := make(map[string]bool)
+	var depends []string
+	for _, file := range files {
+		info, err := buildsys.ReadPkginfo(filepath.Join(r.Repo.Dir, file))
+		if err != nil || len(info["pkgname"]) == 0 || len(info["pkgver"]) == 0 {
+			continue
+		}
+		pkg := info["pkgname"][0]
+		own[pkg] = true
+		idx.remove(pkg)
+		idx.add(pkg, info["pkgver"][0], info["provides"])
+		depends = append(depends, info["depend"]...)
+	}
+	if len(own) == 0 {
+		// Recorded from the database by the next run instead
+		st.SetDeps(name, nil)
+		return
+	}
+	st.SetDeps(name, idx.versions(depends, own))
+}
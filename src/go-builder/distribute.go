@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"builder/internal/chunk"
+	"builder/internal/delta"
+	"builder/internal/ipfs"
+	"builder/internal/log"
+	"builder/internal/repo"
+	"builder/internal/torrent"
+)
+
+// writeTorrents writes a torrent for every package file of the repositories
+// of the run that lacks an up-to-date one, with the servers of the
+// repository as web seeds
+func (r *run) writeTorrents() {
+	conf := r.Config.Publish.Torrent
+	if conf == nil {
+		return
+	}
+	written, failed := 0, 0
+	for _, repoDB := range []*repo.RepoDB{r.Repo, r.Stable, r.Debug} {
+		if repoDB == nil {
+			continue
+		}
+		db, err := repoDB.Open()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Error(fmt.Sprintf("Failed to read the database of %s for its torrents: %v", repoDB.Name, err))
+			failed++
+			continue
+		}
+
+		opts := torrent.Options{Trackers: conf.Trackers, PieceSize: int64(conf.PieceSize)}
+		// Web seeds serve the repository directory below the build directory
+		if rel, err := filepath.Rel(r.Dir, repoDB.Dir); err == nil && filepath.IsLocal(rel) {
+			for _, server := range append(r.Config.Servers(), conf.WebSeeds...) {
+				opts.WebSeeds = append(opts.WebSeeds, torrent.SeedURL(server, rel))
+			}
+		}
+		for _, pkg := range db.List() {
+			path := filepath.Join(repoDB.Dir, pkg.Filename)
+			// Split files are published as their parts, which web seeds
+			// can't serve as one
+			if chunk.IsSplit(path) {
+				continue
+			}
+			ok, err := torrent.Write(path, opts)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to write the torrent of %s: %v", pkg.Filename, err))
+				failed++
+			} else if ok {
+				written++
+			}
+		}
+	}
+	if written > 0 {
+		log.Success(fmt.Sprintf("   Wrote %d torrents", written))
+	}
+}
+
+// addToIPFS adds the repository directory clients use to IPFS, pins it
+// and records its CID for the landing page. Offline runs skip it.
+func (r *run) addToIPFS(repoDB *repo.RepoDB) {
+	conf := r.Config.Publish.IPFS
+	if conf == nil {
+		return
+	}
+	if r.Offline {
+		log.Msg("   Offline, not adding the repository to IPFS")
+		return
+	}
+	path := filepath.Join(r.Dir, ipfs.FileName)
+	prev, err := ipfs.Load(path)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", ipfs.FileName, err))
+	}
+
+	node := &ipfs.Node{API: conf.API}
+	cid, err := node.Add(repoDB.Dir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to add %s to IPFS: %v", repoDB.Name, err))
+		return
+	}
+	if prev != nil && prev.CID == cid && (conf.Key == "" || prev.Name != "") {
+		log.Msg(fmt.Sprintf("   Unchanged on IPFS: %s", cid))
+		return
+	}
+	record := &ipfs.Record{CID: cid, Added: time.Now().UTC()}
+	if conf.Key != "" {
+		if record.Name, err = node.Publish(conf.Key, cid); err != nil {
+			log.Error(fmt.Sprintf("Failed to publish %s under the IPNS key %s: %v", cid, conf.Key, err))
+		}
+	}
+	if err := record.Save(path); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", ipfs.FileName, err))
+		return
+	}
+	log.Success(fmt.Sprintf("   Added to IPFS: %s", record.Path()))
+}
+
+// writeDeltas writes a patch from the previous version still in the
+// repository directory next to every large package file in the database
+// that lacks an up-to-date one. It runs before cleanup removes the previous
+// versions.
+func (r *run) writeDeltas(repoDB *repo.RepoDB) {
+	conf := r.Config.Publish.Deltas
+	if conf == nil {
+		return
+	}
+	if _, err := exec.LookPath("xdelta3"); err != nil {
+		log.Error("xdelta3 is not installed, not writing delta patches")
+		return
+	}
+	db, err := repoDB.Open()
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Error(fmt.Sprintf("Failed to read the database of %s for its delta patches: %v", repoDB.Name, err))
+		return
+	}
+	index, err := delta.Load(repoDB.Dir)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", delta.IndexFile, err))
+		index = make(delta.Index)
+	}
+	index.Prune(repoDB.Dir)
+
+	minSize := cmp.Or(int64(conf.MinSize), delta.DefaultMinSize)
+	maxRatio := cmp.Or(conf.MaxRatio, delta.DefaultMaxRatio)
+	written := 0
+	for _, pkg := range db.List() {
+		path := filepath.Join(repoDB.Dir, pkg.Filename)
+		info, err := os.Stat(path)
+		if err != nil || info.Size() < minSize {
+			continue
+		}
+		// A patch older than its package file is from before a rebuild
+		// without a version bump
+		if patch, err := os.Stat(path + delta.Suffix); err == nil {
+			if _, ok := index[pkg.Filename]; ok && !patch.ModTime().Before(info.ModTime()) {
+				continue
+			}
+			os.Remove(path + delta.Suffix)
+			delete(index, pkg.Filename)
+		}
+		from := previousFile(repoDB.Dir, pkg.Filename)
+		if from == "" {
+			continue
+		}
+		d, err := delta.Make(repoDB.Dir, from, pkg.Filename)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to write the delta patch of %s: %v", pkg.Filename, err))
+			continue
+		}
+		if float64(d.Size) > maxRatio*float64(info.Size()) {
+			log.Msg(fmt.Sprintf("   No delta patch for %s, it would be %d%% of the package", pkg.Filename, d.Size*100/info.Size()))
+			os.Remove(path + delta.Suffix)
+			continue
+		}
+		index[pkg.Filename] = d
+		written++
+	}
+	if err := index.Save(repoDB.Dir); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", delta.IndexFile, err))
+		return
+	}
+	if written > 0 {
+		log.Success(fmt.Sprintf("   Wrote %d delta patches", written))
+	}
+}
+
+// previousFile returns the newest other version of the package file in dir,
+// the one clients upgrade from, or "" if there is none
+func previousFile(dir, file string) string {
+	name, ok := repo.PkgNameFromFile(file)
+	if !ok {
+		return ""
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	version := func(f string) string { return f[:strings.Index(f, ".pkg.tar")] }
+	prev := ""
+	var prevTime time.Time
+	for _, entry := range entries {
+		other := entry.Name()
+		// Skip the same version in another compression
+		if n, ok := repo.PkgNameFromFile(other); !ok || n != name || version(other) == version(file) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if prev == "" || info.ModTime().After(prevTime) {
+			prev, prevTime = other, info.ModTime()
+		}
+	}
+	return prev
+}
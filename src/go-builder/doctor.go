@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"builder/internal/aur"
+	"builder/internal/doctor"
+	"builder/internal/log"
+)
+
+// runDoctor checks that the host can build and publish the repository. It
+// returns the exit code.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	aurClient := newAURClient(cfg)
+
+	log.Msg("")
+	log.Info("Checking the build environment...")
+	checks := doctor.Run(doctor.Env{
+		Config:        cfg,
+		BuildDir:      BuildDir,
+		AURURL:        aurClient.BaseURL,
+		NeedsMultilib: needsMultilib(aurClient, cfg.AURSourceNames()),
+		PacmanConf:    "/etc/pacman.conf",
+	})
+
+	failed := 0
+	for _, check := range checks {
+		if check.Err == nil {
+			log.Success(fmt.Sprintf("   %s", check.Name))
+			continue
+		}
+		failed++
+		log.Error(fmt.Sprintf("   %s: %v", check.Name, check.Err))
+		log.Msg(fmt.Sprintf("      Fix: %s", check.Hint))
+	}
+
+	log.Msg("")
+	if failed > 0 {
+		log.Error(fmt.Sprintf("Doctor found %d problems", failed))
+		return 1
+	}
+	log.Success("Environment is ready")
+	return 0
+}
+
+// needsMultilib reports whether an AUR package depends on lib32 packages.
+// Lookup errors count as no, the reachability check reports them.
+func needsMultilib(client *aur.Client, names []string) bool {
+	infos, _ := client.Info(names)
+	for _, info := range infos {
+		for _, dep := range append(info.Depends, info.MakeDepends...) {
+			if strings.HasPrefix(dep, "lib32-") {
+				return true
+			}
+		}
+	}
+	return false
+}
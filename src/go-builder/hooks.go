@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// hookRun is a pending run of a package's hooks
+type hookRun struct {
+	pkg  config.Package
+	vars []string
+}
+
+// hookVars describes a package and its package files to its hooks
+func (r *run) hookVars(pkg config.Package, upstream, repoVersion, pkgDir string, files []string) []string {
+	abs := func(path string) string {
+		if p, err := filepath.Abs(path); err == nil {
+			return p
+		}
+		return path
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, abs(file))
+	}
+	return []string{
+		"GOB_PACKAGE=" + pkg.Name,
+		"GOB_SOURCE=" + pkg.Source.Kind(),
+		"GOB_VERSION=" + upstream,
+		"GOB_REPO_VERSION=" + repoVersion,
+		"GOB_PKGDIR=" + abs(pkgDir),
+		"GOB_FILES=" + strings.Join(paths, " "),
+		"GOB_REPO_NAME=" + r.Config.Meta.RepoName,
+		"GOB_REPO_DIR=" + abs(r.Repo.Dir),
+	}
+}
+
+// runHooks runs the global command of hook, then the package's, with vars
+// in their environment. It stops at the first failing command.
+func (r *run) runHooks(hook string, pkg config.Package, vars []string) error {
+	for _, command := range []string{r.Config.Hooks.Get(hook), pkg.Hooks.Get(hook)} {
+		if command == "" {
+			continue
+		}
+		log.Msg(fmt.Sprintf("   Running %s hook: %s", hook, command))
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(append(os.Environ(), "GOB_HOOK="+hook), vars...)
+		shell.Attach(cmd)
+		if err := shell.Run(cmd); err != nil {
+			return fmt.Errorf("%s hook failed: %v", hook, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/pages"
+	"builder/internal/tui"
+)
+
+// WorkflowFile is the GitHub Actions workflow running the builder
+const WorkflowFile = ".github/workflows/build.yml"
+
+// initTemplates are the files init copies from the checkout unchanged
+var initTemplates = []string{
+	pages.IndexHTMLTemplate, pages.ReadmeTemplate, pages.InstallerTemplate,
+	pages.FilesTemplate, pages.IconFile, ".gitattributes",
+}
+
+// workflowIdentity matches the git identity the workflow commits with
+var workflowIdentity = regexp.MustCompile(`git config --global user\.(name|email) ".*"`)
+
+// runInit scaffolds a new repository in a directory: config.yml from a few
+// questions, and the site templates, builder and GitHub Actions workflow of
+// a checkout. It returns the exit code.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	name := fs.String("name", "", "repository `name` (default the directory name)")
+	owner := fs.String("owner", "", "GitHub user or organization `name` the repository is hosted under")
+	repoURL := fs.String("repo-url", "", "`url` clients download packages from (default the GitHub Pages URL)")
+	projectURL := fs.String("project-url", "", "`url` of the project page (default the GitHub repository)")
+	packages := fs.String("packages", "", "comma-separated AUR `packages` to start with")
+	signingKey := fs.String("signing-key", "", "GPG key `id` to sign packages with")
+	from := fs.String("from", ".", "copy the templates, builder and workflow from the checkout in `dir`")
+	force := fs.Bool("force", false, "overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: repo-builder init [flags] [dir]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return ExitConfig
+	}
+
+	dir, err := filepath.Abs(cmp.Or(fs.Arg(0), "."))
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	src, err := filepath.Abs(*from)
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	if _, err := os.Stat(filepath.Join(src, pages.IndexHTMLTemplate)); err != nil {
+		log.Error(fmt.Sprintf("%s is no checkout of the builder, run init from one or pass --from", src))
+		return ExitConfig
+	}
+
+	// Flags answer their question, the rest is asked on a terminal
+	interactive := tui.IsTerminal(os.Stdin)
+	in := bufio.NewReader(os.Stdin)
+	answer := func(value *string, question, def string) {
+		if *value == "" && interactive {
+			*value = ask(in, question, def)
+		}
+		if *value == "" {
+			*value = def
+		}
+	}
+	answer(name, "Repository name", filepath.Base(dir))
+	if *repoURL == "" || *projectURL == "" {
+		answer(owner, "GitHub user or organization", "")
+	}
+	pagesURL, githubURL := "", ""
+	if *owner != "" {
+		pagesURL = fmt.Sprintf("https://%s.github.io/%s", strings.ToLower(*owner), *name)
+		githubURL = fmt.Sprintf("https://github.com/%s/%s", *owner, *name)
+	}
+	answer(repoURL, "Repository URL", pagesURL)
+	answer(projectURL, "Project URL", githubURL)
+	answer(packages, "AUR packages to start with (comma-separated)", "")
+	answer(signingKey, "GPG key to sign packages with (empty for none)", "")
+	if *repoURL == "" || *projectURL == "" {
+		log.Error("init needs --owner, or --repo-url and --project-url")
+		return ExitConfig
+	}
+
+	cfg := &config.Config{}
+	cfg.Meta.RepoName, cfg.Meta.RepoURL, cfg.Meta.ProjectURL = *name, strings.TrimSuffix(*repoURL, "/"), *projectURL
+	cfg.Meta.SigningKey = *signingKey
+	names := initPackages(cfg, *packages)
+	if err := cfg.Validate(); err != nil {
+		log.Error(err.Error())
+		return ExitConfig
+	}
+	if key := cfg.Meta.SigningKey; key != "" {
+		if err := exec.Command("gpg", "--batch", "--list-secret-keys", key).Run(); err != nil {
+			log.Warn(fmt.Sprintf("No secret key %s in gpg, import it where the builder runs", key))
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create %s: %v", dir, err))
+		return 1
+	}
+	log.Info(fmt.Sprintf("Scaffolding %s in %s...", cfg.Meta.RepoName, dir))
+	// Files of the builder are summed up instead of listed
+	builder := filepath.Join("src", "go-builder")
+	copied := 0
+	write := func(rel string, data []byte, mode os.FileMode) bool {
+		path := filepath.Join(dir, rel)
+		if _, err := os.Stat(path); err == nil && !*force {
+			log.Msg(fmt.Sprintf("   Keeping %s, --force overwrites it", rel))
+			return true
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Error(fmt.Sprintf("Failed to create %s: %v", filepath.Dir(rel), err))
+			return false
+		}
+		if err := os.WriteFile(path, data, mode); err != nil {
+			log.Error(fmt.Sprintf("Failed to write %s: %v", rel, err))
+			return false
+		}
+		if strings.HasPrefix(rel, builder+string(filepath.Separator)) {
+			copied++
+		} else {
+			log.Success(fmt.Sprintf("   Created %s", rel))
+		}
+		return true
+	}
+
+	ok := write(config.FileName, initConfig(cfg, names), 0644) &&
+		write("README.md", initReadme(cfg), 0644) &&
+		write(".gitignore", []byte(initGitignore), 0644)
+	if src != dir {
+		files, err := initFiles(src, builder)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to list the files of %s: %v", src, err))
+			return 1
+		}
+		for _, rel := range files {
+			info, err := os.Stat(filepath.Join(src, rel))
+			if err != nil {
+				log.Warn(fmt.Sprintf("   Not copying %s: %v", rel, err))
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(src, rel))
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to read %s: %v", rel, err))
+				return 1
+			}
+			if rel == WorkflowFile {
+				data = workflowIdentity.ReplaceAllFunc(data, func(m []byte) []byte {
+					if strings.Contains(string(m), "user.name") {
+						return []byte(`git config --global user.name "github-actions[bot]"`)
+					}
+					return []byte(`git config --global user.email "41898282+github-actions[bot]@users.noreply.github.com"`)
+				})
+			}
+			ok = ok && write(rel, data, info.Mode().Perm())
+		}
+		if copied > 0 {
+			log.Success(fmt.Sprintf("   Created %s, %d files", builder, copied))
+		}
+	}
+	if !ok {
+		return 1
+	}
+
+	log.Msg("")
+	log.Success(fmt.Sprintf("Scaffolded %s", cfg.Meta.RepoName))
+	log.Info("Next steps:")
+	if *owner != "" {
+		log.Msg(fmt.Sprintf("   1. Create %s and push %s to its main branch", githubURL, dir))
+	} else {
+		log.Msg(fmt.Sprintf("   1. Push %s to the main branch of a new GitHub repository", dir))
+	}
+	log.Msg("   2. The first workflow run creates the repo branch; serve it with GitHub Pages (Settings > Pages, deploy from the repo branch)")
+	log.Msg(fmt.Sprintf("   3. Adjust the branding in %s and add packages to %s", filepath.Dir(pages.IndexHTMLTemplate), config.FileName))
+	return 0
+}
+
+// ask prints question with its default and returns the answer, def if it
+// is empty
+func ask(in *bufio.Reader, question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, _ := in.ReadString('\n')
+	return cmp.Or(strings.TrimSpace(answer), def)
+}
+
+// initPackages splits the comma or space separated list of packages and
+// leaves out those the AUR doesn't know
+func initPackages(cfg *config.Config, list string) []string {
+	names := strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(names) == 0 {
+		return nil
+	}
+	infos, err := newAURClient(cfg).Info(names)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to look packages up on the AUR, adding them unchecked: %v", err))
+		return names
+	}
+	var found []string
+	for _, name := range names {
+		if infos[name] == nil {
+			log.Warn(fmt.Sprintf("%s is not on the AUR, leaving it out; add it with a source, see Other sources in README.md", name))
+			continue
+		}
+		found = append(found, name)
+	}
+	return found
+}
+
+// initConfig returns the config.yml of a new repository
+func initConfig(cfg *config.Config, names []string) []byte {
+	var b strings.Builder
+	b.WriteString("meta:\n")
+	fmt.Fprintf(&b, "  repo-name: %s\n", cfg.Meta.RepoName)
+	fmt.Fprintf(&b, "  repo-url: %s\n", cfg.Meta.RepoURL)
+	fmt.Fprintf(&b, "  project-url: %s\n", cfg.Meta.ProjectURL)
+	if cfg.Meta.SigningKey != "" {
+		fmt.Fprintf(&b, "  signing-key: %s\n", cfg.Meta.SigningKey)
+	}
+	b.WriteString("\npackages:\n")
+	if len(names) == 0 {
+		b.WriteString("  aur: []\n")
+	} else {
+		b.WriteString("  aur:\n")
+		for _, name := range names {
+			fmt.Fprintf(&b, "    - name: %s\n", name)
+		}
+	}
+	return []byte(b.String())
+}
+
+// initReadme returns the README.md of a new repository
+func initReadme(cfg *config.Config) []byte {
+	return []byte(fmt.Sprintf(`# %[1]s
+
+Arch Linux packages built from the AUR and hosted on GitHub Pages.
+
+## Installation
+
+Run the following command to add the repository:
+
+`+"```sh\ncurl -sL %[2]s/install | bash\n```"+`
+
+## Adding packages
+
+Add AUR package names to `+"`packages.aur`"+` in `+"`%[3]s`"+`. The GitHub Action builds them, updates the repository database and regenerates the site at %[2]s.
+`, cfg.Meta.RepoName, cfg.Meta.RepoURL, config.FileName))
+}
+
+// initGitignore keeps the caches and the build directory of local runs out
+// of git
+const initGitignore = `/build
+/aur
+/meta
+/builder.lock
+/.ccache
+/.srcdest
+/src/go-builder/builder
+`
+
+// initFiles returns the files of the checkout src init copies, relative to
+// it: the templates, the workflow and the sources of the builder in builder
+func initFiles(src, builder string) ([]string, error) {
+	files := append(append([]string{}, initTemplates...), WorkflowFile)
+	err := filepath.WalkDir(filepath.Join(src, builder), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if name := d.Name(); strings.HasSuffix(name, ".go") || name == "go.mod" || name == "go.sum" {
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,103 @@
+// Package agent builds packages on a build machine for a builder on another
+// host over HTTP. The builder sends a job, the package directory with the
+// arguments of makepkg, signed with a key both share. The agent runs
+// makepkg, streams its output back and serves the built packages until the
+// builder fetched them.
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DefaultPort is the port agents listen on unless configured
+const DefaultPort = 8790
+
+// Job is a build sent to an agent
+type Job struct {
+	Package string `json:"package"`
+	// Commit is the AUR commit the package directory is at, if any
+	Commit string `json:"commit,omitempty"`
+	// Args are the arguments of makepkg, Env its additional variables
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+}
+
+// The job archive holds jobFile and the package directory below pkgDir
+const (
+	jobFile = "job.json"
+	pkgDir  = "pkg/"
+)
+
+// Requests carry the time they were signed at, a nonce, the SHA-256 of
+// their body and the signature over these in these headers. Responses to
+// jobs carry the job in jobHeader, and the outcome in the trailers.
+const (
+	timeHeader      = "X-Gob-Time"
+	nonceHeader     = "X-Gob-Nonce"
+	bodyHeader      = "X-Gob-Body"
+	signatureHeader = "X-Gob-Signature"
+	jobHeader       = "X-Gob-Job"
+	errorTrailer    = "X-Gob-Error"
+	filesTrailer    = "X-Gob-Files"
+)
+
+// maxSkew is how far the time of a request may be off. Agents remember
+// the nonces of requests for twice as long, so none can be replayed.
+const maxSkew = 5 * time.Minute
+
+// nonceFormat matches the nonces sign generates
+var nonceFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// signature returns the signature of a request with key. It covers the
+// method, the path, the time, the nonce and the SHA-256 of the body.
+func signature(key []byte, method, path, at, nonce, bodySum string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, at, nonce, bodySum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign adds the signature of req with the body bodySum to its headers
+func sign(req *http.Request, key []byte, bodySum []byte) {
+	at := strconv.FormatInt(time.Now().Unix(), 10)
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce, sum := hex.EncodeToString(b), hex.EncodeToString(bodySum)
+	req.Header.Set(timeHeader, at)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(bodyHeader, sum)
+	req.Header.Set(signatureHeader, signature(key, req.Method, req.URL.Path, at, nonce, sum))
+}
+
+// verify checks the signature of the headers of req, before its body is
+// read, and returns the SHA-256 the body must have
+func verify(req *http.Request, key []byte) (bodySum []byte, err error) {
+	at := req.Header.Get(timeHeader)
+	unix, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("missing time")
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, fmt.Errorf("time off by %s, check the clocks", skew.Round(time.Second))
+	}
+	nonce := req.Header.Get(nonceHeader)
+	if !nonceFormat.MatchString(nonce) {
+		return nil, fmt.Errorf("missing nonce")
+	}
+	sum := req.Header.Get(bodyHeader)
+	if bodySum, err = hex.DecodeString(sum); err != nil || len(bodySum) != sha256.Size {
+		return nil, fmt.Errorf("missing body hash")
+	}
+	want := signature(key, req.Method, req.URL.Path, at, nonce, sum)
+	if !hmac.Equal([]byte(req.Header.Get(signatureHeader)), []byte(want)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return bodySum, nil
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Client sends jobs to the agent at URL
+type Client struct {
+	URL  string
+	Key  []byte
+	HTTP *http.Client
+}
+
+// NewClient returns the client of the agent at url, signing with key
+func NewClient(url string, key []byte) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Key: key, HTTP: &http.Client{}}
+}
+
+// Check verifies that the agent accepts the key and can build
+func (c *Client) Check(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/health", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Build runs job on the package directory dir on the agent, writing the
+// output of makepkg to out, and fetches the built packages into dir. It
+// returns their names.
+func (c *Client) Build(ctx context.Context, job Job, dir string, out io.Writer) ([]string, error) {
+	archive, err := os.CreateTemp("", "gob-job-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	sum := sha256.New()
+	if err := writeJob(io.MultiWriter(archive, sum), job, dir); err != nil {
+		return nil, fmt.Errorf("packing %s: %w", dir, err)
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/jobs", archive, sum.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	id := resp.Header.Get(jobHeader)
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return nil, fmt.Errorf("agent %s: %w", c.URL, err)
+	}
+	defer c.remove(id)
+	if msg := resp.Trailer.Get(errorTrailer); msg != "" {
+		return nil, fmt.Errorf("agent %s: %s", c.URL, msg)
+	}
+
+	files := strings.Fields(resp.Trailer.Get(filesTrailer))
+	for _, file := range files {
+		if err := c.fetch(ctx, id, file, dir); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// fetch downloads the file of job id into dir
+func (c *Client) fetch(ctx context.Context, id, file, dir string) error {
+	if filepath.Base(file) != file {
+		return fmt.Errorf("agent %s: invalid file %q", c.URL, file)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+id+"/"+file, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	path := filepath.Join(dir, file)
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("fetching %s from %s: %w", file, c.URL, err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// remove drops job id on the agent, which otherwise keeps it for a day
+func (c *Client) remove(id string) {
+	if id == "" {
+		return
+	}
+	if resp, err := c.do(context.Background(), http.MethodDelete, "/jobs/"+id, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do sends the signed request, with body hashing to bodySum, and returns
+// the response if it succeeded
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, bodySum []byte) (*http.Response, error) {
+	if bodySum == nil {
+		empty := sha256.Sum256(nil)
+		bodySum = empty[:]
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	sign(req, c.Key, bodySum)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("agent %s: %s: %s", c.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// writeJob writes the archive of job with the package directory dir,
+// without its git repository, packages and the work directories of
+// earlier builds
+func writeJob(w io.Writer, job Job, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: jobFile, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (rel == "src" || rel == "pkg" || rel == ".git") {
+			return filepath.SkipDir
+		}
+		if strings.Contains(d.Name(), ".pkg.tar.") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = pkgDir + filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// maxJobAge is how long finished jobs are kept for builders that didn't
+// fetch their packages
+const maxJobAge = 24 * time.Hour
+
+// MaxJobSize is the largest job archive the agent accepts
+const MaxJobSize = 256 << 20
+
+// maxUploads is how many request bodies are spooled at once, which bounds
+// the disk space they take
+const maxUploads = 2
+
+// jobID matches the names of jobs
+var jobID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Server runs the jobs it receives below Dir, one at a time
+type Server struct {
+	Dir string
+	Key []byte
+
+	mu      sync.Mutex
+	uploads chan struct{}
+	// nonces are those of the requests seen within twice maxSkew, with
+	// the time they were seen
+	nonces   map[string]time.Time
+	noncesMu sync.Mutex
+}
+
+// NewServer returns a server running jobs below dir, signed with key
+func NewServer(dir string, key []byte) *Server {
+	return &Server{Dir: dir, Key: key, uploads: make(chan struct{}, maxUploads), nonces: make(map[string]time.Time)}
+}
+
+// Handler returns the HTTP API of the server. Every request must be
+// signed with Key.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", s.health)
+	mux.HandleFunc("POST /jobs", s.build)
+	mux.HandleFunc("GET /jobs/{id}/{file}", s.file)
+	mux.HandleFunc("DELETE /jobs/{id}", s.remove)
+	return s.verified(mux)
+}
+
+// verified passes on the requests with a valid signature. The headers
+// are checked first; the body is then spooled to a temporary file, up to
+// MaxJobSize, to check its hash before it is used.
+func (s *Server) verified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want, err := verify(r, s.Key)
+		if err == nil {
+			err = s.fresh(r.Header.Get(nonceHeader))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		select {
+		case s.uploads <- struct{}{}:
+			defer func() { <-s.uploads }()
+		case <-r.Context().Done():
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, MaxJobSize)
+		body, err := os.CreateTemp(s.Dir, ".request-*")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(body.Name())
+		defer body.Close()
+		sum := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(body, sum), r.Body); err != nil {
+			status := http.StatusBadRequest
+			if _, ok := err.(*http.MaxBytesError); ok {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if !bytes.Equal(sum.Sum(nil), want) {
+			http.Error(w, "body doesn't match its signed hash", http.StatusBadRequest)
+			return
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fresh records nonce, failing if a request used it before
+func (s *Server) fresh(nonce string) error {
+	s.noncesMu.Lock()
+	defer s.noncesMu.Unlock()
+	for n, seen := range s.nonces {
+		if time.Since(seen) > 2*maxSkew {
+			delete(s.nonces, n)
+		}
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return fmt.Errorf("replayed request")
+	}
+	s.nonces[nonce] = time.Now()
+	return nil
+}
+
+// health reports whether makepkg is installed and sudo works without a
+// password, which makepkg needs to install the dependencies
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if _, err := exec.LookPath("makepkg"); err != nil {
+		http.Error(w, "makepkg is missing", http.StatusServiceUnavailable)
+		return
+	}
+	if err := exec.Command("sudo", "-n", "true").Run(); err != nil {
+		http.Error(w, "sudo asks for a password", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// build runs the job in the request body, streaming the output of makepkg.
+// The outcome follows in the trailers: the error, or the built packages.
+func (s *Server) build(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+
+	id := newID()
+	dir := filepath.Join(s.Dir, id)
+	job, err := readJob(r.Body, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		http.Error(w, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Info(fmt.Sprintf("Building %s (job %s)", job.Package, id))
+	if job.Commit != "" {
+		log.Msg(fmt.Sprintf("   Commit: %s", job.Commit))
+	}
+	log.Msg(fmt.Sprintf("   makepkg %s", strings.Join(job.Args, " ")))
+
+	w.Header().Set("Trailer", errorTrailer+", "+filesTrailer)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(jobHeader, id)
+	w.WriteHeader(http.StatusOK)
+
+	pkg := filepath.Join(dir, pkgDir)
+	out := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	cmd := exec.CommandContext(r.Context(), "makepkg", job.Args...)
+	cmd.Dir = pkg
+	cmd.Env = append(os.Environ(), job.Env...)
+	cmd.Stdout, cmd.Stderr = out, out
+	// Kill everything makepkg started when the builder goes away
+	shell.SetGroup(cmd)
+	cmd.Cancel = func() error { return shell.KillGroup(cmd) }
+	if err := cmd.Run(); err != nil {
+		log.Error(fmt.Sprintf("Build of %s failed: %v", job.Package, err))
+		w.Header().Set(errorTrailer, fmt.Sprintf("makepkg: %v", err))
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(pkg, "*.pkg.tar.*"))
+	if err != nil {
+		w.Header().Set(errorTrailer, err.Error())
+		return
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	log.Success(fmt.Sprintf("Built %s: %s", job.Package, strings.Join(names, " ")))
+	w.Header().Set(filesTrailer, strings.Join(names, " "))
+}
+
+// file serves a package built by a job
+func (s *Server) file(w http.ResponseWriter, r *http.Request) {
+	id, file := r.PathValue("id"), r.PathValue("file")
+	if !jobID.MatchString(id) || filepath.Base(file) != file || !strings.Contains(file, ".pkg.tar.") {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.Dir, id, pkgDir, file))
+}
+
+// remove drops a job once its packages were fetched
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !jobID.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(s.Dir, id)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// prune drops the jobs older than maxJobAge
+func (s *Server) prune() {
+	entries, _ := os.ReadDir(s.Dir)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && jobID.MatchString(entry.Name()) && time.Since(info.ModTime()) > maxJobAge {
+			os.RemoveAll(filepath.Join(s.Dir, entry.Name()))
+		}
+	}
+}
+
+// readJob extracts the job archive r into dir and returns the job
+func readJob(r io.Reader, dir string) (Job, error) {
+	var job Job
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return job, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return job, err
+		}
+		if header.Name == jobFile {
+			if err := json.NewDecoder(tr).Decode(&job); err != nil {
+				return job, err
+			}
+			continue
+		}
+		name, ok := strings.CutPrefix(header.Name, pkgDir)
+		if !ok || !filepath.IsLocal(name) {
+			return job, fmt.Errorf("unexpected file %s", header.Name)
+		}
+		target := filepath.Join(dir, pkgDir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return job, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return job, err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0777|0600)
+			if err != nil {
+				return job, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return job, err
+			}
+		}
+	}
+	if job.Package == "" {
+		return job, fmt.Errorf("no %s", jobFile)
+	}
+	if _, err := os.Stat(filepath.Join(dir, pkgDir, "PKGBUILD")); err != nil {
+		return job, fmt.Errorf("no PKGBUILD")
+	}
+	return job, nil
+}
+
+// newID returns the name of a new job
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// flushWriter sends the output of makepkg as it is written
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.rc.Flush()
+	return n, err
+}
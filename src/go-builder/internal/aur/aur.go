@@ -0,0 +1,254 @@
+// Package aur talks to the Arch User Repository RPC interface for package
+// metadata. Cloning is done by the source package.
+package aur
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"builder/internal/log"
+)
+
+// DefaultBaseURL is the official AUR
+const DefaultBaseURL = "https://aur.archlinux.org"
+
+// Request limits
+const (
+	// BatchSize is the maximum number of packages per RPC request, keeping
+	// responses small and retries cheap
+	BatchSize = 100
+	// MaxAttempts is how often a request is tried before giving up
+	MaxAttempts = 4
+	// maxFallbackFailures aborts per-package queries after this many
+	// consecutive failures, as the AUR is then most likely unreachable
+	maxFallbackFailures = 3
+)
+
+// RPCResponse is the response of the AUR RPC info endpoint
+type RPCResponse struct {
+	Type    string    `json:"type"`
+	Error   string    `json:"error"`
+	Results []Package `json:"results"`
+}
+
+// Package is the metadata the AUR reports for a package
+type Package struct {
+	Name        string   `json:"Name"`
+	Version     string   `json:"Version"`
+	Description string   `json:"Description"`
+	URL         string   `json:"URL"`
+	Depends     []string `json:"Depends"`
+	MakeDepends []string `json:"MakeDepends"`
+	// Maintainer is empty for orphaned packages
+	Maintainer string `json:"Maintainer"`
+	// OutOfDate is the Unix time the package was flagged, or 0
+	OutOfDate int64 `json:"OutOfDate"`
+	// LastModified is the Unix time of the last push
+	LastModified int64 `json:"LastModified"`
+}
+
+// Orphaned reports whether the package has no maintainer
+func (p *Package) Orphaned() bool {
+	return p.Maintainer == ""
+}
+
+// FlaggedOutOfDate reports whether users flagged the package out-of-date
+func (p *Package) FlaggedOutOfDate() bool {
+	return p.OutOfDate != 0
+}
+
+// Modified returns the time of the last push
+func (p *Package) Modified() time.Time {
+	return time.Unix(p.LastModified, 0)
+}
+
+// Client fetches package metadata from an AUR instance. It is not safe for
+// concurrent use.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+
+	// Interval is the minimum delay between two RPC requests
+	Interval time.Duration
+	// Backoff is the delay before the first retry, doubled for each next one
+	Backoff time.Duration
+
+	lastRequest time.Time
+}
+
+// NewClient returns a client for the official AUR
+func NewClient() *Client {
+	return &Client{
+		BaseURL: DefaultBaseURL,
+		HTTP: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		Interval: 500 * time.Millisecond,
+		Backoff:  2 * time.Second,
+	}
+}
+
+// PackageURL returns the web page of a package on the official AUR, which
+// mirrors don't necessarily serve
+func (c *Client) PackageURL(pkgName string) string {
+	return fmt.Sprintf("%s/packages/%s", DefaultBaseURL, pkgName)
+}
+
+// Info fetches metadata for multiple packages using AUR RPC API, keyed by
+// name. Packages are queried in batches of BatchSize; a batch that keeps
+// failing is retried one package at a time. Packages found are returned
+// even when some queries failed, along with the joined errors.
+func (c *Client) Info(packages []string) (map[string]*Package, error) {
+	if len(packages) == 0 {
+		return nil, nil
+	}
+
+	infos := make(map[string]*Package)
+	var errs []error
+	for start := 0; start < len(packages); start += BatchSize {
+		batch := packages[start:min(start+BatchSize, len(packages))]
+
+		result, err := c.info(batch)
+		if err == nil {
+			mergeResults(infos, result)
+			continue
+		}
+		if len(batch) == 1 {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Warn(fmt.Sprintf("AUR batch query failed (%v), querying packages one by one", err))
+		failures := 0
+		for i, name := range batch {
+			result, err := c.info([]string{name})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				if failures++; failures == maxFallbackFailures {
+					if remaining := len(batch) - i - 1; remaining > 0 {
+						errs = append(errs, fmt.Errorf("giving up on %d remaining packages", remaining))
+					}
+					break
+				}
+				continue
+			}
+			failures = 0
+			mergeResults(infos, result)
+		}
+	}
+
+	return infos, errors.Join(errs...)
+}
+
+func mergeResults(infos map[string]*Package, result *RPCResponse) {
+	for i := range result.Results {
+		infos[result.Results[i].Name] = &result.Results[i]
+	}
+}
+
+// statusError is a non-OK HTTP response
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("AUR API returned non-OK status: %d", e.code)
+}
+
+// retryable reports whether a request failing with err may succeed later
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	var rpcErr *rpcError
+	return !errors.As(err, &rpcErr)
+}
+
+// rpcError is an error reported by the RPC itself, e.g. too many arguments
+type rpcError string
+
+func (e *rpcError) Error() string {
+	return "AUR API error: " + string(*e)
+}
+
+// info queries the info endpoint for names, retrying transient failures
+// with exponential backoff. A 429 waits at least as long as Retry-After.
+func (c *Client) info(names []string) (*RPCResponse, error) {
+	backoff := c.Backoff
+	for attempt := 1; ; attempt++ {
+		result, err := c.infoOnce(names)
+		if err == nil || attempt == MaxAttempts || !retryable(err) {
+			return result, err
+		}
+
+		wait := backoff
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > wait {
+			wait = status.retryAfter
+		}
+		log.Warn(fmt.Sprintf("AUR request failed (%v), retrying in %s", err, wait))
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (c *Client) infoOnce(names []string) (*RPCResponse, error) {
+	if wait := c.Interval - time.Since(c.lastRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.lastRequest = time.Now()
+
+	// POST keeps the arguments out of the URL and its length limit
+	params := url.Values{}
+	params.Add("v", "5")
+	params.Add("type", "info")
+	for _, name := range names {
+		params.Add("arg[]", name)
+	}
+
+	resp, err := c.HTTP.PostForm(c.BaseURL+"/rpc/", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var result RPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Type == "error" {
+		e := rpcError(result.Error)
+		return nil, &e
+	}
+	return &result, nil
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// GitURL returns the git clone URL of a package
+func (c *Client) GitURL(pkgName string) string {
+	return fmt.Sprintf("%s/%s.git", c.BaseURL, pkgName)
+}
@@ -0,0 +1,111 @@
+package aur
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comment is a comment on the AUR page of a package
+type Comment struct {
+	ID     int    `json:"id"`
+	Author string `json:"author"`
+	// Date is as the AUR shows it, e.g. "2024-05-01 12:00 (UTC)"
+	Date string `json:"date"`
+	Text string `json:"text"`
+}
+
+// maxPageSize caps the package page read, which lists the latest comments
+// after the pinned ones
+const maxPageSize = 4 << 20
+
+var (
+	// commentPattern matches the header and content of one comment
+	commentPattern = regexp.MustCompile(`(?s)<h4 id="comment-(\d+)"[^>]*>(.*?)</h4>\s*<div id="comment-\d+-content"[^>]*>(.*?)</div>\s*</div>`)
+	// breakPattern matches the tags ending a line of rendered comments
+	breakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</li>|</h\d>`)
+	// prePattern matches a code block, which keeps its whitespace
+	prePattern = regexp.MustCompile(`(?is)<pre[^>]*>.*?</pre>`)
+	tagPattern = regexp.MustCompile(`<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// PinnedComments returns the comments pinned on the AUR page of a package,
+// where maintainers post manual steps and known breakage. The RPC doesn't
+// serve comments, so they are read from the page of the official AUR.
+func (c *Client) PinnedComments(pkgName string) ([]Comment, error) {
+	if wait := c.Interval - time.Since(c.lastRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.lastRequest = time.Now()
+
+	resp, err := c.HTTP.Get(c.PackageURL(pkgName))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return nil, err
+	}
+	return parsePinned(string(page))
+}
+
+// parsePinned reads the pinned comments from a package page. They come in
+// a section of their own before the latest comments.
+func parsePinned(page string) ([]Comment, error) {
+	_, pinned, ok := strings.Cut(page, ">Pinned Comments<")
+	if !ok {
+		return nil, nil
+	}
+	pinned, _, _ = strings.Cut(pinned, ">Latest Comments<")
+
+	var comments []Comment
+	for _, m := range commentPattern.FindAllStringSubmatch(pinned, -1) {
+		id, _ := strconv.Atoi(m[1])
+		header := plainText(m[2])
+		author, date, ok := strings.Cut(header, " commented on ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected comment header %q", header)
+		}
+		date, _, _ = strings.Cut(date, " (edited")
+		comments = append(comments, Comment{ID: id, Author: strings.TrimSpace(author), Date: strings.TrimSpace(date), Text: plainText(m[3])})
+	}
+	return comments, nil
+}
+
+// plainText turns the HTML of a comment into text, one line per paragraph
+// or line break. Whitespace collapses as in HTML, except in code blocks.
+func plainText(s string) string {
+	var b strings.Builder
+	for s != "" {
+		loc := prePattern.FindStringIndex(s)
+		if loc == nil {
+			loc = []int{len(s), len(s)}
+		}
+		// Each part starts a line
+		text := strings.TrimPrefix(whitespace.ReplaceAllString(s[:loc[0]], " "), " ")
+		text = breakPattern.ReplaceAllString(text, "$0\n")
+		b.WriteString(strings.ReplaceAll(text, "\n ", "\n"))
+		if loc[0] < loc[1] {
+			b.WriteString("\n" + s[loc[0]:loc[1]] + "\n")
+		}
+		s = s[loc[1]:]
+	}
+
+	lines := strings.Split(html.UnescapeString(tagPattern.ReplaceAllString(b.String(), "")), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,53 @@
+package aur
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// FeedItem is one entry of the AUR's recently updated packages feed
+type FeedItem struct {
+	Name    string
+	Updated time.Time
+}
+
+type rss struct {
+	Items []struct {
+		Title   string `xml:"title"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+// RecentlyModified returns the packages most recently pushed to the AUR,
+// newest first
+func (c *Client) RecentlyModified() ([]FeedItem, error) {
+	resp, err := c.HTTP.Get(c.BaseURL + "/rss/modified")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+
+	var feed rss
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("parsing AUR feed: %w", err)
+	}
+
+	items := make([]FeedItem, 0, len(feed.Items))
+	for _, item := range feed.Items {
+		updated, err := time.Parse(time.RFC1123Z, item.PubDate)
+		if err != nil {
+			updated, err = time.Parse(time.RFC1123, item.PubDate)
+		}
+		if err != nil {
+			continue
+		}
+		items = append(items, FeedItem{Name: item.Title, Updated: updated})
+	}
+	return items, nil
+}
@@ -0,0 +1,167 @@
+// Package binrepo finds and downloads prebuilt packages from trusted binary
+// repositories, so packages they already ship don't need a local build.
+package binrepo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/repodb"
+)
+
+// Client looks packages up in the databases of the configured repositories.
+// Each database is downloaded once per client.
+type Client struct {
+	HTTP  *http.Client
+	Repos []config.BinaryRepo
+	Arch  string
+
+	dbs  map[string]*repodb.DB
+	errs map[string]error
+}
+
+// New returns a client for repos
+func New(repos []config.BinaryRepo, arch string) *Client {
+	return &Client{
+		HTTP:  &http.Client{Timeout: 5 * time.Minute},
+		Repos: repos,
+		Arch:  arch,
+		dbs:   make(map[string]*repodb.DB),
+		errs:  make(map[string]error),
+	}
+}
+
+// Match is a package group found in a binary repository
+type Match struct {
+	Repo     config.BinaryRepo
+	Packages []*repodb.Package
+}
+
+// Find returns the packages built from pkgbase at exactly version in the
+// first repository that has them. Repositories whose database cannot be
+// read are skipped; the errors are returned by the first Find only.
+func (c *Client) Find(pkgbase, version string) (*Match, []error) {
+	var errs []error
+	for _, repo := range c.Repos {
+		if _, failed := c.errs[repo.Name]; failed {
+			continue
+		}
+		db, err := c.db(repo)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.Name, err))
+			continue
+		}
+		var pkgs []*repodb.Package
+		for _, pkg := range db.List() {
+			base := pkg.Base
+			if base == "" {
+				base = pkg.Name
+			}
+			if base == pkgbase && pkg.Version == version && (pkg.Arch == c.Arch || pkg.Arch == "any") {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+		if len(pkgs) > 0 {
+			return &Match{Repo: repo, Packages: pkgs}, errs
+		}
+	}
+	return nil, errs
+}
+
+// Packages returns every package in the database of repo
+func (c *Client) Packages(repo config.BinaryRepo) ([]*repodb.Package, error) {
+	db, err := c.db(repo)
+	if err != nil {
+		return nil, err
+	}
+	return db.List(), nil
+}
+
+// Download fetches pkg from repo into dir and checks it against the SHA-256
+// of the database entry. The upstream signature is not kept.
+func (c *Client) Download(repo config.BinaryRepo, pkg *repodb.Package, dir string) error {
+	dest := filepath.Join(dir, pkg.Filename)
+	part := dest + ".part"
+	defer os.Remove(part)
+	sum, err := c.fetch(c.url(repo, pkg.Filename), part)
+	if err != nil {
+		return err
+	}
+	if pkg.SHA256 == "" || sum != pkg.SHA256 {
+		return fmt.Errorf("%s: checksum %s does not match the database", pkg.Filename, sum)
+	}
+	if err := os.Chmod(part, 0644); err != nil {
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+// db downloads and parses the database of repo, once
+func (c *Client) db(repo config.BinaryRepo) (*repodb.DB, error) {
+	if db, ok := c.dbs[repo.Name]; ok {
+		return db, nil
+	}
+
+	db, err := c.loadDB(repo)
+	if err != nil {
+		c.errs[repo.Name] = err
+		return nil, err
+	}
+	c.dbs[repo.Name] = db
+	return db, nil
+}
+
+func (c *Client) loadDB(repo config.BinaryRepo) (*repodb.DB, error) {
+	f, err := os.CreateTemp("", repo.Name+"-*.db")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if _, err := c.fetch(c.url(repo, repo.Name+".db"), f.Name()); err != nil {
+		return nil, err
+	}
+	return repodb.Open(f.Name())
+}
+
+// url returns the URL of file in repo, substituting $repo and $arch in the
+// server URL like pacman does
+func (c *Client) url(repo config.BinaryRepo, file string) string {
+	server := strings.NewReplacer("$repo", repo.Name, "$arch", c.Arch).Replace(repo.URL)
+	return strings.TrimSuffix(server, "/") + "/" + file
+}
+
+// fetch downloads url to dest and returns the SHA-256 of the content
+func (c *Client) fetch(url, dest string) (string, error) {
+	resp, err := c.HTTP.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: status %d", url, resp.StatusCode)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,697 @@
+// Package buildsys builds packages with makepkg and collects the artifacts
+// into the repository directory.
+package buildsys
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"builder/internal/agent"
+	"builder/internal/config"
+	"builder/internal/download"
+	"builder/internal/fileutil"
+	"builder/internal/log"
+	"builder/internal/remote"
+	"builder/internal/repo"
+	"builder/internal/shell"
+)
+
+// Builder runs makepkg and copies the resulting packages to OutDir
+type Builder struct {
+	OutDir string
+
+	// Debug is the policy for the -debug split packages makepkg may
+	// produce, see config.DebugPolicy. With config.DebugSeparate they are
+	// copied to DebugDir instead of OutDir.
+	Debug    string
+	DebugDir string
+
+	// Downloader fetches sources before makepkg runs, nil leaves it to
+	// makepkg's download agents
+	Downloader *download.Downloader
+
+	// Container runs makepkg in a container, nil builds on the host
+	Container *Container
+
+	// Remote runs makepkg on a build machine over SSH, nil builds on the
+	// host. BuildOn builds on other machines.
+	Remote *remote.Host
+
+	// Expect holds the expectations of packages by name
+	Expect map[string]*config.Expect
+
+	// KeepDeps leaves build dependencies installed after each build
+	KeepDeps bool
+
+	// Arch selects the architecture specific dependencies, e.g. depends_x86_64
+	Arch string
+
+	// RunChecks forces check() on (true) or off (false) per package name;
+	// packages not listed follow makepkg.conf
+	RunChecks map[string]bool
+
+	// TestCmd holds the smoke test commands of packages by name, run after
+	// installing the built packages into a throwaway container
+	TestCmd map[string]string
+
+	// Namcap lints the PKGBUILD and packages of every build, failing it on
+	// findings matching NamcapFailOn
+	Namcap       bool
+	NamcapFailOn []string
+
+	// Lints holds the namcap findings of the last build of each package
+	Lints map[string][]Lint
+
+	// Builds describes the last successful build of each package
+	Builds map[string]BuildInfo
+
+	// Offline builds with the sources downloaded before, without updating
+	// VCS sources
+	Offline bool
+
+	// SourceDateEpoch fixes the build date makepkg records, 0 leaves it at
+	// the time of the build
+	SourceDateEpoch int64
+
+	// PkgExt forces the compression of the packages, empty for the PKGEXT
+	// of makepkg.conf
+	PkgExt string
+
+	// CCache compiles through ccache, nil to build without
+	CCache *CCache
+	// PkgCache is the pacman cache dependencies are installed from, nil for
+	// the system's
+	PkgCache *PkgCache
+	// SrcDest keeps downloaded sources across builds, nil to download them
+	// into each package directory
+	SrcDest *SrcDest
+
+	// PostBuild, if set, vets the built package files of pkgName before
+	// they are published. An error fails the build.
+	PostBuild func(pkgName string, pkgFiles []string) error
+
+	// makepkg runs makepkg, so Abort can kill it
+	makepkg shell.Group
+
+	// mu guards Lints, Builds and the groups running makepkg on the build
+	// machines other than Remote, for builds on several at once. ctx is
+	// the context of builds on agents.
+	mu      sync.Mutex
+	groups  map[*remote.Host]*shell.Group
+	ctx     context.Context
+	cancel  context.CancelFunc
+	aborted bool
+}
+
+// New returns a builder publishing packages into outDir
+func New(outDir string) *Builder {
+	return &Builder{OutDir: outDir}
+}
+
+// Abort kills the running makepkg with everything it started and makes
+// later builds fail with shell.ErrKilled
+func (b *Builder) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.aborted = true
+	b.makepkg.Kill()
+	for _, g := range b.groups {
+		g.Kill()
+	}
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// group returns the group running makepkg on host
+func (b *Builder) group(host *remote.Host) *shell.Group {
+	if host == nil || host == b.Remote {
+		return &b.makepkg
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[host]
+	if g == nil {
+		g = &shell.Group{}
+		if b.aborted {
+			g.Kill()
+		}
+		if b.groups == nil {
+			b.groups = make(map[*remote.Host]*shell.Group)
+		}
+		b.groups[host] = g
+	}
+	return g
+}
+
+// context returns the context of builds on agents, canceled by Abort
+func (b *Builder) context() context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ctx == nil {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		if b.aborted {
+			b.cancel()
+		}
+	}
+	return b.ctx
+}
+
+// InstallDeps extracts and installs dependencies, with checkdepends only if
+// checks is set. It returns the packages that were newly installed,
+// including the dependencies they pulled in.
+func (b *Builder) InstallDeps(pkgDir string, checks bool) ([]string, error) {
+	log.Info("Checking for build dependencies")
+
+	fields, err := ReadSrcinfo(pkgDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract dependencies: %v", err)
+	}
+
+	// Split packages may depend on each other
+	own := make(map[string]bool)
+	for _, name := range fields["pkgname"] {
+		own[name] = true
+	}
+	seen := make(map[string]bool)
+	var deps []string
+	keys := []string{"depends", "makedepends"}
+	if checks {
+		keys = append(keys, "checkdepends")
+	}
+	for _, key := range keys {
+		for _, dep := range append(fields[key], fields[key+"_"+b.Arch]...) {
+			if !seen[dep] && !own[depName(dep)] {
+				seen[dep] = true
+				deps = append(deps, dep)
+			}
+		}
+	}
+
+	missing := unsatisfiedDeps(deps)
+	if len(missing) == 0 {
+		log.Info("No build dependencies found")
+		return nil, nil
+	}
+
+	byRepo, unavailable := syncRepos(missing)
+	var makedeps []string
+	for _, repo := range slices.Sorted(maps.Keys(byRepo)) {
+		log.Msg(fmt.Sprintf("  From %s: %s", repo, strings.Join(byRepo[repo], " ")))
+		makedeps = append(makedeps, byRepo[repo]...)
+	}
+	if len(unavailable) > 0 {
+		log.Warn(fmt.Sprintf("  Not in any sync repository, building without: %s", strings.Join(unavailable, " ")))
+	}
+	if len(makedeps) == 0 {
+		return nil, nil
+	}
+
+	before, err := installedPackages()
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot list installed packages, build dependencies will be kept: %v", err))
+	}
+
+	depsStr := strings.Join(makedeps, " ")
+	log.Msg(fmt.Sprintf("  Installing: %s", depsStr))
+	pacmanArgs := []string{"pacman", "-S", "--noconfirm", "--needed", "--asdeps"}
+	if b.PkgCache != nil {
+		pacmanArgs = append(pacmanArgs, "--cachedir", b.PkgCache.Dir)
+	}
+	installCmd := exec.Command("sudo", append(pacmanArgs, makedeps...)...)
+	shell.Attach(installCmd)
+	if err := shell.Run(installCmd); err != nil {
+		log.Error("Failed to install build dependencies")
+		return nil, err
+	}
+
+	if before == nil {
+		return nil, nil
+	}
+	after, err := installedPackages()
+	if err != nil {
+		return nil, nil
+	}
+	var added []string
+	for name := range after {
+		if !before[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	return added, nil
+}
+
+// RemoveDeps uninstalls the packages InstallDeps added
+func (b *Builder) RemoveDeps(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	log.Msg(fmt.Sprintf("   Removing build dependencies: %s", strings.Join(names, " ")))
+	cmd := exec.Command("sudo", append([]string{"pacman", "-Rns", "--noconfirm"}, names...)...)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		log.Warn(fmt.Sprintf("Failed to remove build dependencies: %v: %s", err, strings.TrimSpace(string(out))))
+	}
+}
+
+// unsatisfiedDeps returns the dependencies the installed packages don't
+// satisfy
+func unsatisfiedDeps(deps []string) []string {
+	if len(deps) == 0 {
+		return nil
+	}
+	// pacman -T exits non-zero when it prints anything
+	out, err := shell.Output(exec.Command("pacman", append([]string{"-T"}, deps...)...))
+	if err != nil && len(out) == 0 {
+		return deps
+	}
+	return strings.Fields(string(out))
+}
+
+// syncRepos groups deps by the sync repository providing them
+func syncRepos(deps []string) (map[string][]string, []string) {
+	byRepo := make(map[string][]string)
+	var unavailable []string
+	for _, dep := range deps {
+		// -dd prints the target alone, without its dependencies
+		out, err := shell.Output(exec.Command("pacman", "-Sddp", "--print-format", "%r", dep))
+		repo := strings.TrimSpace(string(out))
+		if err != nil || repo == "" {
+			unavailable = append(unavailable, dep)
+			continue
+		}
+		byRepo[repo] = append(byRepo[repo], dep)
+	}
+	return byRepo, unavailable
+}
+
+// installedPackages returns the names of all installed packages
+func installedPackages() (map[string]bool, error) {
+	out, err := shell.Output(exec.Command("pacman", "-Qq"))
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]bool)
+	for _, name := range strings.Fields(string(out)) {
+		installed[name] = true
+	}
+	return installed, nil
+}
+
+// BuildInfo describes how a package was built
+type BuildInfo struct {
+	// PKGBUILD is the SHA-256 of the PKGBUILD as built
+	PKGBUILD string
+	// Args are the makepkg arguments
+	Args     []string
+	Started  time.Time
+	Finished time.Time
+	// DebugFiles are the debug packages copied to DebugDir
+	DebugFiles []string
+}
+
+// Build builds the package in pkgDir on Remote, or on this host, and
+// returns the list of built package files, relative to OutDir.
+func (b *Builder) Build(pkgName, pkgDir string) ([]string, error) {
+	return b.BuildOn(b.Remote, pkgName, pkgDir)
+}
+
+// BuildOn builds like Build on the build machine host, nil for this host.
+// Builds on different machines may run at the same time.
+func (b *Builder) BuildOn(host *remote.Host, pkgName, pkgDir string) ([]string, error) {
+	b.mu.Lock()
+	delete(b.Lints, pkgName)
+	b.mu.Unlock()
+	info := BuildInfo{Started: time.Now().UTC()}
+	if data, err := os.ReadFile(filepath.Join(pkgDir, "PKGBUILD")); err == nil {
+		info.PKGBUILD = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	// Install dep, containers and build machines install their own
+	runChecks, forced := b.RunChecks[pkgName]
+	if b.Container == nil && host == nil {
+		installed, err := b.InstallDeps(pkgDir, runChecks || !forced)
+		if !b.KeepDeps {
+			defer b.RemoveDeps(installed)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("build failed for %s: Failed to install Dependencies", pkgName))
+			return nil, err
+		}
+	}
+
+	args := []string{"--nodeps", "--noconfirm", "--force", "--clean"}
+	switch {
+	case forced && runChecks:
+		args = append(args, "--check")
+	case forced:
+		log.Msg("  Skipping check()")
+		args = append(args, "--nocheck")
+	}
+	if b.Offline {
+		args = append(args, "--holdver")
+	} else if b.Downloader != nil {
+		if err := b.downloadSources(pkgDir, host == nil); err != nil {
+			log.Error(fmt.Sprintf("Build failed for %s: Failed to download sources: %v", pkgName, err))
+			return nil, err
+		}
+		// The git mirrors were just updated
+		args = append(args, "--holdver")
+	}
+
+	// Build package
+	log.Msg("   Building...")
+	// --clean, --noconfirm, --nodeps (deps handled manually), --force
+	cmd := exec.Command("makepkg", args...)
+	info.Args = args
+	if b.Container != nil {
+		info.Args = append([]string{"--syncdeps"}, args[1:]...)
+		log.Msg(fmt.Sprintf("   Using %s container %s", b.Container.Runtime, b.Container.Image))
+		// Without --nodeps, as the container installs the dependencies
+		c, err := b.Container.command(pkgDir, args[1:], b.cacheMounts(), b.makepkgEnv())
+		if err != nil {
+			return nil, err
+		}
+		cmd = c
+	} else if host != nil {
+		// makepkg installs the dependencies, and removes them unless kept
+		remoteArgs := append([]string{"--syncdeps"}, args[1:]...)
+		if !b.KeepDeps {
+			remoteArgs = append(remoteArgs, "--rmdeps")
+		}
+		info.Args = remoteArgs
+		log.Msg(fmt.Sprintf("   Building %s on %s", pkgName, host))
+		if err := host.Push(pkgDir); err != nil {
+			log.Error(fmt.Sprintf("Build failed for %s: %v", pkgName, err))
+			return nil, err
+		}
+		if host.Agent == nil {
+			c, err := host.Command(pkgDir, b.makepkgEnv(), "makepkg", remoteArgs...)
+			if err != nil {
+				return nil, err
+			}
+			cmd = c
+		}
+	} else if env := b.env(); env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	var err error
+	if host != nil && host.Agent != nil {
+		err = b.buildOnAgent(host, pkgName, pkgDir, info.Args)
+	} else {
+		cmd.Dir = pkgDir
+		shell.Attach(cmd)
+		err = b.group(host).Run(cmd)
+	}
+	if errors.Is(err, shell.ErrKilled) {
+		log.Msg("")
+		log.Warn(fmt.Sprintf("Build of %s aborted", pkgName))
+		return nil, err
+	} else if err != nil {
+		log.Msg("")
+		log.Error(fmt.Sprintf("Build failed for %s: Makepkg returned error.", pkgName))
+		return nil, err
+	}
+
+	info.Finished = time.Now().UTC()
+	log.Msg("")
+	if host != nil {
+		if err := host.Pull(pkgDir, "*.pkg.tar.*"); err != nil {
+			log.Error(fmt.Sprintf("Failed to fetch the packages of %s: %v", pkgName, err))
+			return nil, err
+		}
+	}
+	if b.SrcDest != nil {
+		b.SrcDest.touch(pkgDir, b.Arch)
+	}
+
+	// Find built packages
+	var pkgFiles []string
+	entries, err := os.ReadDir(pkgDir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read dir %s: %v", pkgDir, err))
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".pkg.tar.zst") || strings.HasSuffix(name, ".pkg.tar.xz") {
+			pkgFiles = append(pkgFiles, filepath.Join(pkgDir, name))
+		}
+	}
+
+	if len(pkgFiles) == 0 {
+		log.Error(fmt.Sprintf("No package files found after build for %s", pkgName))
+		return nil, fmt.Errorf("no package files found")
+	}
+
+	if expect := b.Expect[pkgName]; expect != nil {
+		if err := checkBuilt(pkgName, pkgFiles, expect); err != nil {
+			log.Error(fmt.Sprintf("Build of %s violates its expectations, not publishing: %v", pkgName, err))
+			for _, src := range pkgFiles {
+				os.Remove(src)
+			}
+			return nil, err
+		}
+		log.Success("   Expectations met")
+	}
+
+	if b.Namcap {
+		if err := b.lint(pkgName, pkgDir, pkgFiles); err != nil {
+			log.Error(fmt.Sprintf("namcap rejected %s, not publishing: %v", pkgName, err))
+			for _, src := range pkgFiles {
+				os.Remove(src)
+			}
+			return nil, err
+		}
+	}
+
+	if command := b.TestCmd[pkgName]; command != "" {
+		if err := b.smokeTest(b.group(host), pkgFiles, command); err != nil {
+			log.Error(fmt.Sprintf("Smoke test of %s failed, not publishing: %v", pkgName, err))
+			for _, src := range pkgFiles {
+				os.Remove(src)
+			}
+			return nil, err
+		}
+		log.Success("   Smoke test passed")
+	}
+
+	if b.PostBuild != nil {
+		if err := b.PostBuild(pkgName, pkgFiles); err != nil {
+			log.Error(fmt.Sprintf("Not publishing %s: %v", pkgName, err))
+			for _, src := range pkgFiles {
+				os.Remove(src)
+			}
+			return nil, err
+		}
+	}
+
+	var copiedFiles []string
+
+	for _, src := range pkgFiles {
+		baseName := filepath.Base(src)
+		dest := filepath.Join(b.OutDir, baseName)
+
+		debug := isDebugPackage(baseName, pkgName)
+		separate := debug && b.Debug == config.DebugSeparate
+		if debug && !separate && b.Debug != config.DebugInclude {
+			log.Msg(fmt.Sprintf("   Not publishing debug package: %s", baseName))
+			os.Remove(src)
+			continue
+		}
+		if separate {
+			dest = filepath.Join(b.DebugDir, baseName)
+			if err := os.MkdirAll(b.DebugDir, 0755); err != nil {
+				log.Error(fmt.Sprintf("Failed to create %s: %v", b.DebugDir, err))
+				continue
+			}
+		}
+
+		// Copy file
+		if err := fileutil.CopyFile(src, dest); err != nil {
+			log.Error(fmt.Sprintf("Failed to copy %s: %v", baseName, err))
+			continue
+		}
+
+		if separate {
+			log.Success(fmt.Sprintf("Packaged: %s (debug repository)", baseName))
+			info.DebugFiles = append(info.DebugFiles, baseName)
+		} else {
+			log.Success(fmt.Sprintf("Packaged: %s", baseName))
+			copiedFiles = append(copiedFiles, baseName)
+		}
+
+		// Remove artifact
+		if err := os.Remove(src); err != nil {
+			log.Error(fmt.Sprintf("Failed to remove artifact: %s", baseName))
+		}
+	}
+
+	b.mu.Lock()
+	if b.Builds == nil {
+		b.Builds = make(map[string]BuildInfo)
+	}
+	b.Builds[pkgName] = info
+	b.mu.Unlock()
+	return copiedFiles, nil
+}
+
+// buildOnAgent sends the build of the package in pkgDir with the makepkg
+// arguments args to the agent of host, and fetches the packages into
+// pkgDir. It fails with shell.ErrKilled after Abort.
+func (b *Builder) buildOnAgent(host *remote.Host, pkgName, pkgDir string, args []string) error {
+	job := agent.Job{Package: pkgName, Args: args, Env: b.makepkgEnv()}
+	// AUR packages are clones
+	if _, err := os.Stat(filepath.Join(pkgDir, ".git")); err == nil {
+		if out, err := shell.Output(exec.Command("git", "-C", pkgDir, "rev-parse", "HEAD")); err == nil {
+			job.Commit = strings.TrimSpace(string(out))
+		}
+	}
+	ctx := b.context()
+	out, done := shell.Held()
+	_, err := host.Agent.Build(ctx, job, pkgDir, out)
+	if ctx.Err() != nil {
+		return shell.ErrKilled
+	}
+	done(err)
+	if err != nil {
+		log.Msg("   " + err.Error())
+	}
+	return err
+}
+
+// downloadSources fetches the sources of the PKGBUILD in pkgDir natively,
+// into SrcDest if set and the build is local
+func (b *Builder) downloadSources(pkgDir string, local bool) error {
+	fields, err := ReadSrcinfo(pkgDir)
+	if err != nil {
+		return fmt.Errorf("failed to read sources: %v", err)
+	}
+
+	log.Msg("   Downloading sources...")
+	dir := pkgDir
+	// Build machines only see the package directory
+	if b.SrcDest != nil && local {
+		dir = b.SrcDest.Dir
+	}
+	stats, err := b.Downloader.Fetch(dir, fields)
+	if err != nil {
+		return err
+	}
+	log.Msg(fmt.Sprintf("   Downloaded %d files (%.1f MB) in %s, %d cached",
+		stats.Files, float64(stats.Bytes)/1e6, stats.Elapsed.Round(100*time.Millisecond), stats.Skipped))
+	return nil
+}
+
+// env returns the variables host builds add to the environment of makepkg
+func (b *Builder) env() []string {
+	var env []string
+	if b.CCache != nil {
+		env = append(env, b.CCache.env()...)
+	}
+	if b.SrcDest != nil {
+		env = append(env, "SRCDEST="+b.SrcDest.Dir)
+	}
+	return append(env, b.makepkgEnv()...)
+}
+
+// makepkgEnv returns the variables overriding makepkg.conf, for host and
+// container builds alike
+func (b *Builder) makepkgEnv() []string {
+	var env []string
+	if b.SourceDateEpoch != 0 {
+		env = append(env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", b.SourceDateEpoch))
+	}
+	if b.PkgExt != "" {
+		env = append(env, "PKGEXT="+b.PkgExt)
+	}
+	return env
+}
+
+// cacheMounts returns the cache directories container builds mount
+func (b *Builder) cacheMounts() []cacheMount {
+	var mounts []cacheMount
+	if b.CCache != nil {
+		mounts = append(mounts, cacheMount{b.CCache.Dir, "/ccache", "CCACHE_DIR"})
+	}
+	if b.SrcDest != nil {
+		mounts = append(mounts, cacheMount{b.SrcDest.Dir, "/srcdest", "SRCDEST"})
+	}
+	if b.PkgCache != nil {
+		mounts = append(mounts, cacheMount{b.PkgCache.Dir, DefaultPkgCache, ""})
+	}
+	return mounts
+}
+
+// lint runs namcap on the PKGBUILD and the built packages, records the
+// findings in Lints and fails on those matching NamcapFailOn
+func (b *Builder) lint(pkgName, pkgDir string, pkgFiles []string) error {
+	log.Msg("   Running namcap...")
+	var lints []Lint
+	for _, path := range append([]string{filepath.Join(pkgDir, "PKGBUILD")}, pkgFiles...) {
+		found, err := Namcap(path)
+		if err != nil {
+			return fmt.Errorf("namcap failed: %v", err)
+		}
+		lints = append(lints, found...)
+	}
+	b.mu.Lock()
+	if b.Lints == nil {
+		b.Lints = make(map[string][]Lint)
+	}
+	b.Lints[pkgName] = lints
+	b.mu.Unlock()
+
+	failed := 0
+	for _, lint := range lints {
+		if lint.Matches(b.NamcapFailOn) {
+			log.Error("   " + lint.String())
+			failed++
+		} else {
+			log.Warn("   " + lint.String())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d findings match namcap-fail-on", failed)
+	}
+	if len(lints) == 0 {
+		log.Success("   namcap found nothing")
+	}
+	return nil
+}
+
+// checkBuilt checks the built package called pkgName against expect
+func checkBuilt(pkgName string, pkgFiles []string, expect *config.Expect) error {
+	for _, src := range pkgFiles {
+		if name, _ := repo.PkgNameFromFile(filepath.Base(src)); name == pkgName {
+			return CheckExpect(src, expect)
+		}
+	}
+	return fmt.Errorf("no package named %s was built", pkgName)
+}
+
+// isDebugPackage reports whether file is a -debug split package rather than
+// the configured package itself
+func isDebugPackage(file, pkgName string) bool {
+	name, ok := repo.PkgNameFromFile(file)
+	return ok && IsDebugName(name, pkgName)
+}
+
+// IsDebugName reports whether the package name is a -debug split package
+// built with the configured package pkgName
+func IsDebugName(name, pkgName string) bool {
+	return name != pkgName && strings.HasSuffix(name, "-debug")
+}
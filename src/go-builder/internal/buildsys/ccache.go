@@ -0,0 +1,90 @@
+package buildsys
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// ccacheConf enables ccache on top of the system makepkg.conf. The last
+// ccache entry of BUILDENV wins, and options=(!ccache) still opts out.
+const ccacheConf = `source /etc/makepkg.conf
+for conf in /etc/makepkg.conf.d/*.conf; do
+	[[ -f $conf ]] && source "$conf"
+done
+BUILDENV+=(ccache)
+`
+
+// CCache makes makepkg compile through ccache with a persistent cache
+type CCache struct {
+	Dir string
+}
+
+// NewCCache prepares the cache directory dir
+func NewCCache(dir string) (*CCache, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(abs, "makepkg.conf"), []byte(ccacheConf), 0644); err != nil {
+		return nil, err
+	}
+	return &CCache{Dir: abs}, nil
+}
+
+// env returns the environment makepkg runs with on the host
+func (c *CCache) env() []string {
+	return []string{"CCACHE_DIR=" + c.Dir, "MAKEPKG_CONF=" + filepath.Join(c.Dir, "makepkg.conf")}
+}
+
+// CCacheStats counts compilations served from the cache and not
+type CCacheStats struct {
+	Hits, Misses int64
+}
+
+// Sub returns the compilations since an earlier snapshot
+func (s CCacheStats) Sub(before CCacheStats) CCacheStats {
+	return CCacheStats{Hits: s.Hits - before.Hits, Misses: s.Misses - before.Misses}
+}
+
+func (s CCacheStats) String() string {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return "no compilations"
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.0f%% hit rate)", s.Hits, s.Misses, float64(s.Hits)*100/float64(total))
+}
+
+// Stats reads the cumulative statistics of the cache
+func (c *CCache) Stats() (CCacheStats, error) {
+	cmd := exec.Command("ccache", "--print-stats")
+	cmd.Env = append(os.Environ(), "CCACHE_DIR="+c.Dir)
+	out, err := shell.Output(cmd)
+	if err != nil {
+		return CCacheStats{}, err
+	}
+
+	var s CCacheStats
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "direct_cache_hit", "preprocessed_cache_hit":
+			s.Hits += n
+		case "cache_miss":
+			s.Misses += n
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,65 @@
+package buildsys
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Claims tracks which configured entry publishes each package name, so two
+// entries never write the same artifact from different pkgbases. Entries
+// sharing a pkgbase (split packages listed twice) build identical files
+// and don't conflict.
+type Claims struct {
+	owners map[string]claim
+}
+
+type claim struct {
+	entry string
+	base  string
+}
+
+// NewClaims returns an empty claim set
+func NewClaims() *Claims {
+	return &Claims{owners: make(map[string]claim)}
+}
+
+// Add records that entry publishes pkgnames built from base
+func (c *Claims) Add(entry, base string, pkgnames ...string) {
+	for _, name := range pkgnames {
+		c.owners[name] = claim{entry: entry, base: base}
+	}
+}
+
+// Check fails if another entry already publishes one of pkgnames from a
+// different pkgbase
+func (c *Claims) Check(entry, base string, pkgnames []string) error {
+	var conflicts []string
+	for _, name := range pkgnames {
+		owner, ok := c.owners[name]
+		if ok && owner.entry != entry && owner.base != base {
+			conflicts = append(conflicts, fmt.Sprintf("%s (already built by %s from pkgbase %s)", name, owner.entry, owner.base))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("artifact conflict: pkgbase %s would overwrite %s", base, strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// SrcinfoNames returns the pkgbase and package names the PKGBUILD in pkgDir
+// produces
+func SrcinfoNames(pkgDir string) (string, []string, error) {
+	fields, err := ReadSrcinfo(pkgDir)
+	if err != nil {
+		return "", nil, err
+	}
+	names := fields["pkgname"]
+	if len(names) == 0 {
+		return "", nil, fmt.Errorf("no pkgname in .SRCINFO")
+	}
+	base := names[0]
+	if b := fields["pkgbase"]; len(b) > 0 {
+		base = b[0]
+	}
+	return base, names, nil
+}
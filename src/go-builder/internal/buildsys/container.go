@@ -0,0 +1,96 @@
+package buildsys
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultImage is the container image packages are built in
+const DefaultImage = "archlinux:latest"
+
+// containerScript prepares a fresh container and runs makepkg as an
+// unprivileged user with the host's uid, so the bind-mounted files stay
+// owned by the host user. makepkg installs the dependencies itself. The
+// mounted cache directories in CACHE_DIRS are handed over to the build user
+// too.
+const containerScript = `set -e
+pacman -Syu --noconfirm --needed base-devel git sudo >/dev/null
+if [ -n "$CCACHE_DIR" ]; then
+  pacman -S --noconfirm --needed ccache >/dev/null
+  echo 'BUILDENV+=(ccache)' >> /etc/makepkg.conf
+fi
+uid=$HOST_UID; [ "$uid" = 0 ] && uid=1000
+useradd -m -u "$uid" builder
+echo 'builder ALL=(ALL) NOPASSWD: ALL' > /etc/sudoers.d/builder
+chown -R builder /build $CACHE_DIRS
+status=0
+su builder -c "makepkg --syncdeps $MAKEPKG_ARGS" || status=$?
+chown -R "$HOST_UID:$HOST_GID" /build $CACHE_DIRS
+exit $status`
+
+// Container runs makepkg in an ephemeral container instead of on the host
+type Container struct {
+	// Runtime is the docker-compatible CLI, e.g. docker or podman
+	Runtime string
+	Image   string
+}
+
+// DetectContainer returns a container using podman or, failing that, docker
+func DetectContainer() (*Container, error) {
+	for _, runtime := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(runtime); err == nil {
+			return &Container{Runtime: runtime, Image: DefaultImage}, nil
+		}
+	}
+	return nil, fmt.Errorf("container build mode needs podman or docker")
+}
+
+// proxyVars are passed on to container builds, in either case
+var proxyVars = []string{"http_proxy", "https_proxy", "no_proxy", "all_proxy"}
+
+// cacheMount is a persistent host directory mounted at target, which is
+// passed to makepkg in the variable env unless it is empty
+type cacheMount struct {
+	dir, target, env string
+}
+
+// command returns the command running makepkg with args on pkgDir, with
+// the variables env set
+func (c *Container) command(pkgDir string, args []string, mounts []cacheMount, env []string) (*exec.Cmd, error) {
+	dir, err := filepath.Abs(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	run := []string{"run", "--rm",
+		"-v", dir + ":/build",
+		"-w", "/build",
+		"-e", fmt.Sprintf("HOST_UID=%d", os.Getuid()),
+		"-e", fmt.Sprintf("HOST_GID=%d", os.Getgid()),
+		"-e", "MAKEPKG_ARGS=" + strings.Join(args, " "),
+	}
+	// Proxies and git URL rewrites apply inside the container too
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "GIT_CONFIG_") || slices.Contains(proxyVars, strings.ToLower(name)) {
+			run = append(run, "-e", name)
+		}
+	}
+	for _, v := range env {
+		run = append(run, "-e", v)
+	}
+	var targets []string
+	for _, m := range mounts {
+		run = append(run, "-v", m.dir+":"+m.target)
+		if m.env != "" {
+			run = append(run, "-e", m.env+"="+m.target)
+		}
+		targets = append(targets, m.target)
+	}
+	run = append(run, "-e", "CACHE_DIRS="+strings.Join(targets, " "))
+	run = append(run, c.Image, "bash", "-c", containerScript)
+	return exec.Command(c.Runtime, run...), nil
+}
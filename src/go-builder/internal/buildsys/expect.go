@@ -0,0 +1,66 @@
+package buildsys
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"builder/internal/config"
+)
+
+// CheckExpect verifies a built package file against its expectations and
+// returns every violation
+func CheckExpect(pkgFile string, expect *config.Expect) error {
+	info, err := ReadPkginfo(pkgFile)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if len(expect.Files) > 0 {
+		files, err := ListFiles(pkgFile)
+		if err != nil {
+			return err
+		}
+		for _, want := range expect.Files {
+			want = strings.TrimPrefix(want, "/")
+			if !slices.Contains(files, want) {
+				errs = append(errs, fmt.Errorf("missing file /%s", want))
+			}
+		}
+	}
+
+	if expect.MinSize != 0 || expect.MaxSize != 0 {
+		var size int64
+		if v := info["size"]; len(v) > 0 {
+			size, _ = strconv.ParseInt(v[0], 10, 64)
+		}
+		if expect.MinSize != 0 && size < int64(expect.MinSize) {
+			errs = append(errs, fmt.Errorf("installed size %s is below %s", config.ByteSize(size), expect.MinSize))
+		}
+		if expect.MaxSize != 0 && size > int64(expect.MaxSize) {
+			errs = append(errs, fmt.Errorf("installed size %s is above %s", config.ByteSize(size), expect.MaxSize))
+		}
+	}
+
+	depends := make(map[string]bool)
+	for _, dep := range info["depend"] {
+		depends[depName(dep)] = true
+	}
+	for _, want := range expect.Depends {
+		if !depends[want] {
+			errs = append(errs, fmt.Errorf("no longer depends on %s", want))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// depName strips the version constraint from a dependency like foo>=1.0
+func depName(dep string) string {
+	if i := strings.IndexAny(dep, "<>="); i >= 0 {
+		return dep[:i]
+	}
+	return dep
+}
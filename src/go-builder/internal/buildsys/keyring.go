@@ -0,0 +1,120 @@
+package buildsys
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"builder/internal/config"
+)
+
+// KeyringDir is where pacman-key --populate looks for keyrings
+const KeyringDir = "/usr/share/pacman/keyrings"
+
+// HookDir is where pacman looks for the hooks packages install
+const HookDir = "/usr/share/libalpm/hooks"
+
+// Keyring is the public part of a signing key, as the keyring package of a
+// repository ships it
+type Keyring struct {
+	// Fingerprint is that of the primary key
+	Fingerprint string
+	// Key is the minimal binary export of the public key
+	Key []byte
+	// Updated is the time of the newest self-signature, which changes when
+	// the key is extended or gets a new subkey
+	Updated time.Time
+}
+
+// Version returns the version of the keyring package, the day the key was
+// last updated
+func (k *Keyring) Version() string {
+	return k.Updated.UTC().Format("20060102") + "-1"
+}
+
+// ExportKey reads the public key of key from gpg
+func ExportKey(key string) (*Keyring, error) {
+	out, err := gpg("--with-colons", "--fixed-list-mode", "--list-sigs", key)
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyring{}
+	keyID := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 10 {
+			continue
+		}
+		switch fields[0] {
+		case "pub":
+			if keyID != "" {
+				return nil, fmt.Errorf("%s matches more than one key, use its fingerprint", key)
+			}
+			keyID = fields[4]
+		case "fpr":
+			if k.Fingerprint == "" {
+				k.Fingerprint = fields[9]
+			}
+		case "sig":
+			if fields[4] != keyID {
+				continue
+			}
+			if created, err := strconv.ParseInt(fields[5], 10, 64); err == nil && time.Unix(created, 0).After(k.Updated) {
+				k.Updated = time.Unix(created, 0)
+			}
+		}
+	}
+	if k.Fingerprint == "" || k.Updated.IsZero() {
+		return nil, fmt.Errorf("no public key %s in gpg", key)
+	}
+
+	if k.Key, err = gpg("--export-options", "export-minimal", "--export", k.Fingerprint); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// gpg runs gpg in batch mode and returns its output
+func gpg(args ...string) ([]byte, error) {
+	cmd := exec.Command("gpg", append([]string{"--batch"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("gpg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// WriteKeyringPKGBUILD generates the PKGBUILD for the keyring package meta
+// of the repository of cfg below dir and returns the package directory. The
+// package installs the key where pacman-key --populate finds it, and a hook
+// populating the keyring whenever the package is installed or upgraded.
+func WriteKeyringPKGBUILD(cfg *config.Config, meta config.MetaPackage, key *Keyring, dir string) (string, error) {
+	name := cfg.Meta.RepoName
+	hook := fmt.Sprintf(`[Trigger]
+Operation = Install
+Operation = Upgrade
+Type = Package
+Target = %s
+
+[Action]
+Description = Populating the pacman keyring with the %s signing key...
+When = PostTransaction
+Exec = /usr/bin/pacman-key --populate %s
+`, meta.Name, name, name)
+
+	sources := []sourceFile{
+		{Name: name + ".gpg", Data: key.Key},
+		{Name: name + "-trusted", Data: []byte(key.Fingerprint + ":4:\n")},
+		{Name: name + "-revoked", Data: nil},
+		{Name: meta.Name + ".hook", Data: []byte(hook)},
+	}
+	body := fmt.Sprintf("\tinstall -Dm644 -t \"$pkgdir%s\" %s %s %s\n", KeyringDir,
+		ShellQuote(sources[0].Name), ShellQuote(sources[1].Name), ShellQuote(sources[2].Name))
+	body += fmt.Sprintf("\tinstall -Dm644 -t \"$pkgdir%s\" %s\n", HookDir, ShellQuote(sources[3].Name))
+	return writeGenerated(cfg, meta, dir, sources, body)
+}
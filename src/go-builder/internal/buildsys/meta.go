@@ -0,0 +1,108 @@
+package buildsys
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/version"
+)
+
+// WriteMetaPKGBUILD generates the PKGBUILD for a meta-package below dir and
+// returns the package directory.
+func WriteMetaPKGBUILD(cfg *config.Config, meta config.MetaPackage, dir string) (string, error) {
+	return writeGenerated(cfg, meta, dir, nil, "\t:\n")
+}
+
+// sourceFile is a file a generated PKGBUILD ships, next to it
+type sourceFile struct {
+	Name string
+	Data []byte
+}
+
+// writeGenerated writes the PKGBUILD and .SRCINFO of a package generated
+// from meta below dir, with the source files and the body of its package
+// function, and returns the package directory.
+func writeGenerated(cfg *config.Config, meta config.MetaPackage, dir string, sources []sourceFile, body string) (string, error) {
+	epoch, pkgver, pkgrel, err := version.Split(meta.Version)
+	if err != nil {
+		return "", err
+	}
+
+	description := meta.Description
+	if description == "" {
+		description = fmt.Sprintf("Meta-package for the %s repository", cfg.Meta.RepoName)
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by the repo builder from config.yml. Do not edit.\n")
+	fmt.Fprintf(&b, "pkgname=%s\n", ShellQuote(meta.Name))
+	fmt.Fprintf(&b, "pkgver=%s\n", ShellQuote(pkgver))
+	fmt.Fprintf(&b, "pkgrel=%s\n", ShellQuote(pkgrel))
+	if epoch != "" {
+		fmt.Fprintf(&b, "epoch=%s\n", ShellQuote(epoch))
+	}
+	fmt.Fprintf(&b, "pkgdesc=%s\n", ShellQuote(description))
+	b.WriteString("arch=('any')\n")
+	fmt.Fprintf(&b, "url=%s\n", ShellQuote(cfg.Meta.ProjectURL))
+	writeArray(&b, "depends", meta.Depends)
+	if len(sources) > 0 {
+		var names, sums []string
+		for _, f := range sources {
+			names = append(names, f.Name)
+			sums = append(sums, fmt.Sprintf("%x", sha256.Sum256(f.Data)))
+		}
+		writeArray(&b, "source", names)
+		writeArray(&b, "sha256sums", sums)
+	}
+	b.WriteString("\npackage() {\n" + body + "}\n")
+
+	pkgDir := filepath.Join(dir, meta.Name)
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "PKGBUILD"), []byte(b.String()), 0644); err != nil {
+		return "", err
+	}
+	for _, f := range sources {
+		if err := os.WriteFile(filepath.Join(pkgDir, f.Name), f.Data, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	// Lets hosts without makepkg read the package, see ReadSrcinfo
+	var si strings.Builder
+	fmt.Fprintf(&si, "pkgbase = %s\n\tpkgver = %s\n\tpkgrel = %s\n", meta.Name, pkgver, pkgrel)
+	if epoch != "" {
+		fmt.Fprintf(&si, "\tepoch = %s\n", epoch)
+	}
+	si.WriteString("\tarch = any\n")
+	for _, dep := range meta.Depends {
+		fmt.Fprintf(&si, "\tdepends = %s\n", dep)
+	}
+	fmt.Fprintf(&si, "\npkgname = %s\n", meta.Name)
+	if err := os.WriteFile(filepath.Join(pkgDir, ".SRCINFO"), []byte(si.String()), 0644); err != nil {
+		return "", err
+	}
+	return pkgDir, nil
+}
+
+// writeArray writes the PKGBUILD array name of the quoted values to b
+func writeArray(b *strings.Builder, name string, values []string) {
+	b.WriteString(name + "=(")
+	for i, value := range values {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(ShellQuote(value))
+	}
+	b.WriteString(")\n")
+}
+
+// ShellQuote single-quotes s for safe use in a PKGBUILD
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
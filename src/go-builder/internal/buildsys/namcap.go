@@ -0,0 +1,75 @@
+package buildsys
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// namcap severities, as named in fail-on
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+var severities = [][2]string{{"E", SeverityError}, {"W", SeverityWarning}, {"I", "info"}}
+
+// Lint is one namcap finding
+type Lint struct {
+	// Target is PKGBUILD or the package file name
+	Target   string
+	Severity string
+	// Tag names the check, e.g. dependency-detected-not-included
+	Tag    string
+	Detail string
+}
+
+func (l Lint) String() string {
+	s := fmt.Sprintf("%s %s: %s", l.Target, l.Severity, l.Tag)
+	if l.Detail != "" {
+		s += " " + l.Detail
+	}
+	return s
+}
+
+// Matches reports whether the lint is of a severity or tag in failOn
+func (l Lint) Matches(failOn []string) bool {
+	return slices.Contains(failOn, l.Severity) || slices.Contains(failOn, l.Tag)
+}
+
+// Namcap runs namcap on a PKGBUILD or package file and returns its findings
+func Namcap(path string) ([]Lint, error) {
+	out, err := shell.Output(exec.Command("namcap", "-m", path))
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	var lints []Lint
+	for _, line := range strings.Split(string(out), "\n") {
+		if lint, ok := parseLint(filepath.Base(path), line); ok {
+			lints = append(lints, lint)
+		}
+	}
+	return lints, nil
+}
+
+// parseLint parses a machine readable namcap line such as
+// "foo E: dependency-detected-not-included bar (libbar.so)"
+func parseLint(target, line string) (Lint, bool) {
+	for _, s := range severities {
+		code, severity := s[0], s[1]
+		_, rest, ok := strings.Cut(line, " "+code+": ")
+		if !ok {
+			continue
+		}
+		tag, detail, _ := strings.Cut(rest, " ")
+		return Lint{Target: target, Severity: severity, Tag: tag, Detail: detail}, true
+	}
+	return Lint{}, false
+}
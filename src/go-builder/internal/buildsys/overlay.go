@@ -0,0 +1,102 @@
+package buildsys
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/fileutil"
+	"builder/internal/shell"
+)
+
+// OverlayPatch is the file of an overlay applied with git apply instead of
+// being copied
+const OverlayPatch = "pkgbuild.patch"
+
+// ApplyOverlay copies the files in overlayDir over pkgDir, then applies its
+// OverlayPatch, if any. It returns what was applied and a function undoing
+// it; a missing overlayDir applies nothing.
+func ApplyOverlay(overlayDir, pkgDir string) ([]string, func(), error) {
+	var applied []string
+	var undo []func()
+	restore := func() {
+		for _, f := range slices.Backward(undo) {
+			f()
+		}
+	}
+
+	err := filepath.WalkDir(overlayDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(overlayDir, path)
+		if err != nil || rel == "." || rel == OverlayPatch {
+			return err
+		}
+		dest := filepath.Join(pkgDir, rel)
+		if d.IsDir() {
+			if _, err := os.Stat(dest); os.IsNotExist(err) {
+				if err := os.Mkdir(dest, 0755); err != nil {
+					return err
+				}
+				undo = append(undo, func() { os.RemoveAll(dest) })
+			}
+			return nil
+		}
+		if info, err := os.Stat(dest); err == nil {
+			original, err := os.ReadFile(dest)
+			if err != nil {
+				return err
+			}
+			undo = append(undo, func() { os.WriteFile(dest, original, info.Mode()) })
+		} else {
+			undo = append(undo, func() { os.Remove(dest) })
+		}
+		if err := fileutil.CopyFile(path, dest); err != nil {
+			return err
+		}
+		applied = append(applied, rel)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, restore, nil
+	} else if err != nil {
+		restore()
+		return nil, nil, err
+	}
+
+	patch, err := filepath.Abs(filepath.Join(overlayDir, OverlayPatch))
+	if err != nil {
+		restore()
+		return nil, nil, err
+	}
+	if _, err := os.Stat(patch); err == nil {
+		if err := gitApply(pkgDir, patch); err != nil {
+			restore()
+			return nil, nil, fmt.Errorf("%s does not apply: %v", OverlayPatch, err)
+		}
+		undo = append(undo, func() { gitApply(pkgDir, patch, "--reverse") })
+		applied = append(applied, OverlayPatch)
+	}
+	return applied, restore, nil
+}
+
+// gitApply applies patch to pkgDir, with paths relative to pkgDir even if it
+// is a subdirectory of a git checkout
+func gitApply(pkgDir, patch string, args ...string) error {
+	abs, err := filepath.Abs(pkgDir)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", append(append([]string{"apply"}, args...), patch)...)
+	cmd.Dir = abs
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(abs))
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package buildsys
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/repo"
+	"builder/internal/version"
+)
+
+// DefaultPkgCache is where pacman keeps downloaded packages by default
+const DefaultPkgCache = "/var/cache/pacman/pkg"
+
+// PkgCache is the pacman package cache dependency installs download into
+type PkgCache struct {
+	Dir string
+}
+
+// NewPkgCache prepares the package cache directory dir
+func NewPkgCache(dir string) (*PkgCache, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &PkgCache{Dir: abs}, nil
+}
+
+// Prune removes all but the newest cached version of each package, then
+// the least recently downloaded packages until the cache holds at most
+// limit bytes, 0 for no limit. Signatures go with their package. It returns
+// the number of packages removed and the bytes freed.
+func (c *PkgCache) Prune(limit int64) (int, int64, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type cached struct {
+		cacheEntry
+		version string
+	}
+	byName := make(map[string][]cached)
+	for _, entry := range entries {
+		file := entry.Name()
+		name, ok := repo.PkgNameFromFile(file)
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(c.Dir, file)
+		e := cacheEntry{[]string{path}, info.Size(), info.ModTime()}
+		if sig, err := os.Stat(path + ".sig"); err == nil {
+			e.paths = append(e.paths, path+".sig")
+			e.size += sig.Size()
+		}
+		// name-pkgver-pkgrel-arch.pkg.tar.*
+		rest := file[len(name)+1 : strings.Index(file, ".pkg.tar")]
+		ver := rest[:strings.LastIndex(rest, "-")]
+		byName[name] = append(byName[name], cached{e, ver})
+	}
+
+	var removed int
+	var freed int64
+	var newest []cacheEntry
+	for _, versions := range byName {
+		slices.SortFunc(versions, func(a, b cached) int { return version.Compare(b.version, a.version) })
+		newest = append(newest, versions[0].cacheEntry)
+		for _, old := range versions[1:] {
+			for _, path := range old.paths {
+				if err := os.Remove(path); err != nil {
+					return removed, freed, err
+				}
+			}
+			removed++
+			freed += old.size
+		}
+	}
+	if limit == 0 {
+		return removed, freed, nil
+	}
+	n, bytes, err := removeLRU(newest, limit)
+	return removed + n, freed + bytes, err
+}
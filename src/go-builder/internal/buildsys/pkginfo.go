@@ -0,0 +1,43 @@
+package buildsys
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// ReadPkginfo returns every value of each key of the .PKGINFO in a built
+// package file
+func ReadPkginfo(pkgFile string) (map[string][]string, error) {
+	output, err := shell.Output(exec.Command("bsdtar", "-xOqf", pkgFile, ".PKGINFO"))
+	if err != nil {
+		return nil, err
+	}
+	if len(output) == 0 {
+		return nil, fmt.Errorf(".PKGINFO missing")
+	}
+
+	fields := make(map[string][]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if ok {
+			fields[key] = append(fields[key], value)
+		}
+	}
+	return fields, nil
+}
+
+// ListFiles returns the paths in a package file, reading the whole archive
+func ListFiles(pkgFile string) ([]string, error) {
+	output, err := shell.CombinedOutput(exec.Command("bsdtar", "-tf", pkgFile))
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return nil, fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
@@ -0,0 +1,152 @@
+package buildsys
+
+import (
+	"bytes"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/repo"
+	"builder/internal/shell"
+)
+
+// Difference describes how two builds of a package file differ
+type Difference struct {
+	// Missing and Extra are the paths only in the first and only in the
+	// second file
+	Missing, Extra []string
+	// Changed are the paths whose content, mode or link target differ
+	Changed []string
+	// Metadata are the changed lines of .PKGINFO and .BUILDINFO, prefixed
+	// with - and +
+	Metadata []string
+}
+
+// metadataFiles are compared line by line
+var metadataFiles = []string{".PKGINFO", ".BUILDINFO"}
+
+// ComparePackages returns nil if two package files are identical bit for
+// bit. Otherwise it extracts both and returns how their contents differ; an
+// empty Difference means only the archives differ, e.g. in the order or
+// timestamps of their members.
+func ComparePackages(a, b string) (*Difference, error) {
+	sumA, err := repo.FileSHA256(a)
+	if err != nil {
+		return nil, err
+	}
+	sumB, err := repo.FileSHA256(b)
+	if err != nil {
+		return nil, err
+	}
+	if sumA == sumB {
+		return nil, nil
+	}
+
+	tmp, err := os.MkdirTemp("", "compare-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	dirA, dirB := filepath.Join(tmp, "a"), filepath.Join(tmp, "b")
+	for file, dir := range map[string]string{a: dirA, b: dirB} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := shell.Run(exec.Command("bsdtar", "-xpf", file, "-C", dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	entriesA, err := treeEntries(dirA)
+	if err != nil {
+		return nil, err
+	}
+	entriesB, err := treeEntries(dirB)
+	if err != nil {
+		return nil, err
+	}
+	diff := &Difference{}
+	for _, path := range slices.Sorted(maps.Keys(entriesA)) {
+		entryA := entriesA[path]
+		entryB, ok := entriesB[path]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, path)
+		case entryA.mode != entryB.mode || !bytes.Equal(entryA.data, entryB.data):
+			diff.Changed = append(diff.Changed, path)
+			if slices.Contains(metadataFiles, path) {
+				diff.Metadata = append(diff.Metadata, changedLines(entryA.data, entryB.data)...)
+			}
+		}
+	}
+	for _, path := range slices.Sorted(maps.Keys(entriesB)) {
+		if _, ok := entriesA[path]; !ok {
+			diff.Extra = append(diff.Extra, path)
+		}
+	}
+	return diff, nil
+}
+
+// treeEntry is a path in an extracted package
+type treeEntry struct {
+	mode fs.FileMode
+	// data is the content of a file or the target of a link
+	data []byte
+}
+
+// treeEntries returns every path below dir
+func treeEntries(dir string) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{mode: info.Mode()}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.data = []byte(target)
+		case d.Type().IsRegular():
+			if entry.data, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		entries[filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// changedLines returns the lines only in a, prefixed with -, and those only
+// in b, prefixed with +
+func changedLines(a, b []byte) []string {
+	linesA := strings.Split(strings.TrimSpace(string(a)), "\n")
+	linesB := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var changed []string
+	for _, line := range linesA {
+		if !slices.Contains(linesB, line) {
+			changed = append(changed, "- "+line)
+		}
+	}
+	for _, line := range linesB {
+		if !slices.Contains(linesA, line) {
+			changed = append(changed, "+ "+line)
+		}
+	}
+	return changed
+}
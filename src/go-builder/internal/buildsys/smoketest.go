@@ -0,0 +1,52 @@
+package buildsys
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// smokeTestScript installs the packages mounted at /pkgs into a fresh
+// container, resolving dependencies from the official repositories and the
+// repository mounted at /repo, then runs TEST_CMD
+const smokeTestScript = `set -e
+for db in /repo/*.db; do
+  [ -e "$db" ] || continue
+  printf '\n[%s]\nSigLevel = Optional TrustAll\nServer = file:///repo\n' "$(basename "$db" .db)" >> /etc/pacman.conf
+done
+pacman -Syu --noconfirm >/dev/null
+pacman -U --noconfirm /pkgs/*.pkg.tar.* >/dev/null
+sh -c "$TEST_CMD"`
+
+// smokeTest installs pkgFiles into a throwaway container and runs command
+// there, in the group g of the build. It uses the build container or, when
+// building on the host, podman or docker.
+func (b *Builder) smokeTest(g *shell.Group, pkgFiles []string, command string) error {
+	c := b.Container
+	if c == nil {
+		var err error
+		if c, err = DetectContainer(); err != nil {
+			return fmt.Errorf("test-cmd needs podman or docker")
+		}
+	}
+	pkgDir, err := filepath.Abs(filepath.Dir(pkgFiles[0]))
+	if err != nil {
+		return err
+	}
+	repoDir, err := filepath.Abs(b.OutDir)
+	if err != nil {
+		return err
+	}
+
+	log.Msg(fmt.Sprintf("   Running smoke test in %s container: %s", c.Runtime, command))
+	cmd := exec.Command(c.Runtime, "run", "--rm",
+		"-v", pkgDir+":/pkgs:ro",
+		"-v", repoDir+":/repo:ro",
+		"-e", "TEST_CMD="+command,
+		c.Image, "bash", "-c", smokeTestScript)
+	shell.Attach(cmd)
+	return g.Run(cmd)
+}
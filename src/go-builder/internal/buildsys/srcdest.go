@@ -0,0 +1,110 @@
+package buildsys
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"builder/internal/download"
+)
+
+// SrcDest is a source directory shared by all packages, so that makepkg
+// downloads each source tarball and VCS mirror once across builds and runs
+type SrcDest struct {
+	Dir string
+}
+
+// NewSrcDest prepares the source directory dir
+func NewSrcDest(dir string) (*SrcDest, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &SrcDest{Dir: abs}, nil
+}
+
+// touch marks the sources of the package in pkgDir as used now, so Prune
+// removes them last
+func (s *SrcDest) touch(pkgDir, arch string) {
+	fields, err := ReadSrcinfo(pkgDir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range append(fields["source"], fields["source_"+arch]...) {
+		if src, ok := download.ParseSource(entry); ok {
+			os.Chtimes(filepath.Join(s.Dir, src.File), now, now)
+		}
+	}
+}
+
+// Prune removes the least recently used sources until the directory holds
+// at most limit bytes. It returns the number of sources removed and the
+// bytes freed.
+func (s *SrcDest) Prune(limit int64) (int, int64, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var sources []cacheEntry
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			path := filepath.Join(s.Dir, entry.Name())
+			sources = append(sources, cacheEntry{[]string{path}, dirSize(path), info.ModTime()})
+		}
+	}
+	return removeLRU(sources, limit)
+}
+
+// cacheEntry is an item of a cache directory, made of one or more files
+type cacheEntry struct {
+	paths   []string
+	size    int64
+	modTime time.Time
+}
+
+// removeLRU removes the least recently modified entries until the rest
+// holds at most limit bytes. It returns the number of entries removed and
+// the bytes freed.
+func removeLRU(entries []cacheEntry, limit int64) (int, int64, error) {
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	slices.SortFunc(entries, func(a, b cacheEntry) int { return a.modTime.Compare(b.modTime) })
+
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		if total-freed <= limit {
+			break
+		}
+		for _, path := range e.paths {
+			if err := os.RemoveAll(path); err != nil {
+				return removed, freed, err
+			}
+		}
+		removed++
+		freed += e.size
+	}
+	return removed, freed, nil
+}
+
+// dirSize returns the size of the file or directory tree at path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
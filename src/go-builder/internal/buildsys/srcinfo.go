@@ -0,0 +1,118 @@
+package buildsys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"builder/internal/remote"
+	"builder/internal/shell"
+)
+
+// SrcinfoHost runs makepkg --printsrcinfo on hosts without makepkg, nil to
+// read the .SRCINFO file instead
+var SrcinfoHost *remote.Host
+
+// ReadSrcinfo runs makepkg --printsrcinfo in pkgDir and returns every value
+// of each key, across the pkgbase and all pkgname sections. On hosts without
+// makepkg it runs on SrcinfoHost, or else, e.g. in container build mode, the
+// .SRCINFO file is read instead.
+func ReadSrcinfo(pkgDir string) (map[string][]string, error) {
+	cmd := exec.Command("makepkg", "--printsrcinfo")
+	cmd.Dir = pkgDir
+	output, err := shell.Output(cmd)
+	if errors.Is(err, exec.ErrNotFound) && SrcinfoHost != nil {
+		output, err = remoteSrcinfo(pkgDir)
+	} else if errors.Is(err, exec.ErrNotFound) {
+		output, err = os.ReadFile(filepath.Join(pkgDir, ".SRCINFO"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseSrcinfo(output), nil
+}
+
+// parseSrcinfo returns every value of each key of a .SRCINFO
+func parseSrcinfo(data []byte) map[string][]string {
+	fields := make(map[string][]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " = ")
+		if ok {
+			fields[key] = append(fields[key], value)
+		}
+	}
+	return fields
+}
+
+// pkgrelLine matches the top-level pkgrel assignment of a PKGBUILD
+var pkgrelLine = regexp.MustCompile(`(?m)^pkgrel=.*$`)
+
+// SetPkgrel replaces the pkgrel of the PKGBUILD in pkgDir. The returned
+// function restores the original PKGBUILD.
+func SetPkgrel(pkgDir, pkgrel string) (func(), error) {
+	path := filepath.Join(pkgDir, "PKGBUILD")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !pkgrelLine.Match(data) {
+		return nil, fmt.Errorf("PKGBUILD sets no pkgrel")
+	}
+	patched := pkgrelLine.ReplaceAll(data, []byte("pkgrel="+pkgrel))
+	if err := os.WriteFile(path, patched, info.Mode()); err != nil {
+		return nil, err
+	}
+	return func() { os.WriteFile(path, data, info.Mode()) }, nil
+}
+
+// PKGBUILDVersion returns the full version declared by the PKGBUILD in pkgDir
+func PKGBUILDVersion(pkgDir string) string {
+	fields, err := ReadSrcinfo(pkgDir)
+	if err != nil {
+		return ""
+	}
+	return srcinfoVersion(fields)
+}
+
+// SrcinfoFileVersion returns the full version in the .SRCINFO file in
+// pkgDir, or "" if there is none. Unlike PKGBUILDVersion it runs nothing
+// from the PKGBUILD, so it is safe before the PKGBUILD was reviewed.
+func SrcinfoFileVersion(pkgDir string) string {
+	data, err := os.ReadFile(filepath.Join(pkgDir, ".SRCINFO"))
+	if err != nil {
+		return ""
+	}
+	return srcinfoVersion(parseSrcinfo(data))
+}
+
+// srcinfoVersion returns the full version of the .SRCINFO fields, or ""
+func srcinfoVersion(fields map[string][]string) string {
+	if len(fields["pkgver"]) == 0 || len(fields["pkgrel"]) == 0 {
+		return ""
+	}
+	version := fields["pkgver"][0] + "-" + fields["pkgrel"][0]
+	if epoch := fields["epoch"]; len(epoch) > 0 && epoch[0] != "" {
+		version = epoch[0] + ":" + version
+	}
+	return version
+}
+
+// remoteSrcinfo runs makepkg --printsrcinfo in pkgDir on SrcinfoHost
+func remoteSrcinfo(pkgDir string) ([]byte, error) {
+	if err := SrcinfoHost.Push(pkgDir); err != nil {
+		return nil, err
+	}
+	cmd, err := SrcinfoHost.Command(pkgDir, nil, "makepkg", "--printsrcinfo")
+	if err != nil {
+		return nil, err
+	}
+	return shell.Output(cmd)
+}
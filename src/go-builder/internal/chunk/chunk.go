@@ -0,0 +1,219 @@
+// Package chunk splits package files too large for the host into parts, so
+// they can be published where files have a size limit. The client puts them
+// back together with the XferCommand helper in Script.
+package chunk
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix turns a package file name into the name of the directory holding
+// its parts, published next to it
+const Suffix = ".chunks"
+
+// ManifestFile lists the parts in the directory of a split file. Its first
+// line is `file <sha256> <size>` for the whole file, then every part in
+// order as `part <sha256> <size> <name>`.
+const ManifestFile = "manifest"
+
+// ScriptFile is the name of Script in the build root
+const ScriptFile = "xfer.sh"
+
+// IsSplit reports whether the file at path has been split into parts
+func IsSplit(path string) bool {
+	_, err := os.Stat(filepath.Join(path+Suffix, ManifestFile))
+	return err == nil
+}
+
+// Sync splits the package files in dir over size into parts of size, and
+// removes the parts of files that were deleted or are small enough again.
+// A size of 0 removes every split. It returns the files it split.
+func Sync(dir string, size int64) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var split []string
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if entry.IsDir() {
+			if file, ok := strings.CutSuffix(path, Suffix); ok && !needsSplit(file, size) {
+				if err := os.RemoveAll(path); err != nil {
+					return split, err
+				}
+			}
+			continue
+		}
+		if !strings.Contains(name, ".pkg.tar.") || strings.HasSuffix(name, ".sig") || !needsSplit(path, size) {
+			continue
+		}
+		done, err := upToDate(path)
+		if err != nil {
+			return split, err
+		}
+		if done {
+			continue
+		}
+		if err := Split(path, size); err != nil {
+			return split, fmt.Errorf("split %s: %w", name, err)
+		}
+		split = append(split, name)
+	}
+	return split, nil
+}
+
+func needsSplit(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && size > 0 && info.Size() > size
+}
+
+// upToDate reports whether the parts of the file at path match it. Packages
+// rebuilt without a version bump keep their name but not their content.
+func upToDate(path string) (bool, error) {
+	f, err := os.Open(filepath.Join(path+Suffix, ManifestFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var sum string
+	var size int64
+	if _, err := fmt.Fscanf(bufio.NewReader(f), "file %s %d\n", &sum, &size); err != nil {
+		return false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != size {
+		return false, err
+	}
+	actual, err := fileSHA256(path)
+	return actual == sum, err
+}
+
+// Split writes the parts of the file at path and their manifest to its
+// directory, replacing older parts
+func Split(path string, size int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written next to the final directory, which is replaced in one rename
+	tmp, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+Suffix+".*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var parts []string
+	whole := sha256.New()
+	var total int64
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("part-%03d", i)
+		out, err := os.Create(filepath.Join(tmp, name))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(out, h, whole), in, size)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			os.Remove(filepath.Join(tmp, name))
+			break
+		}
+		total += n
+		parts = append(parts, fmt.Sprintf("part %s %d %s\n", hex.EncodeToString(h.Sum(nil)), n, name))
+		if err == io.EOF {
+			break
+		}
+	}
+
+	manifest := fmt.Sprintf("file %s %d\n", hex.EncodeToString(whole.Sum(nil)), total) + strings.Join(parts, "")
+	if err := os.WriteFile(filepath.Join(tmp, ManifestFile), []byte(manifest), 0644); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path + Suffix); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+Suffix)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteScript writes Script to path, leaving an identical file untouched
+func WriteScript(path string) error {
+	if old, err := os.ReadFile(path); err == nil && string(old) == Script {
+		return nil
+	}
+	return os.WriteFile(path, []byte(Script), 0755)
+}
+
+// Script is a pacman XferCommand downloading files with curl, and package
+// files that are missing with their parts instead:
+//
+//	XferCommand = /usr/local/bin/xfer.sh %o %u
+const Script = `#!/bin/sh
+# pacman XferCommand for repositories publishing large packages in parts.
+# Install it and set in /etc/pacman.conf:
+#   XferCommand = /usr/local/bin/xfer.sh %o %u
+set -u
+out=$1 url=$2
+
+curl -fL -C - -o "$out" "$url" && exit 0
+status=$?
+case $url in
+	*.pkg.tar.*.sig) exit $status ;;
+	*.pkg.tar.*) ;;
+	*) exit $status ;;
+esac
+
+# The package is split: download its parts, check and join them
+manifest=$(curl -fsSL "$url` + Suffix + `/` + ManifestFile + `") || exit $status
+part=$out.chunk
+trap 'rm -f "$part"' EXIT
+: > "$out" || exit 1
+while read -r kind sum size name; do
+	case $kind in
+	file)
+		file_sum=$sum
+		;;
+	part)
+		echo "${url##*/}: part $name ($size bytes)" >&2
+		curl -fsSL -o "$part" "$url` + Suffix + `/$name" || exit 1
+		echo "$sum  $part" | sha256sum -c --quiet - || exit 1
+		cat "$part" >> "$out" || exit 1
+		;;
+	esac
+done <<EOF
+$manifest
+EOF
+echo "$file_sum  $out" | sha256sum -c --quiet - || exit 1
+`
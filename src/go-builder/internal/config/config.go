@@ -0,0 +1,961 @@
+// Package config loads and validates the declarative config.yml, or its
+// TOML or JSON equivalent.
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"builder/internal/version"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the default config file, relative to the project root
+const FileName = "config.yml"
+
+// FileNames are the config files looked for, in order
+var FileNames = []string{FileName, "config.yaml", "config.toml", "config.json"}
+
+// Config is the parsed config.yml
+type Config struct {
+	Meta     Meta     `yaml:"meta"`
+	Build    Build    `yaml:"build"`
+	Network  Network  `yaml:"network"`
+	Hooks    Hooks    `yaml:"hooks"`
+	Publish  Publish  `yaml:"publish"`
+	Packages Packages `yaml:"packages"`
+	// Repos are built in the same run, after the repository of Packages
+	Repos []Repo `yaml:"repos"`
+	// Builders run makepkg, repo-add and pacman instead of this host. The
+	// builds of a run are spread over them, the first runs the rest.
+	Builders []Builder `yaml:"builders"`
+
+	// Overrides lists the environment variables and --set settings that
+	// changed values
+	Overrides []string `yaml:"-"`
+}
+
+// Builder is a build machine reached over SSH that runs the Arch-specific
+// steps of a run, for hosts without pacman
+type Builder struct {
+	Name string `yaml:"name"`
+	// SSH is the user@host to connect to, with an optional :port
+	SSH string `yaml:"ssh"`
+	// Identity is the private key file, by default the ssh config's
+	Identity string `yaml:"identity"`
+	// Dir is the directory on the machine the working directory is
+	// mirrored to, relative to the home directory of the user
+	Dir string `yaml:"dir"`
+
+	// Agent is the URL of the agent command running on the machine
+	// instead, which only builds packages
+	Agent string `yaml:"agent"`
+	// KeyEnv is the environment variable holding the key jobs for the
+	// agent are signed with, DefaultAgentKeyEnv unless set
+	KeyEnv string `yaml:"key-env"`
+}
+
+// DefaultAgentKeyEnv holds the key of build agents unless configured
+const DefaultAgentKeyEnv = "GOB_AGENT_KEY"
+
+// AgentKey returns the key jobs for the agent of b are signed with
+func (b Builder) AgentKey() string {
+	return os.Getenv(cmp.Or(b.KeyEnv, DefaultAgentKeyEnv))
+}
+
+// authorPattern matches a git author, "Name <email>"
+var authorPattern = regexp.MustCompile(`^[^<>]+ <[^<>]+>$`)
+
+// pkgnamePattern matches the package names pacman accepts, which are also
+// used as directory names
+var pkgnamePattern = regexp.MustCompile(`^[a-z0-9@_+][a-z0-9@._+-]*$`)
+
+// Publish configures the publish command
+type Publish struct {
+	// ChunkSize splits package files over it into parts of that size for
+	// hosts with a file size limit; off when 0
+	ChunkSize ByteSize   `yaml:"chunk-size"`
+	Git       PublishGit `yaml:"git"`
+	// Mirrors are further hosts publish uploads the build directory to,
+	// listed after repo-url in the order clients should try them
+	Mirrors []Mirror `yaml:"mirrors"`
+	// Torrent writes a .torrent next to every package file, if set
+	Torrent *PublishTorrent `yaml:"torrent"`
+	// IPFS adds the repository to IPFS on every run, if set
+	IPFS *PublishIPFS `yaml:"ipfs"`
+	// Deltas writes a patch from the previous version next to every large
+	// package file, if set
+	Deltas *PublishDeltas `yaml:"deltas"`
+}
+
+// PublishTorrent configures the torrents of the package files. repo-url and
+// the mirrors are always their web seeds.
+type PublishTorrent struct {
+	// Trackers are announce URLs, in order of preference; without any,
+	// clients find peers through DHT and the web seeds
+	Trackers []string `yaml:"trackers"`
+	// WebSeeds are further URLs serving the build directory, as repo-url
+	WebSeeds []string `yaml:"web-seeds"`
+	// PieceSize is a power of two, by default chosen by file size
+	PieceSize ByteSize `yaml:"piece-size"`
+}
+
+// PublishIPFS configures adding the repository to IPFS with the ipfs CLI
+type PublishIPFS struct {
+	// API is the multiaddr of the RPC API of the node to add to, e.g.
+	// /dns/pin.example.com/tcp/5001, the local node by default
+	API string `yaml:"api"`
+	// Gateway is the HTTP gateway the landing page links to, ipfs.io by
+	// default
+	Gateway string `yaml:"gateway"`
+	// Key publishes every new CID under the IPNS name of this key of the
+	// node, so clients can keep one URL
+	Key string `yaml:"key"`
+}
+
+// PublishDeltas configures the patches between consecutive versions of
+// package files
+type PublishDeltas struct {
+	// MinSize skips smaller package files, delta.DefaultMinSize by default
+	MinSize ByteSize `yaml:"min-size"`
+	// MaxRatio drops patches larger than this fraction of the package
+	// file, delta.DefaultMaxRatio by default
+	MaxRatio float64 `yaml:"max-ratio"`
+}
+
+// Mirror is a host publish uploads the build directory to. Exactly one of
+// Dest, Exec, S3 and Rsync says how.
+type Mirror struct {
+	Name string `yaml:"name"`
+	// URL is where clients download the build directory from, as repo-url;
+	// a mirror without one is uploaded to but not listed to clients
+	URL string `yaml:"url"`
+	// Dest is a directory the changes are copied into, e.g. a mounted bucket
+	Dest string `yaml:"dest"`
+	// Exec is a command run with sh for every change, as publish --exec
+	Exec string `yaml:"exec"`
+	// S3 is an s3://bucket/prefix URL the changes are copied to with the
+	// aws CLI
+	S3 string `yaml:"s3"`
+	// Rsync is an rsync destination such as user@host:/srv/repo, synced
+	// whole
+	Rsync string `yaml:"rsync"`
+}
+
+// Mirror upload methods
+const (
+	MirrorDest  = "dest"
+	MirrorExec  = "exec"
+	MirrorS3    = "s3"
+	MirrorRsync = "rsync"
+)
+
+// Method returns how files are uploaded to the mirror, "" if that isn't
+// configured exactly once
+func (m Mirror) Method() string {
+	method := ""
+	for _, set := range []struct {
+		method, value string
+	}{{MirrorDest, m.Dest}, {MirrorExec, m.Exec}, {MirrorS3, m.S3}, {MirrorRsync, m.Rsync}} {
+		if set.value == "" {
+			continue
+		}
+		if method != "" {
+			return ""
+		}
+		method = set.method
+	}
+	return method
+}
+
+// PublishGit commits the build directory to a branch and pushes it
+type PublishGit struct {
+	// Branch is the branch to publish to; publishing to git is off without
+	Branch string `yaml:"branch"`
+	// Remote is a remote name or URL, origin by default
+	Remote string `yaml:"remote"`
+	// Author is "Name <email>" of the commits, from the git config by default
+	Author string `yaml:"author"`
+	// Squash replaces the branch with a single commit, so old packages don't
+	// pile up in its history
+	Squash bool `yaml:"squash"`
+	// LFS stores files over LFSThreshold with Git LFS, instead of failing
+	// over MaxFileSize
+	LFS bool `yaml:"lfs"`
+	// LFSThreshold is the size over which files go to Git LFS, half of
+	// MaxFileSize by default
+	LFSThreshold ByteSize `yaml:"lfs-threshold"`
+	// MaxFileSize is the largest file the remote accepts, 100MB by default
+	MaxFileSize ByteSize `yaml:"max-file-size"`
+}
+
+// Enabled reports whether publishing to git is configured
+func (g PublishGit) Enabled() bool {
+	return g.Branch != ""
+}
+
+// Meta holds repository-wide settings
+type Meta struct {
+	RepoName   string `yaml:"repo-name"`
+	RepoURL    string `yaml:"repo-url"`
+	ProjectURL string `yaml:"project-url"`
+	SigningKey string `yaml:"signing-key"`
+
+	// SignChecksums signs SHA256SUMS with SigningKey
+	SignChecksums bool `yaml:"sign-checksums"`
+
+	// BuildMode is host (default) or container
+	BuildMode string `yaml:"build-mode"`
+
+	// Review gates builds of changed AUR PKGBUILDs: off (default), auto or
+	// prompt
+	Review string `yaml:"review"`
+
+	// FileBrowser publishes a file listing page per package
+	FileBrowser bool `yaml:"file-browser"`
+
+	// DebugPackages is what becomes of the -debug split packages makepkg
+	// produces: strip (default), include or separate, see DebugPolicy
+	DebugPackages string `yaml:"debug-packages"`
+	// PublishDebug is the older spelling of debug-packages: include
+	PublishDebug bool `yaml:"publish-debug"`
+
+	// DBCompression compresses the databases with gz (default), zst, xz or
+	// bz2
+	DBCompression string `yaml:"db-compression"`
+
+	// Staging publishes builds in a <repo-name>-testing repository first,
+	// from which the promote command moves them into the repository
+	Staging bool `yaml:"staging"`
+
+	// BinaryRepos are trusted repositories whose prebuilt packages are
+	// reused by packages with reuse-binaries, in order of preference
+	BinaryRepos []BinaryRepo `yaml:"binary-repos"`
+
+	// MaxRepoSize is the size budget of the build directory, 0 for none
+	MaxRepoSize ByteSize `yaml:"max-repo-size"`
+	// RepoSizePolicy is warn (default) or fail when over budget
+	RepoSizePolicy string `yaml:"repo-size-policy"`
+
+	// DBFailurePolicy decides how database update errors affect the run
+	DBFailurePolicy FailurePolicy `yaml:"db-failure-policy"`
+
+	// FailureThreshold is how many packages may fail to build before the
+	// run exits nonzero
+	FailureThreshold int `yaml:"failure-threshold"`
+
+	// OfficialPackages is what becomes of AUR packages that moved to the
+	// official repositories: warn (default), drop or off
+	OfficialPackages string `yaml:"official-packages"`
+
+	// Keyring builds and publishes a <repo-name>-keyring package of the
+	// public SigningKey, see KeyringPackage
+	Keyring bool `yaml:"keyring"`
+}
+
+// Build modes
+const (
+	BuildModeHost      = "host"
+	BuildModeContainer = "container"
+)
+
+// PKGBUILD review modes
+const (
+	ReviewOff    = "off"
+	ReviewAuto   = "auto"   // show and record the diff, then build
+	ReviewPrompt = "prompt" // build only after confirmation on a terminal
+)
+
+// Debug package policies
+const (
+	DebugStrip    = "strip"    // delete them
+	DebugInclude  = "include"  // publish them next to the packages
+	DebugSeparate = "separate" // publish them in a <repo-name>-debug repository
+)
+
+// Policies for AUR packages in the official repositories
+const (
+	OfficialWarn = "warn" // build them and warn
+	OfficialDrop = "drop" // remove them from the repository
+	OfficialOff  = "off"
+)
+
+// Source downloaders
+const (
+	DownloaderMakepkg = "makepkg"
+	DownloaderNative  = "native"
+)
+
+// Dependency rebuild triggers
+const (
+	DepRebuildsOff     = "off"
+	DepRebuildsSoname  = "soname"  // when a linked soname is no longer provided
+	DepRebuildsVersion = "version" // on every new version of a dependency
+)
+
+// Build holds settings for building packages
+type Build struct {
+	// Downloader fetches PKGBUILD sources: makepkg (default) or native
+	Downloader string `yaml:"downloader"`
+	// ParallelDownloads is the number of concurrent native downloads
+	ParallelDownloads int `yaml:"parallel-downloads"`
+	// KeepDeps leaves build dependencies installed after each build
+	KeepDeps bool `yaml:"keep-deps"`
+	// CCacheDir is a persistent ccache directory to compile through, empty
+	// to build without ccache
+	CCacheDir string `yaml:"ccache-dir"`
+	// SrcDest is a source directory shared across packages and runs, empty
+	// to download sources into each package directory
+	SrcDest string `yaml:"srcdest"`
+	// SrcDestMaxSize prunes the least recently used sources above this
+	// size, 0 for no limit
+	SrcDestMaxSize ByteSize `yaml:"srcdest-max-size"`
+	// PacmanCache is the package cache build dependencies are downloaded
+	// into, empty for pacman's CacheDir
+	PacmanCache string `yaml:"pacman-cache"`
+	// PacmanCacheMaxSize is the size clean-cache prunes the package cache
+	// to, 0 for no limit
+	PacmanCacheMaxSize ByteSize `yaml:"pacman-cache-max-size"`
+	// Namcap lints every PKGBUILD and built package
+	Namcap bool `yaml:"namcap"`
+	// NamcapFailOn fails builds on findings of these severities (error,
+	// warning) or tags
+	NamcapFailOn []string `yaml:"namcap-fail-on"`
+	// DependencyRebuilds rebuilds packages whose dependencies in the repo
+	// changed: soname (default), version or off
+	DependencyRebuilds string `yaml:"dependency-rebuilds"`
+	// PKGBUILDRebuilds rebuilds AUR packages whose git repository changed
+	// since their last build without a new version, nil for on
+	PKGBUILDRebuilds *bool `yaml:"pkgbuild-rebuilds"`
+	// BumpPkgrel publishes rebuilds of an unchanged version with a pkgrel
+	// suffix, so clients upgrade to them
+	BumpPkgrel bool `yaml:"bump-pkgrel"`
+	// PkgExt forces the package compression, .pkg.tar.zst or .pkg.tar.xz,
+	// instead of the PKGEXT of makepkg.conf
+	PkgExt string `yaml:"pkgext"`
+}
+
+// Network holds settings for reaching the AUR and upstream sources
+type Network struct {
+	// AURURL is an AUR mirror used for RPC queries, the update feed and
+	// clones, empty for the official AUR
+	AURURL string `yaml:"aur-url"`
+	// GitMirrors maps URL prefixes to the prefixes git fetches them from
+	// instead, for AUR clones and PKGBUILD sources alike
+	GitMirrors map[string]string `yaml:"git-mirrors"`
+	// HTTPProxy, HTTPSProxy and NoProxy set http_proxy, https_proxy and
+	// no_proxy for the builder and every tool it runs
+	HTTPProxy  string `yaml:"http-proxy"`
+	HTTPSProxy string `yaml:"https-proxy"`
+	NoProxy    string `yaml:"no-proxy"`
+	// AURComments shows the comments pinned on the AUR pages of packages
+	// being updated, nil for on
+	AURComments *bool `yaml:"aur-comments"`
+	// NewsKeywords warns before a run about recent Arch Linux news that
+	// contains one of them, ignoring case; off when empty
+	NewsKeywords []string `yaml:"news-keywords"`
+	// NewsDays is how many days news counts as recent, 14 when 0
+	NewsDays int `yaml:"news-days"`
+}
+
+// Failure policy modes
+const (
+	PolicyFail  = "fail"
+	PolicyWarn  = "warn"
+	PolicyRetry = "retry"
+)
+
+// FailurePolicy is written as "fail" (default), "warn" or "retry N". A
+// retried operation that keeps failing fails the run.
+type FailurePolicy struct {
+	Mode    string
+	Retries int
+}
+
+// UnmarshalYAML parses the policy from its string form
+func (p *FailurePolicy) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+
+	fields := strings.Fields(value)
+	switch {
+	case len(fields) == 1 && (fields[0] == PolicyFail || fields[0] == PolicyWarn):
+		p.Mode = fields[0]
+	case len(fields) == 2 && fields[0] == PolicyRetry:
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("line %d: invalid retry count %q", node.Line, fields[1])
+		}
+		p.Mode, p.Retries = PolicyRetry, n
+	default:
+		return fmt.Errorf("line %d: invalid failure policy %q, expected fail, warn or retry N", node.Line, value)
+	}
+	return nil
+}
+
+// String returns the policy in its config form
+func (p FailurePolicy) String() string {
+	switch p.Mode {
+	case "":
+		return PolicyFail
+	case PolicyRetry:
+		return fmt.Sprintf("%s %d", PolicyRetry, p.Retries)
+	}
+	return p.Mode
+}
+
+// Repo is an additional repository with its own packages. All other
+// settings are shared with the main repository.
+type Repo struct {
+	Name string `yaml:"name"`
+	// Dir is the build directory, by default build/<name>
+	Dir string `yaml:"dir"`
+	// RepoURL is where Dir is served, by default below meta.repo-url when
+	// Dir is inside the main build directory
+	RepoURL  string   `yaml:"repo-url"`
+	Packages Packages `yaml:"packages"`
+}
+
+// ForRepo returns the config of the additional repository repo, which is
+// the main config with its name, URL and packages
+func (c *Config) ForRepo(repo Repo) *Config {
+	derived := *c
+	derived.Meta.RepoName = repo.Name
+	if repo.RepoURL != "" {
+		derived.Meta.RepoURL = repo.RepoURL
+	}
+	derived.Packages = repo.Packages
+	derived.Repos = nil
+	return &derived
+}
+
+// AllRepos returns the main config followed by those of the additional
+// repositories
+func (c *Config) AllRepos() []*Config {
+	all := []*Config{c}
+	for _, repo := range c.Repos {
+		all = append(all, c.ForRepo(repo))
+	}
+	return all
+}
+
+// Packages lists everything the repository publishes
+type Packages struct {
+	AUR  []Package     `yaml:"aur"`
+	Meta []MetaPackage `yaml:"meta"`
+}
+
+// Package is a package built from a PKGBUILD, by default the one on the AUR
+type Package struct {
+	Name   string `yaml:"name"`
+	Force  bool   `yaml:"force"`
+	Source Source `yaml:"source"`
+	// Hold keeps the version in the repo, never building the package
+	Hold bool `yaml:"hold"`
+	// Profiles are the groups --profile selects the package with
+	Profiles []string `yaml:"profiles"`
+	// Expect is checked on every build, nil for no checks
+	Expect *Expect `yaml:"expect"`
+	// RunChecks runs (true) or skips (false) the check() function, nil
+	// follows makepkg.conf
+	RunChecks *bool `yaml:"run-checks"`
+	// TestCmd is a smoke test run after installing the built packages into
+	// a throwaway container; they are only published if it succeeds
+	TestCmd string `yaml:"test-cmd"`
+	// ReuseBinaries publishes the package from a binary repo when one ships
+	// the exact version, instead of building it
+	ReuseBinaries bool `yaml:"reuse-binaries"`
+	// Hooks run after the global hooks of the same name
+	Hooks Hooks `yaml:"hooks"`
+}
+
+// Hook names
+const (
+	HookPreClone    = "pre-clone"
+	HookPostClone   = "post-clone"
+	HookPreBuild    = "pre-build"
+	HookPostBuild   = "post-build"
+	HookPostPublish = "post-publish"
+)
+
+// Hooks are shell commands run at points of a package's build
+type Hooks struct {
+	PreClone    string `yaml:"pre-clone"`
+	PostClone   string `yaml:"post-clone"`
+	PreBuild    string `yaml:"pre-build"`
+	PostBuild   string `yaml:"post-build"`
+	PostPublish string `yaml:"post-publish"`
+}
+
+// Get returns the command of the named hook, empty if there is none
+func (h Hooks) Get(hook string) string {
+	switch hook {
+	case HookPreClone:
+		return h.PreClone
+	case HookPostClone:
+		return h.PostClone
+	case HookPreBuild:
+		return h.PreBuild
+	case HookPostBuild:
+		return h.PostBuild
+	case HookPostPublish:
+		return h.PostPublish
+	}
+	return ""
+}
+
+// BinaryRepo is a pacman repository trusted to ship correct packages
+type BinaryRepo struct {
+	Name string `yaml:"name"`
+	// URL is the server of the repository, $repo and $arch are replaced
+	// like in pacman.conf
+	URL string `yaml:"url"`
+}
+
+// Expect describes what a built package must look like, catching packaging
+// regressions from upstream PKGBUILD changes
+type Expect struct {
+	// Files are paths the package must ship, e.g. usr/bin/foo
+	Files []string `yaml:"files"`
+	// MinSize and MaxSize bound the installed size, 0 for no bound
+	MinSize ByteSize `yaml:"min-size"`
+	MaxSize ByteSize `yaml:"max-size"`
+	// Depends are package names the package must depend on
+	Depends []string `yaml:"depends"`
+}
+
+// Source types
+const (
+	SourceAUR     = "aur"
+	SourceGit     = "git"
+	SourceLocal   = "local"
+	SourceTarball = "tarball"
+)
+
+// Source tells where the PKGBUILD of a package comes from
+type Source struct {
+	// Type is one of aur (default), git, local or tarball
+	Type string `yaml:"type"`
+	// URL of the git repository or tarball
+	URL string `yaml:"url"`
+	// Ref is the git branch or tag to build, default is the remote HEAD
+	Ref string `yaml:"ref"`
+	// Path is the local directory, or the PKGBUILD directory inside a
+	// git repository or tarball
+	Path string `yaml:"path"`
+}
+
+// Kind returns the source type, defaulting to the AUR
+func (s Source) Kind() string {
+	if s.Type == "" {
+		return SourceAUR
+	}
+	return s.Type
+}
+
+// MetaPackage is a files-less package generated by the builder itself that
+// only pulls in its dependencies, e.g. a curated desktop set.
+type MetaPackage struct {
+	Name        string   `yaml:"name"`
+	Version     string   `yaml:"version"`
+	Description string   `yaml:"description"`
+	Depends     []string `yaml:"depends"`
+	Hold        bool     `yaml:"hold"`
+	Profiles    []string `yaml:"profiles"`
+}
+
+// Find returns the first of FileNames that exists
+func Find() (string, error) {
+	for _, name := range FileNames {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no config file found, expected one of %s", strings.Join(FileNames, ", "))
+}
+
+// Load reads and parses the config file at path, picking the format by
+// extension, merges the files it includes and applies the overrides:
+// environment variables, then the key=value settings given to --set
+func Load(path string, settings []string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := parseDoc(path, data)
+	if err != nil {
+		return nil, err
+	}
+	overrides := applyEnv(doc, os.LookupEnv)
+	set, err := applySettings(doc, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := doc.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	cfg.Overrides = append(overrides, set...)
+	return &cfg, nil
+}
+
+// Validate checks that all required settings are present and well-formed
+func (c *Config) Validate() error {
+	if c.Meta.RepoName == "" {
+		return fmt.Errorf("meta.repo-name is required")
+	}
+	if c.Meta.RepoURL == "" {
+		return fmt.Errorf("meta.repo-url is required")
+	}
+	if c.Meta.ProjectURL == "" {
+		return fmt.Errorf("meta.project-url is required")
+	}
+
+	switch c.Meta.BuildMode {
+	case "", BuildModeHost, BuildModeContainer:
+	default:
+		return fmt.Errorf("meta.build-mode must be host or container, got %q", c.Meta.BuildMode)
+	}
+
+	builders := make(map[string]bool)
+	for _, b := range c.Builders {
+		switch {
+		case b.Name == "" || strings.ContainsAny(b.Name, "/\\ "):
+			return fmt.Errorf("builders entries need a name without slashes or spaces, got %q", b.Name)
+		case builders[b.Name]:
+			return fmt.Errorf("builders: %s is listed twice", b.Name)
+		case b.Agent != "" && b.SSH != "":
+			return fmt.Errorf("builders: %s has both ssh and agent", b.Name)
+		case b.Agent != "" && !strings.HasPrefix(b.Agent, "http://") && !strings.HasPrefix(b.Agent, "https://"):
+			return fmt.Errorf("builders: %s: agent must be an http(s) URL, got %q", b.Name, b.Agent)
+		case b.Agent == "" && (b.SSH == "" || strings.ContainsAny(b.SSH, " \t")):
+			return fmt.Errorf("builders: %s needs ssh, a user@host, or agent, a URL, got %q", b.Name, b.SSH)
+		}
+		builders[b.Name] = true
+	}
+	if len(c.Builders) > 0 && c.Meta.BuildMode == BuildModeContainer {
+		return fmt.Errorf("builders and meta.build-mode: container exclude each other")
+	}
+
+	switch c.Meta.DBCompression {
+	case "", "gz", "zst", "xz", "bz2":
+	default:
+		return fmt.Errorf("meta.db-compression must be gz, zst, xz or bz2, got %q", c.Meta.DBCompression)
+	}
+
+	switch c.Build.PkgExt {
+	case "", ".pkg.tar.zst", ".pkg.tar.xz":
+	default:
+		return fmt.Errorf("build.pkgext must be .pkg.tar.zst or .pkg.tar.xz, got %q", c.Build.PkgExt)
+	}
+
+	switch c.Meta.DebugPackages {
+	case "", DebugStrip, DebugInclude, DebugSeparate:
+	default:
+		return fmt.Errorf("meta.debug-packages must be strip, include or separate, got %q", c.Meta.DebugPackages)
+	}
+	switch c.Meta.OfficialPackages {
+	case "", OfficialWarn, OfficialDrop, OfficialOff:
+	default:
+		return fmt.Errorf("meta.official-packages must be warn, drop or off, got %q", c.Meta.OfficialPackages)
+	}
+	if c.Meta.PublishDebug && c.Meta.DebugPackages != "" && c.Meta.DebugPackages != DebugInclude {
+		return fmt.Errorf("meta.publish-debug conflicts with meta.debug-packages: %s", c.Meta.DebugPackages)
+	}
+
+	switch c.Meta.Review {
+	case "", ReviewOff, ReviewAuto, ReviewPrompt:
+	default:
+		return fmt.Errorf("meta.review must be off, auto or prompt, got %q", c.Meta.Review)
+	}
+
+	if c.Meta.Keyring && c.Meta.SigningKey == "" {
+		return fmt.Errorf("meta.keyring requires meta.signing-key")
+	}
+	if c.Meta.SignChecksums && c.Meta.SigningKey == "" {
+		return fmt.Errorf("meta.sign-checksums requires meta.signing-key")
+	}
+
+	if g := c.Publish.Git; !g.Enabled() && (g.Remote != "" || g.Author != "" || g.Squash || g.LFS || g.MaxFileSize != 0) {
+		return fmt.Errorf("publish.git needs a branch")
+	}
+	if c.Publish.ChunkSize != 0 && c.Publish.ChunkSize < 1<<20 {
+		return fmt.Errorf("publish.chunk-size must be at least 1MiB, got %s", c.Publish.ChunkSize)
+	}
+	if g := c.Publish.Git; g.LFSThreshold != 0 && !g.LFS {
+		return fmt.Errorf("publish.git.lfs-threshold requires publish.git.lfs")
+	}
+	if g := c.Publish.Git; g.MaxFileSize != 0 && g.LFSThreshold > g.MaxFileSize {
+		return fmt.Errorf("publish.git.lfs-threshold (%s) must not exceed publish.git.max-file-size (%s)", g.LFSThreshold, g.MaxFileSize)
+	}
+	if author := c.Publish.Git.Author; author != "" && !authorPattern.MatchString(author) {
+		return fmt.Errorf("publish.git.author must look like \"Name <email>\", got %q", author)
+	}
+	if t := c.Publish.Torrent; t != nil {
+		if size := int64(t.PieceSize); size != 0 && (size < 16<<10 || size&(size-1) != 0) {
+			return fmt.Errorf("publish.torrent.piece-size must be a power of two of at least 16KiB, got %s", t.PieceSize)
+		}
+		for _, tracker := range t.Trackers {
+			if !strings.HasPrefix(tracker, "http://") && !strings.HasPrefix(tracker, "https://") && !strings.HasPrefix(tracker, "udp://") {
+				return fmt.Errorf("publish.torrent.trackers must be http(s):// or udp:// URLs, got %q", tracker)
+			}
+		}
+	}
+	if i := c.Publish.IPFS; i != nil && i.Gateway != "" && !strings.HasPrefix(i.Gateway, "http://") && !strings.HasPrefix(i.Gateway, "https://") {
+		return fmt.Errorf("publish.ipfs.gateway must be an http(s) URL, got %q", i.Gateway)
+	}
+	if d := c.Publish.Deltas; d != nil && (d.MaxRatio < 0 || d.MaxRatio > 1) {
+		return fmt.Errorf("publish.deltas.max-ratio must be between 0 and 1, got %g", d.MaxRatio)
+	}
+	mirrors := make(map[string]bool)
+	for _, m := range c.Publish.Mirrors {
+		switch {
+		case m.Name == "" || strings.ContainsAny(m.Name, "/\\ "):
+			return fmt.Errorf("publish.mirrors entries need a name without slashes or spaces, got %q", m.Name)
+		case mirrors[m.Name]:
+			return fmt.Errorf("publish.mirrors: %s is used twice", m.Name)
+		case m.Method() == "":
+			return fmt.Errorf("publish.mirrors: %s needs exactly one of dest, exec, s3 or rsync", m.Name)
+		case m.S3 != "" && !strings.HasPrefix(m.S3, "s3://"):
+			return fmt.Errorf("publish.mirrors: %s: s3 must be an s3:// URL, got %q", m.Name, m.S3)
+		}
+		mirrors[m.Name] = true
+	}
+
+	if c.Meta.FailureThreshold < 0 {
+		return fmt.Errorf("meta.failure-threshold must not be negative, got %d", c.Meta.FailureThreshold)
+	}
+
+	switch c.Meta.RepoSizePolicy {
+	case "", PolicyWarn, PolicyFail:
+	default:
+		return fmt.Errorf("meta.repo-size-policy must be warn or fail, got %q", c.Meta.RepoSizePolicy)
+	}
+
+	switch c.Build.Downloader {
+	case "", DownloaderMakepkg, DownloaderNative:
+	default:
+		return fmt.Errorf("build.downloader must be makepkg or native, got %q", c.Build.Downloader)
+	}
+	switch c.Build.DependencyRebuilds {
+	case "", DepRebuildsOff, DepRebuildsSoname, DepRebuildsVersion:
+	default:
+		return fmt.Errorf("build.dependency-rebuilds must be soname, version or off, got %q", c.Build.DependencyRebuilds)
+	}
+	if c.Build.ParallelDownloads < 0 {
+		return fmt.Errorf("build.parallel-downloads must not be negative")
+	}
+	for key, value := range map[string]string{"aur-url": c.Network.AURURL, "http-proxy": c.Network.HTTPProxy, "https-proxy": c.Network.HTTPSProxy} {
+		if u, err := url.Parse(value); value != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			return fmt.Errorf("network.%s must be a URL like http://host:port, got %q", key, value)
+		}
+	}
+	if c.Network.NewsDays < 0 {
+		return fmt.Errorf("network.news-days must not be negative, got %d", c.Network.NewsDays)
+	}
+	if slices.Contains(c.Network.NewsKeywords, "") {
+		return fmt.Errorf("network.news-keywords entries must not be empty")
+	}
+	for from, to := range c.Network.GitMirrors {
+		if from == "" || to == "" {
+			return fmt.Errorf("network.git-mirrors entries must not be empty")
+		}
+	}
+	for _, repo := range c.Meta.BinaryRepos {
+		if repo.Name == "" || repo.URL == "" {
+			return fmt.Errorf("meta.binary-repos entries need a name and a url")
+		}
+	}
+	if c.Build.SrcDestMaxSize != 0 && c.Build.SrcDest == "" {
+		return fmt.Errorf("build.srcdest-max-size needs build.srcdest")
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range append(c.AURNames(), c.MetaNames()...) {
+		if seen[name] {
+			return fmt.Errorf("package %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+
+	for _, pkg := range c.Packages.AUR {
+		if !pkgnamePattern.MatchString(pkg.Name) {
+			return fmt.Errorf("invalid package name %q: lowercase letters, digits and @._+- only, not starting with a hyphen or dot", pkg.Name)
+		}
+		if err := pkg.Source.validate(); err != nil {
+			return fmt.Errorf("invalid source for %q: %w", pkg.Name, err)
+		}
+		if e := pkg.Expect; e != nil && e.MaxSize != 0 && e.MinSize > e.MaxSize {
+			return fmt.Errorf("expect of %q: min-size is larger than max-size", pkg.Name)
+		}
+		if pkg.ReuseBinaries && len(c.Meta.BinaryRepos) == 0 {
+			return fmt.Errorf("%q has reuse-binaries, but meta.binary-repos is empty", pkg.Name)
+		}
+	}
+
+	for _, meta := range c.Packages.Meta {
+		if err := meta.validate(); err != nil {
+			return fmt.Errorf("invalid meta-package %q: %w", meta.Name, err)
+		}
+	}
+
+	names := map[string]bool{c.Meta.RepoName: true}
+	for _, repo := range c.Repos {
+		if repo.Name == "" {
+			return fmt.Errorf("repos entries need a name")
+		}
+		if names[repo.Name] {
+			return fmt.Errorf("repos: %s is used twice", repo.Name)
+		}
+		names[repo.Name] = true
+		if err := c.ForRepo(repo).Validate(); err != nil {
+			return fmt.Errorf("repos: %s: %w", repo.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s Source) validate() error {
+	switch s.Kind() {
+	case SourceAUR:
+	case SourceGit, SourceTarball:
+		if s.URL == "" {
+			return fmt.Errorf("%s source requires url", s.Kind())
+		}
+	case SourceLocal:
+		if s.Path == "" {
+			return fmt.Errorf("local source requires path")
+		}
+	default:
+		return fmt.Errorf("unknown source type %q", s.Type)
+	}
+	return nil
+}
+
+func (m MetaPackage) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !pkgnamePattern.MatchString(m.Name) {
+		return fmt.Errorf("lowercase letters, digits and @._+- only, not starting with a hyphen or dot")
+	}
+	if _, _, _, err := version.Split(m.Version); err != nil {
+		return err
+	}
+	if len(m.Depends) == 0 {
+		return fmt.Errorf("depends must list at least one package")
+	}
+	return nil
+}
+
+// AURNames returns the names of all configured PKGBUILD packages, whatever
+// their source
+func (c *Config) AURNames() []string {
+	var names []string
+	for _, pkg := range c.Packages.AUR {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+// Profiles returns the sorted names of all profiles packages are in
+func (c *Config) Profiles() []string {
+	var profiles []string
+	for _, pkg := range c.Packages.AUR {
+		profiles = append(profiles, pkg.Profiles...)
+	}
+	for _, meta := range c.Packages.Meta {
+		profiles = append(profiles, meta.Profiles...)
+	}
+	slices.Sort(profiles)
+	return slices.Compact(profiles)
+}
+
+// AURSourceNames returns the names of packages fetched from the AUR
+func (c *Config) AURSourceNames() []string {
+	var names []string
+	for _, pkg := range c.Packages.AUR {
+		if pkg.Source.Kind() == SourceAUR {
+			names = append(names, pkg.Name)
+		}
+	}
+	return names
+}
+
+// PublishedNames returns the names of all packages the repository may hold:
+// every configured package plus, if included, their debug packages
+func (c *Config) PublishedNames() []string {
+	names := append(c.AURNames(), c.MetaNames()...)
+	if c.DebugPolicy() == DebugInclude {
+		for _, name := range c.AURNames() {
+			names = append(names, name+"-debug")
+		}
+	}
+	return names
+}
+
+// DebugPolicy returns the debug package policy, strip unless configured
+func (c *Config) DebugPolicy() string {
+	if c.Meta.PublishDebug {
+		return DebugInclude
+	}
+	return cmp.Or(c.Meta.DebugPackages, DebugStrip)
+}
+
+// MetaNames returns the names of all configured meta-packages, including
+// the keyring package
+func (c *Config) MetaNames() []string {
+	var names []string
+	for _, meta := range c.Packages.Meta {
+		names = append(names, meta.Name)
+	}
+	if c.Meta.Keyring {
+		names = append(names, c.KeyringName())
+	}
+	return names
+}
+
+// Servers returns the URLs clients download the repository from in order
+// of preference: repo-url, then the mirrors that have a URL
+func (c *Config) Servers() []string {
+	servers := []string{c.Meta.RepoURL}
+	for _, m := range c.Publish.Mirrors {
+		if m.URL != "" {
+			servers = append(servers, strings.TrimSuffix(m.URL, "/"))
+		}
+	}
+	return servers
+}
+
+// KeyringName returns the name of the keyring package, built with
+// meta.keyring
+func (c *Config) KeyringName() string {
+	return c.Meta.RepoName + "-keyring"
+}
+
+// KeyringPackage returns the keyring package at version as a meta-package,
+// which the builder fills with the signing key
+func (c *Config) KeyringPackage(version string) MetaPackage {
+	return MetaPackage{
+		Name:        c.KeyringName(),
+		Version:     version,
+		Description: fmt.Sprintf("%s repository keyring", c.Meta.RepoName),
+		Depends:     []string{"pacman"},
+	}
+}
+
+// PackageCount returns the number of configured packages of all kinds
+func (c *Config) PackageCount() int {
+	return len(c.Packages.AUR) + len(c.MetaNames())
+}
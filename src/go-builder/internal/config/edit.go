@@ -0,0 +1,343 @@
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AddPackages appends AUR package entries for names to the YAML config
+// file at path, after the last entry and indented like it. The rest of the
+// file, comments included, is kept as it is, and it is only written if it
+// stays valid.
+func AddPackages(path string, names []string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(strings.Join(lines, "\n")), &doc); err != nil {
+		return err
+	}
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root != nil && (root.Kind != yaml.MappingNode || root.Style&yaml.FlowStyle != 0) {
+		return fmt.Errorf("%s is not a block mapping, add the packages by hand", path)
+	}
+
+	items := func(indent int) []string {
+		var added []string
+		for _, name := range names {
+			added = append(added, strings.Repeat(" ", indent)+"- name: "+name)
+		}
+		return added
+	}
+	pkgsKey, pkgs := mappingEntry(root, "packages")
+	if pkgsKey == nil {
+		lines = append(lines, "", "packages:", "  aur:")
+		return writeEdit(path, append(lines, items(4)...))
+	}
+	at := pkgsKey.Line - 1
+	if pkgs.Kind == yaml.ScalarNode && pkgs.Tag == "!!null" {
+		lines = insert(lines, at+1, append([]string{"  aur:"}, items(4)...)...)
+		return writeEdit(path, lines)
+	}
+	if pkgs.Kind != yaml.MappingNode || pkgs.Style&yaml.FlowStyle != 0 {
+		return fmt.Errorf("packages is not a block mapping, add the packages to %s by hand", path)
+	}
+
+	aurKey, aur := mappingEntry(pkgs, "aur")
+	switch {
+	case aurKey == nil:
+		// Missing, it goes after the last line of packages
+		indent := pkgs.Content[0].Column - 1
+		lines = insert(lines, trimEnd(lines, at, blockEnd(lines, at)), append([]string{strings.Repeat(" ", indent) + "aur:"}, items(indent+2)...)...)
+	case aur.Kind == yaml.ScalarNode && aur.Tag == "!!null":
+		lines = insert(lines, aurKey.Line, items(aurKey.Column+1)...)
+	case aur.Kind != yaml.SequenceNode || aur.Style&yaml.FlowStyle != 0 || len(aur.Content) == 0:
+		return fmt.Errorf("packages.aur is written inline, add the packages to %s by hand", path)
+	default:
+		// The dash of an item may be indented like aur or deeper
+		last := aur.Content[len(aur.Content)-1].Line - 1
+		first := aur.Content[0].Line - 1
+		lines = insert(lines, trimEnd(lines, last, blockEnd(lines, last)), items(indentOf(lines[first]))...)
+	}
+	return writeEdit(path, lines)
+}
+
+// trimEnd returns end moved back over the blank and comment lines ending
+// the block at line start, which rather belong to what follows
+func trimEnd(lines []string, start, end int) int {
+	for end > start+1 {
+		if trimmed := strings.TrimSpace(lines[end-1]); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// blockEnd returns the line after the block of lines indented deeper than
+// the key at line start. Blank and comment lines belong to the block.
+func blockEnd(lines []string, start int) int {
+	indent := indentOf(lines[start])
+	end := start + 1
+	for i := start + 1; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if indentOf(lines[i]) <= indent {
+			break
+		}
+		end = i + 1
+	}
+	return end
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func insert(lines []string, at int, items ...string) []string {
+	return append(lines[:at], append(items, lines[at:]...)...)
+}
+
+// RemovePackage removes the entry of the package name from packages.aur
+// of the YAML config file at path. The rest of the file, comments
+// included, is kept as it is.
+func RemovePackage(path, name string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	item, err := findPackage(lines, name)
+	if err != nil {
+		return err
+	}
+	start := item.Line - 1
+	lines = append(lines[:start], lines[blockEnd(lines, start):]...)
+	return writeEdit(path, lines)
+}
+
+// SetPackage applies settings, key=value pairs, to the entry of the
+// package name in packages.aur of the YAML config file at path. Keys are
+// dotted paths like source.type. Values are written as YAML if they are a
+// scalar or a flow collection and quoted otherwise; an empty value removes
+// the key. The file is only written if it stays valid. It returns the keys
+// to remove that weren't set.
+func SetPackage(path, name string, settings []string) (unset []string, err error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range settings {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected <key>=<value>, got %q", setting)
+		}
+		if key == "name" {
+			return nil, fmt.Errorf("the name of %s can't be set, remove and add the package instead", name)
+		}
+		if value != "" {
+			if value, err = formatValue(value); err != nil {
+				return nil, err
+			}
+		}
+
+		// Every change moves lines, so they are parsed again
+		item, err := findPackage(lines, name)
+		if err != nil {
+			return nil, err
+		}
+		edited, err := setKey(lines, item, blockEnd(lines, item.Line-1), strings.Split(key, "."), value)
+		if err == errNotSet {
+			unset = append(unset, key)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		lines = edited
+	}
+	return unset, writeEdit(path, lines)
+}
+
+// errNotSet is returned by setKey for removing a key that isn't set
+var errNotSet = errors.New("not set")
+
+// readLines returns the lines of the YAML config file at path
+func readLines(path string) ([]string, error) {
+	if ext := filepath.Ext(path); ext != ".yml" && ext != ".yaml" {
+		return nil, fmt.Errorf("only YAML config files can be edited, edit %s by hand", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n"), nil
+}
+
+// findPackage returns the node of the entry of the package name in
+// packages.aur of the config lines
+func findPackage(lines []string, name string) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(strings.Join(lines, "\n")), &doc); err != nil {
+		return nil, err
+	}
+	var aur *yaml.Node
+	if len(doc.Content) > 0 {
+		aur = mappingValue(mappingValue(doc.Content[0], "packages"), "aur")
+	}
+	if aur == nil || aur.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s is not in packages.aur", name)
+	}
+	for _, item := range aur.Content {
+		if v := mappingValue(item, "name"); v == nil || v.Value != name {
+			continue
+		}
+		if item.Style&yaml.FlowStyle != 0 || aur.Style&yaml.FlowStyle != 0 {
+			return nil, fmt.Errorf("%s is written inline, edit it by hand", name)
+		}
+		return item, nil
+	}
+	return nil, fmt.Errorf("%s is not in packages.aur", name)
+}
+
+// mappingValue returns the value of key in the mapping node m, nil if m is
+// no mapping or lacks key
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	_, v := mappingEntry(m, key)
+	return v
+}
+
+// mappingEntry returns the key node and value of key in the mapping node
+// m, nils if m is no mapping or lacks key
+func mappingEntry(m *yaml.Node, key string) (k, v *yaml.Node) {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i], m.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// setKey sets the dotted path parts below the block mapping m, whose lines
+// end before end, to value, or removes it if value is empty
+func setKey(lines []string, m *yaml.Node, end int, parts []string, value string) ([]string, error) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		if k.Value != parts[0] {
+			continue
+		}
+		line := k.Line - 1
+		// The first key of a list item shares its line with the dash
+		ownLine := indentOf(lines[line]) == k.Column-1
+		inline := v.Line == k.Line && v.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 &&
+			(v.Kind == yaml.ScalarNode || v.Style&yaml.FlowStyle != 0)
+		switch {
+		case len(parts) > 1 && (v.Kind != yaml.MappingNode || v.Style&yaml.FlowStyle != 0 || !ownLine):
+			return nil, fmt.Errorf("%s is not a block mapping, edit it by hand", k.Value)
+		case len(parts) == 2 && value == "" && len(v.Content) == 2 && v.Content[0].Value == parts[1]:
+			// Removing its only key removes the mapping
+			return append(lines[:line], lines[blockEnd(lines, line):]...), nil
+		case len(parts) > 1:
+			return setKey(lines, v, blockEnd(lines, line), parts[1:], value)
+		case value == "" && ownLine:
+			return append(lines[:line], lines[blockEnd(lines, line):]...), nil
+		case value == "":
+			return nil, fmt.Errorf("%s can't be removed, edit it by hand", k.Value)
+		case inline:
+			lines[line] = lines[line][:v.Column-1] + value + lineComment(v, k)
+			return lines, nil
+		case ownLine:
+			replaced := lines[line][:k.Column-1] + k.Value + ": " + value
+			return append(lines[:line], append([]string{replaced}, lines[blockEnd(lines, line):]...)...), nil
+		default:
+			return nil, fmt.Errorf("%s spans several lines, edit it by hand", k.Value)
+		}
+	}
+	if value == "" {
+		return nil, errNotSet
+	}
+
+	// Missing keys go after the last line of the mapping, indented like
+	// its keys
+	indent := 2
+	if len(m.Content) > 0 {
+		indent = m.Content[0].Column - 1
+	}
+	var added []string
+	for depth, part := range parts {
+		prefix := strings.Repeat(" ", indent+2*depth) + part + ":"
+		if depth == len(parts)-1 {
+			prefix += " " + value
+		}
+		added = append(added, prefix)
+	}
+	return insert(lines, end, added...), nil
+}
+
+// lineComment returns the comment after the value v of key k, with its
+// separating space
+func lineComment(v, k *yaml.Node) string {
+	if comment := cmp.Or(v.LineComment, k.LineComment); comment != "" {
+		return " " + comment
+	}
+	return ""
+}
+
+// formatValue returns value as it is written into the config: as given if
+// it parses as a YAML scalar or flow collection, else quoted
+func formatValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("values can't span several lines")
+	}
+	var doc yaml.Node
+	if yaml.Unmarshal([]byte(value), &doc) == nil && len(doc.Content) == 1 {
+		if n := doc.Content[0]; n.Kind == yaml.ScalarNode || n.Style&yaml.FlowStyle != 0 {
+			return value, nil
+		}
+	}
+	quoted, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(quoted)), nil
+}
+
+// writeEdit writes the edited lines to the config file at path, unless
+// they no longer make a valid config
+func writeEdit(path string, lines []string) error {
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	// Included files are checked along, the edit may rely on them
+	doc, err := parseDoc(path, data)
+	if err != nil {
+		return fmt.Errorf("the change would break %s: %w", path, err)
+	}
+	merged, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(merged))
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("the change would break %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("the change would break %s: %w", path, err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
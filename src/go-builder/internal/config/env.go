@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables overriding config values, e.g.
+// REPO_BUILDER_META_REPO_NAME for meta.repo-name. ShortEnvPrefix works as
+// well, e.g. GOB_META_REPO_NAME; EnvPrefix wins if both are set.
+const (
+	EnvPrefix      = "REPO_BUILDER_"
+	ShortEnvPrefix = "GOB_"
+)
+
+// OverridableKeys returns the config keys environment variables and --set
+// can override, keyed by their dotted path. Only scalar settings outside
+// the package lists can be overridden.
+func OverridableKeys() map[string][]string {
+	keys := make(map[string][]string)
+	collectKeys(reflect.TypeOf(Config{}), nil, keys)
+	return keys
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+func collectKeys(t reflect.Type, path []string, keys map[string][]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := append(append([]string(nil), path...), name)
+
+		ft := field.Type
+		switch {
+		case reflect.PointerTo(ft).Implements(unmarshalerType), ft.Kind() != reflect.Struct:
+			if ft.Kind() == reflect.Slice || ft.Kind() == reflect.Map || ft.Kind() == reflect.Pointer {
+				continue
+			}
+			keys[strings.Join(key, ".")] = key
+		default:
+			collectKeys(ft, key, keys)
+		}
+	}
+}
+
+// EnvName returns the environment variable with prefix overriding key
+func EnvName(prefix string, key []string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(strings.Join(key, "_"), "-", "_"))
+}
+
+// applyEnv sets the values of overriding environment variables in the
+// document, before it is decoded. lookup is usually os.LookupEnv. It
+// returns the variables applied.
+func applyEnv(doc *yaml.Node, lookup func(string) (string, bool)) []string {
+	keys := OverridableKeys()
+	var applied []string
+	for _, path := range slices.Sorted(maps.Keys(keys)) {
+		for _, prefix := range []string{EnvPrefix, ShortEnvPrefix} {
+			env := EnvName(prefix, keys[path])
+			if value, ok := lookup(env); ok {
+				setPath(root(doc), keys[path], value)
+				applied = append(applied, env)
+				break
+			}
+		}
+	}
+	return applied
+}
+
+// applySettings sets the values of key=value settings, as given to --set,
+// in the document. It returns the settings applied, and an error for
+// settings of unknown keys.
+func applySettings(doc *yaml.Node, settings []string) ([]string, error) {
+	keys := OverridableKeys()
+	var applied []string
+	for _, setting := range settings {
+		path, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("--set %s: expected <key>=<value>", setting)
+		}
+		key, ok := keys[path]
+		if !ok {
+			return nil, fmt.Errorf("--set %s: %s is no setting that can be overridden", setting, path)
+		}
+		setPath(root(doc), key, value)
+		applied = append(applied, "--set "+path)
+	}
+	return applied, nil
+}
+
+// root returns the top mapping of the document, creating it for an empty
+// config
+func root(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == 0 {
+		*doc = yaml.Node{Kind: yaml.DocumentNode}
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+	return doc.Content[0]
+}
+
+// setPath sets the scalar at key below a mapping node, creating mappings
+func setPath(node *yaml.Node, key []string, value string) {
+	if node.Kind != yaml.MappingNode {
+		*node = yaml.Node{Kind: yaml.MappingNode}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key[0] {
+			continue
+		}
+		if len(key) == 1 {
+			node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+		} else {
+			setPath(node.Content[i+1], key[1:], value)
+		}
+		return
+	}
+
+	child := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	if len(key) > 1 {
+		child = &yaml.Node{Kind: yaml.MappingNode}
+		setPath(child, key[1:], value)
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key[0]}, child)
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// IncludeKey is the top-level key listing further config files to merge,
+// as paths or glob patterns relative to the file listing them
+const IncludeKey = "include"
+
+// parseDoc parses the config file data read from path into a document,
+// picking the format by extension, and merges the files it includes
+func parseDoc(path string, data []byte) (*yaml.Node, error) {
+	return parseIncluded(path, data, nil)
+}
+
+// parseIncluded is parseDoc for a file included by the files in parents,
+// which it may not include again
+func parseIncluded(path string, data []byte, parents []string) (*yaml.Node, error) {
+	if filepath.Ext(path) == ".toml" {
+		var tree map[string]any
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		converted, err := yaml.Marshal(tree)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+
+	// JSON is valid YAML
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	patterns, err := takeIncludes(root(&doc))
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return &doc, nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	parents = append(parents, abs)
+	// Included files come first, so the including file wins on settings
+	// and its packages follow theirs
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, pattern := range patterns {
+		files, err := includeFiles(filepath.Dir(path), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", pattern, err)
+		}
+		for _, file := range files {
+			if slices.Contains(parents, file) {
+				return nil, fmt.Errorf("include %s: %s is included in a loop", pattern, file)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			included, err := parseIncluded(file, data, parents)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if err := mergeNode(merged, root(included), ""); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		}
+	}
+	if err := mergeNode(merged, root(&doc), ""); err != nil {
+		return nil, err
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{merged}}, nil
+}
+
+// takeIncludes removes the include key from the mapping m and returns its
+// patterns, a single one or a list
+func takeIncludes(m *yaml.Node) ([]string, error) {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != IncludeKey {
+			continue
+		}
+		value := m.Content[i+1]
+		m.Content = slices.Delete(m.Content, i, i+2)
+		var patterns []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if value.Tag != "!!null" {
+				patterns = []string{value.Value}
+			}
+		case yaml.SequenceNode:
+			if err := value.Decode(&patterns); err != nil {
+				return nil, fmt.Errorf("%s: %w", IncludeKey, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s must be a path or a list of paths", IncludeKey)
+		}
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// includeFiles returns the absolute paths of the files pattern matches,
+// relative to dir, in lexical order. A pattern without wildcards must name
+// an existing file; one with them may match none.
+func includeFiles(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	pattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && !hasMeta(pattern) {
+		_, err := os.Stat(pattern)
+		return nil, err
+	}
+	return files, nil
+}
+
+// hasMeta reports whether path contains glob wildcards
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// mergeNode merges the node src into dst: mappings key by key, lists by
+// appending the items of src, and anything else by src replacing dst. path
+// is the dotted path of dst, for errors. A package named in both fails.
+func mergeNode(dst, src *yaml.Node, path string) error {
+	if src == nil {
+		return nil
+	}
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			sub := key.Value
+			if path != "" {
+				sub = path + "." + key.Value
+			}
+			if existing := mappingValue(dst, key.Value); existing != nil {
+				if err := mergeNode(existing, value, sub); err != nil {
+					return err
+				}
+				continue
+			}
+			dst.Content = append(dst.Content, key, value)
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for _, item := range src.Content {
+			if name := mappingValue(item, "name"); name != nil {
+				for _, other := range dst.Content {
+					if v := mappingValue(other, "name"); v != nil && v.Value == name.Value {
+						return fmt.Errorf("%s lists %s twice", path, name.Value)
+					}
+				}
+			}
+			dst.Content = append(dst.Content, item)
+		}
+		// A block list can't follow a flow one
+		dst.Style &^= yaml.FlowStyle
+	case src.Kind == yaml.ScalarNode && src.Tag == "!!null":
+		// An empty key keeps the included value
+	default:
+		*dst = *src
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package delta makes binary patches between consecutive versions of package
+// files with xdelta3, so clients with helper tooling that still have the
+// previous version only download what changed.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// Suffix turns a package file name into the name of the patch from its
+// previous version, published next to it
+const Suffix = ".xdelta"
+
+// Package files under DefaultMinSize get no patch, and patches over
+// DefaultMaxRatio of their package file are dropped, unless configured
+const (
+	DefaultMinSize  = 10 << 20
+	DefaultMaxRatio = 0.8
+)
+
+// IndexFile lists the patches in the repository directory
+const IndexFile = "deltas.json"
+
+// Delta is the patch turning the previous version of a package file into it
+type Delta struct {
+	// File is the patch, next to the package file
+	File string `json:"file"`
+	// From is the package file the patch applies to
+	From   string `json:"from"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Index maps package file names to their patches
+type Index map[string]Delta
+
+// Load reads the index of the repository directory dir, empty if there is
+// none
+func Load(dir string) (Index, error) {
+	index := make(Index)
+	data, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+	return index, json.Unmarshal(data, &index)
+}
+
+// Save writes the index to the repository directory dir
+func (x Index) Save(dir string) error {
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, IndexFile), append(data, '\n'), 0644)
+}
+
+// Prune drops the patches whose package file or patch is gone from dir
+func (x Index) Prune(dir string) {
+	for file, d := range x {
+		_, errFile := os.Stat(filepath.Join(dir, file))
+		_, errPatch := os.Stat(filepath.Join(dir, d.File))
+		if errFile != nil || errPatch != nil {
+			delete(x, file)
+		}
+	}
+}
+
+// Make writes the patch from the package file from to the package file to,
+// both in dir, and returns it
+func Make(dir, from, to string) (Delta, error) {
+	d := Delta{File: to + Suffix, From: from}
+	path := filepath.Join(dir, d.File)
+	cmd := exec.Command("xdelta3", "-e", "-9", "-f", "-s", filepath.Join(dir, from), filepath.Join(dir, to), path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if _, err := shell.Output(cmd); err != nil {
+		os.Remove(path)
+		return d, fmt.Errorf("xdelta3: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return d, err
+	}
+	d.Size = info.Size()
+	if d.SHA256, err = fileSHA256(path); err != nil {
+		os.Remove(path)
+		return d, err
+	}
+	return d, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
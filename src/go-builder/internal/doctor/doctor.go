@@ -0,0 +1,184 @@
+// Package doctor checks that the host can run the builder, with a hint on
+// how to fix every problem it finds.
+package doctor
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/remote"
+	"builder/internal/shell"
+)
+
+// MinFreeSpace is the free space the build directory needs
+const MinFreeSpace = 2 << 30
+
+// Check is the outcome of one check. Hint says how to fix a failure.
+type Check struct {
+	Name string
+	Err  error
+	Hint string
+}
+
+// Env describes what to check
+type Env struct {
+	Config   *config.Config
+	BuildDir string
+	AURURL   string
+	// NeedsMultilib is set when a configured package depends on lib32-*
+	NeedsMultilib bool
+	// PacmanConf is the pacman configuration checked for [multilib]
+	PacmanConf string
+}
+
+// Run runs every check that applies to env
+func Run(env Env) []Check {
+	var checks []Check
+	add := func(name string, err error, hint string) {
+		checks = append(checks, Check{Name: name, Err: err, Hint: hint})
+	}
+
+	meta := env.Config.Meta
+	container := meta.BuildMode == config.BuildModeContainer
+	// Build machines run makepkg, repo-add and pacman instead, agents
+	// only makepkg
+	machines := len(env.Config.Builders) > 0
+	ssh := slices.ContainsFunc(env.Config.Builders, func(b config.Builder) bool { return b.Agent == "" })
+
+	type tool struct{ name, hint string }
+	tools := []tool{
+		{"git", "install git"},
+		{"bsdtar", "install libarchive"},
+	}
+	if !container && !ssh {
+		tools = append(tools, tool{"repo-add", "install pacman, which ships repo-add"})
+	}
+	for _, b := range env.Config.Builders {
+		if b.Agent != "" {
+			err := fmt.Errorf("builders: %s: no key in $%s", b.Name, cmp.Or(b.KeyEnv, config.DefaultAgentKeyEnv))
+			if key := b.AgentKey(); key != "" {
+				err = remote.NewAgent(b.Name, b.Agent, []byte(key)).Check()
+			}
+			add("build agent "+b.Name+" ready", err,
+				"check that repo-builder agent runs at "+b.Agent+" with the same key, and has base-devel and passwordless sudo")
+			continue
+		}
+		err := fmt.Errorf("builders: %s: no ssh", b.Name)
+		if _, lookErr := exec.LookPath("ssh"); lookErr == nil {
+			var host *remote.Host
+			if host, err = remote.NewSSH(b.Name, b.SSH, b.Identity, b.Dir); err == nil {
+				err = host.Check()
+			}
+		}
+		add("build machine "+b.Name+" ready", err,
+			"check that ssh "+b.SSH+" logs in without prompting and has base-devel, rsync and passwordless sudo")
+	}
+	switch {
+	case ssh:
+		tools = append(tools, tool{"rsync", "install rsync, it copies the packages to and from the build machines"})
+	case machines:
+		// makepkg --printsrcinfo runs here
+		tools = append(tools, tool{"makepkg", "install pacman, or add a build machine reached over ssh"})
+	case container:
+		add("container runtime", detectRuntime(), "install podman or docker, or set build-mode: host")
+	default:
+		tools = append(tools,
+			tool{"makepkg", "install pacman, or set build-mode: container on non-Arch hosts"},
+			tool{"pacman", "build on Arch Linux, or set build-mode: container"},
+			tool{"sudo", "install sudo, it installs build dependencies"},
+		)
+	}
+	if env.Config.Build.CCacheDir != "" && !container && !machines {
+		tools = append(tools, tool{"ccache", "install ccache, or remove build.ccache-dir"})
+	}
+	if env.Config.Build.Namcap {
+		tools = append(tools, tool{"namcap", "install namcap, or disable build.namcap"})
+	}
+	if meta.SigningKey != "" && meta.SignChecksums {
+		tools = append(tools, tool{"gpg", "install gnupg to sign SHA256SUMS"})
+	}
+	for _, tool := range tools {
+		_, err := exec.LookPath(tool.name)
+		add(tool.name+" is installed", err, tool.hint)
+	}
+
+	if !container && !machines {
+		var err error
+		if os.Geteuid() == 0 {
+			err = fmt.Errorf("running as root")
+		}
+		add("not running as root", err, "makepkg refuses to run as root; run as a regular user with sudo rights")
+
+		err = shell.Run(exec.Command("sudo", "-n", "true"))
+		add("passwordless sudo", err, `allow it, e.g. "builder ALL=(ALL) NOPASSWD: ALL" in /etc/sudoers.d/builder`)
+
+		if env.NeedsMultilib {
+			add("multilib repository enabled", checkMultilib(env.PacmanConf),
+				"uncomment the [multilib] section in "+env.PacmanConf+" and run pacman -Sy")
+		}
+	}
+
+	add(fmt.Sprintf("%d GiB free in %s", MinFreeSpace>>30, env.BuildDir), checkFreeSpace(env.BuildDir),
+		"free up disk space or lower max-repo-size")
+
+	add("AUR reachable at "+env.AURURL, checkReachable(env.AURURL),
+		"check the network, proxy settings (https_proxy) and https://status.archlinux.org")
+	return checks
+}
+
+func detectRuntime() error {
+	for _, runtime := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(runtime); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("neither podman nor docker found")
+}
+
+// checkMultilib looks for an enabled [multilib] section
+func checkMultilib(pacmanConf string) error {
+	data, err := os.ReadFile(pacmanConf)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "[multilib]" {
+			return nil
+		}
+	}
+	return fmt.Errorf("[multilib] is not enabled")
+}
+
+func checkFreeSpace(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		dir = "."
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if free < MinFreeSpace {
+		return fmt.Errorf("only %s free", config.ByteSize(free))
+	}
+	return nil
+}
+
+func checkReachable(url string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
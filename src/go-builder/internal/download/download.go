@@ -0,0 +1,289 @@
+// Package download fetches PKGBUILD sources ahead of makepkg, with retries,
+// resumed transfers and parallel downloads. Files are placed where makepkg
+// looks for them, so it only verifies checksums and extracts.
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// Defaults
+const (
+	DefaultParallel = 4
+	DefaultRetries  = 3
+)
+
+// Source is a remote entry of a PKGBUILD source array
+type Source struct {
+	// File is the name makepkg expects in the PKGBUILD directory
+	File string
+	// Protocol is the scheme deciding the agent, e.g. https or git
+	Protocol string
+	// URL is the location without makepkg's protocol prefix and fragment
+	URL string
+}
+
+// ParseSource parses a source entry like makepkg does. Local files return
+// ok false.
+func ParseSource(entry string) (src Source, ok bool) {
+	name, rawURL, hasName := strings.Cut(entry, "::")
+	if !hasName {
+		rawURL, name = entry, ""
+	}
+	scheme, _, found := strings.Cut(rawURL, "://")
+	if !found {
+		return Source{}, false
+	}
+
+	src.Protocol = scheme
+	if prefix, _, ok := strings.Cut(scheme, "+"); ok {
+		src.Protocol = prefix
+		rawURL = strings.TrimPrefix(rawURL, prefix+"+")
+	}
+
+	src.URL = rawURL
+	if src.Protocol == "git" {
+		src.URL, _, _ = strings.Cut(src.URL, "#")
+		src.URL, _, _ = strings.Cut(src.URL, "?")
+	}
+
+	src.File = name
+	if src.File == "" {
+		base := strings.TrimSuffix(rawURL, "/")
+		if u, err := url.Parse(base); err == nil {
+			base = u.Path
+		}
+		src.File = path.Base(base)
+		if src.Protocol == "git" {
+			src.File = strings.TrimSuffix(src.File, ".git")
+		}
+	}
+	return src, true
+}
+
+// Downloader fetches the sources of a PKGBUILD
+type Downloader struct {
+	HTTP *http.Client
+	// Arch selects the source_<arch> entries in addition to source
+	Arch string
+	// Parallel is the number of concurrent downloads
+	Parallel int
+	// Retries is how often a failed download is retried
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each next one
+	Backoff time.Duration
+}
+
+// New returns a downloader honouring the http_proxy, https_proxy and
+// no_proxy environment variables
+func New(arch string) *Downloader {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	return &Downloader{
+		HTTP:     &http.Client{Transport: transport},
+		Arch:     arch,
+		Parallel: DefaultParallel,
+		Retries:  DefaultRetries,
+		Backoff:  2 * time.Second,
+	}
+}
+
+// Stats sums up the downloads of one Fetch
+type Stats struct {
+	Files   int
+	Skipped int
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Fetch downloads the remote sources listed in srcinfo fields into dir.
+// Files already present are kept. VCS sources other than git are left to
+// makepkg.
+func (d *Downloader) Fetch(dir string, fields map[string][]string) (Stats, error) {
+	start := time.Now()
+	entries := append(fields["source"], fields["source_"+d.Arch]...)
+
+	var sources []Source
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		src, ok := ParseSource(entry)
+		if !ok || seen[src.File] {
+			continue
+		}
+		seen[src.File] = true
+		sources = append(sources, src)
+	}
+
+	var (
+		stats Stats
+		bytes atomic.Int64
+		mu    sync.Mutex
+		errs  []error
+		wg    sync.WaitGroup
+	)
+	slots := make(chan struct{}, max(d.Parallel, 1))
+	for _, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			n, fetched, err := d.fetch(dir, src)
+			bytes.Add(n)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("%s: %w", src.File, err))
+			case fetched:
+				stats.Files++
+			default:
+				stats.Skipped++
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats.Bytes = bytes.Load()
+	stats.Elapsed = time.Since(start)
+	return stats, errors.Join(errs...)
+}
+
+// fetch downloads one source with retries. It returns the bytes transferred
+// and whether anything was fetched.
+func (d *Downloader) fetch(dir string, src Source) (int64, bool, error) {
+	dest := filepath.Join(dir, src.File)
+	var get func() (int64, error)
+	switch src.Protocol {
+	case "http", "https":
+		if _, err := os.Stat(dest); err == nil {
+			return 0, false, nil
+		}
+		get = func() (int64, error) { return d.fetchHTTP(dest, src.URL) }
+	case "ftp":
+		if _, err := os.Stat(dest); err == nil {
+			return 0, false, nil
+		}
+		get = func() (int64, error) { return 0, fetchCurl(dest, src.URL) }
+	case "git":
+		get = func() (int64, error) { return 0, fetchGit(dest, src.URL) }
+	default:
+		return 0, false, nil
+	}
+
+	var total int64
+	backoff := d.Backoff
+	for attempt := 0; ; attempt++ {
+		n, err := get()
+		total += n
+		if err == nil {
+			return total, true, nil
+		}
+		if attempt == d.Retries {
+			return total, false, err
+		}
+		log.Warn(fmt.Sprintf("   Download of %s failed (%v), retrying in %s", src.File, err, backoff))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchHTTP downloads url to dest through a .part file, resuming a partial
+// download from an earlier attempt or run
+func (d *Downloader) fetchHTTP(dest, url string) (int64, error) {
+	part := dest + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The part file is complete or stale, start over
+		os.Remove(part)
+		return 0, fmt.Errorf("server rejected resume")
+	default:
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(part, dest)
+}
+
+// fetchCurl downloads with the agent makepkg uses for ftp by default
+func fetchCurl(dest, url string) error {
+	part := dest + ".part"
+	cmd := exec.Command("curl", "-qgfC", "-", "--ftp-pasv", "--retry", "3", "--retry-delay", "3", "-o", part, url)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(part, dest)
+}
+
+// fetchGit creates or updates the bare mirror makepkg expects at dest
+func fetchGit(dest, url string) error {
+	if _, err := os.Stat(dest); err == nil {
+		out, err := shell.Output(exec.Command("git", "-C", dest, "config", "--get", "remote.origin.url"))
+		if err == nil && strings.TrimSpace(string(out)) == url {
+			cmd := exec.Command("git", "-C", dest, "fetch", "--all", "-p")
+			if out, err := shell.CombinedOutput(cmd); err != nil {
+				return fmt.Errorf("git fetch: %v: %s", err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("git", "clone", "--origin=origin", "--mirror", url, dest)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		os.RemoveAll(dest)
+		return fmt.Errorf("git clone: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
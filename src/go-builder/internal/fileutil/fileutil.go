@@ -0,0 +1,55 @@
+// Package fileutil has small file helpers shared by the builder packages.
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by Lock when another process holds the lock
+var ErrLocked = errors.New("locked by another process")
+
+// CopyFile copies src to dest, replacing dest if it exists. dest is
+// written under a temporary name first, so an interrupted copy never
+// leaves a truncated dest behind.
+func CopyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dest)
+}
+
+// SameContent reports whether both files exist and are byte-identical
+func SameContent(a, b string) bool {
+	da, err := os.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	db, err := os.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(da, db)
+}
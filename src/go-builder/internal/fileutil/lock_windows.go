@@ -0,0 +1,37 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errorSharingViolation is returned for opening a file another process has
+// open without sharing it
+const errorSharingViolation syscall.Errno = 32
+
+// Lock opens path without sharing it, creating the file. If another
+// process has it open, Lock waits for it if wait is set, and returns
+// ErrLocked otherwise. The lock is released by unlock or when the process
+// exits.
+func Lock(path string, wait bool) (unlock func(), err error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			f := os.NewFile(uintptr(h), path)
+			return func() { f.Close() }, nil
+		}
+		if !errors.Is(err, errorSharingViolation) {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		if !wait {
+			return nil, ErrLocked
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,103 @@
+// Package ipfs adds the repository to IPFS with the ipfs CLI of kubo and
+// records where it ended up, for the landing page and clients.
+package ipfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"builder/internal/shell"
+)
+
+// FileName is the record of the last add in the build directory
+const FileName = "ipfs.json"
+
+// DefaultGateway serves IPFS content over HTTP for clients without a node
+const DefaultGateway = "https://ipfs.io"
+
+// Record is the outcome of the last add of a repository directory
+type Record struct {
+	// CID is the content ID of the directory
+	CID string `json:"cid"`
+	// Name is the IPNS name the CID was published under, if any
+	Name  string    `json:"name,omitempty"`
+	Added time.Time `json:"added"`
+}
+
+// Path returns the IPFS path of the repository, through IPNS if the CID
+// was published under a name
+func (r *Record) Path() string {
+	if r.Name != "" {
+		return "/ipns/" + r.Name
+	}
+	return "/ipfs/" + r.CID
+}
+
+// Load reads the record at path, nil if there is none
+func Load(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Save writes the record to path
+func (r *Record) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Node is an IPFS node reached with the ipfs CLI
+type Node struct {
+	// API is the multiaddr of the RPC API of a remote node, e.g. of a
+	// pinning host, or "" for the local one
+	API string
+}
+
+// Add adds the directory dir recursively, pins it and returns its CID
+func (n *Node) Add(dir string) (string, error) {
+	out, err := n.run("add", "--recursive", "--quieter", "--pin=true", "--cid-version=1", dir)
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// Publish publishes cid under the IPNS name of key and returns the name
+func (n *Node) Publish(key, cid string) (string, error) {
+	out, err := n.run("name", "publish", "--quieter", "--key="+key, "/ipfs/"+cid)
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// run runs the ipfs CLI with args and returns its trimmed output
+func (n *Node) run(args ...string) (string, error) {
+	if n.API != "" {
+		args = append([]string{"--api", n.API}, args...)
+	}
+	cmd := exec.Command("ipfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := shell.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("ipfs %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// GitHubActions is set when running in a GitHub Actions workflow, whose log
+// viewer understands workflow commands
+var GitHubActions = os.Getenv("GITHUB_ACTIONS") == "true"
+
+// Annotation kinds
+const (
+	AnnotationError   = "error"
+	AnnotationWarning = "warning"
+)
+
+// group is the open log group. Groups can't be nested in GitHub Actions.
+var group struct {
+	sync.Mutex
+	title string
+	open  bool
+	// err is the first error logged in the group
+	err string
+}
+
+// Group starts a collapsible log group, closing the open one. When an error
+// was logged in the closed group, it becomes an error annotation titled
+// like the group. Outside GitHub Actions it does nothing.
+func Group(title string) {
+	if !GitHubActions {
+		return
+	}
+	EndGroup()
+	group.Lock()
+	defer group.Unlock()
+	group.title, group.open, group.err = title, true, ""
+	if Level(level.Load()) >= LevelNormal {
+		fmt.Printf("::group::%s\n", escapeData(title))
+	}
+}
+
+// EndGroup closes the open log group, if any
+func EndGroup() {
+	group.Lock()
+	if !group.open {
+		group.Unlock()
+		return
+	}
+	title, err := group.title, group.err
+	group.open = false
+	group.Unlock()
+
+	if Level(level.Load()) >= LevelNormal {
+		fmt.Println("::endgroup::")
+	}
+	if err != "" {
+		Annotate(AnnotationError, title, err)
+	}
+}
+
+// groupError remembers msg as the error of the open group
+func groupError(msg string) {
+	group.Lock()
+	defer group.Unlock()
+	if group.open && group.err == "" {
+		group.err = strings.TrimSpace(ansiPattern.ReplaceAllString(msg, ""))
+	}
+}
+
+// Annotate adds an annotation of kind with an optional title to the
+// workflow run. Outside GitHub Actions it does nothing.
+func Annotate(kind, title, msg string) {
+	if !GitHubActions || (kind != AnnotationError && Level(level.Load()) < LevelNormal) {
+		return
+	}
+	props := ""
+	if title != "" {
+		props = " title=" + escapeProperty(title)
+	}
+	fmt.Printf("::%s%s::%s\n", kind, props, escapeData(ansiPattern.ReplaceAllString(msg, "")))
+}
+
+// escapeData escapes the message of a workflow command
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a parameter of a workflow command
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// WriteSummary appends markdown to the job summary of the workflow run.
+// Outside GitHub Actions it does nothing.
+func WriteSummary(markdown string) error {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(markdown + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,125 @@
+// Package log prints the builder's colored status messages and mirrors them
+// into the run transcript when one is open.
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// ANSI Colors
+const (
+	ColorRed    = "\033[0;31m"
+	ColorGreen  = "\033[0;32m"
+	ColorYellow = "\033[1;33m"
+	ColorBlue   = "\033[0;34m"
+	ColorReset  = "\033[0m"
+)
+
+// IsCI is set when running under a CI system
+var IsCI = os.Getenv("CI") != ""
+
+// Level is how much the builder prints
+type Level int32
+
+const (
+	// LevelQuiet only prints errors
+	LevelQuiet Level = iota - 1
+	// LevelNormal prints status messages
+	LevelNormal
+	// LevelVerbose also prints the output of commands and how long they took
+	LevelVerbose
+)
+
+var level atomic.Int32
+
+// Stdout and Stderr receive messages and the output of commands. They can
+// be redirected, e.g. to a TUI, before anything is logged.
+var (
+	Stdout io.Writer = os.Stdout
+	Stderr io.Writer = os.Stderr
+)
+
+// color is whether messages are colored, by default when stdout is a
+// terminal and NO_COLOR is unset
+var color atomic.Bool
+
+func init() {
+	color.Store(os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout))
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetLevel sets how much is printed. The transcript records everything
+// regardless.
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// Verbose reports whether the level is LevelVerbose
+func Verbose() bool {
+	return Level(level.Load()) >= LevelVerbose
+}
+
+// DisableColor prints messages without colors
+func DisableColor() {
+	color.Store(false)
+}
+
+// output writes msg to w at the given level, without its colors if they are
+// disabled
+func output(w io.Writer, at Level, msg string) {
+	if Level(level.Load()) < at {
+		return
+	}
+	if !color.Load() {
+		msg = ansiPattern.ReplaceAllString(msg, "")
+	}
+	fmt.Fprintln(w, msg)
+}
+
+// Msg prints a plain message
+func Msg(msg string) {
+	record("", msg)
+	if IsCI {
+		output(Stdout, LevelNormal, fmt.Sprintf("%s-%s %s", ColorBlue, ColorReset, msg))
+	} else {
+		output(Stdout, LevelNormal, "  "+msg)
+	}
+}
+
+// Info prints an informational message
+func Info(msg string) {
+	record("info", msg)
+	output(Stdout, LevelNormal, fmt.Sprintf("%si %s %s", ColorBlue, msg, ColorReset))
+}
+
+// Success prints a success message
+func Success(msg string) {
+	record("success", msg)
+	output(Stdout, LevelNormal, fmt.Sprintf("%s+ %s %s", ColorGreen, msg, ColorReset))
+}
+
+// Warn prints a warning
+func Warn(msg string) {
+	record("warn", msg)
+	output(Stdout, LevelNormal, fmt.Sprintf("%s! %s %s", ColorYellow, msg, ColorReset))
+}
+
+// Error prints an error to stderr
+func Error(msg string) {
+	record("error", msg)
+	groupError(msg)
+	output(Stderr, LevelQuiet, fmt.Sprintf("%sx %s %s", ColorRed, msg, ColorReset))
+}
+
+// Debug prints a message at the verbose level only
+func Debug(msg string) {
+	record("", msg)
+	output(Stdout, LevelVerbose, "  "+msg)
+}
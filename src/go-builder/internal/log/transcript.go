@@ -0,0 +1,138 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ansiPattern matches the color escape sequences used by the loggers
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// transcript is a timestamped markdown record of everything a run decided
+// and executed, written as it happens so a crashed run still leaves a trail.
+type transcript struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+// runTranscript is the active transcript, nil unless --transcript was given
+var runTranscript *transcript
+
+func openTranscript(path string) (*transcript, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transcript{f: f, start: time.Now()}
+	host, _ := os.Hostname()
+	t.write(fmt.Sprintf("# Build transcript\n\n- **Started:** %s\n- **Host:** %s\n- **Arguments:** `%s`\n\n## Log\n\n",
+		t.start.Format(time.RFC3339), host, strings.Join(os.Args, " ")))
+	return t, nil
+}
+
+func (t *transcript) write(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.f.WriteString(s)
+}
+
+// logLine records a log message, turning the terminal colors into markdown
+func (t *transcript) logLine(level, msg string) {
+	msg = strings.TrimSpace(ansiPattern.ReplaceAllString(msg, ""))
+	if msg == "" {
+		return
+	}
+
+	switch level {
+	case "error":
+		msg = "**" + msg + "**"
+	case "warn":
+		msg = "_" + msg + "_"
+	}
+	t.write(fmt.Sprintf("- `%s` %s %s\n", time.Now().Format("15:04:05"), levelMarker(level), msg))
+}
+
+// command records an executed command with its arguments and exit code
+func (t *transcript) command(cmd *exec.Cmd, err error, elapsed time.Duration) {
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+
+	dir := ""
+	if cmd.Dir != "" {
+		dir = fmt.Sprintf(" in `%s`", cmd.Dir)
+	}
+	t.write(fmt.Sprintf("- `%s` `$` `%s`%s → exit %d (%s)\n",
+		time.Now().Format("15:04:05"), strings.Join(cmd.Args, " "), dir, exitCode, elapsed.Round(time.Millisecond)))
+}
+
+// close writes the footer with the final exit code
+func (t *transcript) close(exitCode int) {
+	t.write(fmt.Sprintf("\n## Result\n\n- **Finished:** %s\n- **Duration:** %s\n- **Exit code:** %d\n",
+		time.Now().Format(time.RFC3339), time.Since(t.start).Round(time.Second), exitCode))
+	t.f.Close()
+}
+
+func levelMarker(level string) string {
+	switch level {
+	case "info":
+		return "ℹ️"
+	case "success":
+		return "✅"
+	case "warn":
+		return "⚠️"
+	case "error":
+		return "❌"
+	}
+	return "·"
+}
+
+func record(level, msg string) {
+	if runTranscript != nil {
+		runTranscript.logLine(level, msg)
+	}
+}
+
+// OpenTranscript starts recording the run to a markdown file at path
+func OpenTranscript(path string) error {
+	t, err := openTranscript(path)
+	if err != nil {
+		return err
+	}
+	runTranscript = t
+	return nil
+}
+
+// CloseTranscript finishes the transcript, if any, with the exit code
+func CloseTranscript(exitCode int) {
+	if runTranscript != nil {
+		runTranscript.close(exitCode)
+		runTranscript = nil
+	}
+}
+
+// RecordCommand adds an executed command to the transcript, if any, and
+// prints it with how long it took at the verbose level
+func RecordCommand(cmd *exec.Cmd, err error, elapsed time.Duration) {
+	if runTranscript != nil {
+		runTranscript.command(cmd, err, elapsed)
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	output(Stdout, LevelVerbose, fmt.Sprintf("   $ %s (%s, %s)", strings.Join(cmd.Args, " "), result, elapsed.Round(time.Millisecond)))
+}
@@ -0,0 +1,156 @@
+// Package metrics exports the outcome of runs in the Prometheus text format,
+// served over HTTP or written for the node_exporter textfile collector.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Run is the outcome of the last run of a repository
+type Run struct {
+	Time     time.Time
+	Duration time.Duration
+	OK       bool
+	// Packages counts the packages by report status
+	Packages map[string]int
+	// Outdated counts the packages whose update could not be published
+	Outdated int
+	// Builds are the durations of the builds of the run by package
+	Builds   map[string]time.Duration
+	RepoSize int64
+}
+
+// Metrics collects the runs of every repository. It is safe for concurrent
+// use.
+type Metrics struct {
+	mu        sync.Mutex
+	runs      map[string]*Run
+	builds    map[string]map[string]time.Duration
+	aurErrors int
+}
+
+// New returns empty metrics
+func New() *Metrics {
+	return &Metrics{runs: make(map[string]*Run), builds: make(map[string]map[string]time.Duration)}
+}
+
+// Record sets the last run of repo. Build durations of packages not built
+// in it are kept from earlier runs.
+func (m *Metrics) Record(repo string, run Run) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[repo] = &run
+	if m.builds[repo] == nil {
+		m.builds[repo] = make(map[string]time.Duration)
+	}
+	maps.Copy(m.builds[repo], run.Builds)
+}
+
+// AURError counts a failed AUR RPC request
+func (m *Metrics) AURError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.aurErrors++
+}
+
+// Write writes the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b bytes.Buffer
+	repos := slices.Sorted(maps.Keys(m.runs))
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("gob_last_run_timestamp_seconds", "gauge", "Time the last run finished.")
+	for _, repo := range repos {
+		fmt.Fprintf(&b, "gob_last_run_timestamp_seconds{repo=%q} %d\n", repo, m.runs[repo].Time.Unix())
+	}
+	metric("gob_last_run_success", "gauge", "Whether the last run succeeded.")
+	for _, repo := range repos {
+		fmt.Fprintf(&b, "gob_last_run_success{repo=%q} %d\n", repo, boolValue(m.runs[repo].OK))
+	}
+	metric("gob_last_run_duration_seconds", "gauge", "Duration of the last run.")
+	for _, repo := range repos {
+		fmt.Fprintf(&b, "gob_last_run_duration_seconds{repo=%q} %s\n", repo, seconds(m.runs[repo].Duration))
+	}
+	metric("gob_packages", "gauge", "Packages by outcome of the last run.")
+	for _, repo := range repos {
+		packages := m.runs[repo].Packages
+		for _, status := range slices.Sorted(maps.Keys(packages)) {
+			fmt.Fprintf(&b, "gob_packages{repo=%q,status=%q} %d\n", repo, status, packages[status])
+		}
+	}
+	metric("gob_packages_outdated", "gauge", "Packages whose update could not be published in the last run.")
+	for _, repo := range repos {
+		fmt.Fprintf(&b, "gob_packages_outdated{repo=%q} %d\n", repo, m.runs[repo].Outdated)
+	}
+	metric("gob_build_duration_seconds", "gauge", "Duration of the last build of each package.")
+	for _, repo := range repos {
+		builds := m.builds[repo]
+		for _, pkg := range slices.Sorted(maps.Keys(builds)) {
+			fmt.Fprintf(&b, "gob_build_duration_seconds{repo=%q,package=%q} %s\n", repo, pkg, seconds(builds[pkg]))
+		}
+	}
+	metric("gob_repo_size_bytes", "gauge", "Size of the build directory of the repository.")
+	for _, repo := range repos {
+		fmt.Fprintf(&b, "gob_repo_size_bytes{repo=%q} %d\n", repo, m.runs[repo].RepoSize)
+	}
+	metric("gob_aur_rpc_errors_total", "counter", "Failed AUR RPC requests.")
+	fmt.Fprintf(&b, "gob_aur_rpc_errors_total %d\n", m.aurErrors)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteFile writes the metrics to path, replacing it atomically so the
+// textfile collector never reads a partial file
+func (m *Metrics) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := m.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ServeHTTP serves the metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.Write(w)
+}
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,122 @@
+// Package news reads the Arch Linux news feed, which announces updates
+// needing manual intervention.
+package news
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FeedURL is the RSS feed of the Arch Linux news
+const FeedURL = "https://archlinux.org/feeds/news/"
+
+// AckFile lists the news items acknowledged with --ack-news, relative to
+// the build directory
+const AckFile = "news-ack.json"
+
+// Item is one news item
+type Item struct {
+	Title     string
+	Link      string
+	Published time.Time
+	// Text is the body without markup
+	Text string
+}
+
+type rss struct {
+	Items []struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		Description string `xml:"description"`
+		PubDate     string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// Fetch returns the items of the feed at url, newest first
+func Fetch(client *http.Client, url string) ([]Item, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("news feed returned status %d", resp.StatusCode)
+	}
+
+	var feed rss
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("parsing news feed: %w", err)
+	}
+	var items []Item
+	for _, item := range feed.Items {
+		published, err := time.Parse(time.RFC1123Z, item.PubDate)
+		if err != nil {
+			published, err = time.Parse(time.RFC1123, item.PubDate)
+		}
+		if err != nil {
+			continue
+		}
+		text := html.UnescapeString(tagPattern.ReplaceAllString(item.Description, " "))
+		items = append(items, Item{
+			Title:     strings.TrimSpace(item.Title),
+			Link:      strings.TrimSpace(item.Link),
+			Published: published,
+			Text:      strings.Join(strings.Fields(text), " "),
+		})
+	}
+	slices.SortFunc(items, func(a, b Item) int { return b.Published.Compare(a.Published) })
+	return items, nil
+}
+
+// Match returns the items published after since whose title or text
+// contains one of keywords, ignoring case
+func Match(items []Item, keywords []string, since time.Time) []Item {
+	var matched []Item
+	for _, item := range items {
+		if item.Published.Before(since) {
+			continue
+		}
+		text := strings.ToLower(item.Title + "\n" + item.Text)
+		if slices.ContainsFunc(keywords, func(k string) bool { return strings.Contains(text, strings.ToLower(k)) }) {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+// Acked is the set of acknowledged news items, by link
+type Acked map[string]time.Time
+
+// LoadAcked reads the acknowledged items. A missing file is an empty set.
+func LoadAcked(path string) (Acked, error) {
+	acked := make(Acked)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return acked, nil
+	} else if err != nil {
+		return acked, err
+	}
+	if err := json.Unmarshal(data, &acked); err != nil {
+		return make(Acked), err
+	}
+	return acked, nil
+}
+
+// Save writes the acknowledged items to path
+func (a Acked) Save(path string) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,103 @@
+package pages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"builder/internal/log"
+)
+
+// BadgesDir is the directory below OutDir holding the badge of each package
+const BadgesDir = "badges"
+
+// BadgeFile is the badge of the repository below OutDir
+const BadgeFile = "badge.json"
+
+// badgeCacheSeconds is how long shields.io caches a badge
+const badgeCacheSeconds = 3600
+
+// badge is a shields.io endpoint, see https://shields.io/badges/endpoint-badge
+type badge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	CacheSeconds  int    `json:"cacheSeconds"`
+}
+
+func encodeBadge(label, message string) []byte {
+	data, _ := json.Marshal(badge{1, label, message, "blue", badgeCacheSeconds})
+	return append(data, '\n')
+}
+
+// generateBadges writes a badge with the version of every package, removes
+// the badges of packages that are gone, and writes the repository badge
+// with the package count and the last update
+func (g *Generator) generateBadges(ctx Context) {
+	dir := filepath.Join(g.OutDir, BadgesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create %s: %v", dir, err))
+		return
+	}
+
+	written := make(map[string]bool)
+	changed := 0
+	for _, pkg := range ctx.Packages {
+		name := pkg.Name + ".json"
+		written[name] = true
+		if writeIfChanged(filepath.Join(dir, name), encodeBadge(ctx.Repo.Name, pkg.Version)) {
+			changed++
+		}
+	}
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if !written[entry.Name()] {
+				os.Remove(filepath.Join(dir, entry.Name()))
+				changed++
+			}
+		}
+	}
+	if changed > 0 {
+		log.Success(fmt.Sprintf("   Updated: %d badges.", changed))
+	} else {
+		log.Msg("   Unchanged: Badges.")
+	}
+
+	message := fmt.Sprintf("%d packages", len(ctx.Packages))
+	if last := g.lastUpdate(); !last.IsZero() {
+		message += ", updated " + last.UTC().Format("2006-01-02")
+	}
+	WriteArtifact(filepath.Join(g.OutDir, BadgeFile), string(encodeBadge(ctx.Repo.Name, message)), 0644, "", "Repository badge.")
+}
+
+// lastUpdate returns the time of the latest successful build, zero if
+// unknown
+func (g *Generator) lastUpdate() time.Time {
+	var last time.Time
+	if g.State == nil {
+		return last
+	}
+	for _, e := range g.State.Packages {
+		if e.LastSuccess != nil && e.LastSuccess.Time.After(last) {
+			last = e.LastSuccess.Time
+		}
+	}
+	return last
+}
+
+// writeIfChanged writes data to path unless it already holds it, and
+// reports whether it wrote
+func writeIfChanged(path string, data []byte) bool {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return false
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Error(fmt.Sprintf("Failed to write %s: %v", path, err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package pages
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"builder/internal/log"
+)
+
+// feedLimit is the number of builds listed in the update feed
+const feedLimit = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary,omitempty"`
+}
+
+// generateFeed writes an Atom feed of the latest successful builds
+func (g *Generator) generateFeed(ctx Context) {
+	type update struct {
+		name, version, commit string
+		time                  time.Time
+	}
+	var updates []update
+	for name, e := range g.State.Packages {
+		if e.LastSuccess != nil {
+			updates = append(updates, update{name, e.LastSuccess.Version, e.LastSuccess.Commit, e.LastSuccess.Time})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].time.After(updates[j].time) })
+	if len(updates) > feedLimit {
+		updates = updates[:feedLimit]
+	}
+
+	feed := atomFeed{
+		Title: fmt.Sprintf("%s package updates", ctx.Repo.Name),
+		ID:    ctx.Repo.URL + "/" + FeedFile,
+		Link:  atomLink{Href: ctx.Repo.URL},
+	}
+	for _, u := range updates {
+		stamp := u.time.UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			Title:   fmt.Sprintf("%s %s", u.name, u.version),
+			ID:      fmt.Sprintf("%s/%s#%s-%s", ctx.Repo.URL, FeedFile, u.name, u.version),
+			Link:    atomLink{Href: ctx.Repo.URL},
+			Updated: stamp,
+		}
+		if u.commit != "" {
+			entry.Summary = "Built from commit " + u.commit
+		}
+		feed.Entries = append(feed.Entries, entry)
+		if stamp > feed.Updated {
+			feed.Updated = stamp
+		}
+	}
+	if feed.Updated == "" {
+		feed.Updated = time.Unix(0, 0).UTC().Format(time.RFC3339)
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to encode update feed: %v", err))
+		return
+	}
+	WriteArtifact(filepath.Join(g.OutDir, FeedFile), xml.Header+string(data)+"\n", 0644, "", "Update feed.")
+}
@@ -0,0 +1,551 @@
+// Package pages renders the repository website and its companion files
+// (README, installer) from the templates in src/.
+package pages
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"builder/internal/aur"
+	"builder/internal/config"
+	"builder/internal/delta"
+	"builder/internal/fileutil"
+	"builder/internal/ipfs"
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/repo"
+	"builder/internal/state"
+	"builder/internal/stats"
+)
+
+// Templates
+const (
+	IndexHTMLTemplate = "src/index.html"
+	ReadmeTemplate    = "src/repo-README.md"
+	InstallerTemplate = "src/install.sh"
+	FilesTemplate     = "src/files.html"
+	IconFile          = "src/icon.png"
+)
+
+// DefaultKeyserver is where clients fetch the signing key from
+const DefaultKeyserver = "keyserver.ubuntu.com"
+
+// FilesDir is the directory below OutDir holding the per-package file listings
+const FilesDir = "files"
+
+// ManifestFile is the machine-readable package list below OutDir
+const ManifestFile = "packages.json"
+
+// MirrorlistFile is the pacman mirrorlist below OutDir, written when the
+// repository has mirrors
+const MirrorlistFile = "mirrorlist"
+
+// FeedFile is the Atom feed of recent builds below OutDir
+const FeedFile = "updates.xml"
+
+// templateFuncs are available to every template
+var templateFuncs = map[string]any{
+	"hasSuffix": strings.HasSuffix,
+}
+
+// RepoInfo describes the repository itself to the site templates
+type RepoInfo struct {
+	Name       string
+	URL        string
+	ProjectURL string
+	SigningKey string
+	Keyserver  string
+	SigLevel   string
+	// Servers are the URLs clients download from in order of preference,
+	// URL and then the mirrors
+	Servers []string
+	// IPFS is where the repository was last added to IPFS, nil if it
+	// wasn't
+	IPFS *IPFSInfo
+}
+
+// IPFSInfo describes the repository on IPFS to the site templates
+type IPFSInfo struct {
+	CID string
+	// Path is the IPFS path, through IPNS if published under a name
+	Path string
+	// URL is Path on the gateway, a pacman Server for the repository
+	URL string
+}
+
+// Package is a single published package as shown on the site and in the
+// manifest. Upstream metadata is only known for AUR packages.
+type Package struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	Description  string   `json:"description,omitempty"`
+	Arch         string   `json:"arch"`
+	URL          string   `json:"url,omitempty"`
+	FilesURL     string   `json:"files_url,omitempty"`
+	Homepage     string   `json:"homepage,omitempty"`
+	Maintainer   string   `json:"maintainer,omitempty"`
+	Orphaned     bool     `json:"orphaned,omitempty"`
+	OutOfDate    bool     `json:"out_of_date,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Depends      []string `json:"depends,omitempty"`
+	MakeDepends  []string `json:"makedepends,omitempty"`
+	// Provenance is the path of the provenance record of the package file
+	Provenance string `json:"provenance,omitempty"`
+	// Delta is the patch from the previous version of the package file,
+	// with its File as a path like Provenance
+	Delta *delta.Delta `json:"delta,omitempty"`
+	// Downloads are counted from the access logs by `stats ingest`, in the
+	// last stats.RecentDays days and ever
+	Downloads      int `json:"downloads,omitempty"`
+	TotalDownloads int `json:"total_downloads,omitempty"`
+}
+
+// Context is the data passed to every site template
+type Context struct {
+	Repo     RepoInfo
+	Packages []Package
+	// Attention lists packages that are orphaned or flagged out-of-date
+	// on the AUR
+	Attention    []Package
+	PackageCount int
+	LastUpdated  string
+}
+
+// FilesContext is the data passed to the per-package file listing template
+type FilesContext struct {
+	Repo    RepoInfo
+	Package Package
+	Files   []string
+}
+
+// Generator renders the site for a repository into OutDir
+type Generator struct {
+	Config *config.Config
+	Repo   *repo.RepoDB
+	AUR    *aur.Client
+	OutDir string
+	Arch   string
+
+	// AURInfo returns the AUR metadata of a package, or nil if unknown
+	AURInfo func(name string) *aur.Package
+	// State is the build history behind the update feed
+	State *state.State
+	// Stats are the download counts, nil if none were counted
+	Stats *stats.Stats
+}
+
+// NewContext collects the template data from the config and the database
+func (g *Generator) NewContext() Context {
+	cfg := g.Config
+	ctx := Context{
+		Repo: RepoInfo{
+			Name:       cfg.Meta.RepoName,
+			URL:        cfg.Meta.RepoURL,
+			ProjectURL: cfg.Meta.ProjectURL,
+			SigningKey: cfg.Meta.SigningKey,
+			Keyserver:  DefaultKeyserver,
+			SigLevel:   SigLevel(cfg),
+			Servers:    cfg.Servers(),
+		},
+		PackageCount: cfg.PackageCount(),
+		LastUpdated:  time.Now().Format("2006-01-02T15:04-07:00"),
+	}
+	if conf := cfg.Publish.IPFS; conf != nil {
+		if record, err := ipfs.Load(filepath.Join(g.OutDir, ipfs.FileName)); err != nil {
+			log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", ipfs.FileName, err))
+		} else if record != nil {
+			gateway := strings.TrimSuffix(cmp.Or(conf.Gateway, ipfs.DefaultGateway), "/")
+			ctx.Repo.IPFS = &IPFSInfo{CID: record.CID, Path: record.Path(), URL: gateway + record.Path()}
+		}
+	}
+
+	var deltas delta.Index
+	if cfg.Publish.Deltas != nil {
+		var err error
+		if deltas, err = delta.Load(g.Repo.Dir); err != nil {
+			log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", delta.IndexFile, err))
+		}
+	}
+
+	for _, pkg := range cfg.Packages.AUR {
+		version := g.Repo.Version(pkg.Name)
+		if version == "" {
+			continue
+		}
+		p := Package{
+			Name:    pkg.Name,
+			Version: version,
+			Arch:    g.Arch,
+			URL:     g.packageURL(pkg),
+		}
+		p.Provenance = g.provenancePath(pkg.Name)
+		if d, ok := deltas[g.packageFile(pkg.Name)]; ok {
+			d.File = g.Arch + "/" + d.File
+			p.Delta = &d
+		}
+		if g.AURInfo != nil && pkg.Source.Kind() == config.SourceAUR {
+			if info := g.AURInfo(pkg.Name); info != nil {
+				p.Description = info.Description
+				p.Homepage = info.URL
+				p.Maintainer = info.Maintainer
+				p.Orphaned = info.Orphaned()
+				p.OutOfDate = info.FlaggedOutOfDate()
+				p.LastModified = info.Modified().UTC().Format("2006-01-02")
+				p.Depends = info.Depends
+				p.MakeDepends = info.MakeDepends
+			}
+		}
+		ctx.Packages = append(ctx.Packages, p)
+		if p.Orphaned || p.OutOfDate {
+			ctx.Attention = append(ctx.Attention, p)
+		}
+	}
+
+	// Meta-packages aren't on the AUR, so they get no link
+	metas := cfg.Packages.Meta
+	if cfg.Meta.Keyring {
+		metas = append(slices.Clone(metas), cfg.KeyringPackage(""))
+	}
+	for _, meta := range metas {
+		version := g.Repo.Version(meta.Name)
+		if version == "" {
+			continue
+		}
+		ctx.Packages = append(ctx.Packages, Package{
+			Name:        meta.Name,
+			Version:     version,
+			Description: meta.Description,
+			Arch:        "any",
+		})
+	}
+
+	// The page is sorted by name without JavaScript, so sort here
+	sort.Slice(ctx.Packages, func(i, j int) bool { return ctx.Packages[i].Name < ctx.Packages[j].Name })
+	sort.Slice(ctx.Attention, func(i, j int) bool { return ctx.Attention[i].Name < ctx.Attention[j].Name })
+
+	if g.Stats != nil {
+		for i := range ctx.Packages {
+			p := &ctx.Packages[i]
+			names := []string{p.Name}
+			for _, pkg := range g.Repo.Split(p.Name) {
+				if pkg.Name != p.Name {
+					names = append(names, pkg.Name)
+				}
+			}
+			p.Downloads, p.TotalDownloads = g.Stats.Count(names, stats.RecentDays, g.Stats.Last)
+		}
+	}
+
+	if cfg.Meta.FileBrowser {
+		for i := range ctx.Packages {
+			ctx.Packages[i].FilesURL = fmt.Sprintf("%s/%s.html", FilesDir, ctx.Packages[i].Name)
+		}
+	}
+
+	return ctx
+}
+
+// Generate renders the landing page, README and installer and copies the icon
+func (g *Generator) Generate() {
+	if _, err := os.Stat(IndexHTMLTemplate); os.IsNotExist(err) {
+		log.Warn(fmt.Sprintf("Landing page template not found: %s. Skipping generation.", IndexHTMLTemplate))
+		return
+	}
+
+	log.Msg("")
+	log.Info("Generating landing pages...")
+
+	ctx := g.NewContext()
+
+	content, err := RenderHTML(IndexHTMLTemplate, ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to render landing page: %v", err))
+	} else {
+		// The timestamp changes on every run, so ignore it when deciding
+		// whether the page actually needs rewriting.
+		WriteArtifact(filepath.Join(g.OutDir, "index.html"), content, 0644, `id="last-updated"`, "Landing page.")
+	}
+
+	if g.Config.Meta.FileBrowser {
+		g.generateFileListings(ctx)
+	}
+
+	g.generateManifest(ctx)
+	g.generateMirrorlist()
+	g.generateBadges(ctx)
+	if g.State != nil {
+		g.generateFeed(ctx)
+	}
+
+	// Copy icon
+	if _, err := os.Stat(IconFile); err == nil {
+		destIcon := filepath.Join(g.OutDir, "icon.png")
+		if !fileutil.SameContent(IconFile, destIcon) {
+			if err := fileutil.CopyFile(IconFile, destIcon); err != nil {
+				log.Error(fmt.Sprintf("Failed to copy icon.png: %v", err))
+			} else {
+				log.Success("   Copied icon.png")
+			}
+		}
+	}
+
+	// Generate Repo README
+	if _, err := os.Stat(ReadmeTemplate); err == nil {
+		if content, err := RenderText(ReadmeTemplate, ctx); err != nil {
+			log.Error(fmt.Sprintf("Failed to render repo README: %v", err))
+		} else {
+			WriteArtifact(filepath.Join(g.OutDir, "README.md"), content, 0644, "", "Repo README.")
+		}
+	}
+
+	// Generate Installer
+	if _, err := os.Stat(InstallerTemplate); err == nil {
+		if content, err := RenderText(InstallerTemplate, ctx); err != nil {
+			log.Error(fmt.Sprintf("Failed to render installer: %v", err))
+		} else {
+			WriteArtifact(filepath.Join(g.OutDir, "install"), content, 0755, "", "installer")
+		}
+	}
+}
+
+// provenancePath returns the path below OutDir of the provenance record of
+// the package file of name, or of the first package of a pkgbase, or "" if
+// it has none
+func (g *Generator) provenancePath(name string) string {
+	file := g.packageFile(name)
+	if file == "" {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(g.Repo.Dir, file+provenance.Suffix)); err != nil {
+		return ""
+	}
+	return g.Arch + "/" + file + provenance.Suffix
+}
+
+// packageFile returns the package file of name, or of the first package of
+// a pkgbase, or "" if it isn't in the database
+func (g *Generator) packageFile(name string) string {
+	split := g.Repo.Split(name)
+	if len(split) == 0 {
+		return ""
+	}
+	file := split[0].Filename
+	for _, pkg := range split {
+		if pkg.Name == name {
+			file = pkg.Filename
+		}
+	}
+	return file
+}
+
+// Mirrorlist returns the pacman mirrorlist of the repository of cfg, its
+// servers in order of preference, to include in its pacman.conf section
+func Mirrorlist(cfg *config.Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Mirrors of %s, in order of preference. Use it with\n", cfg.Meta.RepoName)
+	fmt.Fprintf(&b, "#   [%s]\n#   Include = /etc/pacman.d/%s-mirrorlist\n\n", cfg.Meta.RepoName, cfg.Meta.RepoName)
+	for _, server := range cfg.Servers() {
+		fmt.Fprintf(&b, "Server = %s/$arch\n", server)
+	}
+	return b.String()
+}
+
+// generateMirrorlist writes the mirrorlist if the repository has mirrors
+// clients can use, and removes it otherwise
+func (g *Generator) generateMirrorlist() {
+	path := filepath.Join(g.OutDir, MirrorlistFile)
+	if len(g.Config.Servers()) < 2 {
+		if err := os.Remove(path); err == nil {
+			log.Success("   Removed: mirrorlist")
+		}
+		return
+	}
+	WriteArtifact(path, Mirrorlist(g.Config), 0644, "", "Mirrorlist.")
+}
+
+// generateManifest writes the package list as JSON for scripts and tools
+func (g *Generator) generateManifest(ctx Context) {
+	manifest := struct {
+		Repo     string    `json:"repo"`
+		URL      string    `json:"url"`
+		Packages []Package `json:"packages"`
+	}{ctx.Repo.Name, ctx.Repo.URL, ctx.Packages}
+	if manifest.Packages == nil {
+		manifest.Packages = []Package{}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to encode package manifest: %v", err))
+		return
+	}
+	WriteArtifact(filepath.Join(g.OutDir, ManifestFile), string(data)+"\n", 0644, "", "Package manifest.")
+}
+
+// generateFileListings writes a file listing page for every published
+// package from the files database and removes pages of packages that are gone.
+func (g *Generator) generateFileListings(ctx Context) {
+	if _, err := os.Stat(FilesTemplate); os.IsNotExist(err) {
+		log.Warn(fmt.Sprintf("File listing template not found: %s. Skipping generation.", FilesTemplate))
+		return
+	}
+
+	filesDB, err := g.Repo.OpenFiles()
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot read files database, skipping file listings: %v", err))
+		return
+	}
+
+	dir := filepath.Join(g.OutDir, FilesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create %s: %v", dir, err))
+		return
+	}
+
+	tmpl, err := htmltemplate.New(filepath.Base(FilesTemplate)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(FilesTemplate)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to parse file listing template: %v", err))
+		return
+	}
+
+	written := make(map[string]bool)
+	changed := 0
+	for _, pkg := range ctx.Packages {
+		entry, ok := filesDB.Get(pkg.Name)
+		if !ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, FilesContext{Repo: ctx.Repo, Package: pkg, Files: entry.Files}); err != nil {
+			log.Error(fmt.Sprintf("Failed to render file listing for %s: %v", pkg.Name, err))
+			continue
+		}
+
+		name := pkg.Name + ".html"
+		written[name] = true
+		path := filepath.Join(dir, name)
+		if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, buf.Bytes()) {
+			continue
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			log.Error(fmt.Sprintf("Failed to write %s: %v", path, err))
+			continue
+		}
+		changed++
+	}
+
+	// Remove listings of packages no longer published
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if !written[entry.Name()] {
+				os.Remove(filepath.Join(dir, entry.Name()))
+				changed++
+			}
+		}
+	}
+
+	if changed > 0 {
+		log.Success(fmt.Sprintf("   Updated: %d file listings.", changed))
+	} else {
+		log.Msg("   Unchanged: File listings.")
+	}
+}
+
+// RenderHTML renders an HTML template file with contextual escaping
+func RenderHTML(path string, data any) (string, error) {
+	tmpl, err := htmltemplate.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderText renders a plain text template file (markdown, shell)
+func RenderText(path string, data any) (string, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// packageURL returns the web page of a package's source, if it has one
+func (g *Generator) packageURL(pkg config.Package) string {
+	switch pkg.Source.Kind() {
+	case config.SourceAUR:
+		return g.AUR.PackageURL(pkg.Name)
+	case config.SourceGit:
+		if strings.HasPrefix(pkg.Source.URL, "https://") {
+			return strings.TrimSuffix(pkg.Source.URL, ".git")
+		}
+	}
+	return ""
+}
+
+// SigLevel returns the pacman SigLevel clients should use for this repo.
+func SigLevel(cfg *config.Config) string {
+	if cfg.Meta.SigningKey != "" {
+		return "Required DatabaseOptional"
+	}
+	return "Optional TrustAll"
+}
+
+// WriteArtifact writes content to path only if it differs from the existing
+// file. Lines containing ignore (when non-empty) are excluded from the
+// comparison so volatile values don't cause needless rewrites.
+func WriteArtifact(path, content string, mode os.FileMode, ignore, label string) {
+	action := "Generated"
+	if existing, err := os.ReadFile(path); err == nil {
+		if stripLines(string(existing), ignore) == stripLines(content, ignore) {
+			log.Msg(fmt.Sprintf("   Unchanged: %s", label))
+			return
+		}
+		action = "Updated"
+	}
+
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		log.Error(fmt.Sprintf("Failed to write %s: %v", filepath.Base(path), err))
+		return
+	}
+	// WriteFile doesn't change the mode of an existing file
+	if err := os.Chmod(path, mode); err != nil {
+		log.Error(fmt.Sprintf("Failed to chmod %s: %v", filepath.Base(path), err))
+		return
+	}
+	log.Success(fmt.Sprintf("   %s: %s", action, label))
+}
+
+func stripLines(content, substr string) string {
+	if substr == "" {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.Contains(line, substr) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
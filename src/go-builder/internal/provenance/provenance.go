@@ -0,0 +1,78 @@
+// Package provenance records how each published package file was built
+package provenance
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// Suffix turns a package file name into the name of its provenance record,
+// published next to it
+const Suffix = ".provenance.json"
+
+// Record is the provenance of a package file
+type Record struct {
+	Package string `json:"package"`
+	File    string `json:"file"`
+	SHA256  string `json:"sha256"`
+
+	// Source is the source type of the configured package, SourceURL and
+	// Commit where the PKGBUILD came from
+	Source    string `json:"source"`
+	SourceURL string `json:"source_url,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	// PKGBUILDSHA256 is the hash of the PKGBUILD as built, after overlays
+	// and pkgrel bumps
+	PKGBUILDSHA256 string `json:"pkgbuild_sha256"`
+
+	Builder      string    `json:"builder"`
+	Host         string    `json:"host"`
+	BuildMode    string    `json:"build_mode"`
+	MakepkgFlags []string  `json:"makepkg_flags"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	// Repacked is when the package file was recompressed by repack, after
+	// which SHA256 no longer matches a rebuild
+	Repacked *time.Time `json:"repacked,omitempty"`
+}
+
+// Write saves the record next to its package file in dir
+func (r *Record) Write(dir string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, r.File+Suffix), append(data, '\n'), 0644)
+}
+
+// Load reads the record of the package file in dir
+func Load(dir, file string) (*Record, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file+Suffix))
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// BuilderVersion identifies the running builder by its module version and,
+// if it was built from a checkout, the commit
+func BuilderVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " " + setting.Value
+		}
+	}
+	return version
+}
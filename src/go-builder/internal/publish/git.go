@@ -0,0 +1,289 @@
+package publish
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/chunk"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// DefaultMaxFileSize is the largest file GitHub accepts in a push
+const DefaultMaxFileSize = 100 << 20
+
+// Git commits a directory to a branch and pushes it
+type Git struct {
+	Dir    string
+	Branch string
+	// Remote is a remote name or URL
+	Remote string
+	// Author is "Name <email>", empty for the git config
+	Author string
+	// Squash replaces the branch with a single commit
+	Squash bool
+	// LFS tracks files over LFSThreshold with Git LFS. Without it, files
+	// over MaxFileSize fail the publish.
+	LFS          bool
+	LFSThreshold int64
+	MaxFileSize  int64
+}
+
+// LargeFile is a file over a size limit
+type LargeFile struct {
+	Path string
+	Size int64
+}
+
+func (g *Git) git(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-C", g.Dir}, args...)...)
+	if g.Author != "" {
+		name, email, _ := strings.Cut(strings.TrimSuffix(g.Author, ">"), " <")
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME="+name, "GIT_AUTHOR_EMAIL="+email,
+			"GIT_COMMITTER_NAME="+name, "GIT_COMMITTER_EMAIL="+email)
+	}
+	return cmd
+}
+
+// run runs git, returning its trimmed output, or its stderr in the error
+func (g *Git) run(args ...string) (string, error) {
+	cmd := g.git(args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := shell.Output(cmd)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Prepare makes Dir a git repository on Branch, keeping its files
+func (g *Git) Prepare() error {
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); os.IsNotExist(err) {
+		log.Info(fmt.Sprintf("Initializing a git repository in %s", g.Dir))
+		if _, err := g.run("init", "--quiet", "--initial-branch", g.Branch); err != nil {
+			return err
+		}
+	}
+	if head, _ := g.run("symbolic-ref", "--quiet", "--short", "HEAD"); head != g.Branch {
+		// Switches the branch, keeping the files and the index
+		if _, err := g.run("symbolic-ref", "HEAD", "refs/heads/"+g.Branch); err != nil {
+			return err
+		}
+	}
+	if g.LFS {
+		// Installs the hook uploading LFS objects on push
+		if _, err := g.run("lfs", "install", "--local"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// largeFiles returns the files in Dir over limit that Git LFS doesn't
+// store yet
+func (g *Git) largeFiles(limit int64) ([]LargeFile, error) {
+	var large []LargeFile
+	err := filepath.WalkDir(g.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || chunk.IsSplit(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() <= limit {
+			return nil
+		}
+		rel, _ := filepath.Rel(g.Dir, path)
+		rel = filepath.ToSlash(rel)
+		if filter, _ := g.run("check-attr", "filter", "--", rel); strings.HasSuffix(filter, ": lfs") {
+			return nil
+		}
+		large = append(large, LargeFile{rel, info.Size()})
+		return nil
+	})
+	return large, err
+}
+
+// Stage adds every change in Dir to the index, tracking large files with
+// Git LFS if enabled. It returns the staged changes as lines of
+// `git diff --name-status`, none if nothing changed.
+func (g *Git) Stage() ([]string, error) {
+	// GitHub warns about files over half its limit
+	limit := g.MaxFileSize / 2
+	if g.LFS {
+		limit = min(limit, g.LFSThreshold)
+		if err := g.pruneAttributes(); err != nil {
+			return nil, err
+		}
+	}
+	large, err := g.largeFiles(limit)
+	if err != nil {
+		return nil, err
+	}
+	var track, rejected []string
+	for _, f := range large {
+		switch {
+		case g.LFS && f.Size > g.LFSThreshold:
+			log.Msg(fmt.Sprintf("   Storing %s (%s) with Git LFS", f.Path, config.ByteSize(f.Size)))
+			track = append(track, f.Path)
+		case f.Size > g.MaxFileSize:
+			rejected = append(rejected, f.Path)
+		default:
+			log.Warn(fmt.Sprintf("   %s is %s, close to the %s limit of the remote", f.Path, config.ByteSize(f.Size), config.ByteSize(g.MaxFileSize)))
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("files larger than %s, which the remote would reject (set lfs to store them with Git LFS): %s",
+			config.ByteSize(g.MaxFileSize), strings.Join(rejected, ", "))
+	}
+	if err := g.track(track); err != nil {
+		return nil, err
+	}
+
+	// The states of the delta publishes only matter here
+	if _, err := g.run("add", "--all", "--", ".", ":(exclude).publish*.json"); err != nil {
+		return nil, err
+	}
+	if err := g.unstageSplit(); err != nil {
+		return nil, err
+	}
+	out, err := g.run("diff", "--cached", "--name-status", "--no-renames")
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// unstageSplit keeps the files split into parts out of the index, as their
+// parts are published instead
+func (g *Git) unstageSplit() error {
+	var split []string
+	err := filepath.WalkDir(g.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && chunk.IsSplit(path) {
+			rel, _ := filepath.Rel(g.Dir, path)
+			split = append(split, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil || len(split) == 0 {
+		return err
+	}
+	_, err = g.run(append([]string{"rm", "--quiet", "--cached", "--ignore-unmatch", "--"}, split...)...)
+	return err
+}
+
+// lfsAttributes are the attributes of files stored with Git LFS
+const lfsAttributes = "filter=lfs diff=lfs merge=lfs -text"
+
+// attributesFile is where track records the files stored with Git LFS
+func (g *Git) attributesFile() string {
+	return filepath.Join(g.Dir, ".gitattributes")
+}
+
+// track adds files to .gitattributes, to be stored with Git LFS
+func (g *Git) track(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(g.attributesFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fmt.Fprintf(f, "/%s %s\n", attributePattern.Replace(file), lfsAttributes)
+	}
+	return f.Close()
+}
+
+// attributePattern escapes the characters with a meaning in .gitattributes
+var attributePattern = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, " ", "[[:space:]]")
+
+var attributeUnescape = strings.NewReplacer(`\\`, `\`, `\*`, "*", `\?`, "?", `\[`, "[", "[[:space:]]", " ")
+
+// pruneAttributes drops the files track added from .gitattributes once
+// they are deleted, e.g. replaced by a newer version. Patterns matching
+// several files are kept.
+func (g *Git) pruneAttributes() error {
+	data, err := os.ReadFile(g.attributesFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	kept := slices.DeleteFunc(slices.Clone(lines), func(line string) bool {
+		pattern, attrs, _ := strings.Cut(line, " ")
+		file, ok := strings.CutPrefix(pattern, "/")
+		file = attributeUnescape.Replace(file)
+		// Not a file added by track
+		if !ok || attrs != lfsAttributes || attributePattern.Replace(file) != pattern[1:] {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(g.Dir, filepath.FromSlash(file)))
+		return os.IsNotExist(err)
+	})
+	if len(kept) == len(lines) {
+		return nil
+	}
+	return os.WriteFile(g.attributesFile(), []byte(strings.Join(kept, "\n")+"\n"), 0644)
+}
+
+// Commit commits the index with message. With Squash, the commit replaces
+// the history of the branch.
+func (g *Git) Commit(message string) error {
+	if !g.Squash {
+		_, err := g.run("commit", "--quiet", "--message", message)
+		return err
+	}
+	tree, err := g.run("write-tree")
+	if err != nil {
+		return err
+	}
+	commit, err := g.run("commit-tree", tree, "-m", message)
+	if err != nil {
+		return err
+	}
+	_, err = g.run("reset", "--quiet", "--soft", commit)
+	return err
+}
+
+// Push pushes the branch, replacing the remote one with Squash. With LFS,
+// the files stored with LFS are uploaded first.
+func (g *Git) Push() error {
+	if g.LFS {
+		if _, err := g.run("lfs", "push", g.Remote, "HEAD"); err != nil {
+			return err
+		}
+	}
+	args := []string{"push", "--quiet"}
+	if g.Squash {
+		args = append(args, "--force")
+	}
+	_, err := g.run(append(args, g.Remote, "HEAD:refs/heads/"+g.Branch)...)
+	return err
+}
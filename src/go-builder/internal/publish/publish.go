@@ -0,0 +1,137 @@
+// Package publish works out which files of the build directory changed since
+// the last publish, so that only the delta needs uploading.
+package publish
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"builder/internal/chunk"
+)
+
+// StateFile records the hashes of the last publish, relative to the build
+// directory
+const StateFile = ".publish.json"
+
+// MirrorStateFile returns the file recording the last publish to the mirror
+// name, relative to the build directory
+func MirrorStateFile(name string) string {
+	return ".publish-" + name + ".json"
+}
+
+// Manifest maps slash-separated paths relative to the build directory to
+// their SHA-256
+type Manifest map[string]string
+
+// Change is a file to upload or delete
+type Change struct {
+	Path    string
+	Deleted bool
+}
+
+// Scan hashes every file below root, skipping dotfiles and directories.
+// Files split into parts are published as their parts.
+func Scan(root string) (Manifest, error) {
+	m := make(Manifest)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || chunk.IsSplit(path) {
+			return nil
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		m[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return m, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Load reads a manifest; a missing file is an empty manifest, so everything
+// gets published
+func Load(path string) (Manifest, error) {
+	m := make(Manifest)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+// Save writes the manifest to path
+func (m Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// IsDatabase reports whether path is a repository database file. Those are
+// always published, as clients must never see a stale one.
+func IsDatabase(path string) bool {
+	name := filepath.Base(path)
+	if strings.Contains(name, ".pkg.tar") {
+		return false
+	}
+	return strings.Contains(name, ".db") || strings.Contains(name, ".files")
+}
+
+// Diff returns the changes turning old into cur, ordered so a client never
+// sees a database referring to missing files: new and changed files first,
+// then databases, then deletions.
+func Diff(old, cur Manifest) []Change {
+	var files, dbs, deleted []Change
+	for path, sum := range cur {
+		switch {
+		case IsDatabase(path):
+			dbs = append(dbs, Change{Path: path})
+		case old[path] != sum:
+			files = append(files, Change{Path: path})
+		}
+	}
+	for path := range old {
+		if _, ok := cur[path]; !ok {
+			deleted = append(deleted, Change{Path: path, Deleted: true})
+		}
+	}
+
+	for _, list := range [][]Change{files, dbs, deleted} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return append(append(files, dbs...), deleted...)
+}
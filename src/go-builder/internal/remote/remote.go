@@ -0,0 +1,252 @@
+// Package remote runs the Arch-specific steps of a run (makepkg, repo-add,
+// pacman) on a build machine over SSH or in a container, so the builder
+// itself also runs on hosts without pacman, e.g. macOS or Windows.
+package remote
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"builder/internal/agent"
+	"builder/internal/shell"
+)
+
+// DefaultDir is the work directory on build machines, relative to the
+// home directory of the SSH user
+const DefaultDir = "repo-builder"
+
+// Host is where the Arch-specific commands run. The working directory of
+// the builder is mirrored below Dir over SSH, or mounted into a fresh
+// container for every command. Agents only build packages, see Agent.
+type Host struct {
+	Name string
+
+	// Addr is the user@host of a build machine, Port its SSH port if not
+	// the default, and Identity the private key, else the ssh config's
+	Addr     string
+	Port     int
+	Identity string
+	// Dir is the work directory on the machine
+	Dir string
+
+	// Runtime and Image run the commands in a container on this host
+	// instead, e.g. with podman or docker
+	Runtime string
+	Image   string
+
+	// Agent builds packages on a machine running the agent command,
+	// which runs no other commands
+	Agent *agent.Client
+}
+
+// NewSSH returns the build machine at addr, a user@host with an optional
+// :port
+func NewSSH(name, addr, identity, dir string) (*Host, error) {
+	h := &Host{Name: name, Addr: addr, Identity: identity, Dir: dir}
+	if host, port, ok := strings.Cut(addr, ":"); ok {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid SSH port in %q", addr)
+		}
+		h.Addr, h.Port = host, p
+	}
+	if h.Dir == "" {
+		h.Dir = DefaultDir
+	}
+	return h, nil
+}
+
+// NewAgent returns the build machine running the agent at url, which
+// accepts jobs signed with key
+func NewAgent(name, url string, key []byte) *Host {
+	return &Host{Name: name, Agent: agent.NewClient(url, key)}
+}
+
+// NewContainer returns a host running every command in a fresh container
+// of image with runtime
+func NewContainer(runtime, image string) *Host {
+	return &Host{Name: runtime, Runtime: runtime, Image: image}
+}
+
+// String describes the host for the log
+func (h *Host) String() string {
+	if h.Runtime != "" {
+		return fmt.Sprintf("%s container %s", h.Runtime, h.Image)
+	}
+	if h.Agent != nil {
+		return fmt.Sprintf("%s (%s)", h.Name, h.Agent.URL)
+	}
+	return fmt.Sprintf("%s (%s)", h.Name, h.Addr)
+}
+
+// Command returns the command running name with args in the directory dir
+// below the working directory, with the variables env set
+func (h *Host) Command(dir string, env []string, name string, args ...string) (*exec.Cmd, error) {
+	if h.Agent != nil {
+		return nil, fmt.Errorf("%s only builds packages", h)
+	}
+	rel, err := relDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if h.Runtime != "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		run := []string{"run", "--rm",
+			"-v", cwd + ":/work",
+			"-w", "/work/" + rel,
+			"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		}
+		for _, v := range env {
+			run = append(run, "-e", v)
+		}
+		run = append(append(run, h.Image, name), args...)
+		return exec.Command(h.Runtime, run...), nil
+	}
+
+	script := "cd " + quote(h.Dir+"/"+rel) + " && exec"
+	if len(env) > 0 {
+		script += " env"
+		for _, v := range env {
+			script += " " + quote(v)
+		}
+	}
+	for _, arg := range append([]string{name}, args...) {
+		script += " " + quote(arg)
+	}
+	return h.shell(script), nil
+}
+
+// Push mirrors the directory dir below the working directory to the
+// machine, or only the files of it matching include. Files on the machine
+// that aren't pushed are deleted. Containers mount the working directory
+// and agents receive the package directory with the job, so there is
+// nothing to push.
+func (h *Host) Push(dir string, include ...string) error {
+	if h.Runtime != "" || h.Agent != nil {
+		return nil
+	}
+	rel, err := relDir(dir)
+	if err != nil {
+		return err
+	}
+	mkdir := h.shell("mkdir -p " + quote(h.Dir+"/"+rel))
+	if out, err := shell.CombinedOutput(mkdir); err != nil {
+		return fmt.Errorf("ssh %s: %v: %s", h.Addr, err, strings.TrimSpace(string(out)))
+	}
+	args := []string{"-rlpt", "--delete"}
+	if len(include) > 0 {
+		args = append(args, filters(include)...)
+		args = append(args, "--delete-excluded")
+	}
+	return h.rsync(args, filepath.ToSlash(dir)+"/", h.Addr+":"+h.Dir+"/"+rel+"/")
+}
+
+// Pull copies the files matching include from the directory dir on the
+// machine back to dir. Agents return the packages with the job.
+func (h *Host) Pull(dir string, include ...string) error {
+	if h.Runtime != "" || h.Agent != nil {
+		return nil
+	}
+	rel, err := relDir(dir)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-rlpt"}, filters(include)...)
+	return h.rsync(args, h.Addr+":"+h.Dir+"/"+rel+"/", filepath.ToSlash(dir)+"/")
+}
+
+// Check verifies that the host can run the Arch-specific commands. Build
+// machines also need passwordless sudo, makepkg installs the dependencies
+// with it, which agents check themselves.
+func (h *Host) Check() error {
+	if h.Agent != nil {
+		if err := h.Agent.Check(context.Background()); err != nil {
+			return fmt.Errorf("%s: %v", h, err)
+		}
+		return nil
+	}
+	script := `for t in makepkg repo-add pacman; do command -v "$t" >/dev/null || { echo "$t is missing"; exit 1; }; done
+sudo -n true || { echo "sudo asks for a password"; exit 1; }`
+	if h.Runtime != "" {
+		// Containers are fresh, makepkg builds set up their own
+		script = `command -v repo-add >/dev/null || { echo "repo-add is missing"; exit 1; }`
+	}
+	cmd := h.shell(script)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%s: %v: %s", h, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// shell returns the command running script with sh on the host, in the
+// home directory of the SSH user or the root of the container
+func (h *Host) shell(script string) *exec.Cmd {
+	if h.Runtime != "" {
+		return exec.Command(h.Runtime, "run", "--rm", h.Image, "sh", "-c", script)
+	}
+	return exec.Command("ssh", append(h.sshArgs(), h.Addr, "--", script)...)
+}
+
+// sshArgs returns the options of every ssh connection. Batch mode fails
+// instead of prompting for passwords or host keys.
+func (h *Host) sshArgs() []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if h.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(h.Port))
+	}
+	if h.Identity != "" {
+		args = append(args, "-i", h.Identity)
+	}
+	return args
+}
+
+// rsync copies src to dest over the SSH connection of the host
+func (h *Host) rsync(args []string, src, dest string) error {
+	ssh := "ssh " + strings.Join(h.sshArgs(), " ")
+	cmd := exec.Command("rsync", append(append(args, "-e", ssh), src, dest)...)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("rsync with %s: %v: %s", h.Addr, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// filters returns the rsync filter arguments copying only the files
+// matching include
+func filters(include []string) []string {
+	var args []string
+	for _, pattern := range include {
+		args = append(args, "--include="+pattern)
+	}
+	return append(args, "--exclude=*")
+}
+
+// relDir returns dir relative to the working directory, which the host
+// mirrors, as a slash-separated path
+func relDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(cwd, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the working directory, which is all build hosts see", dir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// quote quotes s for the POSIX shell of the build machine
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
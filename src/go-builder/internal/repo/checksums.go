@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// ChecksumFile lists the SHA-256 of every file in the repository directory
+// in sha256sum format, so mirrors can check them with sha256sum -c
+const ChecksumFile = "SHA256SUMS"
+
+// WriteChecksums writes ChecksumFile covering the packages, signatures and
+// databases in Dir. It reports whether the file changed; an unchanged file
+// is left untouched.
+func (r *RepoDB) WriteChecksums() (bool, error) {
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return false, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ChecksumFile) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		sum, err := FileSHA256(filepath.Join(r.Dir, name))
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, name)
+	}
+
+	path := filepath.Join(r.Dir, ChecksumFile)
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, buf.Bytes()) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// SignChecksums writes a detached signature of ChecksumFile made with key
+func (r *RepoDB) SignChecksums(key string) error {
+	return SignFile(filepath.Join(r.Dir, ChecksumFile), key)
+}
+
+// SignFile writes a detached signature of path made with key to path.sig
+func SignFile(path, key string) error {
+	cmd := exec.Command("gpg", "--batch", "--yes", "--local-user", key, "--output", path+".sig", "--detach-sign", path)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Chmod(path+".sig", 0644)
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 of the file at path
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
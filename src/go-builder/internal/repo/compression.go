@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"builder/internal/log"
+	"builder/internal/repodb"
+	"builder/internal/shell"
+)
+
+// compressors are the commands compressing databases to stdout, by
+// compression. gz is compressed natively.
+var compressors = map[string][]string{
+	"zst": {"zstd", "-q", "-c", "-T0"},
+	"xz":  {"xz", "-c", "-T0"},
+	"bz2": {"bzip2", "-c"},
+}
+
+// Compressions are the database compressions repo-add supports
+var Compressions = []string{"gz", "zst", "xz", "bz2"}
+
+// ConvertCompression recompresses the databases written with another
+// compression than Compression, e.g. after it was changed in the config.
+// repo-add would otherwise start new, empty databases.
+func (r *RepoDB) ConvertCompression() error {
+	defer r.invalidate()
+	for _, kind := range []string{".db", ".files"} {
+		want := r.Name + kind + r.tarExt()
+		if _, err := os.Stat(filepath.Join(r.Dir, want)); err == nil {
+			continue
+		}
+		for _, c := range Compressions {
+			old := r.Name + kind + ".tar." + c
+			if old == want {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(r.Dir, old)); err != nil {
+				continue
+			}
+			if err := r.recompress(old, want); err != nil {
+				return fmt.Errorf("converting %s to %s: %w", old, want, err)
+			}
+			log.Msg(fmt.Sprintf("   Converted %s to %s", old, want))
+			r.relink(r.Name+kind, r.Name+kind, want)
+			for _, suffix := range []string{"", snapshotSuffix, ".old"} {
+				os.Remove(filepath.Join(r.Dir, old+suffix))
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// recompress writes the database file old to want with the compression of
+// the repository
+func (r *RepoDB) recompress(old, want string) error {
+	f, err := os.Open(filepath.Join(r.Dir, old))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr, err := repodb.Decompress(f)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if args, ok := compressors[r.Compression]; ok {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		compressed, err := shell.Output(cmd)
+		if err != nil {
+			return err
+		}
+		out.Write(compressed)
+	} else {
+		zw := gzip.NewWriter(&out)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	tmp := filepath.Join(r.Dir, want+".tmp")
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.Dir, want))
+}
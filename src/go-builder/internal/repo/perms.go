@@ -0,0 +1,44 @@
+package repo
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"builder/internal/log"
+)
+
+// FixPermissions makes everything below root world-readable and directories
+// world-traversable. pacman 7 downloads as the unprivileged alpm user, so a
+// repository served from disk must not depend on the builder's umask.
+func FixPermissions(root string) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Name() == ".git" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		want := info.Mode().Perm() | 0444
+		if d.IsDir() {
+			want |= 0111
+		}
+		if want != info.Mode().Perm() {
+			if err := os.Chmod(path, want); err != nil {
+				log.Error(fmt.Sprintf("Failed to fix permissions of %s: %v", path, err))
+			} else {
+				log.Warn(fmt.Sprintf("     Fixed permissions: %s (%o)", path, want))
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"builder/internal/fileutil"
+	"builder/internal/log"
+	"builder/internal/repodb"
+)
+
+// snapshotSuffix marks the last known good copy of a database file
+const snapshotSuffix = ".snapshot"
+
+// ErrCorrupt is returned by Recover when a database is unreadable and
+// there is no backup to restore
+var ErrCorrupt = errors.New("repository database is corrupted and no backup is usable")
+
+// Recover checks that the databases parse. A corrupted one is replaced by
+// the newest snapshot or repo-add .old backup that parses. Without a usable
+// backup it returns ErrCorrupt, unless acceptRebuild is set: the corrupted
+// files are then removed and every package gets rebuilt.
+func (r *RepoDB) Recover(acceptRebuild bool) error {
+	defer r.invalidate()
+	for _, file := range []string{r.DBFile(), r.FilesFile()} {
+		path := filepath.Join(r.Dir, file)
+		_, err := repodb.Open(path)
+		if err == nil {
+			r.snapshot(file)
+			continue
+		}
+
+		backups := r.backups(file)
+		if os.IsNotExist(err) && len(backups) == 0 {
+			continue
+		}
+		log.Warn(fmt.Sprintf("Database %s is unreadable: %v", file, err))
+
+		if backup := firstParsable(backups); backup != "" {
+			if err := replaceFile(backup, path); err != nil {
+				return fmt.Errorf("restoring %s: %w", file, err)
+			}
+			log.Success(fmt.Sprintf("   Restored %s from %s", file, filepath.Base(backup)))
+			continue
+		}
+
+		if !acceptRebuild {
+			return fmt.Errorf("%s: %w; rerun with --accept-db-rebuild to rebuild every package", file, ErrCorrupt)
+		}
+		log.Error(fmt.Sprintf("   No usable backup of %s, recreating it: EVERY PACKAGE WILL BE REBUILT", file))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotAll snapshots the databases that parse after an update
+func (r *RepoDB) snapshotAll() {
+	for _, file := range []string{r.DBFile(), r.FilesFile()} {
+		if _, err := repodb.Open(filepath.Join(r.Dir, file)); err == nil {
+			r.snapshot(file)
+		}
+	}
+}
+
+// snapshot keeps a copy of a database file known to parse
+func (r *RepoDB) snapshot(file string) {
+	path := filepath.Join(r.Dir, file)
+	if fileutil.SameContent(path, path+snapshotSuffix) {
+		return
+	}
+	if err := replaceFile(path, path+snapshotSuffix); err != nil {
+		log.Warn(fmt.Sprintf("Failed to snapshot %s: %v", file, err))
+	}
+}
+
+// backups returns the snapshot and .old copies of file, newest first
+func (r *RepoDB) backups(file string) []string {
+	var found []string
+	for _, suffix := range []string{snapshotSuffix, ".old"} {
+		path := filepath.Join(r.Dir, file+suffix)
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, _ := os.Stat(found[i])
+		b, _ := os.Stat(found[j])
+		return a.ModTime().After(b.ModTime())
+	})
+	return found
+}
+
+func firstParsable(paths []string) string {
+	for _, path := range paths {
+		if _, err := repodb.Open(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// replaceFile atomically replaces dest with a copy of src
+func replaceFile(src, dest string) error {
+	tmp := dest + ".tmp"
+	if err := fileutil.CopyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
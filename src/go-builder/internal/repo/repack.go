@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PkgFormats are the package compressions Repack writes
+var PkgFormats = []string{"zst", "xz"}
+
+// decompressors are the commands decompressing packages to stdout, by
+// extension
+var decompressors = map[string][]string{
+	"zst": {"zstd", "-q", "-d", "-c"},
+	"xz":  {"xz", "-d", "-c"},
+	"gz":  {"gzip", "-d", "-c"},
+	"bz2": {"bzip2", "-d", "-c"},
+}
+
+// LevelRange returns the compression levels of format
+func LevelRange(format string) (lowest, highest int) {
+	if format == "xz" {
+		return 0, 9
+	}
+	return 1, 22
+}
+
+// PkgFormat returns the compression of a package file, e.g. zst
+func PkgFormat(file string) string {
+	_, ext, ok := strings.Cut(file, ".pkg.tar.")
+	if !ok {
+		return ""
+	}
+	return ext
+}
+
+// RepackName returns the name of the package file once recompressed to
+// format
+func RepackName(file, format string) string {
+	base, _, _ := strings.Cut(file, ".pkg.tar.")
+	return base + ".pkg.tar." + format
+}
+
+// Repack recompresses the package file in dir to format at level and
+// returns the name of the new file. check is called on the result before it
+// takes its name, so a file repacked to the same name is only replaced once
+// it passed. An old file of another name is left in place.
+func Repack(dir, file, format string, level int, check func(path string) error) (string, error) {
+	decompress, ok := decompressors[PkgFormat(file)]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression %q", PkgFormat(file))
+	}
+	var compress []string
+	switch format {
+	case "zst":
+		compress = []string{"zstd", "-q", "-c", "-T0", "-" + strconv.Itoa(level)}
+		if level > 19 {
+			compress = append(compress, "--ultra")
+		}
+	case "xz":
+		compress = []string{"xz", "-c", "-T0", "-" + strconv.Itoa(level)}
+	default:
+		return "", fmt.Errorf("unsupported compression %q", format)
+	}
+
+	in, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	newFile := RepackName(file, format)
+	// The check sees the final name, which the package name is checked
+	// against
+	tmpDir, err := os.MkdirTemp(dir, ".repack-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmp := filepath.Join(tmpDir, newFile)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	dec := exec.Command(decompress[0], decompress[1:]...)
+	enc := exec.Command(compress[0], compress[1:]...)
+	dec.Stdin, enc.Stdout = in, out
+	var decErr, encErr strings.Builder
+	dec.Stderr, enc.Stderr = &decErr, &encErr
+	if enc.Stdin, err = dec.StdoutPipe(); err != nil {
+		return "", err
+	}
+	if err := enc.Start(); err != nil {
+		return "", err
+	}
+	if err := dec.Run(); err != nil {
+		enc.Wait()
+		return "", fmt.Errorf("%s: %v: %s", decompress[0], err, strings.TrimSpace(decErr.String()))
+	}
+	if err := enc.Wait(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", compress[0], err, strings.TrimSpace(encErr.String()))
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := check(tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, newFile)); err != nil {
+		return "", err
+	}
+	return newFile, nil
+}
@@ -0,0 +1,474 @@
+// Package repo manages the pacman repository in the build directory: the
+// database maintained with repo-add and the package files next to it.
+package repo
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"builder/internal/delta"
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/remote"
+	"builder/internal/repodb"
+	"builder/internal/shell"
+	"builder/internal/torrent"
+)
+
+// RepoDB is a repository database and the package files in its directory
+type RepoDB struct {
+	Name string
+	Dir  string
+	// Compression is the compression of the databases, gz when empty
+	Compression string
+	// Remote runs repo-add and repo-remove, nil to run them on this host
+	Remote *remote.Host
+
+	mu    sync.Mutex
+	cache map[string]*cachedDB
+}
+
+// cachedDB is a parsed database and the file state it was parsed from
+type cachedDB struct {
+	db      *repodb.DB
+	modTime time.Time
+	size    int64
+}
+
+// New returns the repository called name stored in dir
+func New(name, dir string) *RepoDB {
+	return &RepoDB{Name: name, Dir: dir}
+}
+
+// DBFile returns the database file name, relative to Dir
+func (r *RepoDB) DBFile() string {
+	return r.Name + ".db" + r.tarExt()
+}
+
+// FilesFile returns the files database name, relative to Dir
+func (r *RepoDB) FilesFile() string {
+	return r.Name + ".files" + r.tarExt()
+}
+
+// tarExt is the extension of the database archives, from which repo-add
+// picks the compression
+func (r *RepoDB) tarExt() string {
+	return ".tar." + cmp.Or(r.Compression, "gz")
+}
+
+// Open returns the current database. It is parsed once and cached until
+// the file changes, so lookups for every package stay cheap.
+func (r *RepoDB) Open() (*repodb.DB, error) {
+	return r.load(r.DBFile())
+}
+
+// OpenFiles returns the current files database, which includes file lists
+func (r *RepoDB) OpenFiles() (*repodb.DB, error) {
+	return r.load(r.FilesFile())
+}
+
+// load parses file, or returns the cached result if the file is unchanged
+func (r *RepoDB) load(file string) (*repodb.DB, error) {
+	path := filepath.Join(r.Dir, file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.cache[file]; c != nil && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.db, nil
+	}
+	db, err := repodb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache == nil {
+		r.cache = make(map[string]*cachedDB)
+	}
+	r.cache[file] = &cachedDB{db: db, modTime: info.ModTime(), size: info.Size()}
+	return db, nil
+}
+
+// invalidate drops the cached databases after they were rewritten
+func (r *RepoDB) invalidate() {
+	r.mu.Lock()
+	r.cache = nil
+	r.mu.Unlock()
+}
+
+// Version gets version of package from repo database. A pkgbase that
+// isn't a package name itself has the version of its split packages.
+func (r *RepoDB) Version(pkgName string) string {
+	db, err := r.Open()
+	if err != nil {
+		return ""
+	}
+
+	if pkg, ok := db.Get(pkgName); ok {
+		return pkg.Version
+	}
+	if split := splitOf(db, pkgName); len(split) > 0 {
+		return split[0].Version
+	}
+	return ""
+}
+
+// Split returns the packages built together with pkgName: every package
+// sharing its pkgbase, or sharing pkgName as pkgbase if no package is
+// called pkgName. It is empty if none are in the database.
+func (r *RepoDB) Split(pkgName string) []*repodb.Package {
+	db, err := r.Open()
+	if err != nil {
+		return nil
+	}
+	return splitOf(db, pkgName)
+}
+
+func splitOf(db *repodb.DB, pkgName string) []*repodb.Package {
+	base := pkgName
+	if pkg, ok := db.Get(pkgName); ok && pkg.Base != "" {
+		base = pkg.Base
+	}
+	var split []*repodb.Package
+	for _, pkg := range db.List() {
+		if pkg.Name == pkgName || pkg.Base == base {
+			split = append(split, pkg)
+		}
+	}
+	return split
+}
+
+// HasPackageFile reports whether a package file for pkgName at version
+// exists, and one for each split package built with it
+func (r *RepoDB) HasPackageFile(pkgName, version string) bool {
+	split := r.Split(pkgName)
+	if len(split) == 0 {
+		return hasFile(r.Dir, pkgName, version)
+	}
+	for _, pkg := range split {
+		v := pkg.Version
+		if pkg.Name == pkgName {
+			v = version
+		}
+		if !hasFile(r.Dir, pkg.Name, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasFile(dir, pkgName, version string) bool {
+	pattern := filepath.Join(dir, fmt.Sprintf("%s-%s-*.pkg.tar.*", pkgName, version))
+	matches, _ := filepath.Glob(pattern)
+	return len(matches) > 0
+}
+
+// Add adds package files (relative to Dir) to the database
+func (r *RepoDB) Add(packages []string) error {
+	if len(packages) == 0 {
+		log.Info("No new packages to add to database.")
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("Updating repository database with %d new packages...", len(packages)))
+
+	lockFile := filepath.Join(r.Dir, r.DBFile()+".lck")
+
+	// Runs hold the builder lock, so a left over lock is from a crashed run
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		log.Warn(fmt.Sprintf("Removing stale lock file: %s", lockFile))
+		os.Remove(lockFile)
+	}
+
+	args := []string{r.DBFile()}
+	args = append(args, packages...)
+
+	// repo-add reads the packages and embeds their signatures
+	include := r.dbFiles()
+	for _, pkg := range packages {
+		include = append(include, pkg, pkg+".sig")
+	}
+	cmd, err := r.command(include, "repo-add", args...)
+	if err != nil {
+		return err
+	}
+	shell.Attach(cmd)
+
+	err = r.run(cmd)
+	r.invalidate()
+	if err != nil {
+		return err
+	}
+
+	r.removeOldDBFiles()
+	r.snapshotAll()
+
+	log.Msg("")
+	log.Success("Repository database updated")
+	log.Msg("")
+
+	return nil
+}
+
+// Remove drops packages from the database, ignoring ones that aren't in it
+func (r *RepoDB) Remove(pkgNames ...string) error {
+	if len(pkgNames) == 0 {
+		return nil
+	}
+	db, err := r.Open()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, pkgName := range pkgNames {
+		if _, ok := db.Get(pkgName); !ok {
+			continue
+		}
+		cmd, err := r.command(r.dbFiles(), "repo-remove", r.DBFile(), pkgName)
+		if err == nil {
+			err = r.run(cmd)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("repo-remove %s: %w", pkgName, err))
+		}
+	}
+	r.invalidate()
+	r.removeOldDBFiles()
+	r.snapshotAll()
+	return errors.Join(errs...)
+}
+
+// dbFiles returns the database files and their links, which repo-add and
+// repo-remove rewrite
+func (r *RepoDB) dbFiles() []string {
+	return []string{r.DBFile(), r.FilesFile(), r.Name + ".db", r.Name + ".files"}
+}
+
+// command returns the command running name with args in Dir, on Remote if
+// set, which gets the files of Dir matching include first
+func (r *RepoDB) command(include []string, name string, args ...string) (*exec.Cmd, error) {
+	if r.Remote == nil {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = r.Dir
+		return cmd, nil
+	}
+	if err := r.Remote.Push(r.Dir, include...); err != nil {
+		return nil, err
+	}
+	return r.Remote.Command(r.Dir, nil, name, args...)
+}
+
+// run runs cmd from command and, on Remote, fetches the rewritten
+// databases back
+func (r *RepoDB) run(cmd *exec.Cmd) error {
+	if err := shell.Run(cmd); err != nil || r.Remote == nil {
+		return err
+	}
+	return r.Remote.Pull(r.Dir, r.dbFiles()...)
+}
+
+// removeOldDBFiles deletes the .old backups repo-add/repo-remove leave behind
+func (r *RepoDB) removeOldDBFiles() {
+	matches, _ := filepath.Glob(filepath.Join(r.Dir, "*.old"))
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// PkgNameFromFile extracts the package name from a pkgname-pkgver-pkgrel-arch.pkg.tar.* file name
+func PkgNameFromFile(fileName string) (string, bool) {
+	if !strings.HasSuffix(fileName, ".pkg.tar.zst") && !strings.HasSuffix(fileName, ".pkg.tar.xz") {
+		return "", false
+	}
+
+	base := fileName[:strings.Index(fileName, ".pkg.tar")]
+	for range 3 { // strip -ARCH, -RELEASE, -VERSION
+		i := strings.LastIndex(base, "-")
+		if i <= 0 {
+			return "", false
+		}
+		base = base[:i]
+	}
+	return base, true
+}
+
+// Cleanup removes old versions, stale artifacts of packages no longer in
+// the config and junk files from the repository directory. It returns the
+// stale packages, which the caller should Remove from the database.
+func (r *RepoDB) Cleanup(validPkgs []string) []string {
+	log.Info("Cleaning up repository database...")
+
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return nil
+	}
+
+	valid := make(map[string]bool)
+	for _, name := range validPkgs {
+		valid[name] = true
+	}
+
+	// First pass: identify latest file of each package
+	latest := make(map[string]string)
+	latestTime := make(map[string]time.Time)
+	for _, entry := range entries {
+		pkgName, ok := PkgNameFromFile(entry.Name())
+		if entry.IsDir() || !ok || !valid[pkgName] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if _, seen := latest[pkgName]; !seen || info.ModTime().After(latestTime[pkgName]) {
+			latest[pkgName] = entry.Name()
+			latestTime[pkgName] = info.ModTime()
+		}
+	}
+
+	// Second pass: remove old versions, stale artifacts and junk
+	var stale []string
+	staleSeen := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || r.isMetadataFile(name) {
+			continue
+		}
+
+		// Signatures, provenance records, torrents and patches go with
+		// their package file
+		file := name
+		for _, suffix := range sidecarSuffixes {
+			file = strings.TrimSuffix(file, suffix)
+		}
+		pkgName, ok := PkgNameFromFile(file)
+		switch {
+		case !ok:
+			log.Warn(fmt.Sprintf("     Removing junk file: %s", name))
+		case valid[pkgName] && latest[pkgName] == file:
+			continue
+		case valid[pkgName]:
+			log.Warn(fmt.Sprintf("     Removing old version: %s", name))
+		default:
+			log.Warn(fmt.Sprintf("     Removing stale artifact: %s (extracted: %s)", name, pkgName))
+			if !staleSeen[pkgName] {
+				staleSeen[pkgName] = true
+				stale = append(stale, pkgName)
+			}
+		}
+
+		if err := os.Remove(filepath.Join(r.Dir, name)); err != nil {
+			log.Error(fmt.Sprintf("Failed to remove %s: %v", name, err))
+		}
+	}
+
+	return stale
+}
+
+// sidecarSuffixes turn package file names into the names of the files
+// published next to them
+var sidecarSuffixes = []string{".sig", provenance.Suffix, torrent.Suffix, delta.Suffix}
+
+// isMetadataFile reports whether name is a database or site file that
+// lives next to the packages and must be kept by cleanup.
+func (r *RepoDB) isMetadataFile(name string) bool {
+	return strings.HasPrefix(name, r.Name+".db") ||
+		strings.HasPrefix(name, r.Name+".files") ||
+		strings.HasPrefix(name, "index.html") ||
+		strings.HasPrefix(name, ChecksumFile) ||
+		name == delta.IndexFile ||
+		name == "README.md" || name == "icon.png"
+}
+
+// CleanRoot removes everything from the build root except the repository
+// directories, the site files and dotfiles (e.g. the publishing .git).
+func CleanRoot(buildDir string, keep ...string) {
+	entries, err := os.ReadDir(buildDir)
+	if err != nil {
+		return
+	}
+
+	allowed := map[string]bool{"index.html": true, "README.md": true, "install": true, "icon.png": true}
+	for _, name := range keep {
+		allowed[name] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || allowed[name] {
+			continue
+		}
+		log.Warn(fmt.Sprintf("     Removing junk file (root): %s", name))
+		os.RemoveAll(filepath.Join(buildDir, name))
+	}
+}
+
+// Migrate renames the database files if the repo name changed
+func (r *RepoDB) Migrate() {
+	defer r.invalidate()
+	matches, _ := filepath.Glob(filepath.Join(r.Dir, "*.db"+r.tarExt()))
+	var existingDBs []string
+	for _, match := range matches {
+		if filepath.Base(match) != r.DBFile() {
+			existingDBs = append(existingDBs, match)
+		}
+	}
+
+	switch {
+	case len(existingDBs) == 1:
+		oldBase := strings.TrimSuffix(filepath.Base(existingDBs[0]), ".db"+r.tarExt())
+
+		log.Warn(fmt.Sprintf("Detected repository rename from '%s' to '%s'\n", oldBase, r.Name))
+		log.Info("Migrating database files...")
+
+		if err := os.Rename(existingDBs[0], filepath.Join(r.Dir, r.DBFile())); err != nil {
+			log.Error(fmt.Sprintf("Failed to rename database: %v", err))
+			return
+		}
+		log.Msg(fmt.Sprintf("   Renamed DB: %s.db%s -> %s", oldBase, r.tarExt(), r.DBFile()))
+		r.relink(oldBase+".db", r.Name+".db", r.DBFile())
+
+		oldFiles := filepath.Join(r.Dir, oldBase+".files"+r.tarExt())
+		if _, err := os.Stat(oldFiles); err == nil {
+			if err := os.Rename(oldFiles, filepath.Join(r.Dir, r.FilesFile())); err != nil {
+				log.Error(fmt.Sprintf("Failed to rename files database: %v", err))
+				return
+			}
+			log.Msg(fmt.Sprintf("   Renamed Files DB: %s.files%s -> %s", oldBase, r.tarExt(), r.FilesFile()))
+			r.relink(oldBase+".files", r.Name+".files", r.FilesFile())
+		}
+
+		log.Success("Migration complete")
+
+	case len(existingDBs) > 1:
+		log.Warn("   Multiple database files found. Cannot safely auto-migrate name.")
+		log.Info(fmt.Sprintf("   Found: %s", strings.Join(existingDBs, " ")))
+	}
+
+	log.Msg("")
+}
+
+// relink replaces the oldLink symlink with newLink pointing at target
+func (r *RepoDB) relink(oldLink, newLink, target string) {
+	if _, err := os.Lstat(filepath.Join(r.Dir, oldLink)); err != nil {
+		return
+	}
+	os.Remove(filepath.Join(r.Dir, oldLink))
+	if err := os.Symlink(target, filepath.Join(r.Dir, newLink)); err != nil {
+		log.Error(fmt.Sprintf("Failed to create symlink %s: %v", newLink, err))
+		return
+	}
+	log.Msg(fmt.Sprintf("   Updated symlink: %s -> %s", oldLink, newLink))
+}
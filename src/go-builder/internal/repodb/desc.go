@@ -0,0 +1,102 @@
+package repodb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Package is a single entry of a repository database, as described by its
+// desc file.
+type Package struct {
+	Name           string
+	Base           string
+	Version        string
+	Description    string
+	Filename       string
+	Arch           string
+	URL            string
+	Packager       string
+	SHA256         string
+	PGPSig         string
+	CompressedSize int64
+	InstalledSize  int64
+	BuildDate      time.Time
+	Licenses       []string
+	Groups         []string
+	Depends        []string
+	OptDepends     []string
+	MakeDepends    []string
+	CheckDepends   []string
+	Provides       []string
+	Conflicts      []string
+	Replaces       []string
+
+	// Files lists the paths shipped by the package. Only set when read from
+	// a .files database.
+	Files []string
+
+	// Fields holds every section of the desc file keyed by its name
+	// without the surrounding percent signs, e.g. "NAME".
+	Fields map[string][]string
+}
+
+// ParseDesc parses the contents of a desc file. Unknown sections are kept
+// in Fields; the format has no invalid states worth rejecting.
+func ParseDesc(data []byte) *Package {
+	fields := make(map[string][]string)
+
+	var section string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			section = ""
+		case section == "" && len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			section = strings.Trim(line, "%")
+			fields[section] = nil
+		case section != "":
+			fields[section] = append(fields[section], line)
+		}
+	}
+
+	first := func(key string) string {
+		if v := fields[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	number := func(key string) int64 {
+		n, _ := strconv.ParseInt(first(key), 10, 64)
+		return n
+	}
+
+	pkg := &Package{
+		Name:           first("NAME"),
+		Base:           first("BASE"),
+		Version:        first("VERSION"),
+		Description:    first("DESC"),
+		Filename:       first("FILENAME"),
+		Arch:           first("ARCH"),
+		URL:            first("URL"),
+		Packager:       first("PACKAGER"),
+		SHA256:         first("SHA256SUM"),
+		PGPSig:         first("PGPSIG"),
+		CompressedSize: number("CSIZE"),
+		InstalledSize:  number("ISIZE"),
+		Licenses:       fields["LICENSE"],
+		Groups:         fields["GROUPS"],
+		Depends:        fields["DEPENDS"],
+		OptDepends:     fields["OPTDEPENDS"],
+		MakeDepends:    fields["MAKEDEPENDS"],
+		CheckDepends:   fields["CHECKDEPENDS"],
+		Provides:       fields["PROVIDES"],
+		Conflicts:      fields["CONFLICTS"],
+		Replaces:       fields["REPLACES"],
+		Fields:         fields,
+	}
+	if ts := number("BUILDDATE"); ts > 0 {
+		pkg.BuildDate = time.Unix(ts, 0)
+	}
+	return pkg
+}
@@ -0,0 +1,215 @@
+// Package repodb reads pacman repository databases as produced by repo-add.
+//
+// A DB is loaded into memory once by Open; desc files are only parsed when a
+// package is first requested, and the result is memoized. A DB is immutable
+// after Open, so it is safe for concurrent use by multiple goroutines.
+package repodb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// entry is one package directory of the database with its raw desc file
+// and, for .files databases, the raw file list.
+type entry struct {
+	dir   string
+	desc  []byte
+	files []byte
+
+	once sync.Once
+	pkg  *Package
+}
+
+func (e *entry) parse() *Package {
+	e.once.Do(func() {
+		e.pkg = ParseDesc(e.desc)
+		if e.pkg.Name == "" {
+			e.pkg.Name, _ = splitDirName(e.dir)
+		}
+		if e.files != nil {
+			e.pkg.Files = ParseDesc(e.files).Fields["FILES"]
+		}
+	})
+	return e.pkg
+}
+
+// DB is an in-memory index of a repository database
+type DB struct {
+	path    string
+	entries map[string]*entry
+	names   []string
+}
+
+// Open reads the database at path and indexes its entries by package name.
+// When given a .files database, packages also carry their file lists.
+func Open(dbPath string) (*DB, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := Decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dbPath, err)
+	}
+
+	db := &DB{path: dbPath, entries: make(map[string]*entry)}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dbPath, err)
+		}
+
+		// Clean drops the ./ prefix of databases packed from a directory
+		dir, file := path.Split(path.Clean(header.Name))
+		if file != "desc" && file != "files" {
+			continue
+		}
+		dir = strings.TrimSuffix(dir, "/")
+
+		name, ok := splitDirName(dir)
+		if !ok {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dbPath, err)
+		}
+
+		e, seen := db.entries[name]
+		if !seen || e.dir != dir {
+			if !seen {
+				db.names = append(db.names, name)
+			}
+			e = &entry{dir: dir}
+			db.entries[name] = e
+		}
+		if file == "desc" {
+			e.desc = data
+		} else {
+			e.files = data
+		}
+	}
+
+	sort.Strings(db.names)
+	return db, nil
+}
+
+// Decompress returns the tar archive of a database compressed in any format
+// repo-add writes: gzip natively, zstd, xz and bzip2 through their tools,
+// which pacman depends on
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && len(magic) < 2 {
+		return nil, err
+	}
+	var tool string
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		tool = "zstd"
+	case bytes.HasPrefix(magic, xzMagic):
+		tool = "xz"
+	case bytes.HasPrefix(magic, bzip2Magic):
+		tool = "bzip2"
+	default:
+		return nil, fmt.Errorf("unsupported database compression")
+	}
+	// Databases are small enough to decompress at once
+	cmd := exec.Command(tool, "-d", "-c")
+	cmd.Stdin = br
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return bytes.NewReader(out), nil
+}
+
+// Magic numbers of the database compressions
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte("BZh")
+)
+
+// splitDirName extracts the package name from a name-pkgver-pkgrel directory.
+// Neither pkgver nor pkgrel may contain dashes, so the last two are the
+// separators regardless of dashes in the name.
+func splitDirName(dir string) (string, bool) {
+	name := dir
+	for range 2 {
+		i := strings.LastIndex(name, "-")
+		if i <= 0 {
+			return "", false
+		}
+		name = name[:i]
+	}
+	return name, true
+}
+
+// Path returns the file the database was read from
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Len returns the number of packages in the database
+func (db *DB) Len() int {
+	return len(db.names)
+}
+
+// Names returns the sorted names of all packages in the database
+func (db *DB) Names() []string {
+	return append([]string(nil), db.names...)
+}
+
+// Get returns the package with the given name
+func (db *DB) Get(name string) (*Package, bool) {
+	e, ok := db.entries[name]
+	if !ok {
+		return nil, false
+	}
+	return e.parse(), true
+}
+
+// List returns all packages sorted by name
+func (db *DB) List() []*Package {
+	pkgs := make([]*Package, 0, len(db.names))
+	for _, name := range db.names {
+		pkgs = append(pkgs, db.entries[name].parse())
+	}
+	return pkgs
+}
+
+// Checksums returns the recorded SHA-256 of every package file, keyed by
+// file name.
+func (db *DB) Checksums() map[string]string {
+	sums := make(map[string]string, len(db.names))
+	for _, pkg := range db.List() {
+		if pkg.Filename != "" && pkg.SHA256 != "" {
+			sums[pkg.Filename] = pkg.SHA256
+		}
+	}
+	return sums
+}
@@ -0,0 +1,60 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ChangelogFile is the history of the repository, relative to the build
+// directory
+const ChangelogFile = "CHANGELOG.md"
+
+// changelogHeader starts the changelog, followed by the entries, newest
+// first
+const changelogHeader = "# Changelog\n\n"
+
+// Changelog renders the delta as a changelog entry of a run at t
+func (d Delta) Changelog(t time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s\n\n", t.UTC().Format("2006-01-02 15:04 UTC"))
+	var added, upgraded []VersionChange
+	for _, v := range d.Versions {
+		if v.From == "" {
+			added = append(added, v)
+		} else {
+			upgraded = append(upgraded, v)
+		}
+	}
+	for _, v := range added {
+		fmt.Fprintf(&b, "- Added %s %s\n", v.Name, v.To)
+	}
+	for _, v := range upgraded {
+		fmt.Fprintf(&b, "- Updated %s %s → %s\n", v.Name, v.From, v.To)
+	}
+	for _, name := range d.Removed {
+		fmt.Fprintf(&b, "- Removed %s\n", name)
+	}
+	for _, name := range d.NewlyFailing {
+		fmt.Fprintf(&b, "- Failed to build %s\n", name)
+	}
+	for _, name := range d.StillFailing {
+		fmt.Fprintf(&b, "- Still failing to build %s\n", name)
+	}
+	for _, name := range d.Fixed {
+		fmt.Fprintf(&b, "- Fixed %s\n", name)
+	}
+	return b.String()
+}
+
+// AddToChangelog adds entry to the top of the changelog at path, creating
+// it if needed
+func AddToChangelog(path, entry string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries := strings.TrimPrefix(string(data), changelogHeader)
+	return os.WriteFile(path, []byte(changelogHeader+entry+"\n"+entries), 0644)
+}
@@ -0,0 +1,271 @@
+// Package report records the outcome of a run per package and compares it
+// with the previous run.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileName is the report of the last run, relative to the build directory
+const FileName = "last-run.json"
+
+// Package outcomes
+const (
+	StatusBuilt       = "built"
+	StatusUpToDate    = "up-to-date"
+	StatusKept        = "kept"
+	StatusFailed      = "failed"
+	StatusQuarantined = "quarantined"
+	// StatusRemoved is an AUR package the AUR no longer has, kept at its
+	// repo version
+	StatusRemoved = "removed-from-aur"
+	// StatusOfficial is an AUR package dropped from the repository as it
+	// moved to the official repositories
+	StatusOfficial = "official"
+)
+
+// Result is the outcome for one package
+type Result struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+	// Lints are the namcap findings of the last build
+	Lints []string `json:"lints,omitempty"`
+	// Comments are pinned on the AUR page of the package, as of its last
+	// update
+	Comments []Comment `json:"comments,omitempty"`
+}
+
+// Comment is a comment pinned on the AUR page of a package
+type Comment struct {
+	Author string `json:"author"`
+	Date   string `json:"date"`
+	Text   string `json:"text"`
+	URL    string `json:"url"`
+}
+
+// Report maps package names to their outcome
+type Report struct {
+	Time     time.Time          `json:"time"`
+	Packages map[string]*Result `json:"packages"`
+}
+
+// Load reads a report. A missing file is an empty report.
+func Load(path string) (*Report, error) {
+	r := &Report{Packages: make(map[string]*Result)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return &Report{Packages: make(map[string]*Result)}, err
+	}
+	if r.Packages == nil {
+		r.Packages = make(map[string]*Result)
+	}
+	return r, nil
+}
+
+// Next starts a report for a new run, carrying over the results of packages
+// the run doesn't check
+func (r *Report) Next() *Report {
+	next := &Report{Time: time.Now().UTC(), Packages: make(map[string]*Result, len(r.Packages))}
+	for name, res := range r.Packages {
+		copied := *res
+		next.Packages[name] = &copied
+	}
+	return next
+}
+
+// Set records the outcome of a package
+func (r *Report) Set(name, status string) {
+	if res, ok := r.Packages[name]; ok {
+		res.Status = status
+		return
+	}
+	r.Packages[name] = &Result{Status: status}
+}
+
+// SetLints records the namcap findings of a package's build
+func (r *Report) SetLints(name string, lints []string) {
+	if res, ok := r.Packages[name]; ok {
+		res.Lints = lints
+	}
+}
+
+// SetComments records the comments pinned on the AUR page of a package
+func (r *Report) SetComments(name string, comments []Comment) {
+	if res, ok := r.Packages[name]; ok {
+		res.Comments = comments
+	}
+}
+
+// Prune drops packages that are no longer configured
+func (r *Report) Prune(valid []string) {
+	keep := make(map[string]bool)
+	for _, name := range valid {
+		keep[name] = true
+	}
+	for name := range r.Packages {
+		if !keep[name] {
+			delete(r.Packages, name)
+		}
+	}
+}
+
+// Save writes the report to path
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// VersionChange is a package whose published version changed
+type VersionChange struct {
+	Name, From, To string
+}
+
+// Delta is what changed between two runs
+type Delta struct {
+	NewlyFailing []string
+	// StillFailing failed in both runs
+	StillFailing []string
+	Fixed        []string
+	// Versions are the changed versions, from "" for added packages
+	Versions []VersionChange
+	// Removed were published before and are no longer configured
+	Removed []string
+}
+
+// Compare returns what changed from prev to cur
+func Compare(prev, cur *Report) Delta {
+	var d Delta
+	for name, res := range cur.Packages {
+		old := prev.Packages[name]
+		failed := res.Status == StatusFailed
+		wasFailed := old != nil && old.Status == StatusFailed
+		switch {
+		case failed && !wasFailed:
+			d.NewlyFailing = append(d.NewlyFailing, name)
+		case failed:
+			d.StillFailing = append(d.StillFailing, name)
+		case !failed && wasFailed && res.Status != StatusQuarantined:
+			d.Fixed = append(d.Fixed, name)
+		}
+		if old != nil && old.Version != res.Version && res.Version != "" {
+			d.Versions = append(d.Versions, VersionChange{Name: name, From: old.Version, To: res.Version})
+		}
+	}
+	for name, old := range prev.Packages {
+		if cur.Packages[name] == nil && old.Version != "" {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.NewlyFailing)
+	sort.Strings(d.StillFailing)
+	sort.Strings(d.Fixed)
+	sort.Strings(d.Removed)
+	sort.Slice(d.Versions, func(i, j int) bool { return d.Versions[i].Name < d.Versions[j].Name })
+	return d
+}
+
+// Empty reports whether nothing changed. Packages that keep failing are
+// no change.
+func (d Delta) Empty() bool {
+	return len(d.NewlyFailing) == 0 && len(d.Fixed) == 0 && len(d.Versions) == 0 && len(d.Removed) == 0
+}
+
+// Markdown renders the delta for notifications and CI summaries
+func (d Delta) Markdown() string {
+	var b strings.Builder
+	b.WriteString("### Changes since last run\n\n")
+	if d.Empty() {
+		b.WriteString("Nothing changed.\n")
+		return b.String()
+	}
+	if len(d.NewlyFailing) > 0 {
+		fmt.Fprintf(&b, "**Newly failing:** %s\n\n", strings.Join(d.NewlyFailing, ", "))
+	}
+	if len(d.Fixed) > 0 {
+		fmt.Fprintf(&b, "**Fixed:** %s\n\n", strings.Join(d.Fixed, ", "))
+	}
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(&b, "**Removed:** %s\n\n", strings.Join(d.Removed, ", "))
+	}
+	if len(d.Versions) > 0 {
+		b.WriteString("| Package | From | To |\n| --- | --- | --- |\n")
+		for _, v := range d.Versions {
+			from := v.From
+			if from == "" {
+				from = "—"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", v.Name, from, v.To)
+		}
+	}
+	return b.String()
+}
+
+// Summary renders the outcome of the packages a run checked, names, as a
+// markdown table for CI job summaries. Up-to-date packages are only counted.
+// The pinned AUR comments of added and updated packages follow the table.
+func Summary(title string, prev, cur *Report, names []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s\n\n", title)
+	upToDate := 0
+	var rows, pinned []string
+	for _, name := range names {
+		res := cur.Packages[name]
+		if res == nil {
+			continue
+		}
+		from := ""
+		if old := prev.Packages[name]; old != nil {
+			from = old.Version
+		}
+		outcome, version := res.Status, res.Version
+		switch {
+		case res.Status == StatusUpToDate:
+			upToDate++
+			continue
+		case res.Status == StatusBuilt && from == "":
+			outcome = "added"
+		case res.Status == StatusBuilt && from != res.Version:
+			outcome = "updated"
+			version = from + " → " + res.Version
+		case res.Status == StatusBuilt:
+			outcome = "rebuilt"
+		}
+		if (outcome == "added" || outcome == "updated") && len(res.Comments) > 0 {
+			pinned = append(pinned, name)
+		}
+		rows = append(rows, fmt.Sprintf("| %s | %s | %s |\n", name, outcome, version))
+	}
+	if len(rows) > 0 {
+		b.WriteString("| Package | Result | Version |\n| --- | --- | --- |\n")
+		for _, row := range rows {
+			b.WriteString(row)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d of %d checked packages up to date.\n", upToDate, len(names))
+	if len(pinned) > 0 {
+		b.WriteString("\n#### Pinned AUR comments\n")
+		for _, name := range pinned {
+			for _, c := range cur.Packages[name].Comments {
+				fmt.Fprintf(&b, "\n**%s**, [%s on %s](%s):\n\n", name, c.Author, c.Date, c.URL)
+				for line := range strings.SplitSeq(c.Text, "\n") {
+					b.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+				}
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// StatusFile tells monitoring how the last run went, relative to the build
+// directory
+const StatusFile = "status.json"
+
+// Run states
+const (
+	RunOK = "ok"
+	// RunDegraded means upstream was unreachable, not that builds broke
+	RunDegraded = "degraded"
+	RunFailed   = "failed"
+)
+
+// RunStatus is the overall outcome of a run
+type RunStatus struct {
+	State   string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+	Built   int       `json:"built"`
+	Skipped int       `json:"skipped"`
+	Failed  int       `json:"failed"`
+}
+
+// Save writes the status to path
+func (s *RunStatus) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
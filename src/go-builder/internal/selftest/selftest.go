@@ -0,0 +1,218 @@
+// Package selftest checks a published repository the way pacman clients use
+// it, including pacman 7's sandboxed downloader: downloads run as the
+// unprivileged alpm user and only plain http(s) redirects are followed.
+package selftest
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/repodb"
+)
+
+// maxRedirects matches the redirect limit of pacman's curl downloader
+const maxRedirects = 10
+
+// Result is the outcome of a single check
+type Result struct {
+	Check string
+	Err   error
+}
+
+// Report collects check results
+type Report struct {
+	Results []Result
+}
+
+func (r *Report) add(check string, err error) {
+	r.Results = append(r.Results, Result{Check: check, Err: err})
+}
+
+// Failed returns the number of failed checks
+func (r *Report) Failed() int {
+	n := 0
+	for _, res := range r.Results {
+		if res.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Local checks the repository directory dir holding dbFile: everything must
+// be readable by other users and symlinks must stay inside dir.
+func Local(dir, dbFile string) *Report {
+	report := &Report{}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		report.add("repository directory", err)
+		return report
+	}
+
+	var unreadable, escaping []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil || (target != root && !strings.HasPrefix(target, root+string(filepath.Separator))) {
+				escaping = append(escaping, rel)
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		need := fs.FileMode(0004)
+		if d.IsDir() {
+			need |= 0001
+		}
+		if info.Mode().Perm()&need != need {
+			unreadable = append(unreadable, fmt.Sprintf("%s (%o)", rel, info.Mode().Perm()))
+		}
+		return nil
+	})
+	report.add("repository directory is readable", err)
+	report.add("files readable by the alpm download user", listError("not world-readable", unreadable))
+	report.add("symlinks stay inside the repository", listError("pointing outside", escaping))
+
+	_, err = repodb.Open(filepath.Join(root, dbFile))
+	report.add(fmt.Sprintf("database %s parses", dbFile), err)
+	return report
+}
+
+// Remote downloads the database of repo from baseURL, the pacman Server
+// with $arch expanded, and checks that every package and, when signed, its
+// signature can be fetched.
+func Remote(client *http.Client, baseURL, repo string, signed bool) *Report {
+	report := &Report{}
+	c := sandboxClient(client)
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	dbURL := fmt.Sprintf("%s/%s.db", baseURL, repo)
+	db, err := download(c, dbURL)
+	report.add("download "+dbURL, err)
+	if err != nil {
+		return report
+	}
+	defer os.Remove(db)
+
+	pkgs, err := repodb.Open(db)
+	report.add("parse downloaded database", err)
+	if err != nil {
+		return report
+	}
+
+	for _, pkg := range pkgs.List() {
+		pkgURL := fmt.Sprintf("%s/%s", baseURL, pkg.Filename)
+		report.add("fetch "+pkg.Filename, head(c, pkgURL, pkg.CompressedSize))
+		if signed {
+			report.add("fetch "+pkg.Filename+".sig", head(c, pkgURL+".sig", 0))
+		}
+	}
+	return report
+}
+
+// Client checks what adding repo on a client needs of baseURL, the pacman
+// Server with $arch expanded: the database answers a HEAD request, downloads
+// and parses.
+func Client(client *http.Client, baseURL, repo string) *Report {
+	report := &Report{}
+	c := sandboxClient(client)
+	dbURL := fmt.Sprintf("%s/%s.db", strings.TrimSuffix(baseURL, "/"), repo)
+
+	err := head(c, dbURL, 0)
+	report.add("HEAD "+dbURL, err)
+	if err != nil {
+		return report
+	}
+	db, err := download(c, dbURL)
+	report.add("download "+dbURL, err)
+	if err != nil {
+		return report
+	}
+	defer os.Remove(db)
+
+	pkgs, err := repodb.Open(db)
+	if err != nil {
+		report.add("parse downloaded database", err)
+	} else {
+		report.add(fmt.Sprintf("parse downloaded database, %d packages", pkgs.Len()), nil)
+	}
+	return report
+}
+
+// sandboxClient copies client with pacman's redirect rules
+func sandboxClient(client *http.Client) *http.Client {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("more than %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		if via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return fmt.Errorf("redirect downgrades to plain http: %s", req.URL)
+		}
+		return nil
+	}
+	return &c
+}
+
+// download saves url to a temporary file and returns its path
+func download(c *http.Client, url string) (string, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "selftest-*.db")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// head checks that url exists and, if size is known, has that size
+func head(c *http.Client, url string, size int64) error {
+	resp, err := c.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if size > 0 && resp.ContentLength >= 0 && resp.ContentLength != size {
+		return fmt.Errorf("size %d, database says %d", resp.ContentLength, size)
+	}
+	return nil
+}
+
+func listError(what string, items []string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d %s: %s", len(items), what, strings.Join(items, ", "))
+}
@@ -0,0 +1,131 @@
+package selftest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/buildsys"
+	"builder/internal/repodb"
+)
+
+// Magic numbers of the package compressions pacman accepts from us
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// Packages verifies every package file in dir: the archive must decompress
+// completely, carry a parsable .PKGINFO matching its file name, and match
+// its entry in dbFile by size and SHA-256.
+func Packages(dir, dbFile string) *Report {
+	report := &Report{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		report.add("read repository directory", err)
+		return report
+	}
+
+	db, err := repodb.Open(filepath.Join(dir, dbFile))
+	report.add(fmt.Sprintf("database %s parses", dbFile), err)
+
+	listed := make(map[string]*repodb.Package)
+	if db != nil {
+		for _, pkg := range db.List() {
+			listed[pkg.Filename] = pkg
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.Contains(name, ".pkg.tar.") || strings.HasSuffix(name, ".sig") {
+			continue
+		}
+		err := VerifyArchive(filepath.Join(dir, name))
+		if err == nil && db != nil && listed[name] == nil {
+			err = fmt.Errorf("not listed in the database")
+		}
+		report.add("package "+name, err)
+	}
+	if db == nil {
+		return report
+	}
+
+	for _, pkg := range db.List() {
+		report.add(fmt.Sprintf("database entry %s matches %s", pkg.Name, pkg.Filename), verifyEntry(dir, pkg))
+	}
+	return report
+}
+
+// VerifyArchive checks the compression, archive and .PKGINFO of a package
+func VerifyArchive(path string) error {
+	name := filepath.Base(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, len(xzMagic))
+	_, err = io.ReadFull(f, head)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("truncated file: %v", err)
+	}
+	switch {
+	case strings.HasSuffix(name, ".zst") && bytes.HasPrefix(head, zstdMagic):
+	case strings.HasSuffix(name, ".xz") && bytes.HasPrefix(head, xzMagic):
+	default:
+		return fmt.Errorf("not a valid zstd or xz archive")
+	}
+
+	// Listing decompresses the whole archive
+	if _, err := buildsys.ListFiles(path); err != nil {
+		return fmt.Errorf("corrupt archive: %v", err)
+	}
+
+	info, err := buildsys.ReadPkginfo(path)
+	if err != nil {
+		return fmt.Errorf(".PKGINFO missing")
+	}
+	first := func(key string) string {
+		if v := info[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	pkgname, pkgver, arch := first("pkgname"), first("pkgver"), first("arch")
+	if pkgname == "" || pkgver == "" || arch == "" {
+		return fmt.Errorf(".PKGINFO lacks pkgname, pkgver or arch")
+	}
+	if want := fmt.Sprintf("%s-%s-%s.pkg.tar.", pkgname, pkgver, arch); !strings.HasPrefix(name, want) {
+		return fmt.Errorf("file name does not match .PKGINFO (%s-%s-%s)", pkgname, pkgver, arch)
+	}
+	return nil
+}
+
+// verifyEntry compares a database entry with the file it describes
+func verifyEntry(dir string, pkg *repodb.Package) error {
+	f, err := os.Open(filepath.Join(dir, pkg.Filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if pkg.CompressedSize != 0 && size != pkg.CompressedSize {
+		return fmt.Errorf("size %d, database says %d", size, pkg.CompressedSize)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); pkg.SHA256 != "" && sum != pkg.SHA256 {
+		return fmt.Errorf("sha256 %s, database says %s", sum, pkg.SHA256)
+	}
+	return nil
+}
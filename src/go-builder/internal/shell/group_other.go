@@ -0,0 +1,14 @@
+//go:build !unix
+
+package shell
+
+import "os/exec"
+
+// SetGroup does nothing without process groups
+func SetGroup(cmd *exec.Cmd) {}
+
+// KillGroup kills the started cmd. Without process groups, the processes
+// it started keep running.
+func KillGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,142 @@
+// Package shell runs external commands and records them in the transcript.
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"builder/internal/log"
+)
+
+// maxHeld is how much of the output of a command Attach holds back; a
+// failing command's last lines are the ones that explain it
+const maxHeld = 1 << 20
+
+// heldOutput is the output of a command held back until it is known
+// whether it failed
+type heldOutput struct {
+	bytes.Buffer
+}
+
+func (h *heldOutput) Write(p []byte) (int, error) {
+	if h.Len()+len(p) > 2*maxHeld {
+		h.Next(h.Len() + len(p) - maxHeld)
+	}
+	return h.Buffer.Write(p)
+}
+
+// Attach connects the output of cmd to the terminal at the verbose level.
+// At the other levels, it is held back and only printed if cmd fails.
+func Attach(cmd *exec.Cmd) {
+	if log.Verbose() {
+		cmd.Stdout, cmd.Stderr = log.Stdout, log.Stderr
+		return
+	}
+	held := &heldOutput{}
+	cmd.Stdout, cmd.Stderr = held, held
+}
+
+// Held returns a writer for output that is shown like that of an attached
+// command, and the function to call with the outcome, which prints the
+// held back output if it failed
+func Held() (io.Writer, func(error)) {
+	if log.Verbose() {
+		return log.Stdout, func(error) {}
+	}
+	held := &heldOutput{}
+	return held, func(err error) {
+		if err != nil {
+			log.Stderr.Write(held.Bytes())
+		}
+	}
+}
+
+// release prints the held back output of cmd if it failed
+func release(cmd *exec.Cmd, err error) {
+	if held, ok := cmd.Stdout.(*heldOutput); ok && err != nil {
+		log.Stderr.Write(held.Bytes())
+	}
+}
+
+// Run runs cmd and records it in the transcript
+func Run(cmd *exec.Cmd) error {
+	start := time.Now()
+	err := cmd.Run()
+	log.RecordCommand(cmd, err, time.Since(start))
+	release(cmd, err)
+	return err
+}
+
+// Output runs cmd, returning its stdout, and records it in the transcript
+func Output(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	output, err := cmd.Output()
+	log.RecordCommand(cmd, err, time.Since(start))
+	return output, err
+}
+
+// CombinedOutput runs cmd, returning stdout and stderr, and records it in the transcript
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	log.RecordCommand(cmd, err, time.Since(start))
+	return output, err
+}
+
+// ErrKilled is returned by Group.Run for commands ended by Group.Kill
+var ErrKilled = errors.New("killed")
+
+// Group runs one command at a time in its own process group, so that it
+// can be killed along with everything it spawned. The zero value is ready
+// to use.
+type Group struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	killed bool
+}
+
+// Run runs cmd like Run. After Kill it fails with ErrKilled, without
+// starting cmd.
+func (g *Group) Run(cmd *exec.Cmd) error {
+	g.mu.Lock()
+	if g.killed {
+		g.mu.Unlock()
+		return ErrKilled
+	}
+	SetGroup(cmd)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		g.mu.Unlock()
+		log.RecordCommand(cmd, err, time.Since(start))
+		return err
+	}
+	g.cmd = cmd
+	g.mu.Unlock()
+
+	err := cmd.Wait()
+	log.RecordCommand(cmd, err, time.Since(start))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cmd = nil
+	if g.killed {
+		return ErrKilled
+	}
+	release(cmd, err)
+	return err
+}
+
+// Kill sends SIGTERM to the process group of the running command and
+// makes later runs fail
+func (g *Group) Kill() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.killed = true
+	if g.cmd != nil && g.cmd.Process != nil {
+		KillGroup(g.cmd)
+	}
+}
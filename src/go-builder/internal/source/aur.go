@@ -0,0 +1,84 @@
+package source
+
+import (
+	"errors"
+	"strings"
+
+	"builder/internal/aur"
+	"builder/internal/buildsys"
+)
+
+// ErrRemoved is returned by AUR providers of packages the AUR doesn't have,
+// e.g. deleted or merged into another
+var ErrRemoved = errors.New("package removed from the AUR")
+
+// AUR provides a PKGBUILD from its AUR git repository
+type AUR struct {
+	Name   string
+	Client *aur.Client
+	Dir    string
+	// Offline uses the existing clone and reads the version from it
+	Offline bool
+	// Refresh clones the repository again instead of updating the clone
+	Refresh bool
+	// Review reads versions from the .SRCINFO of the clone, since the
+	// PKGBUILD must not run before it was reviewed
+	Review bool
+
+	version string
+	fetched bool
+}
+
+// Fetch clones or updates the AUR repository
+func (p *AUR) Fetch() error {
+	if p.fetched {
+		return nil
+	}
+	if p.Offline {
+		return cached(p.Dir)
+	}
+	if err := syncGit(p.Dir, p.Client.GitURL(p.Name), "", "from AUR", p.Refresh); errors.Is(err, ErrEmpty) {
+		return ErrRemoved
+	} else if err != nil {
+		return err
+	}
+	p.fetched = true
+	return checkPKGBUILD(p.Dir)
+}
+
+// Version returns the version reported by the AUR RPC. For -git packages it
+// is read from the PKGBUILD instead, as the RPC lags behind the real pkgver.
+// Offline, it is the version of the existing clone. With Review, both are
+// read from the .SRCINFO.
+func (p *AUR) Version() (string, error) {
+	if p.Offline && p.Review {
+		if err := checkPKGBUILD(p.Dir); err != nil {
+			return "", nil
+		}
+		return buildsys.SrcinfoFileVersion(p.Dir), nil
+	}
+	if p.Offline {
+		return cachedVersion(p.Dir)
+	}
+	if !strings.HasSuffix(p.Name, "-git") {
+		return p.version, nil
+	}
+	if err := p.Fetch(); err != nil {
+		return p.version, nil
+	}
+	var v string
+	if p.Review {
+		v = buildsys.SrcinfoFileVersion(p.Dir)
+	} else {
+		v, _ = pkgbuildVersion(p.Dir)
+	}
+	if v != "" {
+		return v, nil
+	}
+	return p.version, nil
+}
+
+// Path returns the clone directory
+func (p *AUR) Path() string {
+	return p.Dir
+}
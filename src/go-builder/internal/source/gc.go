@@ -0,0 +1,57 @@
+package source
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// GC compacts the git clones in cacheDir and drops the objects they no
+// longer reach, such as the history of earlier full clones. It returns how
+// many clones it compacted and the bytes freed.
+func GC(cacheDir string) (int, int64, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	count, freed := 0, int64(0)
+	for _, entry := range entries {
+		dir := filepath.Join(cacheDir, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			continue
+		}
+		before := objectSize(dir)
+		cmd := exec.Command("git", "-C", dir, "gc", "--quiet", "--prune=now")
+		if out, err := shell.CombinedOutput(cmd); err != nil {
+			return count, freed, fmt.Errorf("git gc in %s failed: %s", dir, strings.TrimSpace(string(out)))
+		}
+		count++
+		freed += max(before-objectSize(dir), 0)
+	}
+	return count, freed, nil
+}
+
+// objectSize returns the bytes the objects of the clone in dir take, loose
+// and packed
+func objectSize(dir string) int64 {
+	out, err := shell.Output(exec.Command("git", "-C", dir, "count-objects", "-v"))
+	if err != nil {
+		return 0
+	}
+	var kib int64
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key == "size" || key == "size-pack" || key == "size-garbage" {
+			n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			kib += n
+		}
+	}
+	return kib * 1024
+}
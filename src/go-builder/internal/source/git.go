@@ -0,0 +1,141 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/shell"
+)
+
+// Git provides a PKGBUILD from an arbitrary git repository
+type Git struct {
+	Name   string
+	URL    string
+	Ref    string
+	Dir    string
+	Subdir string
+	// Offline uses the existing clone
+	Offline bool
+	// Refresh clones the repository again instead of updating the clone
+	Refresh bool
+
+	fetched bool
+}
+
+// Fetch clones or updates the repository and checks out Ref
+func (p *Git) Fetch() error {
+	if p.fetched {
+		return nil
+	}
+	if p.Offline {
+		return cached(p.Path())
+	}
+	if err := syncGit(p.Dir, p.URL, p.Ref, "from "+p.URL, p.Refresh); err != nil {
+		return err
+	}
+	p.fetched = true
+	return checkPKGBUILD(p.Path())
+}
+
+// Version returns the version declared by the fetched PKGBUILD
+func (p *Git) Version() (string, error) {
+	if p.Offline {
+		return cachedVersion(p.Path())
+	}
+	if err := p.Fetch(); err != nil {
+		return "", err
+	}
+	return pkgbuildVersion(p.Path())
+}
+
+// Path returns the PKGBUILD directory inside the clone
+func (p *Git) Path() string {
+	return filepath.Join(p.Dir, p.Subdir)
+}
+
+// ErrEmpty is returned for remote repositories without commits, which is
+// what the AUR serves for deleted packages
+var ErrEmpty = errors.New("the repository is empty")
+
+// syncGit makes dir a clone of url at ref (the remote HEAD when empty). An
+// existing clone of a different remote is replaced, as is any with refresh.
+// A clone that fails to update, e.g. corrupted or after a force-push, is
+// cloned again while the remote is reachable. Clones are shallow and fetch
+// file contents on demand, since only the checked out commit is built;
+// older ones are fetched when needed.
+func syncGit(dir, url, ref, from string, refresh bool) error {
+	if _, err := os.Stat(dir); err == nil {
+		cmd := exec.Command("git", "-C", dir, "remote", "get-url", "origin")
+		out, err := shell.Output(cmd)
+		discard := ""
+		switch {
+		case err != nil || strings.TrimSpace(string(out)) != url:
+			discard = "Source changed, discarding cache"
+		case refresh:
+			discard = "Refreshing cache"
+		}
+		if discard != "" {
+			logFetch(discard)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		logFetch("Cloning " + from)
+		cmd := exec.Command("git", "clone", "--quiet", "--depth", "1", "--filter=blob:none", url, dir)
+		if output, err := shell.CombinedOutput(cmd); err != nil {
+			return fmt.Errorf("git clone failed: %s", string(output))
+		}
+		if shell.Run(exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", "HEAD")) != nil {
+			os.RemoveAll(dir)
+			return ErrEmpty
+		}
+		if ref == "" {
+			return nil
+		}
+		return update(dir, ref)
+	}
+
+	logFetch("Updating cache")
+	err := update(dir, ref)
+	if err == nil {
+		return nil
+	}
+	// Only a reachable remote is worth cloning again
+	out, lsErr := shell.Output(exec.Command("git", "ls-remote", url, "HEAD"))
+	switch {
+	case lsErr != nil:
+		return err
+	case strings.TrimSpace(string(out)) == "":
+		return ErrEmpty
+	}
+	logFetch(fmt.Sprintf("Cache broken (%v), cloning again", err))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return syncGit(dir, url, ref, from, false)
+}
+
+// update fetches ref (the remote HEAD when empty) into the clone in dir and
+// checks it out
+func update(dir, ref string) error {
+	target := ref
+	if target == "" {
+		target = "HEAD"
+	}
+	cmd := exec.Command("git", "-C", dir, "fetch", "--quiet", "--depth", "1", "origin", target)
+	if output, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git fetch failed: %s", strings.TrimSpace(string(output)))
+	}
+	cmd = exec.Command("git", "-C", dir, "checkout", "--quiet", "--force", "FETCH_HEAD")
+	if output, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git checkout failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package source
+
+// Local provides a PKGBUILD kept in a directory of the project itself
+type Local struct {
+	Dir string
+}
+
+// Fetch only checks that the PKGBUILD exists
+func (p *Local) Fetch() error {
+	return checkPKGBUILD(p.Dir)
+}
+
+// Version returns the version declared by the PKGBUILD
+func (p *Local) Version() (string, error) {
+	return pkgbuildVersion(p.Dir)
+}
+
+// Path returns the configured directory
+func (p *Local) Path() string {
+	return p.Dir
+}
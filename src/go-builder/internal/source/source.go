@@ -0,0 +1,230 @@
+// Package source fetches PKGBUILDs from wherever a package is configured to
+// come from: the AUR, a plain git repository, a local directory or a tarball.
+package source
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/aur"
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/shell"
+)
+
+// Provider makes the PKGBUILD of one package available for building
+type Provider interface {
+	// Fetch downloads or updates the PKGBUILD so that Path can be built
+	Fetch() error
+	// Version returns the upstream version, or "" if it is unknown
+	Version() (string, error)
+	// Path returns the directory containing the PKGBUILD
+	Path() string
+}
+
+// Set creates providers for the configured packages. AUR versions are
+// fetched for all AUR packages at once by Prefetch.
+type Set struct {
+	AUR      *aur.Client
+	CacheDir string
+	// Offline uses the sources earlier runs fetched, without network access
+	Offline bool
+	// Refresh clones git sources again, once per package and process
+	Refresh bool
+	// Review keeps AUR PKGBUILDs from running before their review, see
+	// AUR.Review
+	Review bool
+
+	aurInfo   map[string]*aur.Package
+	refreshed map[string]bool
+}
+
+// NewSet returns a provider set caching fetched sources under cacheDir
+func NewSet(client *aur.Client, cacheDir string) *Set {
+	return &Set{AUR: client, CacheDir: cacheDir, aurInfo: make(map[string]*aur.Package), refreshed: make(map[string]bool)}
+}
+
+// Prefetch fetches the metadata of all AUR packages in batched RPC
+// requests. Packages that could be fetched are kept even if it fails.
+func (s *Set) Prefetch(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	infos, err := s.AUR.Info(names)
+	for name, info := range infos {
+		s.aurInfo[name] = info
+	}
+	return err
+}
+
+// AURInfoCount returns the number of packages with prefetched metadata
+func (s *Set) AURInfoCount() int {
+	return len(s.aurInfo)
+}
+
+// AURInfo returns the prefetched AUR metadata of a package, or nil
+func (s *Set) AURInfo(name string) *aur.Package {
+	return s.aurInfo[name]
+}
+
+// For returns the provider of pkg
+func (s *Set) For(pkg config.Package) Provider {
+	dir := filepath.Join(s.CacheDir, pkg.Name)
+	src := pkg.Source
+	refresh := s.Refresh && !s.refreshed[pkg.Name]
+	s.refreshed[pkg.Name] = true
+	switch src.Kind() {
+	case config.SourceGit:
+		return &Git{Name: pkg.Name, URL: src.URL, Ref: src.Ref, Dir: dir, Subdir: src.Path, Offline: s.Offline, Refresh: refresh}
+	case config.SourceLocal:
+		return &Local{Dir: src.Path}
+	case config.SourceTarball:
+		return &Tarball{Name: pkg.Name, URL: src.URL, Dir: dir, Subdir: src.Path, HTTP: s.AUR.HTTP, Offline: s.Offline}
+	default:
+		p := &AUR{Name: pkg.Name, Client: s.AUR, Dir: dir, Offline: s.Offline, Refresh: refresh, Review: s.Review}
+		if info := s.aurInfo[pkg.Name]; info != nil {
+			p.version = info.Version
+		}
+		return p
+	}
+}
+
+// pkgbuildVersion returns the version declared by the PKGBUILD in dir
+func pkgbuildVersion(dir string) (string, error) {
+	if err := checkPKGBUILD(dir); err != nil {
+		return "", err
+	}
+	return buildsys.PKGBUILDVersion(dir), nil
+}
+
+// checkPKGBUILD fails if dir has no PKGBUILD
+func checkPKGBUILD(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "PKGBUILD")); os.IsNotExist(err) {
+		return fmt.Errorf("no PKGBUILD found in %s", dir)
+	}
+	return nil
+}
+
+// cached checks that an earlier run left a PKGBUILD in dir, for offline
+// providers
+func cached(dir string) error {
+	if err := checkPKGBUILD(dir); err != nil {
+		return fmt.Errorf("not fetched before, unavailable offline")
+	}
+	logFetch("Using the cached copy (offline)")
+	return nil
+}
+
+// cachedVersion returns the version of the cached PKGBUILD in dir, or "" if
+// there is none
+func cachedVersion(dir string) (string, error) {
+	if checkPKGBUILD(dir) != nil {
+		return "", nil
+	}
+	return pkgbuildVersion(dir)
+}
+
+// logFetch prints what a provider is about to do
+func logFetch(msg string) {
+	log.Msg("  " + msg)
+}
+
+// emptyTree is the hash of git's empty tree, diffing against it shows
+// every file as added
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// Commit returns the checked out commit of a git based provider, or ""
+func Commit(p Provider) string {
+	if !isGit(p) {
+		return ""
+	}
+	out, err := shell.Output(exec.Command("git", "-C", p.Path(), "rev-parse", "HEAD"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Diff returns the changes to the PKGBUILD and install scripts of a git
+// based provider since commit, fetching commit if the clone doesn't have
+// it. If commit is empty or can't be fetched, their full content is
+// returned as added, and full is set.
+func Diff(p Provider, commit string) (diff string, full bool, err error) {
+	if !isGit(p) {
+		return "", false, fmt.Errorf("not a git source")
+	}
+	dir := p.Path()
+	base := emptyTree
+	if commit != "" {
+		if err := fetchCommit(p, commit); err != nil {
+			log.Warn(fmt.Sprintf("Can't fetch %s to diff against: %v", commit, err))
+		} else {
+			base = commit
+		}
+	}
+	cmd := exec.Command("git", "-C", dir, "diff", "--no-color", base, "HEAD", "--", "PKGBUILD", "*.install")
+	out, err := shell.Output(cmd)
+	if err != nil {
+		return "", false, fmt.Errorf("git diff failed: %w", err)
+	}
+	return string(out), base == emptyTree, nil
+}
+
+// fetchCommit makes sure the clone of a git based provider has commit.
+// Shallow clones only have the commits fetched so far.
+func fetchCommit(p Provider, commit string) error {
+	dir := p.Path()
+	if shell.Run(exec.Command("git", "-C", dir, "cat-file", "-e", commit+"^{commit}")) == nil {
+		return nil
+	}
+	if offline(p) {
+		return fmt.Errorf("commit not in the clone, unavailable offline")
+	}
+	cmd := exec.Command("git", "-C", dir, "fetch", "--quiet", "--depth", "1", "origin", commit)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git fetch failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// offline reports whether a provider must not use the network
+func offline(p Provider) bool {
+	switch p := p.(type) {
+	case *AUR:
+		return p.Offline
+	case *Git:
+		return p.Offline
+	}
+	return false
+}
+
+func isGit(p Provider) bool {
+	switch p.(type) {
+	case *AUR, *Git:
+		return true
+	}
+	return false
+}
+
+// Checkout checks out commit in a git based provider, fetching it if
+// needed, and returns a function going back to the commit checked out
+// before
+func Checkout(p Provider, commit string) (func(), error) {
+	head := Commit(p)
+	if head == "" {
+		return nil, fmt.Errorf("not a git source")
+	}
+	dir := p.Path()
+	if err := fetchCommit(p, commit); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("git", "-C", dir, "checkout", "--quiet", "--force", commit)
+	if out, err := shell.CombinedOutput(cmd); err != nil {
+		return nil, fmt.Errorf("git checkout failed: %s", strings.TrimSpace(string(out)))
+	}
+	return func() { shell.Run(exec.Command("git", "-C", dir, "checkout", "--quiet", "--force", head)) }, nil
+}
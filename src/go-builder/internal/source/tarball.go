@@ -0,0 +1,135 @@
+package source
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Tarball provides a PKGBUILD from a .tar or .tar.gz archive, such as an
+// AUR snapshot. A single top-level directory in the archive is stripped.
+type Tarball struct {
+	Name   string
+	URL    string
+	Dir    string
+	Subdir string
+	HTTP   *http.Client
+	// Offline uses the archive extracted before
+	Offline bool
+
+	fetched bool
+}
+
+// Fetch downloads the archive and extracts it into Dir
+func (p *Tarball) Fetch() error {
+	if p.fetched {
+		return nil
+	}
+	if p.Offline {
+		return cached(p.Path())
+	}
+	logFetch("Downloading " + p.URL)
+
+	resp, err := p.HTTP.Get(p.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download of %s returned status %d", p.URL, resp.StatusCode)
+	}
+
+	if err := os.RemoveAll(p.Dir); err != nil {
+		return err
+	}
+	if err := extract(resp.Body, p.Dir); err != nil {
+		return fmt.Errorf("extracting %s: %w", p.URL, err)
+	}
+	p.fetched = true
+	return checkPKGBUILD(p.Path())
+}
+
+// Version returns the version declared by the downloaded PKGBUILD
+func (p *Tarball) Version() (string, error) {
+	if p.Offline {
+		return cachedVersion(p.Path())
+	}
+	if err := p.Fetch(); err != nil {
+		return "", err
+	}
+	return pkgbuildVersion(p.Path())
+}
+
+// Path returns the PKGBUILD directory inside the extracted archive
+func (p *Tarball) Path() string {
+	return filepath.Join(p.Dir, p.Subdir)
+}
+
+// extract unpacks regular files and directories of a possibly gzipped tar
+// stream into dir
+func extract(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	var stream io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(header.Name)
+		if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		target := filepath.Join(tmp, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0777|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Strip a single top-level directory, as in AUR snapshots
+	root := tmp
+	if entries, err := os.ReadDir(tmp); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+	return os.Rename(root, dir)
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// AdoptedFile lists the packages adopted into the repository, relative to
+// the build directory
+const AdoptedFile = "adopted.json"
+
+// AdoptedPackage is a package built outside the builder
+type AdoptedPackage struct {
+	Version string    `json:"version"`
+	File    string    `json:"file"`
+	Time    time.Time `json:"time"`
+}
+
+// Adopted maps the names of adopted packages to their latest adoption
+type Adopted map[string]AdoptedPackage
+
+// LoadAdopted reads the adopted packages file at path. A missing file
+// means no package was adopted.
+func LoadAdopted(path string) (Adopted, error) {
+	a := make(Adopted)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return make(Adopted), err
+	}
+	return a, nil
+}
+
+// Names returns the names of the adopted packages
+func (a Adopted) Names() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Save writes the adopted packages file to path
+func (a Adopted) Save(path string) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
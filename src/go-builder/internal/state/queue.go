@@ -0,0 +1,184 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueueFile is the build queue of the running or last run, relative to the
+// build directory
+const QueueFile = "queue.json"
+
+// Job states besides the outcomes of the report, which end a job unless
+// it is built. Built packages are only published with the database update
+// at the end of a run.
+const (
+	JobPending   = "pending"
+	JobChecking  = "checking"
+	JobQueued    = "queued"
+	JobBuilding  = "building"
+	JobBuilt     = "built"
+	JobPublished = "published"
+)
+
+// Queue is the plan of a run, written before it starts and on every change,
+// so that a run that crashed can be resumed and others can follow it
+type Queue struct {
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	// Finished is unset while the run is going, or after it crashed
+	Finished *time.Time `json:"finished,omitempty"`
+	PID      int        `json:"pid"`
+	Jobs     []*Job     `json:"jobs"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// Job is a package of the queue with the states it went through
+type Job struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Host is the build machine, if not this host
+	Host    string       `json:"host,omitempty"`
+	History []Transition `json:"history"`
+}
+
+// Transition is a change of the state of a job
+type Transition struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// NewQueue writes the queue of the packages names to path, all pending
+func NewQueue(path string, names []string) (*Queue, error) {
+	now := time.Now().UTC()
+	q := &Queue{Started: now, PID: os.Getpid(), path: path}
+	for _, name := range names {
+		q.Jobs = append(q.Jobs, &Job{Name: name, Status: JobPending, History: []Transition{{JobPending, now}}})
+	}
+	return q, q.save()
+}
+
+// LoadQueue reads the queue file at path, nil if there is none
+func LoadQueue(path string) (*Queue, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	q := &Queue{path: path}
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Set moves the job name to status, on the build machine host unless
+// empty. Jobs not in the queue are ignored, as is a nil queue.
+func (q *Queue) Set(name, status, host string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.Jobs, func(j *Job) bool { return j.Name == name })
+	if i < 0 || q.Jobs[i].Status == status {
+		return nil
+	}
+	job := q.Jobs[i]
+	job.Status = status
+	if host != "" {
+		job.Host = host
+	}
+	job.History = append(job.History, Transition{status, time.Now().UTC()})
+	return q.save()
+}
+
+// Status returns the state of the job name, empty if it isn't queued
+func (q *Queue) Status(name string) string {
+	if q == nil {
+		return ""
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.Jobs {
+		if job.Name == name {
+			return job.Status
+		}
+	}
+	return ""
+}
+
+// Publish marks the built jobs published, once the database holds them
+func (q *Queue) Publish() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	for _, job := range q.Jobs {
+		if job.Status == JobBuilt {
+			job.Status = JobPublished
+			job.History = append(job.History, Transition{JobPublished, now})
+		}
+	}
+	return q.save()
+}
+
+// Finish records that the run ended, even if interrupted
+func (q *Queue) Finish() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	q.Finished = &now
+	return q.save()
+}
+
+// Remaining returns the jobs a run left unfinished, including those built
+// but not published
+func (q *Queue) Remaining() []string {
+	var names []string
+	for _, job := range q.Jobs {
+		switch job.Status {
+		case JobPending, JobChecking, JobQueued, JobBuilding, JobBuilt:
+			names = append(names, job.Name)
+		}
+	}
+	return names
+}
+
+// save writes the queue, replacing the file at once so readers never see
+// half of it
+func (q *Queue) save() error {
+	q.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".queue-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
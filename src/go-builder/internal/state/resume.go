@@ -0,0 +1,41 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// ResumeFile lists the packages an interrupted run didn't process,
+// relative to the build directory
+const ResumeFile = "resume.json"
+
+// Resume is what an interrupted run left to do
+type Resume struct {
+	Time      time.Time `json:"time"`
+	Remaining []string  `json:"remaining"`
+}
+
+// LoadResume reads the resume file at path, nil if there is none
+func LoadResume(path string) (*Resume, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r Resume
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Save writes the resume file to path
+func (r *Resume) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,218 @@
+// Package state persists the build history of every package between runs,
+// so that decisions can depend on more than what the database holds.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileName is the state file, relative to the build directory
+const FileName = "state.json"
+
+// MaxFailures is how often the same version may fail before it is no
+// longer retried
+const MaxFailures = 3
+
+// Cooldown is how long a failed build is quarantined before it is retried
+// from the same source commit
+const Cooldown = 72 * time.Hour
+
+// Build is a single build attempt
+type Build struct {
+	Version string    `json:"version"`
+	Commit  string    `json:"commit,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Bump is a local rebuild published with a pkgrel suffix
+type Bump struct {
+	// Upstream is the rebuilt version, Version the published one
+	Upstream string `json:"upstream"`
+	Version  string `json:"version"`
+}
+
+// Entry is the history of one package
+type Entry struct {
+	// Last is the most recent attempt and Success its outcome
+	Last    Build `json:"last"`
+	Success bool  `json:"success"`
+	// Failures counts consecutive failures of Last.Version
+	Failures int `json:"failures,omitempty"`
+	// LastSuccess is the most recent successful build
+	LastSuccess *Build `json:"last_success,omitempty"`
+	// Reviewed is the last source commit approved in review
+	Reviewed string `json:"reviewed,omitempty"`
+	// Deps maps the repo packages the package depends on to the versions
+	// it was last built against
+	Deps map[string]string `json:"deps,omitempty"`
+	// Bump is set while the repo holds a local rebuild
+	Bump *Bump `json:"bump,omitempty"`
+	// BuildSeconds is how long the last successful build took, which
+	// orders the builds spread over several build machines
+	BuildSeconds int `json:"build_seconds,omitempty"`
+}
+
+// State maps package names to their history
+type State struct {
+	Packages map[string]*Entry `json:"packages"`
+}
+
+// Load reads the state file at path. A missing file is an empty state.
+func Load(path string) (*State, error) {
+	s := &State{Packages: make(map[string]*Entry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return &State{Packages: make(map[string]*Entry)}, err
+	}
+	if s.Packages == nil {
+		s.Packages = make(map[string]*Entry)
+	}
+	return s, nil
+}
+
+// Save writes the state to path, replacing it atomically
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the history of a package, or nil
+func (s *State) Get(name string) *Entry {
+	return s.Packages[name]
+}
+
+// Record stores the outcome of building version at commit
+func (s *State) Record(name, version, commit string, success bool) {
+	e := s.Packages[name]
+	if e == nil {
+		e = &Entry{}
+		s.Packages[name] = e
+	}
+
+	build := Build{Version: version, Commit: commit, Time: time.Now().UTC()}
+	if success {
+		e.Failures = 0
+		e.LastSuccess = &build
+	} else if e.Last.Version == version && !e.Success {
+		e.Failures++
+	} else {
+		e.Failures = 1
+	}
+	e.Last = build
+	e.Success = success
+}
+
+// Approve records that the source at commit passed review
+func (s *State) Approve(name, commit string) {
+	e := s.Packages[name]
+	if e == nil {
+		e = &Entry{}
+		s.Packages[name] = e
+	}
+	e.Reviewed = commit
+}
+
+// SetDeps records the versions of the repo packages name was built against
+func (s *State) SetDeps(name string, deps map[string]string) {
+	e := s.Packages[name]
+	if e == nil {
+		e = &Entry{}
+		s.Packages[name] = e
+	}
+	e.Deps = deps
+}
+
+// SetBuildTime records how long a successful build of name took
+func (s *State) SetBuildTime(name string, d time.Duration) {
+	e := s.Packages[name]
+	if e == nil {
+		e = &Entry{}
+		s.Packages[name] = e
+	}
+	e.BuildSeconds = int(d.Round(time.Second) / time.Second)
+}
+
+// BuildTime returns how long the last successful build of name took, 0 if
+// unknown
+func (s *State) BuildTime(name string) time.Duration {
+	if e := s.Packages[name]; e != nil {
+		return time.Duration(e.BuildSeconds) * time.Second
+	}
+	return 0
+}
+
+// SetBump records the local rebuild in the repo, nil if the repo holds the
+// upstream version
+func (s *State) SetBump(name string, bump *Bump) {
+	e := s.Packages[name]
+	if e == nil {
+		if bump == nil {
+			return
+		}
+		e = &Entry{}
+		s.Packages[name] = e
+	}
+	e.Bump = bump
+}
+
+// Quarantined reports whether building version from commit failed before
+// and shouldn't be retried yet, along with the reason. A new version or
+// source commit lifts the quarantine, otherwise it lasts for Cooldown, or
+// for good after MaxFailures failures.
+func (s *State) Quarantined(name, version, commit string) (bool, string) {
+	e := s.Packages[name]
+	if e == nil || e.Success || e.Last.Version != version {
+		return false, ""
+	}
+	if commit != "" && e.Last.Commit != "" && commit != e.Last.Commit {
+		return false, ""
+	}
+
+	if e.Failures >= MaxFailures {
+		return true, fmt.Sprintf("failed %d times in a row", e.Failures)
+	}
+	if until := e.Last.Time.Add(Cooldown); time.Now().Before(until) {
+		return true, fmt.Sprintf("failed on %s, retrying after %s", e.Last.Time.Format("2006-01-02 15:04"), until.Format("2006-01-02 15:04"))
+	}
+	return false, ""
+}
+
+// Prune drops packages that are no longer configured
+func (s *State) Prune(valid []string) {
+	keep := make(map[string]bool)
+	for _, name := range valid {
+		keep[name] = true
+	}
+	for name := range s.Packages {
+		if !keep[name] {
+			delete(s.Packages, name)
+		}
+	}
+}
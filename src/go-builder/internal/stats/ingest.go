@@ -0,0 +1,192 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"builder/internal/repo"
+)
+
+// Request is a request from an access log
+type Request struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Status int
+}
+
+// Result sums up the lines of an ingested log
+type Result struct {
+	Lines int
+	// Unparsable lines are in no known format
+	Unparsable int
+	// Counted are the package downloads counted, Old the ones skipped as
+	// counted before
+	Counted int
+	Old     int
+}
+
+// clfPattern matches the Common and Combined Log Formats of nginx, Apache
+// and most CDNs
+var clfPattern = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3})\b`)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// ParseLine parses a line in the Common or Combined Log Format, or a JSON
+// object as logged by Caddy, nginx with a JSON log_format or Cloudflare
+func ParseLine(line string) (Request, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		return parseJSON(line)
+	}
+	m := clfPattern.FindStringSubmatch(line)
+	if m == nil {
+		return Request{}, false
+	}
+	t, err := time.Parse(clfTime, m[1])
+	if err != nil {
+		return Request{}, false
+	}
+	status, _ := strconv.Atoi(m[4])
+	return Request{Time: t, Method: m[2], Path: m[3], Status: status}, true
+}
+
+// JSON field names, by log format
+var (
+	timeFields   = []string{"time", "timestamp", "ts", "time_iso8601", "time_local", "EdgeStartTimestamp"}
+	methodFields = []string{"method", "request_method", "ClientRequestMethod"}
+	pathFields   = []string{"uri", "path", "request_uri", "ClientRequestPath", "ClientRequestURI"}
+	statusFields = []string{"status", "status_code", "EdgeResponseStatus"}
+)
+
+func parseJSON(line string) (Request, bool) {
+	var obj map[string]any
+	if json.Unmarshal([]byte(line), &obj) != nil {
+		return Request{}, false
+	}
+	var req Request
+	// Caddy nests the request, nginx may log its request line
+	fields := []map[string]any{obj}
+	switch r := obj["request"].(type) {
+	case map[string]any:
+		fields = append(fields, r)
+	case string:
+		if method, rest, ok := strings.Cut(r, " "); ok {
+			req.Method = method
+			req.Path, _, _ = strings.Cut(rest, " ")
+		}
+	}
+	for _, f := range fields {
+		if v, ok := lookup(f, methodFields).(string); ok {
+			req.Method = v
+		}
+		if v, ok := lookup(f, pathFields).(string); ok {
+			req.Path = v
+		}
+		switch v := lookup(f, statusFields).(type) {
+		case float64:
+			req.Status = int(v)
+		case string:
+			req.Status, _ = strconv.Atoi(v)
+		}
+		if t, ok := parseTime(lookup(f, timeFields)); ok {
+			req.Time = t
+		}
+	}
+	if req.Path == "" || req.Status == 0 || req.Time.IsZero() {
+		return Request{}, false
+	}
+	return req, true
+}
+
+func lookup(obj map[string]any, names []string) any {
+	for _, name := range names {
+		if v, ok := obj[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// parseTime parses RFC 3339, the Common Log Format or Unix seconds,
+// milliseconds or nanoseconds
+func parseTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, clfTime} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseTime(f)
+		}
+	case float64:
+		switch {
+		case v > 1e17:
+			return time.Unix(0, int64(v)), true
+		case v > 1e11:
+			return time.UnixMilli(int64(v)), true
+		case v > 0:
+			sec := int64(v)
+			return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Package returns the name of the package a request downloaded, if it is
+// a successful download of a package file. Resumed downloads aren't
+// counted again.
+func (r Request) Package() (string, bool) {
+	if r.Method != "GET" || r.Status != 200 {
+		return "", false
+	}
+	p, _, _ := strings.Cut(r.Path, "?")
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	file, ok := packageFile(p)
+	if !ok {
+		return "", false
+	}
+	return repo.PkgNameFromFile(file)
+}
+
+// Ingest counts the package downloads of the access log r made after
+// since, and moves Last to the latest one
+func (s *Stats) Ingest(r io.Reader, since time.Time) (Result, error) {
+	var res Result
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		res.Lines++
+		req, ok := ParseLine(scanner.Text())
+		if !ok {
+			res.Unparsable++
+			continue
+		}
+		name, ok := req.Package()
+		switch {
+		case !ok:
+		case !req.Time.After(since):
+			res.Old++
+		default:
+			s.Add(name, req.Time)
+			res.Counted++
+			if req.Time.After(s.Last) {
+				s.Last = req.Time
+			}
+		}
+	}
+	return res, scanner.Err()
+}
@@ -0,0 +1,138 @@
+// Package stats counts package downloads from the access logs of the web
+// server or CDN hosting the repository.
+package stats
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"builder/internal/chunk"
+)
+
+// FileName holds the download counts, relative to the build directory
+const FileName = "stats.json"
+
+// KeepDays is how long daily counts are kept
+const KeepDays = 90
+
+// RecentDays is the period of the counts shown on the site
+const RecentDays = 30
+
+// dayFormat keys the daily counts
+const dayFormat = "2006-01-02"
+
+// Stats are the download counts of the packages
+type Stats struct {
+	// Last is the time of the latest download counted. Older requests are
+	// skipped, so ingesting a log twice counts nothing.
+	Last     time.Time           `json:"last"`
+	Packages map[string]*Package `json:"packages"`
+}
+
+// Package is the download count of a package
+type Package struct {
+	Total int `json:"total"`
+	// Daily maps days of the last KeepDays to their count
+	Daily map[string]int `json:"daily"`
+}
+
+// Load reads the counts at path. A missing file means no download was
+// counted yet.
+func Load(path string) (*Stats, error) {
+	s := &Stats{Packages: make(map[string]*Package)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return &Stats{Packages: make(map[string]*Package)}, err
+	}
+	if s.Packages == nil {
+		s.Packages = make(map[string]*Package)
+	}
+	return s, nil
+}
+
+// Save writes the counts to path
+func (s *Stats) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Add counts a download of name at t
+func (s *Stats) Add(name string, t time.Time) {
+	p := s.Packages[name]
+	if p == nil {
+		p = &Package{Daily: make(map[string]int)}
+		s.Packages[name] = p
+	}
+	p.Total++
+	p.Daily[t.UTC().Format(dayFormat)]++
+}
+
+// Prune drops the daily counts older than KeepDays before now
+func (s *Stats) Prune(now time.Time) {
+	oldest := now.UTC().AddDate(0, 0, -KeepDays).Format(dayFormat)
+	for _, p := range s.Packages {
+		for day := range p.Daily {
+			if day < oldest {
+				delete(p.Daily, day)
+			}
+		}
+	}
+}
+
+// Count returns the downloads of the packages names in the days days
+// before now, and ever. Split packages are counted together this way.
+func (s *Stats) Count(names []string, days int, now time.Time) (recent, total int) {
+	oldest := now.UTC().AddDate(0, 0, -days).Format(dayFormat)
+	for _, name := range names {
+		p := s.Packages[name]
+		if p == nil {
+			continue
+		}
+		total += p.Total
+		for day, n := range p.Daily {
+			if day > oldest {
+				recent += n
+			}
+		}
+	}
+	return recent, total
+}
+
+// Names returns the packages with downloads, sorted
+func (s *Stats) Names() []string {
+	names := make([]string, 0, len(s.Packages))
+	for name := range s.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageFile returns the package file downloaded by a request for the
+// URL path urlPath, directly or through the manifest of its parts
+func packageFile(urlPath string) (string, bool) {
+	file := path.Base(urlPath)
+	if file == chunk.ManifestFile {
+		dir, ok := strings.CutSuffix(path.Base(path.Dir(urlPath)), chunk.Suffix)
+		if !ok {
+			return "", false
+		}
+		file = dir
+	}
+	if !strings.Contains(file, ".pkg.tar.") || strings.HasSuffix(file, ".sig") {
+		return "", false
+	}
+	return file, true
+}
@@ -0,0 +1,170 @@
+// Package torrent writes BitTorrent metainfo files for package files, so
+// clients can fetch large packages from peers and the web seeds of the
+// repository instead of its host alone.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Suffix turns a package file name into the name of its torrent, published
+// next to it
+const Suffix = ".torrent"
+
+// Piece sizes are powers of two between these, aiming for about TargetPieces
+// pieces per file
+const (
+	MinPieceSize = 16 << 10
+	MaxPieceSize = 16 << 20
+	TargetPieces = 1500
+)
+
+// Options are what the torrents of a repository share
+type Options struct {
+	// Trackers are announce URLs, in order of preference
+	Trackers []string
+	// WebSeeds are URLs of the directory serving the file, ending in a
+	// slash so clients append its name (BEP 19)
+	WebSeeds []string
+	// PieceSize is the piece size, chosen by file size if 0
+	PieceSize int64
+}
+
+// PieceSize returns the piece size for a file of size bytes
+func PieceSize(size int64) int64 {
+	piece := int64(MinPieceSize)
+	for piece < MaxPieceSize && size/piece > TargetPieces {
+		piece *= 2
+	}
+	return piece
+}
+
+// Create returns the metainfo of the file at path. It holds no creation
+// date, so the same file and options always give the same torrent.
+func Create(path string, opts Options) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pieceSize := opts.PieceSize
+	if pieceSize == 0 {
+		pieceSize = PieceSize(info.Size())
+	}
+	var pieces bytes.Buffer
+	buf := make([]byte, pieceSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces.Write(sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	meta := map[string]any{
+		"info": map[string]any{
+			"name":         filepath.Base(path),
+			"length":       info.Size(),
+			"piece length": pieceSize,
+			"pieces":       pieces.String(),
+		},
+	}
+	if len(opts.Trackers) > 0 {
+		meta["announce"] = opts.Trackers[0]
+		var tiers []any
+		for _, tracker := range opts.Trackers {
+			tiers = append(tiers, []any{tracker})
+		}
+		meta["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		var seeds []any
+		for _, seed := range opts.WebSeeds {
+			seeds = append(seeds, seed)
+		}
+		meta["url-list"] = seeds
+	}
+
+	var b bytes.Buffer
+	if err := encode(&b, meta); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Write writes the torrent of the file at path next to it, unless it is
+// already newer than the file. It reports whether it wrote one.
+func Write(path string, opts Options) (bool, error) {
+	file, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if t, err := os.Stat(path + Suffix); err == nil && !t.ModTime().Before(file.ModTime()) {
+		return false, nil
+	}
+	data, err := Create(path, opts)
+	if err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(path+Suffix, data, 0644)
+}
+
+// encode writes v bencoded to b. Dictionaries are written with sorted keys,
+// as the info hash depends on it.
+func encode(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(b, "%d:%s", len(v), v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case []any:
+		b.WriteByte('l')
+		for _, item := range v {
+			if err := encode(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		b.WriteByte('d')
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			encode(b, key)
+			if err := encode(b, v[key]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", v)
+	}
+	return nil
+}
+
+// SeedURL returns the web seed URL of the directory rel below the server
+// base URL
+func SeedURL(base, rel string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.Trim(filepath.ToSlash(rel), "/") + "/"
+}
@@ -0,0 +1,11 @@
+//go:build darwin || freebsd
+
+package tui
+
+import "syscall"
+
+// The ioctls reading and setting the termios of a terminal
+const (
+	getTermios = syscall.TIOCGETA
+	setTermios = syscall.TIOCSETA
+)
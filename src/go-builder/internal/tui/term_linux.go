@@ -0,0 +1,9 @@
+package tui
+
+import "syscall"
+
+// The ioctls reading and setting the termios of a terminal
+const (
+	getTermios = syscall.TCGETS
+	setTermios = syscall.TCSETS
+)
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || freebsd)
+
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+// errUnsupported is returned for terminals the TUI can't drive
+var errUnsupported = errors.New("terminal not supported on this platform")
+
+func cbreak(fd int) (func(), error) {
+	return nil, errUnsupported
+}
+
+func size(fd int) (int, int, error) {
+	return 0, 0, errUnsupported
+}
+
+// IsTerminal reports whether f is a character device, like a console
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin || freebsd
+
+package tui
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cbreak turns off line buffering and echo on the terminal fd, so single
+// keys can be read, and returns a function restoring it. Ctrl-C still
+// sends SIGINT.
+func cbreak(fd int) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(fd, getTermios, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, setTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(fd, setTermios, unsafe.Pointer(&old)) }, nil
+}
+
+// size returns the columns and rows of the terminal fd
+func size(fd int) (int, int, error) {
+	var ws struct{ Row, Col, X, Y uint16 }
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
+
+// IsTerminal reports whether f is a terminal, which unlike /dev/null
+// answers the termios ioctl
+func IsTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(int(f.Fd()), getTermios, unsafe.Pointer(&termios)) == nil
+}
@@ -0,0 +1,417 @@
+// Package tui shows the progress of a run on a terminal: a live status
+// table of the packages and the log of the selected one, instead of the
+// interleaved output of every command.
+package tui
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"builder/internal/report"
+)
+
+// maxLines is how many log lines are kept per package
+const maxLines = 5000
+
+// Package states before the outcome in the report is known
+const (
+	stateQueued   = "queued"
+	stateChecking = "checking"
+	stateBuilding = "building"
+	stateRunning  = "running"
+	stateDone     = "done"
+)
+
+const (
+	colorRed    = "\033[0;31m"
+	colorGreen  = "\033[0;32m"
+	colorYellow = "\033[1;33m"
+	colorBlue   = "\033[0;34m"
+	colorDim    = "\033[2m"
+	colorBold   = "\033[1m"
+	colorReset  = "\033[0m"
+)
+
+// ansiPattern matches terminal escape sequences in command output
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// entry is a package in the table, or the run itself
+type entry struct {
+	name              string
+	state             string
+	started, finished time.Time
+	lines             []string
+	// partial is the unterminated last line
+	partial string
+}
+
+func (e *entry) write(p []byte) {
+	parts := strings.Split(e.partial+string(p), "\n")
+	for _, line := range parts[:len(parts)-1] {
+		e.lines = append(e.lines, clean(line))
+	}
+	e.partial = parts[len(parts)-1]
+	if len(e.lines) > 2*maxLines {
+		e.lines = append([]string(nil), e.lines[len(e.lines)-maxLines:]...)
+	}
+}
+
+// tail returns the last n lines, including the partial one
+func (e *entry) tail(n int) []string {
+	lines := e.lines
+	if e.partial != "" {
+		lines = append(lines[:len(lines):len(lines)], clean(e.partial))
+	}
+	return lines[max(len(lines)-n, 0):]
+}
+
+func (e *entry) duration() time.Duration {
+	switch {
+	case e.started.IsZero():
+		return 0
+	case e.finished.IsZero():
+		return time.Since(e.started)
+	}
+	return e.finished.Sub(e.started)
+}
+
+// clean drops escape sequences and what carriage returns overwrote, as in
+// progress bars
+func clean(line string) string {
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	return strings.ReplaceAll(ansiPattern.ReplaceAllString(line, ""), "\t", "    ")
+}
+
+// UI is the TUI of a run. It is an io.Writer for the log of the package
+// being processed. Its methods do nothing on a nil UI.
+type UI struct {
+	mu      sync.Mutex
+	title   string
+	entries []*entry // entries[0] is the run itself
+	current *entry
+	results *report.Report
+	// selected is the index of the entry whose log is shown, follow moves
+	// it along with current
+	selected int
+	follow   bool
+
+	out     *os.File
+	restore func()
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Available reports whether stdin and stdout are terminals
+func Available() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if _, _, err := size(int(f.Fd())); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// New takes over the terminal until Close
+func New(title string) (*UI, error) {
+	restore, err := cbreak(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	u := &UI{
+		title:   title,
+		entries: []*entry{{name: "(run)", state: stateRunning, started: time.Now()}},
+		follow:  true,
+		out:     os.Stdout,
+		restore: restore,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// Alternate screen, hidden cursor
+	fmt.Fprint(u.out, "\x1b[?1049h\x1b[?25l")
+	go u.readKeys()
+	go u.loop()
+	return u, nil
+}
+
+// Close restores the terminal and prints the outcome of every package, with
+// the end of the log of failed ones
+func (u *UI) Close() {
+	if u == nil {
+		return
+	}
+	u.once.Do(func() {
+		close(u.stop)
+		<-u.done
+		fmt.Fprint(u.out, "\x1b[?25h\x1b[?1049l")
+		u.restore()
+		u.summary()
+	})
+}
+
+// Begin queues the packages of a run, whose outcomes results records
+func (u *UI) Begin(names []string, results *report.Report) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.results = results
+	for _, name := range names {
+		u.entries = append(u.entries, &entry{name: name, state: stateQueued})
+	}
+}
+
+// Start marks name as being checked, finishing the previous package
+func (u *UI) Start(name string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.finish()
+	for i, e := range u.entries {
+		if e.name == name && e.state == stateQueued {
+			e.state, e.started = stateChecking, time.Now()
+			u.current = e
+			if u.follow {
+				u.selected = i
+			}
+			return
+		}
+	}
+}
+
+// Building marks the current package as building
+func (u *UI) Building() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current != nil {
+		u.current.state = stateBuilding
+	}
+}
+
+// End finishes the last package of a run. Later output goes to the log of
+// the run.
+func (u *UI) End() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.finish()
+	if u.follow {
+		u.selected = 0
+	}
+}
+
+// finish sets the state of the current package to its outcome
+func (u *UI) finish() {
+	if u.current == nil {
+		return
+	}
+	u.current.state = stateDone
+	if u.results != nil && u.results.Packages[u.current.name] != nil {
+		u.current.state = u.results.Packages[u.current.name].Status
+	}
+	u.current.finished = time.Now()
+	u.current = nil
+}
+
+// Write adds output to the log of the current package
+func (u *UI) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	target := u.current
+	if target == nil {
+		target = u.entries[0]
+	}
+	target.write(p)
+	return len(p), nil
+}
+
+func (u *UI) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		switch string(buf[:n]) {
+		case "\x1b[A", "k":
+			u.selected, u.follow = max(u.selected-1, 0), false
+		case "\x1b[B", "j":
+			u.selected, u.follow = min(u.selected+1, len(u.entries)-1), false
+		case "f":
+			u.follow = true
+			u.selected = 0
+			for i, e := range u.entries {
+				if e == u.current {
+					u.selected = i
+				}
+			}
+		}
+		u.mu.Unlock()
+	}
+}
+
+func (u *UI) loop() {
+	defer close(u.done)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		u.render()
+		select {
+		case <-ticker.C:
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// render redraws the screen: a header, the status table, the log of the
+// selected entry and a key help line
+func (u *UI) render() {
+	width, height, err := size(int(u.out.Fd()))
+	if err != nil || width < 20 || height < 8 {
+		width, height = 80, 24
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	done, failed := 0, 0
+	nameWidth := 0
+	for i, e := range u.entries {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(e.name))
+		if i == 0 {
+			continue
+		}
+		switch e.state {
+		case stateQueued, stateChecking, stateBuilding:
+		case report.StatusFailed:
+			failed++
+			done++
+		default:
+			done++
+		}
+	}
+	nameWidth = min(nameWidth, width/2)
+
+	var lines []string
+	header := fmt.Sprintf(" %s  %d/%d done", u.title, done, len(u.entries)-1)
+	if failed > 0 {
+		header += fmt.Sprintf(", %d failed", failed)
+	}
+	header += fmt.Sprintf("  %s", u.entries[0].duration().Round(time.Second))
+	lines = append(lines, colorBold+truncate(header, width)+colorReset)
+
+	rows := min(len(u.entries), max((height-3)/3, 1))
+	first := min(max(u.selected-rows/2, 0), len(u.entries)-rows)
+	for i, e := range u.entries[first : first+rows] {
+		marker := "  "
+		if first+i == u.selected {
+			marker = "> "
+		}
+		dur := ""
+		if d := e.duration(); d > 0 {
+			dur = d.Round(time.Second).String()
+		}
+		name := truncate(e.name, nameWidth)
+		prefix := fmt.Sprintf("%s%s%s  ", marker, name, strings.Repeat(" ", nameWidth-utf8.RuneCountInString(name)))
+		rest := fmt.Sprintf("%-11s  %s", e.state, dur)
+		row := truncate(prefix+rest, width)
+		// Color the state, unless the truncation cut it
+		if used := utf8.RuneCountInString(prefix) + len(e.state); e != u.entries[0] && used <= width {
+			row = prefix + stateColor(e.state) + e.state + colorReset + truncate(rest[len(e.state):], width-used)
+		}
+		lines = append(lines, row)
+	}
+
+	selected := u.entries[u.selected]
+	title := fmt.Sprintf("── %s ", selected.name)
+	lines = append(lines, colorDim+truncate(title+strings.Repeat("─", max(width-utf8.RuneCountInString(title), 0)), width)+colorReset)
+	logRows := height - len(lines) - 1
+	tail := selected.tail(logRows)
+	for _, line := range tail {
+		lines = append(lines, truncate(line, width))
+	}
+	for range logRows - len(tail) {
+		lines = append(lines, "")
+	}
+	help := "↑/↓ select  f follow  Ctrl-C stop"
+	if u.follow {
+		help = "↑/↓ select  following  Ctrl-C stop"
+	}
+	lines = append(lines, colorDim+truncate(help, width)+colorReset)
+
+	fmt.Fprint(u.out, "\x1b[H"+strings.Join(lines, "\x1b[K\r\n")+"\x1b[K\x1b[J")
+}
+
+// summary prints the outcome of every package, and the end of the logs of
+// failed ones
+func (u *UI) summary() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	nameWidth := 0
+	for _, e := range u.entries[1:] {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(e.name))
+	}
+	for _, e := range u.entries[1:] {
+		dur := ""
+		if d := e.duration(); d > 0 {
+			dur = d.Round(time.Second).String()
+		}
+		fmt.Fprintf(u.out, "  %-*s  %s%-11s%s  %s\n", nameWidth, e.name, stateColor(e.state), e.state, colorReset, dur)
+	}
+	for _, e := range u.entries[1:] {
+		if e.state != report.StatusFailed {
+			continue
+		}
+		fmt.Fprintf(u.out, "\n%s── %s%s\n", colorRed, e.name, colorReset)
+		for _, line := range e.tail(20) {
+			fmt.Fprintln(u.out, line)
+		}
+	}
+	fmt.Fprintln(u.out)
+	for _, line := range u.entries[0].tail(20) {
+		fmt.Fprintln(u.out, line)
+	}
+}
+
+func stateColor(state string) string {
+	switch state {
+	case report.StatusBuilt, report.StatusUpToDate:
+		return colorGreen
+	case report.StatusFailed:
+		return colorRed
+	case report.StatusQuarantined, report.StatusKept, report.StatusRemoved, report.StatusOfficial:
+		return colorYellow
+	case stateChecking, stateBuilding:
+		return colorBlue
+	case stateQueued:
+		return colorDim
+	}
+	return ""
+}
+
+// truncate cuts s to width runes
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width])
+}
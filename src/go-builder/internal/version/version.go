@@ -0,0 +1,207 @@
+// Package version handles pacman [epoch:]pkgver-pkgrel version strings.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Split splits a full [epoch:]pkgver-pkgrel version into its parts
+func Split(version string) (epoch, pkgver, pkgrel string, err error) {
+	rest := version
+	if i := strings.Index(rest, ":"); i >= 0 {
+		epoch, rest = rest[:i], rest[i+1:]
+	}
+
+	i := strings.LastIndex(rest, "-")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", "", fmt.Errorf("version %q must be in the form [epoch:]pkgver-pkgrel", version)
+	}
+	return epoch, rest[:i], rest[i+1:], nil
+}
+
+// Bump returns version with a repo-local rebuild suffix on its pkgrel, or
+// with the suffix incremented: 1.0-1 becomes 1.0-1.1, then 1.0-1.2
+func Bump(version string) (string, error) {
+	_, _, pkgrel, err := Split(version)
+	if err != nil {
+		return "", err
+	}
+	prefix := version[:len(version)-len(pkgrel)]
+	rel, suffix, found := strings.Cut(pkgrel, ".")
+	if !found {
+		return prefix + pkgrel + ".1", nil
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil {
+		return "", fmt.Errorf("pkgrel %q has no numeric rebuild suffix", pkgrel)
+	}
+	return fmt.Sprintf("%s%s.%d", prefix, rel, n+1), nil
+}
+
+// Or returns v, or def when v is empty
+func Or(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// Compare compares two full versions like pacman's vercmp: it returns -1 if
+// a is older than b, 0 if they are equal and 1 if a is newer. The epoch
+// (default 0) decides first, then pkgver, then pkgrel if both have one.
+func Compare(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epoch1, ver1, rel1 := parseEVR(a)
+	epoch2, ver2, rel2 := parseEVR(b)
+	if c := rpmvercmp(epoch1, epoch2); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(ver1, ver2); c != 0 || rel1 == "" || rel2 == "" {
+		return c
+	}
+	return rpmvercmp(rel1, rel2)
+}
+
+// parseEVR splits a version into epoch, pkgver and pkgrel like libalpm,
+// which unlike Split accepts versions without pkgrel
+func parseEVR(evr string) (epoch, ver, rel string) {
+	epoch, ver = "0", evr
+	i := 0
+	for i < len(evr) && isDigit(evr[i]) {
+		i++
+	}
+	if i < len(evr) && evr[i] == ':' {
+		if i > 0 {
+			epoch = evr[:i]
+		}
+		ver = evr[i+1:]
+	}
+	if j := strings.LastIndex(ver, "-"); j >= 0 {
+		ver, rel = ver[:j], ver[j+1:]
+	}
+	return epoch, ver, rel
+}
+
+// rpmvercmp compares version strings segment by segment, the algorithm
+// libalpm inherited from rpm. Numeric segments are newer than alphabetic
+// ones, and a trailing alphabetic segment is older than none, so 1.0alpha
+// is older than 1.0.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	one, two := a, b
+	for one != "" && two != "" {
+		sep1, sep2 := one, two
+		one = strings.TrimLeftFunc(one, isSeparator)
+		two = strings.TrimLeftFunc(two, isSeparator)
+		if one == "" || two == "" {
+			break
+		}
+		// A longer separator makes the version newer
+		if n1, n2 := len(sep1)-len(one), len(sep2)-len(two); n1 != n2 {
+			return cmpInt(n1, n2)
+		}
+
+		isNum := isDigit(one[0])
+		seg1, seg2 := segment(one, isNum), segment(two, isNum)
+		if seg2 == "" {
+			// Different segment types, numeric ones are newer
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+		one, two = one[len(seg1):], two[len(seg2):]
+
+		if isNum {
+			seg1 = strings.TrimLeft(seg1, "0")
+			seg2 = strings.TrimLeft(seg2, "0")
+			if len(seg1) != len(seg2) {
+				return cmpInt(len(seg1), len(seg2))
+			}
+		}
+		if c := strings.Compare(seg1, seg2); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case one == "" && two == "":
+		return 0
+	case one == "" && !isAlpha(two[0]), one != "" && isAlpha(one[0]):
+		return -1
+	default:
+		return 1
+	}
+}
+
+// segment returns the leading run of digits, or letters, of s
+func segment(s string, digits bool) string {
+	i := 0
+	for i < len(s) && (digits && isDigit(s[i]) || !digits && isAlpha(s[i])) {
+		i++
+	}
+	return s[:i]
+}
+
+func isSeparator(r rune) bool {
+	return r > 127 || !isDigit(byte(r)) && !isAlpha(byte(r))
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func cmpInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	return 1
+}
+
+// ParseDep splits a dependency like "foo>=1.0" or "libfoo.so=1-64" into the
+// name, the comparison operator and the version, which are empty for a
+// dependency on the name alone
+func ParseDep(dep string) (name, op, version string) {
+	i := strings.IndexAny(dep, "<>=")
+	if i < 0 {
+		return dep, "", ""
+	}
+	name, rest := dep[:i], dep[i:]
+	for _, o := range []string{">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(rest, o) {
+			return name, o, rest[len(o):]
+		}
+	}
+	return dep, "", ""
+}
+
+// Satisfies reports whether a package or provision at version have meets
+// the constraint op want of a dependency. Like in pacman, an unversioned
+// provision only satisfies unversioned dependencies.
+func Satisfies(have, op, want string) bool {
+	if op == "" {
+		return true
+	}
+	if have == "" {
+		return false
+	}
+	c := Compare(have, want)
+	switch op {
+	case "=":
+		return c == 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/state"
+)
+
+// handleSignals stops the run on SIGINT or SIGTERM: the running makepkg is
+// killed and no further package is started, but everything done so far is
+// published and recorded. A second signal exits immediately.
+func (r *run) handleSignals() {
+	r.stop = make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Msg("")
+		log.Warn(fmt.Sprintf("Received %s, aborting the current build and saving progress (again to quit now)", sig))
+		r.stopping.Store(true)
+		close(r.stop)
+		r.Builder.Abort()
+
+		<-signals
+		log.Error("Interrupted again, quitting without saving")
+		exit(ExitInterrupted)
+	}()
+}
+
+// interrupted reports whether a signal asked the run to stop
+func (r *run) interrupted() bool {
+	return r.stopping.Load()
+}
+
+// failingFast reports whether --fail-fast stops the run, given the number
+// of failed packages so far. Once it did, it stays stopped.
+func (r *run) failingFast(failed int) bool {
+	if r.FailFast && failed > 0 && !r.failedFast {
+		r.failedFast = true
+		log.Msg("")
+		log.Warn("Not checking further packages after the first failure (--fail-fast)")
+	}
+	return r.failedFast
+}
+
+// resumeSet returns the packages an interrupted or crashed run left, or nil
+// to check all packages if there is nothing to resume
+func (r *run) resumeSet() map[string]bool {
+	res, err := state.LoadResume(filepath.Join(r.Dir, state.ResumeFile))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", state.ResumeFile, err))
+	}
+	if res == nil {
+		if only := r.crashedSet(); only != nil {
+			return only
+		}
+		log.Info("No interrupted run to resume, checking all packages")
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("Resuming the run interrupted at %s", res.Time.Local().Format(time.DateTime)))
+	r.Resumed = true
+	only := make(map[string]bool)
+	for _, name := range res.Remaining {
+		only[name] = true
+	}
+	return only
+}
+
+// crashedSet returns the packages the queue of a run that never finished,
+// e.g. as it was killed, didn't get to or didn't publish, or nil if the
+// last run finished
+func (r *run) crashedSet() map[string]bool {
+	q, err := state.LoadQueue(filepath.Join(r.Dir, state.QueueFile))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", state.QueueFile, err))
+	}
+	if q == nil || q.Finished != nil {
+		return nil
+	}
+
+	remaining := q.Remaining()
+	log.Info(fmt.Sprintf("Resuming the run started at %s, which stopped without finishing (%d packages left)",
+		q.Started.Local().Format(time.DateTime), len(remaining)))
+	r.Resumed = true
+	only := make(map[string]bool)
+	for _, name := range remaining {
+		only[name] = true
+	}
+	return only
+}
+
+// saveResume records the packages an interrupted run didn't process, or
+// removes the record once every package was processed
+func (r *run) saveResume(only map[string]bool, packages []config.Package, metas []config.MetaPackage, processed []string) {
+	path := filepath.Join(r.Dir, state.ResumeFile)
+	if !r.interrupted() && !r.failedFast {
+		if only == nil || r.Resumed {
+			os.Remove(path)
+		}
+		return
+	}
+
+	done := make(map[string]bool)
+	for _, name := range processed {
+		done[name] = true
+	}
+	res := &state.Resume{Time: time.Now().UTC()}
+	for _, pkg := range packages {
+		if !done[pkg.Name] {
+			res.Remaining = append(res.Remaining, pkg.Name)
+		}
+	}
+	for _, meta := range metas {
+		if !done[meta.Name] {
+			res.Remaining = append(res.Remaining, meta.Name)
+		}
+	}
+
+	log.Msg("")
+	cause := "Interrupted"
+	if !r.interrupted() {
+		cause = "Stopped"
+	}
+	log.Warn(fmt.Sprintf("%s with %d packages left, run with --resume to continue", cause, len(res.Remaining)))
+	if err := res.Save(path); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", state.ResumeFile, err))
+	}
+}
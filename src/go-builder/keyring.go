@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+)
+
+// keyringPackage exports the signing key for the keyring package and
+// returns the package, versioned by the last update of the key. It reports
+// false, keeping the published keyring, if gpg has no such key.
+func (r *run) keyringPackage() (config.MetaPackage, bool) {
+	cfg := r.Config
+	key, err := buildsys.ExportKey(cfg.Meta.SigningKey)
+	r.keyring = key
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to export signing key %s for %s: %v", cfg.Meta.SigningKey, cfg.KeyringName(), err))
+		return config.MetaPackage{}, false
+	}
+	return cfg.KeyringPackage(key.Version()), true
+}
+
+// writeMetaPKGBUILD generates the PKGBUILD of a meta-package or of the
+// keyring package and returns the package directory
+func (r *run) writeMetaPKGBUILD(meta config.MetaPackage) (string, error) {
+	if r.keyring != nil && meta.Name == r.Config.KeyringName() {
+		return buildsys.WriteKeyringPKGBUILD(r.Config, meta, r.keyring, MetaPkgDir)
+	}
+	return buildsys.WriteMetaPKGBUILD(r.Config, meta, MetaPkgDir)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/metrics"
+	"builder/internal/repo"
+	"builder/internal/report"
+)
+
+// recordMetrics records the outcome of a Run started at started
+func (r *run) recordMetrics(started time.Time, status *report.RunStatus, results *report.Report, builds map[string]time.Duration) {
+	m := metrics.Run{
+		Time:     status.Time,
+		Duration: time.Since(started),
+		OK:       status.State == report.RunOK,
+		Packages: make(map[string]int),
+		Builds:   builds,
+	}
+	for _, res := range results.Packages {
+		m.Packages[res.Status]++
+		if res.Status == report.StatusFailed || res.Status == report.StatusQuarantined {
+			m.Outdated++
+		}
+	}
+	m.RepoSize, _ = repo.Size(r.Dir)
+	r.Metrics.Record(r.Config.Meta.RepoName, m)
+}
+
+// serveMetrics serves m at /metrics on addr in the background
+func serveMetrics(addr string, m *metrics.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Error(fmt.Sprintf("Metrics endpoint stopped: %v", err))
+		}
+	}()
+	log.Info(fmt.Sprintf("Serving metrics on %s/metrics", addr))
+}
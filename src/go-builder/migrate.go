@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"builder/internal/binrepo"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/repo"
+	"builder/internal/repodb"
+	"builder/internal/state"
+	"builder/internal/tui"
+)
+
+// runMigrate takes over another pacman repository: its packages are pulled
+// into the repository at their current versions, and those on the AUR can
+// be added to the config so later runs keep them updated. The rest is
+// adopted. It returns the exit code.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromURL := fs.String("from-url", "", "pacman Server `url` of the repository, or the URL of its .db file")
+	name := fs.String("name", "", "`name` of the repository, needed unless --from-url points to the .db file")
+	addConfig := fs.Bool("add-config", false, "add the AUR packages to the config without asking")
+	dryRun := fs.Bool("dry-run", false, "only list the packages")
+	fs.Parse(args)
+
+	src, err := migrationSource(*fromURL, *name)
+	if err != nil {
+		log.Error(err.Error())
+		return ExitConfig
+	}
+
+	cfg := loadConfig()
+	lockRun()
+	repoDB := mainRepo(cfg)
+	if err := os.MkdirAll(repoDB.Dir, 0755); err != nil {
+		log.Error(fmt.Sprintf("Failed to create build dir: %v", err))
+		return 1
+	}
+
+	log.Info(fmt.Sprintf("Reading %s from %s...", src.Name, src.URL))
+	client := binrepo.New([]config.BinaryRepo{src}, Arch)
+	all, err := client.Packages(src)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read the database: %v", err))
+		return 1
+	}
+
+	// Group by pkgbase, the unit the config lists
+	managed := managedNames(cfg, repoDB)
+	groups := make(map[string][]*repodb.Package)
+	for _, pkg := range all {
+		if pkg.Arch != Arch && pkg.Arch != "any" {
+			continue
+		}
+		if slices.Contains(managed, pkg.Name) {
+			log.Msg(fmt.Sprintf("   Skipping %s, config.yml already builds it", pkg.Name))
+			continue
+		}
+		base := pkg.Base
+		if base == "" {
+			base = pkg.Name
+		}
+		groups[base] = append(groups[base], pkg)
+	}
+	bases := slices.Sorted(maps.Keys(groups))
+
+	infos, err := newAURClient(cfg).Info(bases)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to look packages up on the AUR: %v", err))
+	}
+	var onAUR []string
+	log.Info(fmt.Sprintf("Found %d PKGBUILDs to take over:", len(bases)))
+	for _, base := range bases {
+		var names []string
+		for _, pkg := range groups[base] {
+			names = append(names, pkg.Name)
+		}
+		where := "not on the AUR"
+		if infos[base] != nil {
+			where = "AUR " + infos[base].Version
+			onAUR = append(onAUR, base)
+		}
+		log.Msg(fmt.Sprintf("   %s %s (%s): %s", base, groups[base][0].Version, where, strings.Join(names, " ")))
+	}
+	if *dryRun || len(bases) == 0 {
+		return 0
+	}
+
+	var added []string
+	if len(onAUR) > 0 {
+		path, err := config.Find()
+		question := fmt.Sprintf("Add the %d packages on the AUR to %s?", len(onAUR), path)
+		if err == nil && (*addConfig || tui.IsTerminal(os.Stdin) && confirm(question)) {
+			if err := config.AddPackages(path, onAUR); err != nil {
+				log.Error(fmt.Sprintf("Failed to update %s: %v", path, err))
+				return 1
+			}
+			log.Success(fmt.Sprintf("Added %s to %s", strings.Join(onAUR, ", "), path))
+			added = onAUR
+		}
+	}
+
+	adoptedPath := filepath.Join(BuildDir, state.AdoptedFile)
+	adopted, err := state.LoadAdopted(adoptedPath)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+
+	log.Info("Downloading packages...")
+	failed := 0
+	var files []string
+	for _, base := range bases {
+		for _, pkg := range groups[base] {
+			if err := client.Download(src, pkg, repoDB.Dir); err != nil {
+				log.Error(fmt.Sprintf("Failed to download %s: %v", pkg.Filename, err))
+				failed++
+				continue
+			}
+			if key := cfg.Meta.SigningKey; key != "" {
+				if err := repo.SignFile(filepath.Join(repoDB.Dir, pkg.Filename), key); err != nil {
+					log.Error(fmt.Sprintf("Failed to sign %s: %v", pkg.Filename, err))
+					failed++
+					continue
+				}
+			}
+			files = append(files, pkg.Filename)
+			if slices.Contains(added, base) {
+				delete(adopted, pkg.Name)
+			} else {
+				adopted[pkg.Name] = state.AdoptedPackage{Version: pkg.Version, File: pkg.Filename, Time: time.Now().UTC()}
+			}
+			log.Success(fmt.Sprintf("Pulled: %s", pkg.Filename))
+		}
+	}
+
+	if len(files) > 0 {
+		if err := repoDB.Add(files); err != nil {
+			log.Error(fmt.Sprintf("Failed to update the database: %v", err))
+			return 1
+		}
+	}
+	if err := adopted.Save(adoptedPath); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrationSource returns the repository at url, named name. A URL of the
+// .db file names the repository itself.
+func migrationSource(url, name string) (config.BinaryRepo, error) {
+	if url == "" {
+		return config.BinaryRepo{}, fmt.Errorf("migrate needs --from-url")
+	}
+	url = strings.TrimSuffix(url, "/")
+	if dir, file := filepath.Split(url); strings.HasSuffix(file, ".db") {
+		url, name = strings.TrimSuffix(dir, "/"), strings.TrimSuffix(file, ".db")
+	}
+	if name == "" {
+		return config.BinaryRepo{}, fmt.Errorf("migrate needs --name, or a --from-url ending in <name>.db")
+	}
+	return config.BinaryRepo{Name: name, URL: url}, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"builder/internal/aur"
+	"builder/internal/config"
+)
+
+// applyNetwork exports the proxy and git mirror settings to the
+// environment, where the HTTP clients, git, curl and makepkg read them
+func applyNetwork(n config.Network) {
+	for _, proxy := range [][2]string{{"http_proxy", n.HTTPProxy}, {"https_proxy", n.HTTPSProxy}, {"no_proxy", n.NoProxy}} {
+		name, value := proxy[0], proxy[1]
+		if value != "" {
+			os.Setenv(name, value)
+			os.Setenv(strings.ToUpper(name), value)
+		}
+	}
+
+	// git reads extra config from GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n>
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	for _, from := range slices.Sorted(maps.Keys(n.GitMirrors)) {
+		os.Setenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), "url."+n.GitMirrors[from]+".insteadOf")
+		os.Setenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), from)
+		count++
+	}
+	if count > 0 {
+		os.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(count))
+	}
+}
+
+// newAURClient returns a client for the configured AUR mirror or the
+// official AUR
+func newAURClient(cfg *config.Config) *aur.Client {
+	client := aur.NewClient()
+	if cfg.Network.AURURL != "" {
+		client.BaseURL = strings.TrimSuffix(cfg.Network.AURURL, "/")
+	}
+	return client
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/news"
+)
+
+// DefaultNewsDays is how many days news counts as recent without
+// network.news-days
+const DefaultNewsDays = 14
+
+// checkNews warns about recent Arch Linux news matching the news-keywords
+// of cfg that wasn't acknowledged yet, and acknowledges it with ack. It
+// reports whether the run may go on, which with strict it may not while
+// such news is left.
+func checkNews(cfg *config.Config, strict, ack bool) bool {
+	keywords := cfg.Network.NewsKeywords
+	if len(keywords) == 0 {
+		if strict || ack {
+			log.Warn("--strict-news and --ack-news need network.news-keywords, not checking the news")
+		}
+		return true
+	}
+	items, err := news.Fetch(&http.Client{Timeout: 10 * time.Second}, news.FeedURL)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to check the Arch Linux news: %v", err))
+		return true
+	}
+
+	ackPath := filepath.Join(BuildDir, news.AckFile)
+	acked, err := news.LoadAcked(ackPath)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable %s: %v", news.AckFile, err))
+	}
+	since := time.Now().AddDate(0, 0, -cmp.Or(cfg.Network.NewsDays, DefaultNewsDays))
+	var pending []news.Item
+	for _, item := range news.Match(items, keywords, since) {
+		if _, ok := acked[item.Link]; !ok {
+			pending = append(pending, item)
+		}
+	}
+	if len(pending) == 0 {
+		return true
+	}
+
+	for _, item := range pending {
+		log.Warn(fmt.Sprintf("Arch Linux news from %s: %s", item.Published.Format(time.DateOnly), item.Title))
+		log.Msg("   " + item.Link)
+		log.Annotate(log.AnnotationWarning, "Arch Linux news", fmt.Sprintf("%s: %s", item.Title, item.Link))
+	}
+	if ack {
+		now := time.Now().UTC()
+		for _, item := range pending {
+			acked[item.Link] = now
+		}
+		if err := acked.Save(ackPath); err != nil {
+			log.Error(fmt.Sprintf("Failed to save %s: %v", news.AckFile, err))
+			return !strict
+		}
+		log.Success(fmt.Sprintf("Acknowledged %d news items", len(pending)))
+		return true
+	}
+	if strict {
+		log.Error("Not building until the news is handled, acknowledge it with --ack-news")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/remote"
+	"builder/internal/shell"
+)
+
+// OfficialRepos are the Arch Linux repositories AUR packages move to
+var OfficialRepos = []string{"core", "extra", "multilib"}
+
+// officialSearchURL is the package search API of archlinux.org
+const officialSearchURL = "https://archlinux.org/packages/search/json/"
+
+// officialPackages returns which of the AUR packages names are in the
+// official repositories, mapped to the repository. It reads the sync
+// databases of pacman where it is installed, else it asks archlinux.org,
+// which offline runs skip.
+func (r *run) officialPackages(names []string) map[string]string {
+	if r.Config.Meta.OfficialPackages == config.OfficialOff || len(names) == 0 {
+		return nil
+	}
+	var found map[string]string
+	var err error
+	if _, lookErr := exec.LookPath("pacman"); lookErr == nil {
+		found, err = syncDBPackages(names, nil)
+	} else if host := r.Builder.Remote; host != nil && host.Agent == nil {
+		found, err = syncDBPackages(names, host)
+	} else if !r.Offline {
+		found, err = searchOfficial(names)
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to check for packages in the official repositories: %v", err))
+	}
+	return found
+}
+
+// syncDBPackages looks names up in the pacman sync databases of the
+// official repositories, on host unless nil. Repositories not in
+// pacman.conf are left out.
+func syncDBPackages(names []string, host *remote.Host) (map[string]string, error) {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+	found := make(map[string]string)
+	listed := 0
+	for _, repo := range OfficialRepos {
+		cmd := exec.Command("pacman", "-Sl", repo)
+		if host != nil {
+			var err error
+			if cmd, err = host.Command(".", nil, "pacman", "-Sl", repo); err != nil {
+				return nil, err
+			}
+		}
+		out, err := shell.Output(cmd)
+		if err != nil {
+			continue
+		}
+		listed++
+		for _, line := range strings.Split(string(out), "\n") {
+			// repo name version [installed]
+			if fields := strings.Fields(line); len(fields) >= 2 && want[fields[1]] {
+				found[fields[1]] = repo
+			}
+		}
+	}
+	if listed == 0 {
+		return nil, fmt.Errorf("no sync database of %s, run pacman -Sy", strings.Join(OfficialRepos, ", "))
+	}
+	return found, nil
+}
+
+// searchOfficial looks names up with the package search of archlinux.org,
+// one request per package
+func searchOfficial(names []string) (map[string]string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	found := make(map[string]string)
+	for _, name := range names {
+		params := url.Values{"name": {name}}
+		for _, repo := range OfficialRepos {
+			params.Add("repo", strings.ToUpper(repo[:1])+repo[1:])
+		}
+		resp, err := client.Get(officialSearchURL + "?" + params.Encode())
+		if err != nil {
+			return found, err
+		}
+		var result struct {
+			Results []struct {
+				Name string `json:"pkgname"`
+				Repo string `json:"repo"`
+			} `json:"results"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("archlinux.org returned status %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return found, err
+		}
+		for _, res := range result.Results {
+			if res.Name == name {
+				found[name] = res.Repo
+			}
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/log"
+)
+
+// runPkg edits the packages of the config file with `pkg add`, `pkg remove`
+// and `pkg set`, keeping its comments and order. It returns the exit code.
+func runPkg(args []string) int {
+	if len(args) == 0 {
+		log.Error("Usage: repo-builder pkg add|remove|set ... (YAML configs only, TOML and JSON configs can't be edited)")
+		return ExitConfig
+	}
+	path, err := config.Find()
+	if err != nil {
+		log.Error(err.Error())
+		return ExitConfig
+	}
+	switch args[0] {
+	case "add":
+		return pkgAdd(path, args[1:])
+	case "remove":
+		return pkgRemove(path, args[1:])
+	case "set":
+		return pkgSet(path, args[1:])
+	}
+	log.Error(fmt.Sprintf("Unknown pkg command %q, expected add, remove or set", args[0]))
+	return ExitConfig
+}
+
+// pkgAddUsage is the usage of pkg add
+const pkgAddUsage = "Usage: repo-builder pkg add [--force] [--vcs] <name>... (YAML configs only, TOML and JSON configs can't be edited)"
+
+// pkgAdd adds AUR packages to the config, checking that the AUR has them
+func pkgAdd(path string, args []string) int {
+	force, vcs, args, err := parsePkgAdd(args)
+	if err != nil {
+		log.Error(err.Error())
+		log.Error(pkgAddUsage)
+		return ExitConfig
+	}
+	if len(args) == 0 {
+		log.Error(pkgAddUsage)
+		return ExitConfig
+	}
+
+	cfg := loadConfig()
+	var names []string
+	for _, name := range args {
+		if vcs && !strings.HasSuffix(name, "-git") {
+			name += "-git"
+		}
+		if slices.Contains(cfg.AURNames(), name) || slices.Contains(names, name) {
+			log.Warn(fmt.Sprintf("%s is already in %s", name, path))
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return 0
+	}
+
+	infos, err := newAURClient(cfg).Info(names)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to look packages up on the AUR, adding them unchecked: %v", err))
+	} else {
+		for _, name := range names {
+			if infos[name] == nil {
+				log.Error(fmt.Sprintf("%s is not on the AUR", name))
+				return ExitConfig
+			}
+		}
+	}
+
+	if err := config.AddPackages(path, names); err != nil {
+		log.Error(fmt.Sprintf("Failed to update %s: %v", path, err))
+		return 1
+	}
+	if force {
+		for _, name := range names {
+			if _, err := config.SetPackage(path, name, []string{"force=true"}); err != nil {
+				log.Error(fmt.Sprintf("Failed to update %s: %v", path, err))
+				return 1
+			}
+		}
+	}
+	log.Success(fmt.Sprintf("Added %s to %s", strings.Join(names, ", "), path))
+	return 0
+}
+
+// parsePkgAdd parses the flags of pkg add, which may come before, after or
+// between the package names, and returns the names
+func parsePkgAdd(args []string) (force, vcs bool, names []string, err error) {
+	fs := flag.NewFlagSet("pkg add", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&force, "force", false, "rebuild the packages on every run")
+	fs.BoolVar(&vcs, "vcs", false, "add the VCS packages <name>-git instead")
+	for {
+		if err := fs.Parse(args); err != nil {
+			return false, false, nil, err
+		}
+		if fs.NArg() == 0 {
+			return force, vcs, names, nil
+		}
+		name := fs.Arg(0)
+		if strings.HasPrefix(name, "-") {
+			return false, false, nil, fmt.Errorf("invalid package name %q", name)
+		}
+		names = append(names, name)
+		args = fs.Args()[1:]
+	}
+}
+
+// pkgRemove removes packages from the config. The next run removes them
+// from the repository.
+func pkgRemove(path string, args []string) int {
+	if len(args) == 0 {
+		log.Error("Usage: repo-builder pkg remove <name>... (YAML configs only, TOML and JSON configs can't be edited)")
+		return ExitConfig
+	}
+	cfg := loadConfig()
+	for _, name := range args {
+		if !slices.Contains(cfg.AURNames(), name) {
+			log.Warn(fmt.Sprintf("%s is not in %s", name, path))
+			continue
+		}
+		if err := config.RemovePackage(path, name); err != nil {
+			log.Error(fmt.Sprintf("Failed to remove %s: %v", name, err))
+			return 1
+		}
+		log.Success(fmt.Sprintf("Removed %s from %s, the next run removes it from the repository", name, path))
+	}
+	return 0
+}
+
+// pkgSet sets options of a package in the config
+func pkgSet(path string, args []string) int {
+	if len(args) < 2 {
+		log.Error("Usage: repo-builder pkg set <name> <key>=<value>... (an empty value removes the key; YAML configs only, TOML and JSON configs can't be edited)")
+		return ExitConfig
+	}
+	name := args[0]
+	unset, err := config.SetPackage(path, name, args[1:])
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to update %s: %v", name, err))
+		return 1
+	}
+	for _, key := range unset {
+		log.Warn(fmt.Sprintf("%s of %s is not set", key, name))
+	}
+	log.Success(fmt.Sprintf("Updated %s in %s", name, path))
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePkgAdd(t *testing.T) {
+	tests := []struct {
+		args       []string
+		force, vcs bool
+		names      []string
+	}{
+		{[]string{"foo"}, false, false, []string{"foo"}},
+		{[]string{"--vcs", "--force", "foo"}, true, true, []string{"foo"}},
+		{[]string{"foo", "--vcs", "--force"}, true, true, []string{"foo"}},
+		{[]string{"foo", "--vcs", "bar"}, false, true, []string{"foo", "bar"}},
+		{[]string{"foo", "--", "bar"}, false, false, []string{"foo", "bar"}},
+		{nil, false, false, nil},
+	}
+	for _, tt := range tests {
+		force, vcs, names, err := parsePkgAdd(tt.args)
+		if err != nil {
+			t.Errorf("parsePkgAdd(%q): %v", tt.args, err)
+			continue
+		}
+		if force != tt.force || vcs != tt.vcs || !slices.Equal(names, tt.names) {
+			t.Errorf("parsePkgAdd(%q) = %v, %v, %q, want %v, %v, %q", tt.args, force, vcs, names, tt.force, tt.vcs, tt.names)
+		}
+	}
+}
+
+func TestParsePkgAddErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"foo", "--unknown"},
+		{"foo", "--", "-bar"},
+	} {
+		if _, _, names, err := parsePkgAdd(args); err == nil {
+			t.Errorf("parsePkgAdd(%q) = %q, want an error", args, names)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/remote"
+	"builder/internal/shell"
+	"builder/internal/state"
+)
+
+// buildPool spreads the builds of a run over several build machines, one
+// build per machine at a time. Builds are queued while the packages are
+// checked and start once all are, the longest first by their last build
+// time, so a heavy package doesn't end up building alone at the end.
+type buildPool struct {
+	hosts []*remote.Host
+	jobs  []*buildJob
+}
+
+// buildJob is a queued build and what becomes of it
+type buildJob struct {
+	name, pkgDir, bumpTo string
+	// expected is how long the last build took, 0 if unknown
+	expected time.Duration
+	// postBuild runs the post-build hooks on the package files
+	postBuild func(pkgFiles []string) error
+	// done handles the outcome after all builds finished, in the order
+	// the jobs were queued
+	done func(files []string, err error)
+
+	host  *remote.Host
+	files []string
+	err   error
+}
+
+// newBuildPool returns the pool of hosts, or nil for fewer than two,
+// which build one package after the other
+func newBuildPool(hosts []*remote.Host) *buildPool {
+	if len(hosts) < 2 {
+		return nil
+	}
+	return &buildPool{hosts: hosts}
+}
+
+// queue adds job to the builds of the run
+func (p *buildPool) queue(job *buildJob) {
+	p.jobs = append(p.jobs, job)
+}
+
+// run builds the queued packages and hands their outcomes to the jobs.
+// After an interrupt, the builds not started yet fail with shell.ErrKilled
+// and are left to the resumed run.
+func (p *buildPool) run(r *run) {
+	jobs := p.jobs
+	p.jobs = nil
+	if len(jobs) == 0 {
+		return
+	}
+	log.Msg("")
+	log.Info(fmt.Sprintf("Building %d packages on %d build machines...", len(jobs), len(p.hosts)))
+
+	byName := make(map[string]*buildJob)
+	for _, job := range jobs {
+		byName[job.name] = job
+	}
+	r.Builder.PostBuild = func(pkgName string, pkgFiles []string) error {
+		return byName[pkgName].postBuild(pkgFiles)
+	}
+	defer func() { r.Builder.PostBuild = nil }()
+
+	order := slices.Clone(jobs)
+	slices.SortStableFunc(order, func(a, b *buildJob) int { return cmp.Compare(b.expected, a.expected) })
+	queue := make(chan *buildJob, len(order))
+	for _, job := range order {
+		queue <- job
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for _, host := range p.hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.host = host
+				if r.interrupted() {
+					job.err = shell.ErrKilled
+					continue
+				}
+				r.setJob(job.name, state.JobBuilding, host)
+				job.files, job.err = r.buildOn(host, job.name, job.pkgDir, job.bumpTo)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, job := range jobs {
+		if job.err == nil {
+			log.Msg(fmt.Sprintf("   Built %s on %s", job.name, job.host.Name))
+		}
+	}
+	for _, job := range jobs {
+		job.done(job.files, job.err)
+	}
+}
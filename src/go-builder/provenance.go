@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/repo"
+	"builder/internal/version"
+)
+
+// writeProvenance records how the package files of pkg were built from
+// commit, next to them in the repository
+func (r *run) writeProvenance(pkg config.Package, commit string, files []string) {
+	info, ok := r.Builder.Builds[pkg.Name]
+	if !ok {
+		return
+	}
+	host, _ := os.Hostname()
+	sourceURL := version.Or(pkg.Source.URL, pkg.Source.Path)
+	if pkg.Source.Kind() == config.SourceAUR {
+		sourceURL = r.AUR.GitURL(pkg.Name)
+	}
+
+	for _, file := range files {
+		sum, err := repo.FileSHA256(filepath.Join(r.Repo.Dir, file))
+		if err != nil {
+			log.Warn(fmt.Sprintf("   No provenance for %s: %v", file, err))
+			continue
+		}
+		record := &provenance.Record{
+			Package:        pkg.Name,
+			File:           file,
+			SHA256:         sum,
+			Source:         pkg.Source.Kind(),
+			SourceURL:      sourceURL,
+			Commit:         commit,
+			PKGBUILDSHA256: info.PKGBUILD,
+			Builder:        provenance.BuilderVersion(),
+			Host:           host,
+			BuildMode:      version.Or(r.Config.Meta.BuildMode, config.BuildModeHost),
+			MakepkgFlags:   info.Args,
+			Started:        info.Started,
+			Finished:       info.Finished,
+		}
+		if err := record.Write(r.Repo.Dir); err != nil {
+			log.Warn(fmt.Sprintf("   Failed to write provenance of %s: %v", file, err))
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"builder/internal/chunk"
+	"builder/internal/config"
+	"builder/internal/fileutil"
+	"builder/internal/log"
+	"builder/internal/publish"
+	"builder/internal/repo"
+	"builder/internal/shell"
+)
+
+// runPublish uploads the files of the build directory that changed since the
+// last publish, either by mirroring them into a directory or by running a
+// command per change. Without either, it commits the build directory to the
+// branch of publish.git and uploads it to the publish.mirrors. It returns
+// the exit code.
+func runPublish(args []string) int {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	dest := fs.String("dest", "", "mirror changes into `dir`, e.g. a mounted bucket")
+	command := fs.String("exec", "", "run `cmd` with sh for every change; it gets PUBLISH_ACTION (upload|delete), PUBLISH_PATH and PUBLISH_FILE")
+	mirror := fs.String("mirror", "", "only publish to the mirror `name` of publish.mirrors")
+	dryRun := fs.Bool("dry-run", false, "only list the changes")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	if *dest == "" && *command == "" && (cfg.Publish.Git.Enabled() || len(cfg.Publish.Mirrors) > 0) {
+		lockRun()
+		if err := splitPackages(cfg); err != nil {
+			log.Error(fmt.Sprintf("Failed to split large packages: %v", err))
+			return 1
+		}
+		return publishAll(cfg, *mirror, *dryRun)
+	}
+	if (*dest == "") == (*command == "") && !*dryRun {
+		log.Error("publish needs exactly one of --dest or --exec, or publish.git or publish.mirrors in the config")
+		return ExitConfig
+	}
+
+	lockRun()
+	if err := splitPackages(cfg); err != nil {
+		log.Error(fmt.Sprintf("Failed to split large packages: %v", err))
+		return 1
+	}
+	upload := func(change publish.Change) error {
+		if *dest != "" {
+			return mirrorChange(change, *dest)
+		}
+		return execChange(change, *command)
+	}
+	if !publishDelta(filepath.Join(BuildDir, publish.StateFile), upload, *dryRun) {
+		return 1
+	}
+	return 0
+}
+
+// publishAll publishes the build directory to the branch of publish.git and
+// to every mirror, or only to the mirror named only, going on when one of
+// them fails. It returns the exit code.
+func publishAll(cfg *config.Config, only string, dryRun bool) int {
+	var failed []string
+	if only == "" && cfg.Publish.Git.Enabled() {
+		if publishGit(cfg, dryRun) != 0 {
+			failed = append(failed, cfg.Publish.Git.Branch)
+		}
+	}
+	found := false
+	for _, m := range cfg.Publish.Mirrors {
+		if only != "" && m.Name != only {
+			continue
+		}
+		found = true
+		log.Msg("")
+		log.Info(fmt.Sprintf("Publishing to mirror %s...", m.Name))
+		if !publishMirror(m, dryRun) {
+			failed = append(failed, m.Name)
+		}
+	}
+	if only != "" && !found {
+		log.Error(fmt.Sprintf("No mirror %s in publish.mirrors", only))
+		return ExitConfig
+	}
+
+	if len(failed) > 0 {
+		log.Msg("")
+		log.Error(fmt.Sprintf("Publishing to %s failed", strings.Join(failed, ", ")))
+		return 1
+	}
+	return 0
+}
+
+// publishMirror uploads the build directory to the mirror m and reports
+// whether it succeeded. rsync syncs the whole directory, the other methods
+// upload the changes since the last publish to m.
+func publishMirror(m config.Mirror, dryRun bool) bool {
+	var upload func(publish.Change) error
+	switch m.Method() {
+	case config.MirrorRsync:
+		return rsyncMirror(m.Rsync, dryRun)
+	case config.MirrorDest:
+		upload = func(change publish.Change) error { return mirrorChange(change, m.Dest) }
+	case config.MirrorExec:
+		upload = func(change publish.Change) error { return execChange(change, m.Exec) }
+	case config.MirrorS3:
+		upload = func(change publish.Change) error { return s3Change(change, m.S3) }
+	}
+	return publishDelta(filepath.Join(BuildDir, publish.MirrorStateFile(m.Name)), upload, dryRun)
+}
+
+// publishDelta uploads the files of the build directory that changed since
+// the publish recorded in statePath with upload, and records the new state.
+// It reports whether every change was published.
+func publishDelta(statePath string, upload func(publish.Change) error, dryRun bool) bool {
+	old, err := publish.Load(statePath)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Ignoring unreadable publish state, publishing everything: %v", err))
+	}
+	cur, err := publish.Scan(BuildDir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to scan %s: %v", BuildDir, err))
+		return false
+	}
+
+	changes := publish.Diff(old, cur)
+	log.Info(fmt.Sprintf("Publishing %d of %d files", len(changes), len(cur)))
+
+	failed := 0
+	for _, change := range changes {
+		if dryRun {
+			if change.Deleted {
+				log.Msg(fmt.Sprintf("   - %s", change.Path))
+			} else {
+				log.Msg(fmt.Sprintf("   + %s", change.Path))
+			}
+			continue
+		}
+
+		if err := upload(change); err != nil {
+			log.Error(fmt.Sprintf("Failed to publish %s: %v", change.Path, err))
+			failed++
+			// Keep the old state so the change is retried next time
+			if sum, ok := old[change.Path]; ok {
+				cur[change.Path] = sum
+			} else {
+				delete(cur, change.Path)
+			}
+			continue
+		}
+		if change.Deleted {
+			log.Warn(fmt.Sprintf("   Deleted: %s", change.Path))
+		} else {
+			log.Success(fmt.Sprintf("   Uploaded: %s", change.Path))
+		}
+	}
+
+	if dryRun {
+		return true
+	}
+
+	if err := cur.Save(statePath); err != nil {
+		log.Error(fmt.Sprintf("Failed to save publish state: %v", err))
+		return false
+	}
+
+	if failed > 0 {
+		log.Error(fmt.Sprintf("Publish failed for %d files", failed))
+		return false
+	}
+	log.Success("Publish completed")
+	return true
+}
+
+// splitPackages splits the package files over publish.chunk-size of the
+// repositories in the build directory into parts, and writes the client
+// script joining them. Without chunk-size, it removes any parts.
+func splitPackages(cfg *config.Config) error {
+	size := int64(cfg.Publish.ChunkSize)
+	script := filepath.Join(BuildDir, chunk.ScriptFile)
+	if size == 0 {
+		if err := os.Remove(script); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := chunk.WriteScript(script); err != nil {
+		return err
+	}
+
+	for _, t := range targets(cfg) {
+		dirs := []string{t.Repo.Dir}
+		if t.Stable != nil {
+			dirs = append(dirs, t.Stable.Dir)
+		}
+		if t.Debug != nil {
+			dirs = append(dirs, t.Debug.Dir)
+		}
+		for _, dir := range dirs {
+			if _, ok := nestedDir(dir); !ok {
+				continue
+			}
+			split, err := chunk.Sync(dir, size)
+			for _, name := range split {
+				log.Msg(fmt.Sprintf("   Split %s into parts of %s", name, cfg.Publish.ChunkSize))
+			}
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mirrorChange applies a change to the mirror directory dest
+func mirrorChange(change publish.Change, dest string) error {
+	target := filepath.Join(dest, filepath.FromSlash(change.Path))
+	if change.Deleted {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return fileutil.CopyFile(filepath.Join(BuildDir, filepath.FromSlash(change.Path)), target)
+}
+
+// execChange runs the user's upload command for a change
+func execChange(change publish.Change, command string) error {
+	action := "upload"
+	if change.Deleted {
+		action = "delete"
+	}
+	file, _ := filepath.Abs(filepath.Join(BuildDir, filepath.FromSlash(change.Path)))
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"PUBLISH_ACTION="+action,
+		"PUBLISH_PATH="+change.Path,
+		"PUBLISH_FILE="+file,
+	)
+	shell.Attach(cmd)
+	return shell.Run(cmd)
+}
+
+// s3Change applies a change to the S3 URL base with the aws CLI
+func s3Change(change publish.Change, base string) error {
+	target := strings.TrimSuffix(base, "/") + "/" + change.Path
+	cmd := exec.Command("aws", "s3", "rm", "--only-show-errors", target)
+	if !change.Deleted {
+		file := filepath.Join(BuildDir, filepath.FromSlash(change.Path))
+		cmd = exec.Command("aws", "s3", "cp", "--only-show-errors", file, target)
+	}
+	shell.Attach(cmd)
+	return shell.Run(cmd)
+}
+
+// rsyncMirror syncs the build directory to the rsync destination dest and
+// reports whether it succeeded. The packages go first, the databases and
+// deletions after them, so clients never see a database listing missing
+// files.
+func rsyncMirror(dest string, dryRun bool) bool {
+	passes := [][]string{
+		{"--exclude=*.db*", "--exclude=*.files*"},
+		{"--delete-after"},
+	}
+	for _, pass := range passes {
+		args := append([]string{"-rlptz", "--exclude=.*"}, pass...)
+		if dryRun {
+			args = append(args, "--dry-run", "--itemize-changes")
+		}
+		cmd := exec.Command("rsync", append(args, BuildDir+"/", dest)...)
+		if dryRun {
+			out, err := shell.Output(cmd)
+			for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+				if line != "" {
+					log.Msg("   " + line)
+				}
+			}
+			if err != nil {
+				log.Error(fmt.Sprintf("rsync to %s failed: %v", dest, err))
+				return false
+			}
+			continue
+		}
+		shell.Attach(cmd)
+		if err := shell.Run(cmd); err != nil {
+			log.Error(fmt.Sprintf("rsync to %s failed: %v", dest, err))
+			return false
+		}
+	}
+	if !dryRun {
+		log.Success(fmt.Sprintf("Synced %s to %s", BuildDir, dest))
+	}
+	return true
+}
+
+// publishGit commits the changes in the build directory to the branch of
+// publish.git and pushes it. It returns the exit code.
+func publishGit(cfg *config.Config, dryRun bool) int {
+	conf := cfg.Publish.Git
+	maxFileSize := cmp.Or(int64(conf.MaxFileSize), publish.DefaultMaxFileSize)
+	g := &publish.Git{
+		Dir:          BuildDir,
+		Branch:       conf.Branch,
+		Remote:       cmp.Or(conf.Remote, "origin"),
+		Author:       conf.Author,
+		Squash:       conf.Squash,
+		LFS:          conf.LFS,
+		LFSThreshold: cmp.Or(int64(conf.LFSThreshold), maxFileSize/2),
+		MaxFileSize:  maxFileSize,
+	}
+
+	lockRun()
+	if err := g.Prepare(); err != nil {
+		log.Error(fmt.Sprintf("Failed to prepare %s: %v", BuildDir, err))
+		return 1
+	}
+	changes, err := g.Stage()
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to stage %s: %v", BuildDir, err))
+		return 1
+	}
+	if len(changes) == 0 {
+		log.Success(fmt.Sprintf("Nothing to publish, %s is up to date", g.Branch))
+		return 0
+	}
+
+	message := gitCommitMessage(cfg.Meta.RepoName, changes)
+	log.Info(fmt.Sprintf("Publishing %d changed files to %s of %s", len(changes), g.Branch, g.Remote))
+	for _, line := range strings.Split(message, "\n") {
+		log.Msg("   " + line)
+	}
+	if dryRun {
+		return 0
+	}
+
+	if err := g.Commit(message); err != nil {
+		log.Error(fmt.Sprintf("Failed to commit: %v", err))
+		return 1
+	}
+	if err := g.Push(); err != nil {
+		log.Error(fmt.Sprintf("Failed to push to %s: %v", g.Remote, err))
+		return 1
+	}
+	log.Success("Publish completed")
+	return 0
+}
+
+// gitCommitMessage describes the package files added and removed by
+// changes, lines of `git diff --name-status`
+func gitCommitMessage(repoName string, changes []string) string {
+	added := make(map[string]string)
+	removed := make(map[string]string)
+	for _, line := range changes {
+		status, file, _ := strings.Cut(line, "\t")
+		base := path.Base(file)
+		name, ok := repo.PkgNameFromFile(base)
+		if !ok {
+			continue
+		}
+		// pkgver-pkgrel, without the architecture
+		ver := base[len(name)+1 : strings.Index(base, ".pkg.tar")]
+		ver = ver[:strings.LastIndex(ver, "-")]
+		switch status {
+		case "A":
+			added[name] = ver
+		case "D":
+			removed[name] = ver
+		}
+	}
+
+	var lines, counts []string
+	updated := 0
+	for _, name := range slices.Sorted(maps.Keys(added)) {
+		if from, ok := removed[name]; ok {
+			lines = append(lines, fmt.Sprintf("- %s %s → %s", name, from, added[name]))
+			updated++
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(added)) {
+		if _, ok := removed[name]; !ok {
+			lines = append(lines, fmt.Sprintf("- Added %s %s", name, added[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(removed)) {
+		if _, ok := added[name]; !ok {
+			lines = append(lines, fmt.Sprintf("- Removed %s %s", name, removed[name]))
+		}
+	}
+	for _, c := range []struct {
+		n    int
+		what string
+	}{{updated, "updated"}, {len(added) - updated, "added"}, {len(removed) - updated, "removed"}} {
+		if c.n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", c.n, c.what))
+		}
+	}
+
+	if len(lines) == 0 {
+		return fmt.Sprintf("Update %s", repoName)
+	}
+	return fmt.Sprintf("Update %s: %s\n\n%s", repoName, strings.Join(counts, ", "), strings.Join(lines, "\n"))
+}
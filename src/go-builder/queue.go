@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"builder/internal/log"
+	"builder/internal/remote"
+	"builder/internal/report"
+	"builder/internal/state"
+)
+
+// startQueue writes the build queue of the packages names before the run
+// starts
+func (r *run) startQueue(names []string) {
+	r.queueFailed.Store(false)
+	r.checking = ""
+	q, err := state.NewQueue(filepath.Join(r.Dir, state.QueueFile), names)
+	r.queue = q
+	r.queueError(err)
+}
+
+// checkJob settles the job checked before, and marks name being checked
+// unless empty
+func (r *run) checkJob(name string, results *report.Report) {
+	r.settleJob(r.checking, results)
+	r.checking = name
+	if name != "" {
+		r.setJob(name, state.JobChecking, nil)
+	}
+}
+
+// settleJob records the outcome of name in results in the queue, unless it
+// waits for a build machine. Outcomes are only final once a package is
+// done, the report starts out with kept.
+func (r *run) settleJob(name string, results *report.Report) {
+	res := results.Packages[name]
+	if name == "" || res == nil || r.queue.Status(name) == state.JobQueued {
+		return
+	}
+	r.setJob(name, res.Status, nil)
+}
+
+// setJob records the state of the job name, running on host unless nil
+func (r *run) setJob(name, status string, host *remote.Host) {
+	hostName := ""
+	if host != nil {
+		hostName = host.Name
+	}
+	r.queueError(r.queue.Set(name, status, hostName))
+}
+
+// requeueJob puts the job name an interrupt stopped back to pending
+func (r *run) requeueJob(name string) {
+	if r.checking == name {
+		r.checking = ""
+	}
+	r.setJob(name, state.JobPending, nil)
+}
+
+// publishJobs marks the built jobs published, once the database has them
+func (r *run) publishJobs() {
+	r.queueError(r.queue.Publish())
+}
+
+// finishQueue records that the run ended
+func (r *run) finishQueue() {
+	r.queueError(r.queue.Finish())
+	r.queue = nil
+}
+
+// queueError warns about the first error writing the queue of a run
+func (r *run) queueError(err error) {
+	if err != nil && r.queueFailed.CompareAndSwap(false, true) {
+		log.Warn(fmt.Sprintf("Failed to write %s: %v", state.QueueFile, err))
+	}
+}
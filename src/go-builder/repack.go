@@ -0,0 +1,203 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/repo"
+	"builder/internal/selftest"
+	"builder/internal/state"
+)
+
+// runRepack recompresses the packages in the repositories to another
+// format or level and updates the databases, without rebuilding them. It
+// returns the exit code.
+func runRepack(args []string) int {
+	fs := flag.NewFlagSet("repack", flag.ExitOnError)
+	format := fs.String("format", "", "compress to `format`, zst or xz (default the format of build.pkgext, else zst)")
+	level := fs.Int("level", -1, "compression `level`, 1-22 for zst and 0-9 for xz (default 19 for zst, 9 for xz)")
+	all := fs.Bool("all", false, "also recompress the packages already in the format, e.g. to change the level")
+	dryRun := fs.Bool("dry-run", false, "only list the packages")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	if *format == "" {
+		*format = cmp.Or(repo.PkgFormat(cfg.Build.PkgExt), "zst")
+	}
+	if !slices.Contains(repo.PkgFormats, *format) {
+		log.Error(fmt.Sprintf("Unsupported format %q, expected %s", *format, strings.Join(repo.PkgFormats, " or ")))
+		return ExitConfig
+	}
+	lowest, highest := repo.LevelRange(*format)
+	if *level < 0 {
+		*level = min(highest, 19)
+	}
+	if *level < lowest || *level > highest {
+		log.Error(fmt.Sprintf("Level %d is out of range for %s, %d-%d", *level, *format, lowest, highest))
+		return ExitConfig
+	}
+	if pkgExt := cfg.Build.PkgExt; pkgExt != "" && repo.PkgFormat(pkgExt) != *format {
+		log.Warn(fmt.Sprintf("build.pkgext is %s, later builds are compressed with it again", pkgExt))
+	}
+	lockRun()
+
+	adoptedPath := filepath.Join(BuildDir, state.AdoptedFile)
+	adopted, err := state.LoadAdopted(adoptedPath)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+
+	failed, repacked := 0, 0
+	for _, t := range targets(cfg) {
+		r := &run{Config: t.Config}
+		for _, repoDB := range []*repo.RepoDB{t.Repo, t.Stable, t.Debug} {
+			if repoDB == nil {
+				continue
+			}
+			n, errs := repackRepo(r, repoDB, adopted, *format, *level, *all, *dryRun)
+			repacked += n
+			failed += errs
+		}
+	}
+	if *dryRun {
+		return 0
+	}
+	if err := adopted.Save(adoptedPath); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", state.AdoptedFile, err))
+		return 1
+	}
+	if repacked > 0 {
+		log.Success(fmt.Sprintf("Repacked %d package files, publish or run to upload them", repacked))
+	} else if failed == 0 {
+		log.Info("Nothing to repack")
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// repackRepo recompresses the packages in the database of repoDB and
+// returns how many it repacked and how many failed
+func repackRepo(r *run, repoDB *repo.RepoDB, adopted state.Adopted, format string, level int, all, dryRun bool) (repacked, failed int) {
+	db, err := repoDB.Open()
+	if os.IsNotExist(err) {
+		return 0, 0
+	} else if err != nil {
+		log.Error(fmt.Sprintf("Failed to read the database of %s: %v", repoDB.Name, err))
+		return 0, 1
+	}
+
+	var todo []string
+	for _, pkg := range db.List() {
+		if all || repo.PkgFormat(pkg.Filename) != format {
+			todo = append(todo, pkg.Filename)
+		}
+	}
+	if len(todo) == 0 {
+		return 0, 0
+	}
+	log.Info(fmt.Sprintf("Repacking %d packages of %s to %s -%d...", len(todo), repoDB.Name, format, level))
+	if dryRun {
+		for _, file := range todo {
+			log.Msg(fmt.Sprintf("   %s -> %s", file, repo.RepackName(file, format)))
+		}
+		return 0, 0
+	}
+
+	key := r.Config.Meta.SigningKey
+	var files, replaced []string
+	for _, file := range todo {
+		if _, err := os.Stat(filepath.Join(repoDB.Dir, file+".sig")); err == nil && key == "" {
+			log.Warn(fmt.Sprintf("   Skipping %s, it is signed but there is no signing-key to sign it again", file))
+			continue
+		}
+		newFile, err := repackFile(repoDB.Dir, file, format, level, key)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to repack %s: %v", file, err))
+			failed++
+			continue
+		}
+		log.Msg(fmt.Sprintf("   %s", newFile))
+		files = append(files, newFile)
+		if newFile != file {
+			replaced = append(replaced, file)
+		}
+		for name, a := range adopted {
+			if a.File == file {
+				a.File = newFile
+				adopted[name] = a
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return 0, failed
+	}
+	r.Repo = repoDB
+	if !r.withDBPolicy("update repo database", func() error { return repoDB.Add(files) }) {
+		// The database still lists the old files, so the new ones go
+		for _, file := range files {
+			if !slices.Contains(todo, file) {
+				os.Remove(filepath.Join(repoDB.Dir, file))
+				os.Remove(filepath.Join(repoDB.Dir, file+".sig"))
+				os.Remove(filepath.Join(repoDB.Dir, file+provenance.Suffix))
+			}
+		}
+		return 0, failed + len(files)
+	}
+	for _, file := range replaced {
+		os.Remove(filepath.Join(repoDB.Dir, file))
+		os.Remove(filepath.Join(repoDB.Dir, file+".sig"))
+		os.Remove(filepath.Join(repoDB.Dir, file+provenance.Suffix))
+	}
+	r.updateChecksums(repoDB)
+	repo.FixPermissions(repoDB.Dir)
+	return len(files), failed
+}
+
+// repackFile recompresses the package file in dir, checks and signs the
+// result and moves the provenance record over. It returns the new file
+// name.
+func repackFile(dir, file, format string, level int, key string) (string, error) {
+	newFile, err := repo.Repack(dir, file, format, level, selftest.VerifyArchive)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, newFile)
+	if key != "" {
+		if err := repo.SignFile(path, key); err != nil {
+			if newFile != file {
+				os.Remove(path)
+				os.Remove(path + ".sig")
+			}
+			return "", fmt.Errorf("signing: %w", err)
+		}
+	}
+
+	record, err := provenance.Load(dir, file)
+	if os.IsNotExist(err) {
+		return newFile, nil
+	} else if err != nil {
+		log.Warn(fmt.Sprintf("   Failed to read the provenance of %s: %v", file, err))
+		return newFile, nil
+	}
+	now := time.Now().UTC()
+	record.File, record.Repacked = newFile, &now
+	if record.SHA256, err = repo.FileSHA256(path); err == nil {
+		err = record.Write(dir)
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("   Failed to update the provenance of %s: %v", newFile, err))
+	}
+	return newFile, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/repo"
+)
+
+// target is a repository built by a run
+type target struct {
+	Config *config.Config
+	// Dir is the build directory, holding the Arch directory, site and
+	// state of the repository
+	Dir  string
+	Repo *repo.RepoDB
+	// Stable is the repository promote publishes to with staging, which
+	// builds go to Repo then; nil without staging
+	Stable *repo.RepoDB
+	// Debug is the repository of the debug packages with debug-packages:
+	// separate, else nil
+	Debug *repo.RepoDB
+}
+
+// targets returns the main repository followed by the additional ones,
+// exiting if one cannot be placed
+func targets(cfg *config.Config) []target {
+	all := []target{{Config: cfg, Dir: BuildDir}}
+	for _, r := range cfg.Repos {
+		dir := filepath.Clean(r.Dir)
+		if r.Dir == "" {
+			dir = filepath.Join(BuildDir, r.Name)
+		}
+		derived := cfg.ForRepo(r)
+		rel, nested := nestedDir(dir)
+		if r.RepoURL == "" {
+			if !nested {
+				log.Error(fmt.Sprintf("repos: %s needs a repo-url, %s is outside %s", r.Name, dir, BuildDir))
+				exit(ExitConfig)
+			}
+			derived.Meta.RepoURL = strings.TrimSuffix(cfg.Meta.RepoURL, "/") + "/" + filepath.ToSlash(rel)
+		}
+		// Mirrors hold the build directory, so only the repositories in it
+		derived.Publish.Mirrors = nil
+		for _, m := range cfg.Publish.Mirrors {
+			if nested && m.URL != "" {
+				m.URL = strings.TrimSuffix(m.URL, "/") + "/" + filepath.ToSlash(rel)
+				derived.Publish.Mirrors = append(derived.Publish.Mirrors, m)
+			}
+		}
+		all = append(all, target{Config: derived, Dir: dir})
+	}
+
+	dirs := make(map[string]string)
+	claim := func(dir, name string) {
+		if other, ok := dirs[dir]; ok {
+			log.Error(fmt.Sprintf("repos: %s and %s share %s", other, name, dir))
+			exit(ExitConfig)
+		}
+		dirs[dir] = name
+	}
+	for i, t := range all {
+		name := t.Config.Meta.RepoName
+		claim(t.Dir, name)
+		all[i].Repo = repo.New(name, filepath.Join(t.Dir, Arch))
+		all[i].Repo.Compression = t.Config.Meta.DBCompression
+		if t.Config.Meta.Staging {
+			claim(stagingDir(t), name+StagingSuffix)
+			all[i].Stable = all[i].Repo
+			all[i].Repo = repo.New(name+StagingSuffix, filepath.Join(stagingDir(t), Arch))
+			all[i].Repo.Compression = t.Config.Meta.DBCompression
+		}
+		if t.Config.DebugPolicy() == config.DebugSeparate {
+			claim(debugDir(t), name+DebugSuffix)
+			all[i].Debug = repo.New(name+DebugSuffix, filepath.Join(debugDir(t), Arch))
+			all[i].Debug.Compression = t.Config.Meta.DBCompression
+		}
+	}
+	host := repoHost(cfg)
+	for _, t := range all {
+		for _, r := range []*repo.RepoDB{t.Repo, t.Stable, t.Debug} {
+			if r != nil {
+				r.Remote = host
+			}
+		}
+	}
+	return all
+}
+
+// mainRepo returns the main repository, for the commands only handling it
+func mainRepo(cfg *config.Config) *repo.RepoDB {
+	r := repo.New(cfg.Meta.RepoName, filepath.Join(BuildDir, Arch))
+	r.Compression = cfg.Meta.DBCompression
+	r.Remote = repoHost(cfg)
+	return r
+}
+
+// nestedDir returns the path of dir inside BuildDir, and false if it is
+// outside
+func nestedDir(dir string) (string, bool) {
+	rel, err := filepath.Rel(BuildDir, dir)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// use switches the run to the repository t
+func (r *run) use(t target) {
+	r.Config, r.Dir, r.Repo, r.Stable, r.Debug = t.Config, t.Dir, t.Repo, t.Stable, t.Debug
+	r.Resumed = false
+	r.Builder.OutDir = t.Repo.Dir
+	r.Builder.Debug = t.Config.DebugPolicy()
+	r.Builder.DebugDir = ""
+	if t.Debug != nil {
+		r.Builder.DebugDir = t.Debug.Dir
+	}
+	r.Builder.Expect = make(map[string]*config.Expect)
+	r.Builder.RunChecks = make(map[string]bool)
+	r.Builder.TestCmd = make(map[string]string)
+	for _, pkg := range t.Config.Packages.AUR {
+		if pkg.Expect != nil {
+			r.Builder.Expect[pkg.Name] = pkg.Expect
+		}
+		if pkg.RunChecks != nil {
+			r.Builder.RunChecks[pkg.Name] = *pkg.RunChecks
+		}
+		if pkg.TestCmd != "" {
+			r.Builder.TestCmd[pkg.Name] = pkg.TestCmd
+		}
+	}
+}
+
+// RunAll runs every repository and returns the number of failed packages
+// and database operations. With a non-nil only, just those packages are
+// checked, and repositories holding none of them are left out; with resume,
+// each repository continues its interrupted run instead.
+func (r *run) RunAll(only map[string]bool, resume bool) int {
+	failed := 0
+	degraded := ""
+	publishFailed := false
+	r.failedFast = false
+	for _, t := range r.Targets {
+		if r.interrupted() || r.failedFast {
+			break
+		}
+		if only != nil && !holdsAny(t.Config, only) {
+			continue
+		}
+		r.use(t)
+		if len(r.Targets) > 1 {
+			log.Msg("")
+			log.Warn(fmt.Sprintf("Repository %s (%s)", t.Config.Meta.RepoName, t.Dir))
+		}
+		selected := only
+		if resume {
+			selected = r.resumeSet()
+		}
+		failed += r.Run(selected)
+		if r.Degraded != "" {
+			degraded = r.Degraded
+		}
+		publishFailed = publishFailed || r.PublishFailed
+	}
+	r.Degraded, r.PublishFailed = degraded, publishFailed
+	if r.MetricsFile != "" {
+		if err := r.Metrics.WriteFile(r.MetricsFile); err != nil {
+			log.Error(fmt.Sprintf("Failed to write metrics: %v", err))
+		}
+	}
+	return failed
+}
+
+// holdsAny reports whether cfg has one of names among its packages
+func holdsAny(cfg *config.Config, names map[string]bool) bool {
+	for _, name := range append(cfg.AURNames(), cfg.MetaNames()...) {
+		if names[name] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/shell"
+	"builder/internal/source"
+	"builder/internal/state"
+)
+
+// verifyReproducible rebuilds a package and compares the result bit for bit
+// with the published package files, rebuilding from the commit and with the
+// build date they were built with. Without published files of the current
+// version it builds the package twice instead. It returns the exit code.
+func (r *run) verifyReproducible(name string) int {
+	var pkg *config.Package
+	for _, t := range r.Targets {
+		for i := range t.Config.Packages.AUR {
+			if t.Config.Packages.AUR[i].Name == name {
+				r.use(t)
+				pkg = &t.Config.Packages.AUR[i]
+			}
+		}
+	}
+	if pkg == nil {
+		log.Error(fmt.Sprintf("--verify-reproducible: %s is not an AUR package in the config", name))
+		return ExitConfig
+	}
+
+	src := r.Sources.For(*pkg)
+	if err := src.Fetch(); err != nil {
+		log.Error(fmt.Sprintf("Failed to fetch %s: %v", name, err))
+		return 1
+	}
+	tmp, err := os.MkdirTemp("", "reproducible-")
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+
+	published, bumpTo, restore, err := r.reproduceFrom(*pkg, src)
+	if err != nil {
+		log.Error(fmt.Sprintf("Cannot rebuild the published %s: %v", name, err))
+		return 1
+	}
+	defer restore()
+
+	first := filepath.Join(tmp, "first")
+	var reference []string
+	if len(published) > 0 {
+		log.Info(fmt.Sprintf("Rebuilding %s %s to compare it with the published packages", name, r.Repo.Version(name)))
+		for _, file := range published {
+			reference = append(reference, filepath.Join(r.Repo.Dir, file))
+		}
+	} else {
+		log.Info(fmt.Sprintf("Building %s twice to compare the builds", name))
+		r.Builder.SourceDateEpoch = time.Now().Unix()
+		files, err := r.buildInto(name, src.Path(), bumpTo, first)
+		if err != nil {
+			return 1
+		}
+		for _, file := range files {
+			reference = append(reference, filepath.Join(first, file))
+		}
+		first = filepath.Join(tmp, "second")
+	}
+	files, err := r.buildInto(name, src.Path(), bumpTo, first)
+	if err != nil {
+		return 1
+	}
+
+	log.Msg("")
+	mismatches := 0
+	for _, ref := range reference {
+		file := filepath.Base(ref)
+		rebuilt := filepath.Join(first, file)
+		if !slices.Contains(files, file) {
+			log.Error(fmt.Sprintf("Not reproducible: %s was not built again", file))
+			mismatches++
+			continue
+		}
+		diff, err := buildsys.ComparePackages(ref, rebuilt)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to compare %s: %v", file, err))
+			mismatches++
+			continue
+		}
+		if diff == nil {
+			log.Success(fmt.Sprintf("Reproducible: %s", file))
+			continue
+		}
+		mismatches++
+		log.Error(fmt.Sprintf("Not reproducible: %s", file))
+		reportDifference(diff)
+		if _, err := exec.LookPath("diffoscope"); err == nil {
+			cmd := exec.Command("diffoscope", "--text", "-", ref, rebuilt)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			shell.Run(cmd)
+		}
+	}
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// reproduceFrom prepares rebuilding the published packages of pkg: it
+// checks out the commit their provenance records and fixes the build date
+// to theirs. It returns the published package files and the pkgrel bump
+// they were built with, or no files if the source no longer builds their
+// version, and a function restoring the source.
+func (r *run) reproduceFrom(pkg config.Package, src source.Provider) ([]string, string, func(), error) {
+	none := func() {}
+	split := r.Repo.Split(pkg.Name)
+	if len(split) == 0 {
+		return nil, "", none, nil
+	}
+
+	restore := none
+	if record, err := provenance.Load(r.Repo.Dir, split[0].Filename); err != nil {
+		log.Warn(fmt.Sprintf("No provenance for %s, rebuilding from the current source", split[0].Filename))
+	} else if record.Commit != "" {
+		if restore, err = source.Checkout(src, record.Commit); err != nil {
+			return nil, "", nil, fmt.Errorf("checking out %s: %v", record.Commit, err)
+		}
+		log.Msg(fmt.Sprintf("   Checked out %s", shortCommit(record.Commit)))
+	}
+
+	published := r.Repo.Version(pkg.Name)
+	bumpTo := ""
+	st, _ := state.Load(filepath.Join(r.Dir, state.FileName))
+	if entry := st.Get(pkg.Name); entry != nil && entry.Bump != nil && entry.Bump.Version == published {
+		bumpTo = published
+	}
+	if bumpTo == "" && buildsys.PKGBUILDVersion(src.Path()) != published {
+		log.Warn(fmt.Sprintf("The source no longer builds the published %s", published))
+		restore()
+		return nil, "", none, nil
+	}
+
+	info, err := buildsys.ReadPkginfo(filepath.Join(r.Repo.Dir, split[0].Filename))
+	if err != nil || len(info["builddate"]) == 0 {
+		restore()
+		return nil, "", nil, fmt.Errorf("no build date in %s", split[0].Filename)
+	}
+	if r.Builder.SourceDateEpoch, err = strconv.ParseInt(info["builddate"][0], 10, 64); err != nil {
+		restore()
+		return nil, "", nil, fmt.Errorf("invalid build date in %s: %v", split[0].Filename, err)
+	}
+
+	var files []string
+	for _, p := range split {
+		files = append(files, p.Filename)
+	}
+	return files, bumpTo, restore, nil
+}
+
+// buildInto builds a package with its package files going to dir
+func (r *run) buildInto(name, pkgDir, bumpTo, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	outDir := r.Builder.OutDir
+	r.Builder.OutDir = dir
+	defer func() { r.Builder.OutDir = outDir }()
+	return r.build(name, pkgDir, bumpTo)
+}
+
+// reportDifference summarizes how a rebuilt package differs
+func reportDifference(diff *buildsys.Difference) {
+	if len(diff.Missing)+len(diff.Extra)+len(diff.Changed) == 0 {
+		log.Msg("   Same contents, only the archive differs (member order or timestamps)")
+		return
+	}
+	for _, path := range diff.Missing {
+		log.Msg(fmt.Sprintf("   Missing: %s", path))
+	}
+	for _, path := range diff.Extra {
+		log.Msg(fmt.Sprintf("   Extra:   %s", path))
+	}
+	for _, path := range diff.Changed {
+		log.Msg(fmt.Sprintf("   Changed: %s", path))
+	}
+	for _, line := range diff.Metadata {
+		log.Msg(fmt.Sprintf("     %s", line))
+	}
+}
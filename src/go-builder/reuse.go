@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"builder/internal/buildsys"
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/repo"
+)
+
+// reuseBinaries publishes the packages built from pkgbase at version from
+// the first binary repository shipping them, signed with the repository
+// key if there is one. It returns the published files, relative to the
+// repository directory, and false if the package must be built instead.
+func (r *run) reuseBinaries(pkgbase, version string) ([]string, bool) {
+	if r.Binaries == nil || version == "" {
+		return nil, false
+	}
+	match, errs := r.Binaries.Find(pkgbase, version)
+	for _, err := range errs {
+		log.Warn(fmt.Sprintf("   Cannot read binary repo %v", err))
+	}
+	if match == nil {
+		log.Msg(fmt.Sprintf("   %s %s is in no binary repo, building it", pkgbase, version))
+		return nil, false
+	}
+
+	log.Msg(fmt.Sprintf("   Reusing %s %s from %s", pkgbase, version, match.Repo.Name))
+	var files, debugFiles []string
+	abandon := func(err error) ([]string, bool) {
+		log.Warn(fmt.Sprintf("   %v, building instead", err))
+		for _, file := range files {
+			os.Remove(filepath.Join(r.Repo.Dir, file))
+			os.Remove(filepath.Join(r.Repo.Dir, file+".sig"))
+		}
+		for _, file := range debugFiles {
+			os.Remove(filepath.Join(r.Debug.Dir, file))
+			os.Remove(filepath.Join(r.Debug.Dir, file+".sig"))
+		}
+		return nil, false
+	}
+	for _, pkg := range match.Packages {
+		dir := r.Repo.Dir
+		separate := false
+		if buildsys.IsDebugName(pkg.Name, pkgbase) {
+			switch r.Config.DebugPolicy() {
+			case config.DebugStrip:
+				continue
+			case config.DebugSeparate:
+				dir, separate = r.Debug.Dir, true
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return abandon(err)
+				}
+			}
+		}
+		if err := r.Binaries.Download(match.Repo, pkg, dir); err != nil {
+			return abandon(fmt.Errorf("failed to download %s: %w", pkg.Filename, err))
+		}
+		if separate {
+			debugFiles = append(debugFiles, pkg.Filename)
+		} else {
+			files = append(files, pkg.Filename)
+		}
+		if key := r.Config.Meta.SigningKey; key != "" {
+			if err := repo.SignFile(filepath.Join(dir, pkg.Filename), key); err != nil {
+				return abandon(fmt.Errorf("failed to sign %s: %w", pkg.Filename, err))
+			}
+		}
+		log.Success(fmt.Sprintf("Reused: %s", pkg.Filename))
+	}
+	r.debugFiles = append(r.debugFiles, debugFiles...)
+	return files, true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"builder/internal/config"
+	"builder/internal/log"
+	"builder/internal/source"
+	"builder/internal/state"
+	"builder/internal/tui"
+)
+
+// ReviewDir holds the last reviewed PKGBUILD diff of every AUR package,
+// relative to the build directory
+const ReviewDir = "reviews"
+
+// review shows the PKGBUILD and install script changes of an AUR package
+// since its last successful build and returns an error if it must not be
+// built. The diff is recorded under ReviewDir.
+func (r *run) review(name string, src source.Provider, st *state.State, commit string) error {
+	mode := r.Config.Meta.Review
+	if mode == "" || mode == config.ReviewOff {
+		return nil
+	}
+
+	base := ""
+	if e := st.Get(name); e != nil {
+		if commit != "" && e.Reviewed == commit {
+			return nil
+		}
+		if e.LastSuccess != nil {
+			base = e.LastSuccess.Commit
+		}
+	}
+	if commit != "" && base == commit {
+		return nil
+	}
+
+	diff, full, err := source.Diff(src, base)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		log.Warn("Review: first build, showing the full PKGBUILD")
+	} else if full {
+		log.Warn(fmt.Sprintf("Review: %s is unavailable, showing the full PKGBUILD", shortCommit(base)))
+	} else {
+		log.Warn(fmt.Sprintf("Review: PKGBUILD changes since %s", shortCommit(base)))
+	}
+	log.Msg(strings.TrimRight(diff, "\n"))
+
+	path := filepath.Join(r.Dir, ReviewDir, name+".diff")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		err = os.WriteFile(path, []byte(diff), 0644)
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to record review: %v", err))
+	}
+
+	if mode == config.ReviewPrompt {
+		if !tui.IsTerminal(os.Stdin) {
+			return fmt.Errorf("review required, run interactively or set review: auto")
+		}
+		if !confirm(fmt.Sprintf("Build %s with these changes?", name)) {
+			return fmt.Errorf("rejected in review")
+		}
+	}
+	st.Approve(name, commit)
+	return nil
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// confirm asks question on the terminal and reports whether it was
+// answered with yes
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	a := strings.ToLower(strings.TrimSpace(answer))
+	return a == "y" || a == "yes"
+}
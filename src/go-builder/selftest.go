@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/selftest"
+)
+
+// runSelftest checks the local repository and, unless --local is given, the
+// published one as a pacman 7 client would see it. It returns the exit code.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	localOnly := fs.Bool("local", false, "only check the local build directory")
+	serverURL := fs.String("url", "", "pacman `server` to check instead of repo-url/"+Arch)
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	repoDB := mainRepo(cfg)
+
+	log.Msg("")
+	log.Info(fmt.Sprintf("Checking local repository %s...", repoDB.Dir))
+	failed := printReport(selftest.Local(repoDB.Dir, repoDB.DBFile()))
+
+	if !*localOnly {
+		url := *serverURL
+		if url == "" {
+			url = cfg.Meta.RepoURL + "/" + Arch
+		}
+		log.Msg("")
+		log.Info(fmt.Sprintf("Simulating pacman client against %s...", url))
+		client := &http.Client{Timeout: 30 * time.Second}
+		failed += printReport(selftest.Remote(client, url, cfg.Meta.RepoName, cfg.Meta.SigningKey != ""))
+	}
+
+	log.Msg("")
+	if failed > 0 {
+		log.Error(fmt.Sprintf("Selftest failed: %d checks", failed))
+		return 1
+	}
+	log.Success("Selftest passed")
+	return 0
+}
+
+// printReport logs every check and returns the number of failures
+func printReport(report *selftest.Report) int {
+	for _, res := range report.Results {
+		if res.Err != nil {
+			log.Error(fmt.Sprintf("   %s: %v", res.Check, res.Err))
+		} else {
+			log.Success(fmt.Sprintf("   %s", res.Check))
+		}
+	}
+	return report.Failed()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/metrics"
+)
+
+// repoTypes are the content types of the repository files Go doesn't know
+var repoTypes = map[string]string{
+	".zst":   "application/zstd",
+	".xz":    "application/x-xz",
+	".gz":    "application/gzip",
+	".bz2":   "application/x-bzip2",
+	".sig":   "application/pgp-signature",
+	".db":    "application/octet-stream",
+	".files": "application/octet-stream",
+}
+
+// runServe serves the build directory over HTTP, so pacman on another
+// machine or in a container can use the repository before it is published.
+// It returns the exit code.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "`address` to listen on")
+	dir := fs.String("dir", BuildDir, "`directory` to serve")
+	metricsFile := fs.String("metrics-file", "", "also serve the metrics a run wrote to `file` at /metrics")
+	auth := fs.String("auth", os.Getenv("GOB_SERVE_AUTH"), "require HTTP basic auth with `user:password` (default $GOB_SERVE_AUTH)")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*dir); err != nil {
+		log.Error(fmt.Sprintf("Nothing to serve: %v", err))
+		return 1
+	}
+	user, password, ok := strings.Cut(*auth, ":")
+	if *auth != "" && !ok {
+		log.Error("--auth takes user:password")
+		return ExitConfig
+	}
+	for ext, typ := range repoTypes {
+		mime.AddExtensionType(ext, typ)
+	}
+
+	// http.FileServer handles range requests and conditional requests
+	var handler http.Handler = http.FileServer(http.Dir(*dir))
+	handler = hideDotfiles(handler)
+	if *metricsFile != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", metrics.ContentType)
+			http.ServeFile(w, r, *metricsFile)
+		})
+		handler = mux
+	}
+	if *auth != "" {
+		handler = basicAuth(handler, user, password)
+	}
+
+	host, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("Invalid --addr: %v", err))
+		return ExitConfig
+	}
+	if host == "" {
+		host = "<host>"
+	}
+	log.Info(fmt.Sprintf("Serving %s on %s", *dir, *addr))
+	log.Msg(fmt.Sprintf("   pacman.conf: Server = http://%s/$arch", net.JoinHostPort(host, port)))
+	server := &http.Server{Addr: *addr, Handler: logRequests(handler), ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		log.Error(fmt.Sprintf("Failed to serve: %v", err))
+		return 1
+	}
+	return 0
+}
+
+// hideDotfiles answers 404 for paths with a dotfile, e.g. the publishing
+// .git directory
+func hideDotfiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// basicAuth requires the credentials user and password
+func basicAuth(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="repository"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logRequests logs every request with its response status
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Msg(fmt.Sprintf("   %s %s %s %d", r.RemoteAddr, r.Method, r.URL.Path, rec.status))
+	})
+}
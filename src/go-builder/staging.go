@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"builder/internal/fileutil"
+	"builder/internal/log"
+	"builder/internal/provenance"
+	"builder/internal/repo"
+	"builder/internal/version"
+)
+
+// StagingSuffix turns a repository name into the name of its staging
+// repository
+const StagingSuffix = "-testing"
+
+// stagingDir is the build directory of the staging repository of t, inside
+// the one of t
+func stagingDir(t target) string {
+	return filepath.Join(t.Dir, t.Config.Meta.RepoName+StagingSuffix)
+}
+
+// seedStaging fills a new staging repository with the packages of the
+// repository, so enabling staging doesn't rebuild everything
+func seedStaging(t target) error {
+	if _, err := os.Stat(filepath.Join(t.Repo.Dir, t.Repo.DBFile())); err == nil {
+		return nil
+	}
+	db, err := t.Stable.Open()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Seeding %s with the packages of %s...", t.Repo.Name, t.Stable.Name))
+	var files []string
+	for _, pkg := range db.List() {
+		if err := copyPackage(pkg.Filename, t.Stable.Dir, t.Repo.Dir); err != nil {
+			return err
+		}
+		files = append(files, pkg.Filename)
+	}
+	return t.Repo.Add(files)
+}
+
+// copyPackage copies a package file, with its signature and provenance
+// record if there are ones, from one repository directory to another
+func copyPackage(file, from, to string) error {
+	if err := fileutil.CopyFile(filepath.Join(from, file), filepath.Join(to, file)); err != nil {
+		return err
+	}
+	for _, sidecar := range []string{file + ".sig", file + provenance.Suffix} {
+		if _, err := os.Stat(filepath.Join(from, sidecar)); err == nil {
+			if err := fileutil.CopyFile(filepath.Join(from, sidecar), filepath.Join(to, sidecar)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cleanupStable removes packages no longer in the config from the stable
+// repository of a staged run, like cleanup does from the staging one. It
+// reports whether the database was updated.
+func (r *run) cleanupStable() bool {
+	if r.Stable == nil {
+		return true
+	}
+	valid, err := r.keptNames(r.Stable, nil)
+	if err != nil {
+		// Already reported by cleanup
+		return true
+	}
+	stale := r.Stable.Cleanup(valid)
+	ok := r.withDBPolicy("remove stale packages", func() error { return r.Stable.Remove(stale...) })
+	r.updateChecksums(r.Stable)
+	return ok
+}
+
+// runPromote copies the named packages, or with --all every package with a
+// newer build, from the staging repository into the repository. It returns
+// the exit code.
+func runPromote(args []string) int {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	all := fs.Bool("all", false, "promote every package whose staged build differs from the repository")
+	repoName := fs.String("repo", "", "promote within the repository `name` from the repos list instead of the main one")
+	dryRun := fs.Bool("dry-run", false, "only list the packages")
+	fs.Parse(args)
+	if fs.NArg() == 0 && !*all {
+		log.Error("Usage: repo-builder promote [--repo <name>] <package>... | --all")
+		return ExitConfig
+	}
+
+	cfg := loadConfig()
+	lockRun()
+	var t *target
+	for _, candidate := range targets(cfg) {
+		if *repoName == "" || candidate.Config.Meta.RepoName == *repoName {
+			t = &candidate
+			break
+		}
+	}
+	switch {
+	case t == nil:
+		log.Error(fmt.Sprintf("No repository %s in the config", *repoName))
+		return ExitConfig
+	case t.Stable == nil:
+		log.Error(fmt.Sprintf("Staging is not enabled for %s", t.Config.Meta.RepoName))
+		return ExitConfig
+	}
+	staging, stable := t.Repo, t.Stable
+
+	names := fs.Args()
+	if *all {
+		names = append(t.Config.AURNames(), t.Config.MetaNames()...)
+	}
+	failed := 0
+	var files, dropped, replaced []string
+	for _, name := range names {
+		split := staging.Split(name)
+		if len(split) == 0 {
+			if !*all {
+				log.Error(fmt.Sprintf("%s is not in %s", name, staging.Name))
+				failed++
+			}
+			continue
+		}
+
+		built := make(map[string]string)
+		var changed []string
+		for _, pkg := range split {
+			built[pkg.Name] = pkg.Filename
+			if stable.Version(pkg.Name) != pkg.Version {
+				changed = append(changed, pkg.Filename)
+			}
+		}
+		var gone []string
+		for _, pkg := range stable.Split(name) {
+			if file, ok := built[pkg.Name]; !ok {
+				gone = append(gone, pkg.Name)
+			} else if file != pkg.Filename {
+				replaced = append(replaced, pkg.Filename)
+			}
+		}
+		if len(changed) == 0 && len(gone) == 0 {
+			if !*all {
+				log.Info(fmt.Sprintf("%s %s is already in %s", name, staging.Version(name), stable.Name))
+			}
+			continue
+		}
+
+		log.Msg(fmt.Sprintf("   %s: %s -> %s", name, version.Or(stable.Version(name), "<not in repo>"), staging.Version(name)))
+		if *dryRun {
+			continue
+		}
+		for _, file := range changed {
+			if err := copyPackage(file, staging.Dir, stable.Dir); err != nil {
+				log.Error(fmt.Sprintf("Failed to copy %s: %v", file, err))
+				failed++
+				continue
+			}
+			files = append(files, file)
+		}
+		dropped = append(dropped, gone...)
+	}
+	if len(files) == 0 && len(dropped) == 0 {
+		if failed > 0 {
+			return 1
+		}
+		if !*dryRun {
+			log.Info("Nothing to promote")
+		}
+		return 0
+	}
+
+	r := &run{Config: t.Config, Repo: stable}
+	if !r.withDBPolicy("update repo database", func() error { return stable.Add(files) }) ||
+		!r.withDBPolicy("remove dropped packages", func() error { return stable.Remove(dropped...) }) {
+		return 1
+	}
+	for _, file := range replaced {
+		os.Remove(filepath.Join(stable.Dir, file))
+		os.Remove(filepath.Join(stable.Dir, file+".sig"))
+		os.Remove(filepath.Join(stable.Dir, file+provenance.Suffix))
+	}
+	r.updateChecksums(stable)
+	repo.FixPermissions(t.Dir)
+
+	log.Success(fmt.Sprintf("Promoted %d package files to %s, the site lists them after the next run", len(files), stable.Name))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
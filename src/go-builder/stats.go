@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"builder/internal/log"
+	"builder/internal/repo"
+	"builder/internal/stats"
+)
+
+// runStats counts package downloads from access logs with `stats ingest`,
+// and lists them with `stats show`, the default. It returns the exit code.
+func runStats(args []string) int {
+	cmd := "show"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "ingest":
+		return statsIngest(args)
+	case "show":
+		return statsShow(args)
+	}
+	log.Error(fmt.Sprintf("Unknown stats command %q, expected ingest or show", cmd))
+	return ExitConfig
+}
+
+// statsIngest adds the package downloads of the access logs in args to the
+// counts in the build directory
+func statsIngest(args []string) int {
+	fs := flag.NewFlagSet("stats ingest", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print what would be counted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stats ingest [--dry-run] <log>... (- for stdin, .gz files are decompressed)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ExitConfig
+	}
+
+	lockRun()
+	path := filepath.Join(BuildDir, stats.FileName)
+	s, err := stats.Load(path)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read %s: %v", path, err))
+		return 1
+	}
+
+	// Logs of several servers may overlap, so every one is compared with
+	// the downloads counted before this run
+	since := s.Last
+	counted := 0
+	for _, file := range fs.Args() {
+		res, err := ingestLog(s, file, since)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to read %s: %v", file, err))
+			return 1
+		}
+		log.Info(fmt.Sprintf("%s: %d downloads in %d lines", file, res.Counted, res.Lines))
+		if res.Old > 0 {
+			log.Msg(fmt.Sprintf("   Skipped %d downloads counted before", res.Old))
+		}
+		if res.Unparsable > 0 {
+			log.Warn(fmt.Sprintf("   Skipped %d lines in an unknown format", res.Unparsable))
+		}
+		counted += res.Counted
+	}
+
+	if *dryRun {
+		return 0
+	}
+	s.Prune(time.Now())
+	if err := s.Save(path); err != nil {
+		log.Error(fmt.Sprintf("Failed to save %s: %v", path, err))
+		return 1
+	}
+	log.Success(fmt.Sprintf("Counted %d downloads, shown on the site from the next run", counted))
+	return 0
+}
+
+// ingestLog counts the downloads in the log file, - for stdin
+func ingestLog(s *stats.Stats, file string, since time.Time) (stats.Result, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return stats.Result{}, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return stats.Result{}, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return s.Ingest(r, since)
+}
+
+// statsShow lists the downloads of the packages in the config, least
+// downloaded first, as candidates for removal
+func statsShow(args []string) int {
+	fs := flag.NewFlagSet("stats show", flag.ExitOnError)
+	days := fs.Int("days", stats.RecentDays, "count the downloads of the last `n` days")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	s, err := stats.Load(filepath.Join(BuildDir, stats.FileName))
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read %s: %v", stats.FileName, err))
+		return 1
+	}
+	if s.Last.IsZero() {
+		log.Warn("No downloads counted yet, see stats ingest")
+		return 0
+	}
+
+	type row struct {
+		name          string
+		recent, total int
+	}
+	repoDB := mainRepo(cfg)
+	var rows []row
+	width := len("Package")
+	for _, name := range append(cfg.AURNames(), cfg.MetaNames()...) {
+		recent, total := s.Count(downloadNames(repoDB, name), *days, s.Last)
+		rows = append(rows, row{name, recent, total})
+		width = max(width, len(name))
+	}
+	slices.SortStableFunc(rows, func(a, b row) int {
+		return cmp.Or(cmp.Compare(a.recent, b.recent), cmp.Compare(a.total, b.total), strings.Compare(a.name, b.name))
+	})
+
+	log.Info(fmt.Sprintf("Downloads until %s", s.Last.Local().Format("2006-01-02 15:04")))
+	log.Msg(fmt.Sprintf("   %-*s  %8s  %8s", width, "Package", fmt.Sprintf("%dd", *days), "Total"))
+	unused := 0
+	for _, r := range rows {
+		log.Msg(fmt.Sprintf("   %-*s  %8d  %8d", width, r.name, r.recent, r.total))
+		if r.recent == 0 {
+			unused++
+		}
+	}
+	if unused > 0 {
+		log.Warn(fmt.Sprintf("%d packages had no downloads in %d days", unused, *days))
+	}
+	return 0
+}
+
+// downloadNames returns the packages whose downloads count for the
+// configured package name: itself, or the packages split from it
+func downloadNames(repoDB *repo.RepoDB, name string) []string {
+	names := []string{name}
+	for _, pkg := range repoDB.Split(name) {
+		if pkg.Name != name {
+			names = append(names, pkg.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"builder/internal/log"
+	"builder/internal/tui"
+)
+
+// closeTUI hands the terminal back from the TUI, if one is open
+var closeTUI = func() {}
+
+// startTUI shows the progress of the following runs in a TUI titled title,
+// instead of printing their log. Without a usable terminal, it logs why and
+// leaves the log as it is.
+func (r *run) startTUI(title string) {
+	ui, err := tui.New(title)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot start the TUI, printing the log instead: %v", err))
+		return
+	}
+	r.UI = ui
+	// The log pane shows the output of commands as it comes
+	verbose := log.Verbose()
+	log.Stdout, log.Stderr = ui, ui
+	log.SetLevel(log.LevelVerbose)
+	closeTUI = func() {
+		ui.Close()
+		log.Stdout, log.Stderr = os.Stdout, os.Stderr
+		if !verbose {
+			log.SetLevel(log.LevelNormal)
+		}
+		closeTUI = func() {}
+	}
+}
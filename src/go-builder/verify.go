@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"builder/internal/log"
+	"builder/internal/selftest"
+)
+
+// runVerify checks the integrity of every package in the build directory
+// against itself and the database. It returns the exit code.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	repoDB := mainRepo(cfg)
+
+	log.Msg("")
+	log.Info(fmt.Sprintf("Verifying packages in %s...", repoDB.Dir))
+	failed := printReport(selftest.Packages(repoDB.Dir, repoDB.DBFile()))
+
+	log.Msg("")
+	if failed > 0 {
+		log.Error(fmt.Sprintf("Verification failed: %d checks", failed))
+		return 1
+	}
+	log.Success("All packages verified")
+	return 0
+}
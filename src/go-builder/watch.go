@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"builder/internal/log"
+)
+
+// runWatch runs every repository, then again after interval plus a random
+// delay of up to jitter, or as soon as the webhook at webhookAddr is called
+// with token. With resume, the first run continues an interrupted one. It
+// never returns.
+func runWatch(r *run, interval, jitter time.Duration, webhookAddr, token string, resume bool) {
+	trigger := make(chan struct{}, 1)
+	if webhookAddr != "" {
+		server := &http.Server{Addr: webhookAddr, Handler: webhook(trigger, token), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Error(fmt.Sprintf("Webhook stopped: %v", err))
+			}
+		}()
+		log.Info(fmt.Sprintf("Watch mode: running every %s, webhook on %s", interval, webhookAddr))
+	} else {
+		log.Info(fmt.Sprintf("Watch mode: running every %s", interval))
+	}
+
+	for {
+		failed := r.RunAll(nil, resume)
+		resume = false
+		if r.interrupted() {
+			exit(ExitInterrupted)
+		}
+		if failed > 0 {
+			log.Warn("Watch keeps running, failed packages are retried on the next run")
+		}
+
+		wait := interval
+		if jitter > 0 {
+			wait += rand.N(jitter)
+		}
+		log.Msg("")
+		log.Info(fmt.Sprintf("Next run at %s", time.Now().Add(wait).Format(time.DateTime)))
+		select {
+		case <-time.After(wait):
+		case <-trigger:
+			log.Info("Run requested by webhook")
+		case <-r.stop:
+			exit(ExitInterrupted)
+		}
+	}
+}
+
+// webhook requests a run on POST requests carrying token as bearer token.
+// Requests during a run queue a single run after it.
+func webhook(trigger chan<- struct{}, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -40,7 +40,7 @@ has-cmd() {
 
 clear -x && echo ""
 
-log.info "Adding {{REPO_NAME}} repository..."
+log.info "Adding {{.Repo.Name}} repository..."
 
 # Check if running on Arch Linux
 if [[ ! -f /etc/arch-release ]]; then
@@ -54,15 +54,30 @@ if ! has-cmd "pacman curl grep sed"; then
     exit 1
 fi
 
+{{- if .Repo.SigningKey}}
+# Import the repository signing key
+if ! has-cmd pacman-key; then
+    log.error "pacman-key is required to import the signing key\n"
+    exit 1
+fi
+
+log.info "Importing signing key {{.Repo.SigningKey}}..."
+sudo -p "? Enter your password: " pacman-key --recv-keys "{{.Repo.SigningKey}}" --keyserver "{{.Repo.Keyserver}}" < /dev/tty
+sudo -p "? Enter your password: " pacman-key --lsign-key "{{.Repo.SigningKey}}" < /dev/tty
+log.success "Signing key imported."
+{{- end}}
+
 # Check for existing entry
-if grep -q "\[{{REPO_NAME}}\]" /etc/pacman.conf; then
+if grep -q "\[{{.Repo.Name}}\]" /etc/pacman.conf; then
     log.warn "Repository already exists in pacman.conf"
 else
     log.info "Adding repository to pacman.conf..."
     sudo -p "? Enter your password: " bash -c "cat <<'EOF' >> /etc/pacman.conf
-[{{REPO_NAME}}]
-SigLevel = Optional TrustAll
-Server = {{REPO_URL}}/\$arch
+[{{.Repo.Name}}]
+SigLevel = {{.Repo.SigLevel}}
+{{- range .Repo.Servers}}
+Server = {{.}}/\$arch
+{{- end}}
 EOF" < /dev/tty
     log.success "Repository added."
 fi